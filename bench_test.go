@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// benchPayload is the size of a typical get_device_info request.
+var benchPayload = []byte(`{"method":"get_device_info","requestTimeMils":1712000000000,"terminalUUID":"00000000-0000-0000-0000-000000000000"}`)
+
+// benchDeviceInfo is a typical get_device_info response.
+var benchDeviceInfo = []byte(`{"error_code":0,"result":{"device_id":"80225A0000000000000000000000000000000000","fw_ver":"1.2.3 Build 230425 Rel.142542","hw_ver":"1.0","type":"SMART.TAPOPLUG","model":"P110","mac":"00-11-22-33-44-55","hw_id":"00000000000000000000000000000000","fw_id":"00000000000000000000000000000000","oem_id":"00000000000000000000000000000000","ip":"192.0.2.1","time_diff":60,"ssid":"bXluZXR3b3Jr","rssi":-52,"signal_level":3,"latitude":0,"longitude":0,"lang":"en_US","avatar":"plug","region":"Europe/Rome","specs":"","nickname":"TGl2aW5nIHJvb20=","has_set_location_info":false,"device_on":true,"on_time":3600,"default_states":{"type":"last_states","state":{}},"overheated":false,"power_protection_status":"normal","location":""}}`)
+
+func newBenchKlapSession() *KlapSession {
+	s := NewKlapSession(nil)
+	s.LocalSeed = bytes.Repeat([]byte{1}, 16)
+	s.RemoteSeed = bytes.Repeat([]byte{2}, 16)
+	s.UserHash = KlapAuthHash("user", "pass")
+	return s
+}
+
+func BenchmarkKlapEncrypt(b *testing.B) {
+	s := newBenchKlapSession()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchPayload)))
+	for i := 0; i < b.N; i++ {
+		if _, _, err := s.encrypt(benchPayload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKlapDecrypt(b *testing.B) {
+	s := newBenchKlapSession()
+	enc, _, err := s.encrypt(benchDeviceInfo)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// decrypt works in place
+	buf := make([]byte, len(enc))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchDeviceInfo)))
+	for i := 0; i < b.N; i++ {
+		copy(buf, enc)
+		if _, err := s.decrypt(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func newBenchPassthroughSession() *PassthroughSession {
+	s := NewPassthroughSession(nil)
+	s.Key = bytes.Repeat([]byte{1}, 16)
+	s.IV = bytes.Repeat([]byte{2}, 16)
+	return s
+}
+
+func BenchmarkPassthroughEncrypt(b *testing.B) {
+	s := newBenchPassthroughSession()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchPayload)))
+	for i := 0; i < b.N; i++ {
+		if _, err := s.encryptRequest(benchPayload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPassthroughDecrypt(b *testing.B) {
+	s := newBenchPassthroughSession()
+	enc, err := s.encryptRequest(benchDeviceInfo)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchDeviceInfo)))
+	for i := 0; i < b.N; i++ {
+		if _, err := s.decryptResponse(enc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalRequest(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(NewGetDeviceInfoRequest()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalDeviceInfo(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchDeviceInfo)))
+	for i := 0; i < b.N; i++ {
+		var resp GetDeviceInfoResponse
+		if err := json.Unmarshal(benchDeviceInfo, &resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchDiscoverConn is a net.PacketConn returning the same discovery response
+// n times, then timing out.
+type benchDiscoverConn struct {
+	net.PacketConn
+	packet []byte
+	n      int
+}
+
+type benchTimeout struct{}
+
+func (benchTimeout) Error() string   { return "timeout" }
+func (benchTimeout) Timeout() bool   { return true }
+func (benchTimeout) Temporary() bool { return true }
+
+var benchDiscoverFrom = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: discoverV2Port}
+
+func (c *benchDiscoverConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if c.n == 0 {
+		return 0, nil, benchTimeout{}
+	}
+	c.n--
+	return copy(p, c.packet), benchDiscoverFrom, nil
+}
+
+func BenchmarkReadDiscoverResponses(b *testing.B) {
+	packet := append(make([]byte, 16), `{"result":{"device_id":"80225A0000000000000000000000000000000000","owner":"00000000000000000000000000000000","device_type":"SMART.TAPOPLUG","device_model":"P110(EU)","ip":"192.0.2.1","mac":"00-11-22-33-44-55","is_support_iot_cloud":true,"obd_src":"tplink","factory_default":false,"mgt_encrypt_schm":{"is_support_https":false,"encrypt_type":"KLAP","http_port":80,"lv":2}},"error_code":0}`...)
+	const perScan = 20
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		conn := benchDiscoverConn{packet: packet, n: perScan}
+		errs := readDiscoverResponses(&conn, func(*DiscoverResponse) {})
+		if len(errs) > 0 {
+			b.Fatal(errs)
+		}
+	}
+}
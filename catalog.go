@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// MethodSpec describes a device method of the catalog. The catalog is
+// generated from methods.json, which also generates the typed request and
+// response of each method: adding a device method only requires a new entry
+// there, followed by `go generate`.
+type MethodSpec struct {
+	// Name is the method name on the wire, e.g. get_device_info.
+	Name string
+	Doc  string
+	// Component is the component the device must support to implement the
+	// method, if any, e.g. energy_monitoring.
+	Component string
+	Params    []ParamSpec
+
+	newParams   func() interface{}
+	newResponse func() interface{}
+}
+
+// ParamSpec describes a parameter of a device method.
+type ParamSpec struct {
+	Name string
+	// Type is the Go type of the parameter.
+	Type string
+	Doc  string
+}
+
+// Methods returns the methods of the catalog, sorted by name.
+func Methods() []MethodSpec {
+	ret := make([]MethodSpec, len(methodCatalog))
+	copy(ret, methodCatalog)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// LookupMethod returns the catalog entry of a method.
+func LookupMethod(name string) (MethodSpec, bool) {
+	for _, m := range methodCatalog {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return MethodSpec{}, false
+}
+
+// ValidateParams checks that params, a JSON object, has exactly the
+// parameters of the method, with the right types. Empty params are valid for
+// methods without parameters.
+func (m MethodSpec) ValidateParams(params json.RawMessage) error {
+	if len(bytes.TrimSpace(params)) == 0 || bytes.Equal(bytes.TrimSpace(params), []byte("null")) {
+		if len(m.Params) > 0 {
+			return fmt.Errorf("%s requires parameters", m.Name)
+		}
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(params, &fields); err != nil {
+		return fmt.Errorf("params must be a JSON object: %w", err)
+	}
+	known := make(map[string]bool, len(m.Params))
+	for _, p := range m.Params {
+		known[p.Name] = true
+		if _, ok := fields[p.Name]; !ok {
+			return fmt.Errorf("missing parameter '%s' (%s)", p.Name, p.Type)
+		}
+	}
+	for name := range fields {
+		if !known[name] {
+			return fmt.Errorf("unknown parameter '%s' for %s", name, m.Name)
+		}
+	}
+	if m.newParams != nil {
+		if err := json.Unmarshal(params, m.newParams()); err != nil {
+			return fmt.Errorf("invalid parameters for %s: %w", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// CheckResponse checks that a response of the method decodes into its typed
+// response. A failure means that the device replies with a different schema
+// than the one known to this package.
+func (m MethodSpec) CheckResponse(response []byte) error {
+	if err := json.Unmarshal(response, m.newResponse()); err != nil {
+		return fmt.Errorf("response does not match the %s schema: %w", m.Name, err)
+	}
+	return nil
+}
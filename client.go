@@ -4,6 +4,7 @@ package tapo
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -14,12 +15,22 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-const baseURL = "https://wap.tplinkcloud.com"
+// DefaultCloudURL is the base URL of the tp-link cloud service. It can be
+// overridden with OptionCloudURL or with the TAPO_CLOUD_URL environment
+// variable.
+const DefaultCloudURL = "https://wap.tplinkcloud.com"
+
+// Environment variables used to configure the cloud client.
+const (
+	EnvCloudURL   = "TAPO_CLOUD_URL"
+	EnvCloudProxy = "TAPO_CLOUD_PROXY"
+)
 
 // Client is a tp-link cloud client for cloud-based operations.
 type Client struct {
@@ -27,17 +38,54 @@ type Client struct {
 	terminalUUID uuid.UUID
 	timeout      time.Duration
 	token        string
+	cloudURL     string
+	proxy        *url.URL
+	// discoveryInterfaces restricts discovery to these network interfaces.
+	discoveryInterfaces []string
+	// discoverTarget, if set, is the only destination of the discovery
+	// probes, instead of the broadcast addresses of the network interfaces.
+	// It is set by the tests, to discover over the loopback interface.
+	discoverTarget *net.UDPAddr
+	// discoverTimeout is how long discovery waits for responses.
+	discoverTimeout time.Duration
 }
 
-func NewClient(logger *log.Logger) *Client {
+func NewClient(logger *log.Logger, opts ...ClientOption) *Client {
 	if logger == nil {
 		logger = log.New(io.Discard, "", 0)
 	}
-	return &Client{
-		log:          logger,
-		terminalUUID: uuid.New(),
-		timeout:      defaultTimeout,
+	c := Client{
+		log:             logger,
+		terminalUUID:    uuid.New(),
+		timeout:         defaultTimeout,
+		cloudURL:        DefaultCloudURL,
+		discoverTimeout: defaultDiscoverTimeout,
+	}
+	if u := os.Getenv(EnvCloudURL); u != "" {
+		c.cloudURL = u
+	}
+	if p := os.Getenv(EnvCloudProxy); p != "" {
+		proxy, err := url.Parse(p)
+		if err != nil {
+			logger.Printf("Ignoring invalid %s '%s': %v", EnvCloudProxy, p, err)
+		} else {
+			c.proxy = proxy
+		}
+	}
+	// options take precedence over the environment
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return &c
+}
+
+// httpClient returns the HTTP client used to talk to the cloud service.
+func (c *Client) httpClient() *http.Client {
+	hc := http.Client{Timeout: c.timeout, Transport: defaultTransport}
+	if c.proxy != nil {
+		hc.Transport = newProxyTransport(c.proxy)
 	}
+	return &hc
 }
 
 func (c *Client) buildLoginRequest(username, password string) ([]byte, error) {
@@ -53,7 +101,7 @@ func (c *Client) buildLoginRequest(username, password string) ([]byte, error) {
 	}
 	r := loginRequest{
 		Method: "login",
-		URL:    baseURL,
+		URL:    c.cloudURL,
 	}
 	r.Params.AppType = "Kasa_Android"
 	r.Params.CloudUserName = username
@@ -82,7 +130,7 @@ func (c *Client) buildDeviceListRequest() ([]byte, error) {
 	return b, nil
 }
 
-func (c *Client) post(cloudURL string, data []byte) ([]byte, error) {
+func (c *Client) post(ctx context.Context, cloudURL string, data []byte) ([]byte, error) {
 	u, err := url.Parse(cloudURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse URL: %w", err)
@@ -101,7 +149,12 @@ func (c *Client) post(cloudURL string, data []byte) ([]byte, error) {
 
 	// TODO set headers:
 	//      User-Agent: Dalvik/2.1.0 (Linux; U; Android 6.0.1; A0001 Build/M4B30X)
-	resp, err := http.Post(u.String(), "application/json", bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("http request creation failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("POST failed: %w", err)
 	}
@@ -117,17 +170,24 @@ func (c *Client) post(cloudURL string, data []byte) ([]byte, error) {
 }
 
 func (c *Client) CloudLogin(username, password string) error {
+	return c.CloudLoginContext(context.Background(), username, password)
+}
+
+// CloudLoginContext is like CloudLogin, but the request is aborted when ctx is
+// done.
+func (c *Client) CloudLoginContext(ctx context.Context, username, password string) error {
 	lr, err := c.buildLoginRequest(username, password)
 	if err != nil {
 		return fmt.Errorf("failed to build login request: %w", err)
 	}
-	resp, err := c.post(baseURL, lr)
+	resp, err := c.post(ctx, c.cloudURL, lr)
 	if err != nil {
 		return fmt.Errorf("login request failed: %w", err)
 	}
 
 	loginResp := struct {
-		ErrorCode int `json:"error_code"`
+		ErrorCode int    `json:"error_code"`
+		Msg       string `json:"msg"`
 		Result    struct {
 			AccountID    string `json:"accountId"`
 			RegTime      string `json:"regTime"`
@@ -141,21 +201,31 @@ func (c *Client) CloudLogin(username, password string) error {
 	if err := json.Unmarshal(resp, &loginResp); err != nil {
 		return fmt.Errorf("decode failed: %w", err)
 	}
+	if loginResp.ErrorCode != 0 {
+		return fmt.Errorf("login failed: %w", &CloudError{Code: loginResp.ErrorCode, Message: loginResp.Msg})
+	}
 	c.token = loginResp.Result.Token
 	return nil
 }
 
 func (c *Client) CloudList() ([]Device, error) {
+	return c.CloudListContext(context.Background())
+}
+
+// CloudListContext is like CloudList, but the request is aborted when ctx is
+// done.
+func (c *Client) CloudListContext(ctx context.Context) ([]Device, error) {
 	lr, err := c.buildDeviceListRequest()
 	if err != nil {
 		return nil, fmt.Errorf("failed to build device list request: %w", err)
 	}
-	resp, err := c.post(baseURL, lr)
+	resp, err := c.post(ctx, c.cloudURL, lr)
 	if err != nil {
 		return nil, fmt.Errorf("device list request failed: %w", err)
 	}
 	deviceListResp := struct {
-		ErrorCode int `json:"error_code"`
+		ErrorCode int    `json:"error_code"`
+		Msg       string `json:"msg"`
 		Result    struct {
 			DeviceList []Device `json:"deviceList"`
 		}
@@ -163,6 +233,9 @@ func (c *Client) CloudList() ([]Device, error) {
 	if err := json.Unmarshal(resp, &deviceListResp); err != nil {
 		return nil, fmt.Errorf("decode failed: %w", err)
 	}
+	if deviceListResp.ErrorCode != 0 {
+		return nil, fmt.Errorf("device list failed: %w", &CloudError{Code: deviceListResp.ErrorCode, Message: deviceListResp.Msg})
+	}
 	devices := deviceListResp.Result.DeviceList
 	for idx, d := range devices {
 		switch d.Alias {
@@ -186,88 +259,6 @@ func (c *Client) CloudList() ([]Device, error) {
 	return deviceListResp.Result.DeviceList, nil
 }
 
-func (c *Client) Discover() (map[string]DiscoverResponse, []DiscoverResponse, error) {
-	// TODO make broadcast addresses and timeout configurable.
-	// TODO make it possible to only use one discovery method.
-	reqv2, err := hex.DecodeString("020000010000000000000000463cb5d3")
-	if err != nil {
-		return nil, nil, fmt.Errorf("invalid request v2 hex string. Bug? %w", err)
-	}
-
-	// discovery protocol v1: send a broadcast UDP message to port 9999
-	// containing a XOR'ed JSON request.
-	req := NewDiscoverV1Request()
-	reqb, err := json.Marshal(req)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to marshal discovery request to JSON: %w", err)
-	}
-	encReq := make([]byte, len(reqb))
-	key := byte(DiscoverV1InitializationVector)
-	for idx := range reqb {
-		key ^= reqb[idx]
-		encReq[idx] = key
-	}
-	// send broadcast packet
-	pc, err := net.ListenPacket("udp4", "0.0.0.0:0")
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to listen on packet connection: %w", err)
-	}
-	defer pc.Close()
-	addr, err := net.ResolveUDPAddr("udp4", "255.255.255.255:9999")
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to resolve broadcast address: %w", err)
-	}
-	addrv2, err := net.ResolveUDPAddr("udp4", "255.255.255.255:20002")
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to resolve broadcast address: %w", err)
-	}
-	// listen for responses in a different goroutine
-	if err := pc.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
-		return nil, nil, fmt.Errorf("failed to set read deadline: %w", err)
-	}
-	go func() {
-		for i := 0; i < 6; i++ {
-			// send req v1
-			_, err = pc.WriteTo(encReq, addr)
-			if err != nil {
-				c.log.Printf("Failed to send broadcast discover v1 packet: %v", err)
-				break
-			}
-			// send req v2
-			_, err = pc.WriteTo(reqv2, addrv2)
-			if err != nil {
-				c.log.Printf("Failed to send broadcast discover v2 packet: %v", err)
-				break
-			}
-			time.Sleep(200 * time.Millisecond)
-		}
-	}()
-	ret := make(map[string]DiscoverResponse, 0)
-	errs := make([]DiscoverResponse, 0)
-	for {
-		msg := make([]byte, 2048)
-		n, _, err := pc.ReadFrom(msg)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				break
-			}
-			return nil, nil, fmt.Errorf("read failed: %w", err)
-		}
-		var resp DiscoverResponse
-		if err := json.Unmarshal(msg[16:n], &resp); err != nil {
-			return nil, nil, fmt.Errorf("failed to unmarshal discover response to JSON: %w", err)
-		}
-		// override earlier responses with later responses
-		if resp.Result.ErrorCode != 0 {
-			errs = append(errs, resp)
-		} else {
-			ret[resp.Result.DeviceID] = resp
-		}
-	}
-
-	return ret, errs, nil
-}
-
 // Tapo uses a non-standard MAC representation, a 12-char hex string with no
 // separators. Custom unmarshalling here it goes.
 type tapoMAC net.HardwareAddr
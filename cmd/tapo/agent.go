@@ -0,0 +1,263 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !lite
+
+package main
+
+// The agent runs on a machine in the same collision domain as the Tapo
+// devices, and exposes discovery and device control over a small REST API.
+// Other tapo CLIs can then use it with --agent host:port, which is useful when
+// broadcast discovery cannot reach the devices.
+//
+// API:
+//   GET  /api/v1/discover              discovery results
+//   GET  /api/v1/devices/{ip}/info     device info
+//   GET  /api/v1/devices/{ip}/usage    device usage
+//   GET  /api/v1/devices/{ip}/energy   energy usage
+//   GET  /api/v1/devices/{ip}/time     device clock and time zone
+//   POST /api/v1/devices/{ip}/on       turn the device on
+//   POST /api/v1/devices/{ip}/off      turn the device off
+//   GET  /api/v1/openapi.json          OpenAPI document, never authenticated
+//
+// Requests are authenticated with a bearer token, either the --agent-token
+// shared secret or an API token created with `tapo token-create`. API tokens
+// have a read or control scope, and can be restricted to some devices.
+// {ip} must be a device found by a discovery of the agent, or listed by
+// address in its configuration.
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+	"github.com/insomniacslk/tapo/internal/apitoken"
+)
+
+func writeAgentJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+func writeAgentError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeAgentJSON(w, status, agentError{Error: fmt.Sprintf(format, args...)})
+}
+
+// fullAccess is the token used for requests authenticated with the
+// --agent-token shared secret, or for all the requests when the agent is not
+// authenticated.
+var fullAccess = &apitoken.Token{Name: "agent-token", Scope: apitoken.ScopeControl}
+
+type tokenKey struct{}
+
+// requestToken returns the token that authenticated a request.
+func requestToken(r *http.Request) *apitoken.Token {
+	return r.Context().Value(tokenKey{}).(*apitoken.Token)
+}
+
+// deviceAllowed reports whether a token can access the device at ip. The MAC
+// address and the ID of the device are those of the discovery results of the
+// agent, the device is not asked who it is, since any host could answer.
+func deviceAllowed(cfg *cmdCfg, tok *apitoken.Token, ip netip.Addr) bool {
+	if tok.AllowsDevice(ip.String()) {
+		return true
+	}
+	d, ok := lookupDiscovered(cfg, ip)
+	if !ok {
+		return false
+	}
+	return tok.AllowsDevice(d.Result.MAC.String(), d.Result.DeviceID)
+}
+
+// knownDevice reports whether the device at ip is in the discovery results of
+// the agent, or listed by address in the configuration. The agent only opens
+// sessions to the devices it knows, since the handshake sends the account
+// credentials, and passthrough devices receive the password in clear.
+func knownDevice(cfg *cmdCfg, ip netip.Addr) bool {
+	if _, ok := lookupDiscovered(cfg, ip); ok {
+		return true
+	}
+	lists := [][]string{cfg.Protected, cfg.FirmwarePinned}
+	for _, members := range cfg.Groups {
+		lists = append(lists, members)
+	}
+	for _, b := range cfg.Budgets {
+		lists = append(lists, []string{b.Device})
+	}
+	for _, list := range lists {
+		if isListed(list, net.IP(ip.Unmap().AsSlice()), "") {
+			return true
+		}
+	}
+	return false
+}
+
+// agentHandler returns the HTTP handler serving the agent API. Requests must
+// carry either the shared secret or one of the API tokens, unless both are
+// empty.
+func agentHandler(cfg *cmdCfg, token string, tokens *apitoken.Set) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(agentAPIPrefix+"/discover", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeAgentError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		devices, failed, err := discoverDevices(cfg)
+		if err != nil {
+			writeAgentError(w, http.StatusInternalServerError, "discovery failed: %v", err)
+			return
+		}
+		// only return the devices the token has access to
+		tok := requestToken(r)
+		allowed := func(d tapo.DiscoverResponse) bool {
+			return tok.AllowsDevice(d.Result.IP.String(), d.Result.MAC.String(), d.Result.DeviceID)
+		}
+		result := agentDiscoverResult{Devices: make(map[string]tapo.DiscoverResponse)}
+		for k, d := range devices {
+			if allowed(d) {
+				result.Devices[k] = d
+			}
+		}
+		for _, d := range failed {
+			if allowed(d) {
+				result.Failed = append(result.Failed, d)
+			}
+		}
+		writeAgentJSON(w, http.StatusOK, result)
+	})
+	mux.HandleFunc(agentAPIPrefix+"/devices/", func(w http.ResponseWriter, r *http.Request) {
+		// path is /api/v1/devices/{ip}/{action}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, agentAPIPrefix+"/devices/"), "/")
+		if len(parts) != 2 {
+			writeAgentError(w, http.StatusNotFound, "not found")
+			return
+		}
+		addr, action := parts[0], parts[1]
+		wantMethod, wantScope := http.MethodGet, apitoken.ScopeRead
+		if action == "on" || action == "off" {
+			wantMethod, wantScope = http.MethodPost, apitoken.ScopeControl
+		}
+		if r.Method != wantMethod {
+			writeAgentError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		tok := requestToken(r)
+		if !tok.Allows(wantScope) {
+			writeAgentError(w, http.StatusForbidden, "token '%s' does not have the %s scope", tok.Name, wantScope)
+			return
+		}
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			writeAgentError(w, http.StatusNotFound, "invalid device address '%s'", addr)
+			return
+		}
+		if !knownDevice(cfg, ip) {
+			writeAgentError(w, http.StatusNotFound, "device %s was not discovered and is not in the configuration", addr)
+			return
+		}
+		if !deviceAllowed(cfg, tok, ip) {
+			writeAgentError(w, http.StatusForbidden, "token '%s' has no access to device %s", tok.Name, addr)
+			return
+		}
+		plug, err := getPlug(cfg, addr)
+		if err != nil {
+			writeAgentError(w, http.StatusBadGateway, "%v", err)
+			return
+		}
+		// the requests are aborted when the client goes away
+		ctx := r.Context()
+		var result interface{}
+		switch action {
+		case "info":
+			result, err = plug.GetDeviceInfoContext(ctx)
+		case "usage":
+			result, err = plug.GetDeviceUsageContext(ctx)
+		case "energy":
+			result, err = plug.GetEnergyUsageContext(ctx)
+		case "time":
+			result, err = plug.GetDeviceTimeContext(ctx)
+		case "on":
+			err = plug.SetDeviceInfoContext(ctx, true)
+		case "off":
+			err = plug.SetDeviceInfoContext(ctx, false)
+		default:
+			writeAgentError(w, http.StatusNotFound, "unknown action '%s'", action)
+			return
+		}
+		if err != nil {
+			writeAgentError(w, http.StatusBadGateway, "%s failed: %v", action, err)
+			return
+		}
+		if result == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeAgentJSON(w, http.StatusOK, result)
+	})
+	auth := token != "" || !tokens.Empty()
+	openapiHandler := agentDocument(auth).Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == agentAPIPrefix+"/openapi.json" {
+			openapiHandler(w, r)
+			return
+		}
+		tok := fullAccess
+		if auth {
+			secret := apitoken.FromRequest(r)
+			if token == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(token)) != 1 {
+				tok = tokens.Lookup(secret)
+			}
+			if tok == nil {
+				writeAgentError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, tok)))
+	})
+}
+
+// cmdAgent runs the agent HTTP server until it fails.
+func cmdAgent(cfg *cmdCfg, listen, token, tokensFile string) error {
+	tokens, err := apitoken.Load(tokensFile)
+	if err != nil {
+		return fmt.Errorf("failed to load API tokens: %w", err)
+	}
+	if token == "" && tokens.Empty() {
+		log.Printf("Warning: no --agent-token nor API tokens set, the agent API is not authenticated")
+	}
+	srv := http.Server{
+		Addr:    listen,
+		Handler: agentHandler(cfg, token, tokens),
+	}
+	go func() {
+		<-cfg.ctx.Done()
+		// let the requests in flight complete
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Agent shutdown failed: %v", err)
+		}
+	}()
+	// the device requests are only served for the devices discovered so far,
+	// or listed in the configuration.
+	if _, _, err := discoverDevices(cfg); err != nil {
+		log.Printf("Warning: discovery failed: %v", err)
+	}
+	log.Printf("Agent listening on %s", listen)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Printf("Agent stopped")
+	return nil
+}
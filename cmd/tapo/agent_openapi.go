@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !lite
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/insomniacslk/tapo"
+	"github.com/insomniacslk/tapo/internal/openapi"
+)
+
+// agentDocument returns the OpenAPI document of the agent API, served at
+// /api/v1/openapi.json.
+func agentDocument(auth bool) *openapi.Document {
+	doc := openapi.New("tapo agent", "Discovery and device control API of the tapo agent.", "1")
+	if auth {
+		doc.BearerAuth()
+	}
+	errResp := openapi.Response{Description: "Error", Content: openapi.JSON(doc.SchemaOf(agentError{}))}
+	ipParam := openapi.Parameter{Name: "ip", In: "path", Required: true, Description: "IP address of a device discovered by the agent or listed in its configuration", Schema: &openapi.Schema{Type: "string"}}
+	responses := func(desc string, result interface{}) map[string]openapi.Response {
+		ok := openapi.Response{Description: desc}
+		status := "204"
+		if result != nil {
+			ok.Content = openapi.JSON(doc.SchemaOf(result))
+			status = "200"
+		}
+		ret := map[string]openapi.Response{
+			status: ok,
+			"502":  errResp,
+		}
+		if auth {
+			ret["401"] = errResp
+			ret["403"] = errResp
+		}
+		return ret
+	}
+
+	doc.Add(http.MethodGet, agentAPIPrefix+"/discover", &openapi.Operation{
+		Summary:     "Discover the devices on the agent network",
+		OperationID: "discover",
+		Responses:   responses("Discovered devices, indexed by IP address", agentDiscoverResult{}),
+	})
+	for _, op := range []struct {
+		action, method, id, summary string
+		result                      interface{}
+	}{
+		{"info", http.MethodGet, "getDeviceInfo", "Get the device info", tapo.DeviceInfo{}},
+		{"usage", http.MethodGet, "getDeviceUsage", "Get the device usage", tapo.DeviceUsage{}},
+		{"energy", http.MethodGet, "getEnergyUsage", "Get the energy usage", tapo.EnergyUsage{}},
+		{"time", http.MethodGet, "getDeviceTime", "Get the device clock and time zone", tapo.DeviceTime{}},
+		{"on", http.MethodPost, "turnOn", "Turn the device on", nil},
+		{"off", http.MethodPost, "turnOff", "Turn the device off", nil},
+	} {
+		resp := responses(op.summary, op.result)
+		// the device is unknown to the agent
+		resp["404"] = errResp
+		doc.Add(op.method, agentAPIPrefix+"/devices/{ip}/"+op.action, &openapi.Operation{
+			Summary:     op.summary,
+			OperationID: op.id,
+			Parameters:  []openapi.Parameter{ipParam},
+			Responses:   resp,
+		})
+	}
+	return doc
+}
@@ -0,0 +1,216 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !lite
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/insomniacslk/tapo"
+	"github.com/insomniacslk/tapo/internal/apitoken"
+)
+
+// discoveredPlug is a device found by the fake discovery of the agent tests. No
+// device listens on its address, so the requests to it fail.
+const discoveredPlug = `{"result":{"device_id":"8022A","device_type":"SMART.TAPOPLUG","device_model":"P110(EU)","ip":"127.0.0.1","mac":"00-11-22-33-44-55"}}`
+
+// fakeLocalDiscover makes the discoveries return the given responses.
+func fakeLocalDiscover(t *testing.T, responses ...string) {
+	t.Helper()
+	devices := make(map[string]tapo.DiscoverResponse)
+	for _, r := range responses {
+		var d tapo.DiscoverResponse
+		if err := json.Unmarshal([]byte(r), &d); err != nil {
+			t.Fatal(err)
+		}
+		devices[d.Result.DeviceID] = d
+	}
+	orig := localDiscover
+	localDiscover = func(*cmdCfg) (map[string]tapo.DiscoverResponse, []tapo.DiscoverResponse, error) {
+		found := make(map[string]tapo.DiscoverResponse, len(devices))
+		for k, d := range devices {
+			found[k] = d
+		}
+		return found, nil, nil
+	}
+	t.Cleanup(func() { localDiscover = orig })
+}
+
+// recordingProxy is the HTTP proxy of the device sessions of the agent tests.
+// It records the devices the agent connects to, and fails the requests.
+type recordingProxy struct {
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (p *recordingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.hosts = append(p.hosts, r.URL.Hostname())
+	p.mu.Unlock()
+	http.Error(w, "no such device", http.StatusBadGateway)
+}
+
+// contacted reports whether the agent connected to host.
+func (p *recordingProxy) contacted(host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, h := range p.hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// testAgent is an agent whose device sessions go through a recordingProxy.
+type testAgent struct {
+	http.Handler
+	cfg   *cmdCfg
+	proxy *recordingProxy
+	// secrets maps the names of the API tokens to their secrets.
+	secrets map[string]string
+}
+
+// newTestAgent returns an agent accepting the given API tokens.
+func newTestAgent(t *testing.T, tokens ...apitoken.Token) *testAgent {
+	t.Helper()
+	set, err := apitoken.Load(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := testAgent{proxy: &recordingProxy{}, secrets: make(map[string]string)}
+	for _, tok := range tokens {
+		if a.secrets[tok.Name], err = set.Create(tok.Name, tok.Scope, tok.Devices); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(a.proxy)
+	t.Cleanup(srv.Close)
+	proxyURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.cfg = &cmdCfg{
+		ctx:      context.Background(),
+		sessions: tapo.NewSessionManager("user@example.com", "password", 0, nil, tapo.OptionProxy(proxyURL)),
+	}
+	a.Handler = agentHandler(a.cfg, "", set)
+	return &a
+}
+
+// do sends a request authenticated with the named API token, if any.
+func (a *testAgent) do(method, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, agentAPIPrefix+path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+a.secrets[token])
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	return w
+}
+
+// TestAgentConcurrentDiscovery checks that discoveries and device requests can
+// be served at once, run it with -race.
+func TestAgentConcurrentDiscovery(t *testing.T) {
+	fakeLocalDiscover(t, discoveredPlug)
+	a := newTestAgent(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if w := a.do(http.MethodGet, "/discover", ""); w.Code != http.StatusOK {
+				t.Errorf("discover: status = %d, want %d", w.Code, http.StatusOK)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			a.do(http.MethodGet, "/devices/127.0.0.1/info", "")
+		}()
+	}
+	wg.Wait()
+}
+
+// TestAgentUnknownDevice checks that the agent only opens sessions, which send
+// the account credentials, to the devices it discovered or that are in its
+// configuration.
+func TestAgentUnknownDevice(t *testing.T) {
+	fakeLocalDiscover(t, discoveredPlug)
+	a := newTestAgent(t, apitoken.Token{Name: "reader", Scope: apitoken.ScopeRead})
+	a.cfg.Groups = map[string][]string{"porch": {"192.0.2.10", "Lamp"}}
+	if _, _, err := discoverDevices(a.cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name       string
+		addr       string
+		wantStatus int
+	}{
+		{"discovered", "127.0.0.1", http.StatusBadGateway},
+		{"configured", "192.0.2.10", http.StatusBadGateway},
+		{"unknown", "192.0.2.99", http.StatusNotFound},
+		{"host name", "attacker.example", http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := a.do(http.MethodGet, "/devices/"+tc.addr+"/info", "reader")
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+			if contacted, want := a.proxy.contacted(tc.addr), tc.wantStatus != http.StatusNotFound; contacted != want {
+				t.Errorf("device contacted = %v, want %v", contacted, want)
+			}
+		})
+	}
+}
+
+// TestAgentDeviceTokens checks that the tokens restricted to some devices are
+// authorized from the discovery results, before contacting the device.
+func TestAgentDeviceTokens(t *testing.T) {
+	fakeLocalDiscover(t, discoveredPlug, `{"result":{"device_id":"8022B","ip":"127.0.0.2","mac":"00-11-22-33-44-66"}}`)
+	tokens := []apitoken.Token{
+		{Name: "by-mac", Scope: apitoken.ScopeRead, Devices: []string{"00-11-22-33-44-55"}},
+		{Name: "by-id", Scope: apitoken.ScopeRead, Devices: []string{"8022b"}},
+		{Name: "by-ip", Scope: apitoken.ScopeRead, Devices: []string{"192.0.2.10"}},
+	}
+	for _, tc := range []struct {
+		token   string
+		addr    string
+		allowed bool
+	}{
+		{"by-mac", "127.0.0.1", true},
+		{"by-mac", "127.0.0.2", false},
+		{"by-mac", "192.0.2.10", false},
+		{"by-id", "127.0.0.2", true},
+		{"by-id", "127.0.0.1", false},
+		{"by-ip", "192.0.2.10", true},
+		{"by-ip", "127.0.0.1", false},
+	} {
+		t.Run(tc.token+" "+tc.addr, func(t *testing.T) {
+			a := newTestAgent(t, tokens...)
+			a.cfg.Groups = map[string][]string{"porch": {"192.0.2.10"}}
+			if _, _, err := discoverDevices(a.cfg); err != nil {
+				t.Fatal(err)
+			}
+			w := a.do(http.MethodGet, "/devices/"+tc.addr+"/info", tc.token)
+			wantStatus := http.StatusForbidden
+			if tc.allowed {
+				// the proxy fails the requests to the device
+				wantStatus = http.StatusBadGateway
+			}
+			if w.Code != wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, wantStatus)
+			}
+			if a.proxy.contacted(tc.addr) != tc.allowed {
+				t.Errorf("device contacted = %v, want %v", !tc.allowed, tc.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+)
+
+const agentAPIPrefix = "/api/v1"
+
+// agentError is the JSON body returned by the agent on failure.
+type agentError struct {
+	Error string `json:"error"`
+}
+
+// agentClient talks to a remote tapo agent.
+type agentClient struct {
+	baseURL string
+	token   string
+	client  http.Client
+}
+
+func newAgentClient(hostport, token string) *agentClient {
+	return &agentClient{
+		baseURL: "http://" + hostport + agentAPIPrefix,
+		token:   token,
+		client:  http.Client{Timeout: time.Minute},
+	}
+}
+
+// do sends a request to the agent, and decodes the JSON response into result
+// if it is not nil.
+func (a *agentClient) do(method, path string, result interface{}) error {
+	req, err := http.NewRequest(method, a.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("agent request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read agent response: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		var aerr agentError
+		if err := json.Unmarshal(body, &aerr); err == nil && aerr.Error != "" {
+			return fmt.Errorf("agent returned %s: %s", resp.Status, aerr.Error)
+		}
+		return fmt.Errorf("agent returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("failed to decode agent response: %w", err)
+	}
+	return nil
+}
+
+func (a *agentClient) Discover() (map[string]tapo.DiscoverResponse, []tapo.DiscoverResponse, error) {
+	var result agentDiscoverResult
+	if err := a.do(http.MethodGet, "/discover", &result); err != nil {
+		return nil, nil, err
+	}
+	return result.Devices, result.Failed, nil
+}
+
+// Device returns a device that forwards all the operations to the agent.
+func (a *agentClient) Device(addr netip.Addr) device {
+	return &agentDevice{agent: a, addr: addr}
+}
+
+// agentDevice is a device reached through a remote agent.
+type agentDevice struct {
+	agent *agentClient
+	addr  netip.Addr
+}
+
+func (d *agentDevice) path(action string) string {
+	return "/devices/" + d.addr.String() + "/" + action
+}
+
+func (d *agentDevice) GetDeviceInfo() (*tapo.DeviceInfo, error) {
+	var info tapo.DeviceInfo
+	if err := d.agent.do(http.MethodGet, d.path("info"), &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (d *agentDevice) GetDeviceUsage() (*tapo.DeviceUsage, error) {
+	var usage tapo.DeviceUsage
+	if err := d.agent.do(http.MethodGet, d.path("usage"), &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (d *agentDevice) GetDeviceTime() (*tapo.DeviceTime, error) {
+	var dt tapo.DeviceTime
+	if err := d.agent.do(http.MethodGet, d.path("time"), &dt); err != nil {
+		return nil, err
+	}
+	return &dt, nil
+}
+
+func (d *agentDevice) GetEnergyUsage() (*tapo.EnergyUsage, error) {
+	var usage tapo.EnergyUsage
+	if err := d.agent.do(http.MethodGet, d.path("energy"), &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (d *agentDevice) SetDeviceInfo(deviceOn bool) error {
+	action := "off"
+	if deviceOn {
+		action = "on"
+	}
+	return d.agent.do(http.MethodPost, d.path(action), nil)
+}
@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !lite
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// benchResult holds the timings collected for a single protocol.
+type benchResult struct {
+	protocol  string
+	handshake time.Duration
+	latencies []time.Duration
+	failures  int
+	err       error
+	// interrupted is true if the benchmark was stopped by a signal.
+	interrupted bool
+}
+
+// percentile returns the p-th percentile of the given sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p / 100)
+	return sorted[idx]
+}
+
+func (r *benchResult) print() {
+	fmt.Printf("%s:\n", r.protocol)
+	if r.err != nil {
+		fmt.Printf("  Error                 : %v\n", r.err)
+		fmt.Printf("\n")
+		return
+	}
+	fmt.Printf("  Handshake             : %s\n", r.handshake)
+	fmt.Printf("  Requests              : %d ok, %d failed\n", len(r.latencies), r.failures)
+	if r.interrupted {
+		fmt.Printf("  Interrupted, partial results\n")
+	}
+	if len(r.latencies) > 0 {
+		sorted := make([]time.Duration, len(r.latencies))
+		copy(sorted, r.latencies)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		var total time.Duration
+		for _, l := range sorted {
+			total += l
+		}
+		fmt.Printf("  Min                   : %s\n", sorted[0])
+		fmt.Printf("  Avg                   : %s\n", total/time.Duration(len(sorted)))
+		fmt.Printf("  p50                   : %s\n", percentile(sorted, 50))
+		fmt.Printf("  p90                   : %s\n", percentile(sorted, 90))
+		fmt.Printf("  p99                   : %s\n", percentile(sorted, 99))
+		fmt.Printf("  Max                   : %s\n", sorted[len(sorted)-1])
+	}
+	fmt.Printf("\n")
+}
+
+// benchSession runs a handshake followed by `count` get_device_info requests
+// on the given session, and records how long each step took.
+func benchSession(cfg *cmdCfg, protocol string, s tapo.Session, addr netip.Addr, count int) *benchResult {
+	res := benchResult{protocol: protocol}
+	start := time.Now()
+	if err := s.Handshake(addr, cfg.Email, cfg.Password); err != nil {
+		res.err = fmt.Errorf("handshake failed: %w", err)
+		return &res
+	}
+	res.handshake = time.Since(start)
+	requestBytes, err := json.Marshal(tapo.NewGetDeviceInfoRequest())
+	if err != nil {
+		res.err = fmt.Errorf("failed to marshal get_device_info payload: %w", err)
+		return &res
+	}
+	for i := 0; i < count; i++ {
+		if cfg.ctx.Err() != nil {
+			res.interrupted = true
+			break
+		}
+		start := time.Now()
+		if _, err := s.Request(requestBytes); err != nil {
+			cfg.logger.Printf("%s request %d failed: %v", protocol, i, err)
+			res.failures++
+			continue
+		}
+		res.latencies = append(res.latencies, time.Since(start))
+	}
+	return &res
+}
+
+// cmdBench measures the handshake time and the request round-trip latency
+// distribution for each of the supported protocols.
+func cmdBench(cfg *cmdCfg, ip net.IP, count int) error {
+	if cfg.agent != nil {
+		return fmt.Errorf("bench is not supported through an agent")
+	}
+	if count <= 0 {
+		return fmt.Errorf("request count must be positive, got %d", count)
+	}
+	addr, err := netip.ParseAddr(ip.String())
+	if err != nil {
+		return fmt.Errorf("failed to parse IP address: %w", err)
+	}
+	fmt.Printf("Benchmarking %s with %d requests per protocol\n\n", addr, count)
+	var transport http.RoundTripper
+	if cfg.proxy != "" {
+		proxy, err := url.Parse(cfg.proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.Proxy = http.ProxyURL(proxy)
+		transport = tr
+	}
+	ks := tapo.NewKlapSession(cfg.logger)
+	ks.Transport = transport
+	ps := tapo.NewPassthroughSession(cfg.logger)
+	ps.Transport = transport
+	sessions := []struct {
+		protocol string
+		session  tapo.Session
+	}{
+		{"KLAP", ks},
+		{"Passthrough", ps},
+	}
+	ok := false
+	for _, s := range sessions {
+		if cfg.ctx.Err() != nil {
+			return interrupted(cfg)
+		}
+		r := benchSession(cfg, s.protocol, s.session, addr, count)
+		r.print()
+		if r.err == nil {
+			ok = true
+		}
+	}
+	if cfg.ctx.Err() != nil {
+		return interrupted(cfg)
+	}
+	if !ok {
+		return fmt.Errorf("no protocol succeeded")
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+// Budgets cap the monthly energy use of a device or a group, in kWh or in
+// money at a flat price per kWh. `tapo budget` prints how much of each budget
+// was used in the current month, and telegrambot checks them periodically and
+// notifies when a budget reaches 50%, 80% and 100%.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// budgetThresholds are the percentages of a budget that are notified.
+var budgetThresholds = []int{50, 80, 100}
+
+// budgetCheckInterval is how often telegrambot checks the budgets. The energy
+// data of the devices is hourly at best.
+const budgetCheckInterval = time.Hour
+
+// budgetCfg is an entry of the budgets section of the configuration file.
+type budgetCfg struct {
+	// Device is the IP address or nickname of a device, Group the name of a
+	// group. Exactly one of them must be set.
+	Device string `json:"device,omitempty"`
+	Group  string `json:"group,omitempty"`
+	// KWh is the monthly budget in kWh.
+	KWh float64 `json:"kwh,omitempty"`
+	// Amount is the monthly budget in Currency, at Price per kWh. It is
+	// an alternative to KWh.
+	Amount   float64 `json:"amount,omitempty"`
+	Price    float64 `json:"price,omitempty"`
+	Currency string  `json:"currency,omitempty"`
+}
+
+func (b budgetCfg) name() string {
+	if b.Group != "" {
+		return "group " + b.Group
+	}
+	return b.Device
+}
+
+// validate checks that the budget has a target and a limit.
+func (b budgetCfg) validate() error {
+	switch {
+	case (b.Device == "") == (b.Group == ""):
+		return errors.New("set one of device or group")
+	case b.KWh < 0 || b.Amount < 0 || b.Price < 0:
+		return errors.New("kwh, amount and price cannot be negative")
+	case b.KWh > 0 && b.Amount > 0:
+		return errors.New("set one of kwh or amount")
+	case b.KWh == 0 && (b.Amount == 0 || b.Price == 0):
+		return errors.New("set kwh, or amount and price")
+	}
+	return nil
+}
+
+// limit returns the budget in kWh.
+func (b budgetCfg) limit() float64 {
+	if b.KWh > 0 {
+		return b.KWh
+	}
+	return b.Amount / b.Price
+}
+
+// budgetUsage is the use of a budget in the current month.
+type budgetUsage struct {
+	budget budgetCfg
+	// month is the current month of the devices, as YYYY-MM.
+	month string
+	// wh is the energy used since the start of the month.
+	wh int
+	// failed are the devices whose energy data could not be read. Their
+	// energy is not counted.
+	failed []string
+}
+
+func (u budgetUsage) percent() float64 {
+	return float64(u.wh) / 1000 / u.budget.limit() * 100
+}
+
+// threshold returns the highest threshold reached, 0 if none.
+func (u budgetUsage) threshold() int {
+	ret := 0
+	for _, t := range budgetThresholds {
+		if u.percent() >= float64(t) {
+			ret = t
+		}
+	}
+	return ret
+}
+
+// describe formats the use of the budget, e.g. "Heater: 40.0 of 100.0 kWh
+// (40%)".
+func (u budgetUsage) describe(un units) string {
+	var (
+		b   = u.budget
+		kwh = float64(u.wh) / 1000
+		s   string
+	)
+	if b.KWh > 0 {
+		s = fmt.Sprintf("%s: %s of %s kWh", b.name(), un.locale.format(kwh, 1), un.locale.format(b.KWh, 1))
+	} else {
+		s = fmt.Sprintf("%s: %s of %s %s", b.name(), un.locale.format(kwh*b.Price, 2), un.locale.format(b.Amount, 2), b.Currency)
+	}
+	s += fmt.Sprintf(" (%.0f%%)", u.percent())
+	if len(u.failed) > 0 {
+		s += ", not counting " + strings.Join(u.failed, ", ")
+	}
+	return s
+}
+
+// budgetIPs returns the addresses of the devices of a budget.
+func budgetIPs(cfg *cmdCfg, b budgetCfg) ([]net.IP, error) {
+	if b.Group != "" {
+		return resolveGroup(cfg, b.Group)
+	}
+	if ip := net.ParseIP(b.Device); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ip, err := ipByName(cfg, b.Device)
+	if err != nil {
+		return nil, err
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("unknown device name '%s'", b.Device)
+	}
+	return []net.IP{ip}, nil
+}
+
+// monthToDate returns the current month of a device, as YYYY-MM, and the
+// energy it used since the start of the month in Wh, from its daily energy
+// data.
+func monthToDate(cfg *cmdCfg, ip net.IP) (string, int, error) {
+	plug, err := getPlug(cfg, ip.String())
+	if err != nil {
+		return "", 0, err
+	}
+	dt, err := plug.GetDeviceTimeContext(cfg.ctx)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get device time: %w", err)
+	}
+	loc := dt.Location()
+	now := dt.Time()
+	_, start, err := energyRange("daily", now)
+	if err != nil {
+		return "", 0, err
+	}
+	data, err := plug.GetEnergyDataRangeContext(cfg.ctx, start, now, tapo.EnergyDaily, loc, nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get energy data: %w", err)
+	}
+	wh := 0
+	for _, b := range data.Buckets(loc) {
+		wh += b.Energy
+	}
+	return now.Format("2006-01"), wh, nil
+}
+
+// checkBudget returns the use of a budget. Devices that fail are skipped, and
+// listed in the result, unless all of them fail.
+func checkBudget(cfg *cmdCfg, b budgetCfg) (*budgetUsage, error) {
+	if err := b.validate(); err != nil {
+		return nil, fmt.Errorf("invalid budget: %w", err)
+	}
+	if cfg.agent != nil {
+		return nil, fmt.Errorf("budgets are not supported through --agent")
+	}
+	ips, err := budgetIPs(cfg, b)
+	if err != nil {
+		return nil, err
+	}
+	u := budgetUsage{budget: b}
+	var lastErr error
+	for _, ip := range ips {
+		month, wh, err := monthToDate(cfg, ip)
+		if err != nil {
+			log.Printf("Warning: budget %s: %s: %v", b.name(), ip, err)
+			u.failed = append(u.failed, ip.String())
+			lastErr = err
+			continue
+		}
+		u.month = month
+		u.wh += wh
+	}
+	if len(u.failed) == len(ips) {
+		if lastErr == nil {
+			return nil, fmt.Errorf("no devices")
+		}
+		return nil, lastErr
+	}
+	return &u, nil
+}
+
+// cmdBudget prints the use of the budgets of the configuration file in the
+// current month.
+func cmdBudget(cfg *cmdCfg) error {
+	if len(cfg.Budgets) == 0 {
+		return fmt.Errorf("no budgets in the configuration file")
+	}
+	failed := 0
+	for _, b := range cfg.Budgets {
+		u, err := checkBudget(cfg, b)
+		if err != nil {
+			failed++
+			fmt.Printf("%s: FAILED: %v\n", b.name(), err)
+			continue
+		}
+		fmt.Println(u.describe(cfg.units))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d budgets failed", failed, len(cfg.Budgets))
+	}
+	return nil
+}
+
+// budgetTracker remembers the highest threshold notified for each budget in
+// the current month. It is not persisted, after a restart the highest
+// threshold reached is notified again.
+type budgetTracker struct {
+	// notified is indexed like the budgets of the configuration.
+	notified []budgetMark
+}
+
+type budgetMark struct {
+	month     string
+	threshold int
+}
+
+// check returns the notifications of the budgets that reached a threshold
+// since the previous check.
+func (t *budgetTracker) check(cfg *cmdCfg) []string {
+	if t.notified == nil {
+		t.notified = make([]budgetMark, len(cfg.Budgets))
+	}
+	var msgs []string
+	for idx, b := range cfg.Budgets {
+		if cfg.ctx.Err() != nil {
+			break
+		}
+		u, err := checkBudget(cfg, b)
+		if err != nil {
+			log.Printf("Warning: failed to check budget %s: %v", b.name(), err)
+			continue
+		}
+		mark := t.notified[idx]
+		if mark.month != u.month {
+			mark = budgetMark{month: u.month}
+		}
+		if th := u.threshold(); th > mark.threshold {
+			msgs = append(msgs, fmt.Sprintf("Budget %d%% reached, %s", th, u.describe(cfg.units)))
+			mark.threshold = th
+		}
+		t.notified[idx] = mark
+	}
+	return msgs
+}
@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// capabilityColumns are the features printed by capabilities, and the
+// component that provides each of them.
+var capabilityColumns = []struct {
+	name      string
+	component string
+}{
+	{"ENERGY", "energy_monitoring"},
+	{"COUNTDOWN", "countdown"},
+	{"SCHEDULE", "schedule"},
+	{"LED", "led"},
+	{"AUTO-OFF", "auto_off"},
+}
+
+// componentLister is implemented by the devices that can list their
+// components. Devices reached through an agent cannot.
+type componentLister interface {
+	GetComponents() (*tapo.ComponentList, error)
+}
+
+// deviceCapabilities is a row of the capabilities matrix.
+type deviceCapabilities struct {
+	name       string
+	model      string
+	components *tapo.ComponentList
+}
+
+// cmdCapabilities prints which features each device supports, from the
+// components it reports. ip is ignored if group is set.
+func cmdCapabilities(cfg *cmdCfg, ip net.IP, group string) error {
+	ips := []net.IP{ip}
+	if group != "" {
+		var err error
+		if ips, err = resolveGroup(cfg, group); err != nil {
+			return err
+		}
+	}
+	rows := make([]deviceCapabilities, len(ips))
+	runner := fleetRunner{cfg: cfg}
+	results := runner.runParallel(ips, groupInfoWorkers, func(idx int, d device) error {
+		lister, ok := d.(componentLister)
+		if !ok {
+			return errors.New("listing the components is not supported through --agent")
+		}
+		info, err := d.GetDeviceInfo()
+		if err != nil {
+			return fmt.Errorf("failed to get device info: %w", err)
+		}
+		components, err := lister.GetComponents()
+		if err != nil {
+			return fmt.Errorf("failed to get components: %w", err)
+		}
+		rows[idx] = deviceCapabilities{name: info.DecodedNickname, model: info.Model, components: components}
+		return nil
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "IP\tNAME\tMODEL")
+	for _, c := range capabilityColumns {
+		fmt.Fprintf(w, "\t%s", c.name)
+	}
+	fmt.Fprintf(w, "\n")
+	failed := 0
+	for idx, r := range results {
+		if r.err != nil {
+			failed++
+			fmt.Fprintf(w, "%s\tFAILED: %v\t\n", r.ip, r.err)
+			continue
+		}
+		row := rows[idx]
+		fmt.Fprintf(w, "%s\t%s\t%s", r.ip, row.name, row.model)
+		for _, c := range capabilityColumns {
+			mark := "-"
+			if row.components.Has(c.component) {
+				mark = "yes"
+			}
+			fmt.Fprintf(w, "\t%s", mark)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d devices failed", failed, len(ips))
+	}
+	if len(results) < len(ips) {
+		return fmt.Errorf("%d of %d devices not queried: %w", len(ips)-len(results), len(ips), interrupted(cfg))
+	}
+	return nil
+}
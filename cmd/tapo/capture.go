@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// unsafePathChars matches characters that should not end up in file names.
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// captureSchemas returns a middleware that writes every decrypted device
+// response to dir/<model>/<method>.json, to help adding typed structures for
+// unknown models.
+func captureSchemas(dir string) tapo.Middleware {
+	return func(s tapo.Session) tapo.Session {
+		return &captureSession{Session: s, dir: dir, model: "unknown"}
+	}
+}
+
+type captureSession struct {
+	tapo.Session
+	dir string
+
+	mu    sync.Mutex
+	model string
+}
+
+func (c *captureSession) Unwrap() tapo.Session {
+	return c.Session
+}
+
+func (c *captureSession) Request(payload []byte) ([]byte, error) {
+	resp, err := c.Session.Request(payload)
+	if err != nil {
+		return resp, err
+	}
+	var req struct {
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil || req.Method == "" {
+		return resp, nil
+	}
+	if req.Method == "get_device_info" {
+		var info struct {
+			Result struct {
+				Model string `json:"model"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(resp, &info); err == nil && info.Result.Model != "" {
+			c.mu.Lock()
+			c.model = info.Result.Model
+			c.mu.Unlock()
+		}
+	}
+	if err := c.write(req.Method, resp); err != nil {
+		log.Printf("Warning: failed to capture schema for '%s': %v", req.Method, err)
+	}
+	return resp, nil
+}
+
+func (c *captureSession) write(method string, resp []byte) error {
+	c.mu.Lock()
+	model := c.model
+	c.mu.Unlock()
+	dir := filepath.Join(c.dir, unsafePathChars.ReplaceAllString(model, "_"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, resp, "", "  "); err != nil {
+		return fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	buf.WriteByte('\n')
+	path := filepath.Join(dir, unsafePathChars.ReplaceAllString(method, "_")+".json")
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
@@ -0,0 +1,320 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/insomniacslk/tapo"
+	"github.com/spf13/pflag"
+)
+
+// configTemplate is the configuration written by `config init`. JSON has no
+// comments, the fields are explained by configHelp.
+const configTemplate = `{
+  "email": "",
+  "password": "",
+  "debug": false,
+  "groups": {
+    "living-room": ["192.168.1.10", "Desk lamp"]
+  },
+  "protected": []
+}
+`
+
+const configHelp = `  email     e-mail of the Tapo cloud account the devices are registered to
+  password  password of the Tapo cloud account, or its encrypted form
+            printed by "tapo config encrypt"
+  debug     enable debug logs, like --debug
+  groups    named groups of devices for --group, as IP addresses or device
+            nicknames; "all" is reserved for all the discovered devices
+  protected devices that must not be switched by accident, e.g. a freezer,
+            as IP addresses or device nicknames; switching them needs
+            --force, and group operations skip them
+  firmware_pinned
+            devices whose firmware "tapo firmware rollout" must not update,
+            as IP addresses or device nicknames
+  hooks     commands run with a JSON description of the event on stdin, as
+            {"event": "after_change", "command": ["/path/to/cmd", "arg"]};
+            events are before_change (a failing hook cancels the change),
+            after_change, and alert for the notifications of telegrambot
+  budgets   monthly energy budgets printed by "tapo budget", and notified by
+            telegrambot at 50%, 80% and 100%, as {"device": "Heater",
+            "kwh": 100} or {"group": "living-room", "amount": 30,
+            "price": 0.25, "currency": "EUR"}
+  sites     places reached differently, selected with --site NAME, as
+            {"office": {"agent": "host:7491", "agent_token": "..."}}; a
+            site has one of agent, via or proxy, and optional
+            "discovery_interfaces" and "groups" added to the global ones
+  telegram  optional, for telegrambot: "token" is the bot token given by
+            @BotFather, or its encrypted form printed by "tapo config
+            encrypt", and "chats" the IDs of the chats allowed to use the
+            bot, which also receive the offline notifications
+`
+
+// cmdConfig runs the config subcommands.
+func cmdConfig(cfg *cmdCfg, configFile string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: config validate|init|encrypt")
+	}
+	switch args[0] {
+	case "validate":
+		return cmdConfigValidate(cfg, configFile)
+	case "init":
+		return cmdConfigInit(configFile)
+	case "encrypt":
+		return cmdConfigEncrypt(*flagKeyFile)
+	}
+	return fmt.Errorf("unknown config command '%s', want validate, init or encrypt", args[0])
+}
+
+// cmdConfigInit writes a configuration file with placeholder values. It does
+// not overwrite an existing file.
+func cmdConfigInit(configFile string) error {
+	if err := os.MkdirAll(filepath.Dir(configFile), 0o700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	// the file stores the account password
+	f, err := os.OpenFile(configFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("'%s' already exists, not overwriting it", configFile)
+		}
+		return fmt.Errorf("failed to create config file: %w", err)
+	}
+	if _, err := f.WriteString(configTemplate); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	fmt.Printf("Created %s, edit it to set:\n%s", configFile, configHelp)
+	return nil
+}
+
+// configProblem is an issue found by `config validate`.
+type configProblem struct {
+	fatal bool
+	msg   string
+}
+
+// cmdConfigValidate checks the configuration file for syntax errors, unknown
+// fields, missing credentials and group members that do not match any
+// device. Nicknames are checked with a discovery.
+func cmdConfigValidate(cfg *cmdCfg, configFile string) error {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var (
+		problems []configProblem
+		fc       cmdCfg
+	)
+	report := func(fatal bool, format string, args ...interface{}) {
+		problems = append(problems, configProblem{fatal: fatal, msg: fmt.Sprintf(format, args...)})
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		if !strings.HasPrefix(err.Error(), "json: unknown field") {
+			report(true, "%s", describeJSONError(data, err))
+			return printConfigProblems(configFile, problems)
+		}
+		// loadConfig ignores unknown fields, they are likely typos
+		report(false, "%s", strings.TrimPrefix(err.Error(), "json: "))
+		fc = cmdCfg{}
+		if err := json.Unmarshal(data, &fc); err != nil {
+			report(true, "%s", describeJSONError(data, err))
+			return printConfigProblems(configFile, problems)
+		}
+	}
+	email, password := fc.Email, fc.Password
+	if pflag.CommandLine.Changed("email") {
+		email = *flagEmail
+	}
+	if pflag.CommandLine.Changed("password") {
+		password = *flagPassword
+	}
+	if email == "" {
+		report(true, "email is not set")
+	}
+	if password == "" && fc.Password == "" {
+		report(true, "password is not set")
+	}
+	if isEncrypted(fc.Password) && !pflag.CommandLine.Changed("password") {
+		key, err := loadKey(*flagKeyFile)
+		if err == nil {
+			password, err = decryptValue(key, fc.Password)
+		}
+		if err != nil {
+			report(true, "cannot decrypt password: %v", err)
+			password = ""
+		}
+	} else if fc.Password != "" {
+		if fi, err := os.Stat(configFile); err == nil && fi.Mode().Perm()&0o077 != 0 {
+			report(false, "file contains the password but is readable by other users (mode %04o), consider chmod 600", fi.Mode().Perm())
+		}
+	}
+	var nicknames []string
+	groups := make([]string, 0, len(fc.Groups))
+	for name := range fc.Groups {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+	for _, name := range groups {
+		members := fc.Groups[name]
+		switch {
+		case name == groupAll:
+			report(true, "group '%s' is reserved for all the discovered devices", name)
+		case strings.TrimSpace(name) == "":
+			report(true, "group with an empty name")
+		case len(members) == 0:
+			report(false, "group '%s' is empty", name)
+		}
+		seen := make(map[string]bool, len(members))
+		for _, m := range members {
+			if seen[m] {
+				report(false, "group '%s': '%s' is listed more than once", name, m)
+			}
+			seen[m] = true
+			if strings.TrimSpace(m) == "" {
+				report(true, "group '%s': empty member", name)
+			} else if net.ParseIP(m) == nil {
+				nicknames = append(nicknames, m)
+			}
+		}
+	}
+	for _, m := range fc.Protected {
+		if strings.TrimSpace(m) == "" {
+			report(true, "protected: empty entry")
+		} else if net.ParseIP(m) == nil {
+			nicknames = append(nicknames, m)
+		}
+	}
+	for _, m := range fc.FirmwarePinned {
+		if strings.TrimSpace(m) == "" {
+			report(true, "firmware_pinned: empty entry")
+		} else if net.ParseIP(m) == nil {
+			nicknames = append(nicknames, m)
+		}
+	}
+	for idx, h := range fc.Hooks {
+		switch h.Event {
+		case hookBeforeChange, hookAfterChange, hookAlert:
+		default:
+			report(true, "hooks[%d]: unknown event '%s', want %s, %s or %s", idx, h.Event, hookBeforeChange, hookAfterChange, hookAlert)
+		}
+		if len(h.Command) == 0 || h.Command[0] == "" {
+			report(true, "hooks[%d]: empty command", idx)
+		} else if _, err := exec.LookPath(h.Command[0]); err != nil {
+			report(false, "hooks[%d]: %v", idx, err)
+		}
+	}
+	for idx, b := range fc.Budgets {
+		if err := b.validate(); err != nil {
+			report(true, "budgets[%d]: %v", idx, err)
+			continue
+		}
+		if b.Group != "" {
+			if _, ok := fc.Groups[b.Group]; !ok && b.Group != groupAll {
+				report(true, "budgets[%d]: unknown group '%s'", idx, b.Group)
+			}
+		} else if net.ParseIP(b.Device) == nil {
+			nicknames = append(nicknames, b.Device)
+		}
+	}
+	for name, s := range fc.Sites {
+		if strings.TrimSpace(name) == "" {
+			report(true, "sites: empty site name")
+		}
+		if err := s.validate(); err != nil {
+			report(true, "site '%s': %v", name, err)
+		}
+	}
+	if t := fc.Telegram; t != nil {
+		if t.Token == "" {
+			report(true, "telegram: token is not set")
+		}
+		if len(t.Chats) == 0 {
+			report(false, "telegram: no chats, the bot will not answer anybody")
+		}
+	}
+	if len(nicknames) > 0 {
+		if email == "" || password == "" {
+			report(false, "cannot check device nicknames without credentials")
+		} else {
+			plugOpts, err := plugOptions(cfg)
+			if err != nil {
+				return err
+			}
+			cfg.sessions = tapo.NewSessionManager(email, password, 0, cfg.logger, plugOpts...)
+			byName, err := ipsByName(cfg)
+			if err != nil {
+				report(false, "cannot check device nicknames: %v", err)
+			}
+			for _, n := range nicknames {
+				if err == nil && byName[n] == nil {
+					report(true, "no device named '%s' was discovered", n)
+				}
+			}
+		}
+	}
+	return printConfigProblems(configFile, problems)
+}
+
+// describeJSONError adds the line and column to JSON decoding errors.
+func describeJSONError(data []byte, err error) string {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+		offset    int64
+	)
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+		err = fmt.Errorf("field '%s' must be of type %s, not %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	default:
+		return err.Error()
+	}
+	line, col := 1, 1
+	for _, c := range data[:offset] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Sprintf("line %d, column %d: %v", line, col, err)
+}
+
+// printConfigProblems prints the problems found in the configuration, and
+// returns an error if any of them is fatal.
+func printConfigProblems(configFile string, problems []configProblem) error {
+	fatal := 0
+	for _, p := range problems {
+		level := "warning"
+		if p.fatal {
+			level = "error"
+			fatal++
+		}
+		fmt.Printf("%s: %s: %s\n", configFile, level, p.msg)
+	}
+	if fatal > 0 {
+		return fmt.Errorf("%s is not valid, errors: %d", configFile, fatal)
+	}
+	fmt.Printf("%s: OK\n", configFile)
+	return nil
+}
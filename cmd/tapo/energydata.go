@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// energyRange returns the interval and the time range of energy data for a
+// granularity: the hours of today, the days of this month or the months of
+// this year, in the device time zone.
+func energyRange(granularity string, now time.Time) (tapo.EnergyInterval, time.Time, error) {
+	y, m, d := now.Date()
+	switch granularity {
+	case "hourly":
+		return tapo.EnergyHourly, time.Date(y, m, d, 0, 0, 0, 0, now.Location()), nil
+	case "", "daily":
+		return tapo.EnergyDaily, time.Date(y, m, 1, 0, 0, 0, 0, now.Location()), nil
+	case "monthly":
+		return tapo.EnergyMonthly, time.Date(y, 1, 1, 0, 0, 0, 0, now.Location()), nil
+	}
+	return 0, time.Time{}, fmt.Errorf("unknown granularity '%s', want hourly, daily or monthly", granularity)
+}
+
+// cmdEnergyData prints the energy consumption of a device in hourly, daily or
+// monthly buckets, with timestamps in the device time zone. args are the
+// granularity and an optional date range; by default the current day, month or
+// year is printed. Large ranges are fetched in chunks.
+func cmdEnergyData(cfg *cmdCfg, ip net.IP, args []string) error {
+	if len(args) > 3 {
+		return fmt.Errorf("usage: energy-data [hourly|daily|monthly] [from YYYY-MM-DD [to YYYY-MM-DD]]")
+	}
+	if cfg.agent != nil {
+		return fmt.Errorf("energy-data is not supported through --agent")
+	}
+	var granularity string
+	if len(args) >= 1 {
+		granularity = args[0]
+	}
+	plug, err := getPlug(cfg, ip.String())
+	if err != nil {
+		return err
+	}
+	dt, err := plug.GetDeviceTime()
+	if err != nil {
+		return fmt.Errorf("failed to get device time: %w", err)
+	}
+	loc := dt.Location()
+	now := dt.Time()
+	interval, start, err := energyRange(granularity, now)
+	if err != nil {
+		return err
+	}
+	end := now
+	if len(args) >= 2 {
+		start, err = time.ParseInLocation(time.DateOnly, args[1], loc)
+		if err != nil {
+			return fmt.Errorf("invalid start date: %w", err)
+		}
+	}
+	if len(args) == 3 {
+		end, err = time.ParseInLocation(time.DateOnly, args[2], loc)
+		if err != nil {
+			return fmt.Errorf("invalid end date: %w", err)
+		}
+		// include the whole end day
+		end = end.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	data, err := plug.GetEnergyDataRange(start, end, interval, loc, func(done, total int) {
+		if total > 1 {
+			fmt.Fprintf(os.Stderr, "\rFetched %d/%d chunks", done, total)
+			if done == total {
+				fmt.Fprintf(os.Stderr, "\n")
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get energy data: %w", err)
+	}
+	layout := "2006-01-02"
+	switch interval {
+	case tapo.EnergyHourly:
+		layout = "2006-01-02 15:04 MST"
+	case tapo.EnergyMonthly:
+		layout = "2006-01"
+	}
+	for _, b := range data.Buckets(loc) {
+		fmt.Printf("%-20s %12s\n", b.Start.Format(layout), cfg.units.energy(b.Energy))
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+// `tapo firmware status` prints the installed and the latest firmware of the
+// devices, and `tapo firmware rollout` updates them in batches of --batch
+// devices. After each batch the devices must come back online with a new
+// firmware within --wait, otherwise the rollout stops, so that a bad firmware
+// only reaches the first batch. Devices in firmware_pinned are never updated,
+// protected devices and devices in maintenance only with --force.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// firmwarePollInterval is how often a device is queried while it installs a
+// firmware.
+const firmwarePollInterval = 15 * time.Second
+
+// firmwareUpdater is implemented by the devices that can update their
+// firmware. Devices reached through an agent cannot.
+type firmwareUpdater interface {
+	GetLatestFirmware() (*tapo.LatestFirmware, error)
+	UpdateFirmware() error
+}
+
+// firmwareStatus is the firmware of a device, and whether rollout updates it.
+type firmwareStatus struct {
+	ip      net.IP
+	name    string
+	model   string
+	current string
+	latest  *tapo.LatestFirmware
+	// skip is why rollout does not update the device, if it does not.
+	skip string
+}
+
+func (s firmwareStatus) state() string {
+	if s.skip != "" {
+		return s.skip
+	}
+	return "update available"
+}
+
+// cmdFirmware runs the firmware subcommands.
+func cmdFirmware(cfg *cmdCfg, args []string, group string, batch int, wait time.Duration) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: firmware status|rollout")
+	}
+	if group == "" {
+		group = groupAll
+	}
+	switch args[0] {
+	case "status":
+		_, err := firmwareStatuses(cfg, group, true)
+		return err
+	case "rollout":
+		return cmdFirmwareRollout(cfg, group, batch, wait)
+	}
+	return fmt.Errorf("unknown firmware command '%s', want status or rollout", args[0])
+}
+
+// firmwareStatuses queries the installed and the latest firmware of the
+// devices of a group, and prints them if verbose is set. It returns the
+// devices that were queried successfully, in group order.
+func firmwareStatuses(cfg *cmdCfg, group string, verbose bool) ([]firmwareStatus, error) {
+	ips, err := resolveGroup(cfg, group)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]firmwareStatus, len(ips))
+	runner := fleetRunner{cfg: cfg}
+	results := runner.runParallel(ips, groupInfoWorkers, func(idx int, d device) error {
+		updater, ok := d.(firmwareUpdater)
+		if !ok {
+			return errors.New("firmware updates are not supported through --agent")
+		}
+		info, err := d.GetDeviceInfo()
+		if err != nil {
+			return fmt.Errorf("failed to get device info: %w", err)
+		}
+		latest, err := updater.GetLatestFirmware()
+		if err != nil {
+			return fmt.Errorf("failed to get the latest firmware: %w", err)
+		}
+		s := firmwareStatus{
+			ip:      ips[idx],
+			name:    info.DecodedNickname,
+			model:   info.Model,
+			current: info.FWVersion,
+			latest:  latest,
+		}
+		switch {
+		case !latest.NeedToUpgrade:
+			s.skip = "up to date"
+		case isListed(cfg.FirmwarePinned, ips[idx], s.name):
+			s.skip = "pinned"
+		case !cfg.force && isProtected(cfg, ips[idx], s.name):
+			// the update reboots the device
+			s.skip = "protected"
+		case !cfg.force && inMaintenance(cfg, ips[idx], s.name):
+			s.skip = "in maintenance"
+		}
+		statuses[idx] = s
+		return nil
+	})
+	var (
+		ret    []firmwareStatus
+		failed int
+	)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if verbose {
+		fmt.Fprintf(w, "IP\tNAME\tMODEL\tINSTALLED\tLATEST\tSTATE\n")
+	}
+	for idx, r := range results {
+		if r.err != nil {
+			failed++
+			if verbose {
+				fmt.Fprintf(w, "%s\tFAILED: %v\t\n", r.ip, r.err)
+			}
+			continue
+		}
+		s := statuses[idx]
+		ret = append(ret, s)
+		if verbose {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.ip, s.name, s.model, s.current, s.latest.FWVersion, s.state())
+		}
+	}
+	w.Flush()
+	if !verbose {
+		for _, r := range results {
+			if r.err != nil {
+				fmt.Printf("%-16s FAILED: %v\n", r.ip, r.err)
+			}
+		}
+	}
+	if failed > 0 {
+		return ret, fmt.Errorf("%d of %d devices failed", failed, len(ips))
+	}
+	if len(results) < len(ips) {
+		return ret, fmt.Errorf("%d of %d devices not queried: %w", len(ips)-len(results), len(ips), interrupted(cfg))
+	}
+	return ret, nil
+}
+
+// cmdFirmwareRollout updates the firmware of the devices of a group, batch
+// devices at a time. Every device of a batch must come back online with a
+// new firmware within wait before the next batch starts. The rollout stops
+// at the first batch with a failure, and does not start if any device cannot
+// be queried.
+func cmdFirmwareRollout(cfg *cmdCfg, group string, batch int, wait time.Duration) error {
+	if batch < 1 {
+		return fmt.Errorf("batch size must be at least 1")
+	}
+	if wait <= 0 {
+		return fmt.Errorf("wait must be positive")
+	}
+	statuses, err := firmwareStatuses(cfg, group, false)
+	if err != nil {
+		return fmt.Errorf("not starting the rollout: %w", err)
+	}
+	var todo []firmwareStatus
+	for _, s := range statuses {
+		if s.skip == "" {
+			todo = append(todo, s)
+			continue
+		}
+		fmt.Printf("%-16s skipped: %s\n", s.ip, s.skip)
+	}
+	if len(todo) == 0 {
+		fmt.Printf("No devices to update\n")
+		return nil
+	}
+	batches := (len(todo) + batch - 1) / batch
+	fmt.Printf("Updating %d devices in %d batches of up to %d\n", len(todo), batches, batch)
+	runner := fleetRunner{cfg: cfg}
+	for n := 0; n < batches; n++ {
+		current := todo[n*batch : min((n+1)*batch, len(todo))]
+		ips := make([]net.IP, len(current))
+		for idx, s := range current {
+			ips[idx] = s.ip
+			fmt.Printf("Batch %d/%d: %s (%s) %s -> %s\n", n+1, batches, s.ip, s.name, s.current, s.latest.FWVersion)
+		}
+		results := runner.runParallel(ips, len(ips), func(idx int, d device) error {
+			return updateFirmware(cfg, d, current[idx].current, wait)
+		})
+		err := printFleetResults(results)
+		if err == nil && len(results) < len(ips) {
+			err = interrupted(cfg)
+		}
+		if err != nil {
+			left := len(todo) - n*batch
+			for _, r := range results {
+				if r.err == nil {
+					left--
+				}
+			}
+			return fmt.Errorf("rollout stopped at batch %d of %d, %d devices not updated: %w", n+1, batches, left, err)
+		}
+	}
+	return nil
+}
+
+// updateFirmware starts the firmware update of a device, and waits until it
+// is back online with a firmware other than current.
+func updateFirmware(cfg *cmdCfg, d device, current string, wait time.Duration) error {
+	if err := d.(firmwareUpdater).UpdateFirmware(); err != nil {
+		return fmt.Errorf("failed to start the update: %w", err)
+	}
+	deadline := time.Now().Add(wait)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		select {
+		case <-cfg.ctx.Done():
+			return fmt.Errorf("stopped waiting for the update: %w", interrupted(cfg))
+		case <-time.After(firmwarePollInterval):
+		}
+		// the device is unreachable while it reboots
+		info, err := d.GetDeviceInfo()
+		if err != nil {
+			cfg.logger.Printf("firmware: waiting for device: %v", err)
+			lastErr = err
+			continue
+		}
+		lastErr = nil
+		if info.FWVersion != current {
+			return nil
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("not back online after %s: %w", wait, lastErr)
+	}
+	return fmt.Errorf("still on firmware %s after %s", current, wait)
+}
@@ -0,0 +1,362 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// groupAll is the name of the implicit group containing all the discovered
+// devices.
+const groupAll = "all"
+
+// resolveGroup returns the addresses of the devices in the given group. Group
+// members in the configuration can be IP addresses or device nicknames;
+// nicknames are resolved with a discovery.
+func resolveGroup(cfg *cmdCfg, name string) ([]net.IP, error) {
+	if name == groupAll {
+		devices, _, err := discoverDevices(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("discovery failed: %w", err)
+		}
+		ips := make([]net.IP, 0, len(devices))
+		for _, dev := range devices {
+			ips = append(ips, net.IP(dev.Result.IP))
+		}
+		sort.Slice(ips, func(i, j int) bool { return ips[i].String() < ips[j].String() })
+		return ips, nil
+	}
+	members, ok := cfg.Groups[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown group '%s'", name)
+	}
+	var (
+		ips   []net.IP
+		names []string
+	)
+	for _, m := range members {
+		if ip := net.ParseIP(m); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, m)
+		}
+	}
+	if len(names) > 0 {
+		byName, err := ipsByName(cfg)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			ip, ok := byName[n]
+			if !ok {
+				return nil, fmt.Errorf("group '%s': unknown device name '%s'", name, n)
+			}
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// ipsByName runs a discovery and returns the addresses of the devices indexed
+// by nickname.
+func ipsByName(cfg *cmdCfg) (map[string]net.IP, error) {
+	devices, _, err := discoverDevices(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("discovery failed: %w", err)
+	}
+	ret := make(map[string]net.IP, len(devices))
+	for _, dev := range devices {
+		plug, err := getDevice(cfg, dev.Result.IP.String())
+		if err != nil {
+			log.Printf("Warning: skipping plug '%s': %v\n", dev.Result.IP.String(), err)
+			continue
+		}
+		info, err := plug.GetDeviceInfo()
+		if err != nil {
+			log.Printf("Warning: skipping plug '%s': %v", dev.Result.IP.String(), err)
+			continue
+		}
+		ret[info.DecodedNickname] = net.IP(dev.Result.IP)
+	}
+	return ret, nil
+}
+
+// fleetResult is the outcome of an operation on a single device.
+type fleetResult struct {
+	ip  net.IP
+	err error
+}
+
+// fleetRunner runs an operation on many devices.
+type fleetRunner struct {
+	cfg *cmdCfg
+	// stagger is the delay between the operations on consecutive devices.
+	// When turning on many devices it avoids that their combined inrush
+	// current trips a breaker.
+	stagger time.Duration
+	// abort, if set, is checked before each device by run, which stops
+	// when it returns true.
+	abort func() bool
+}
+
+// run executes fn on every device, in order, and returns the results. fn
+// receives the index of the device in ips. It stops early when the command is
+// interrupted, returning the results so far.
+func (f *fleetRunner) run(ips []net.IP, fn func(int, device) error) []fleetResult {
+	results := make([]fleetResult, 0, len(ips))
+	for idx, ip := range ips {
+		if idx > 0 && f.stagger > 0 {
+			select {
+			case <-f.cfg.ctx.Done():
+			case <-time.After(f.stagger):
+			}
+		}
+		if f.cfg.ctx.Err() != nil || (f.abort != nil && f.abort()) {
+			break
+		}
+		res := fleetResult{ip: ip}
+		dev, err := getDevice(f.cfg, ip.String())
+		if err == nil {
+			err = fn(idx, dev)
+		}
+		res.err = err
+		results = append(results, res)
+	}
+	return results
+}
+
+// printFleetResults prints the outcome of a group operation, and returns an
+// error if any device failed. Skipped protected devices and devices in
+// maintenance are not failures.
+func printFleetResults(results []fleetResult) error {
+	failed := 0
+	for _, r := range results {
+		if errors.Is(r.err, errProtected) {
+			fmt.Printf("%-16s skipped: protected\n", r.ip)
+		} else if errors.Is(r.err, errMaintenance) {
+			fmt.Printf("%-16s skipped: in maintenance\n", r.ip)
+		} else if r.err != nil {
+			failed++
+			fmt.Printf("%-16s FAILED: %v\n", r.ip, r.err)
+		} else {
+			fmt.Printf("%-16s ok\n", r.ip)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d devices failed", failed, len(results))
+	}
+	return nil
+}
+
+// cmdGroupSet turns all the devices of a group on or off. The previous state
+// of the devices that are changed is saved to undoFile for `tapo undo`. If
+// more than rollbackAfter devices fail, the operation stops and the devices
+// changed so far are restored; 0 disables the rollback.
+func cmdGroupSet(cfg *cmdCfg, group string, deviceOn bool, stagger time.Duration, undoFile string, rollbackAfter int) error {
+	ips, err := resolveGroup(cfg, group)
+	if err != nil {
+		return err
+	}
+	var (
+		changed []undoState
+		failed  int
+	)
+	runner := fleetRunner{cfg: cfg, stagger: stagger}
+	if rollbackAfter > 0 {
+		runner.abort = func() bool { return failed > rollbackAfter }
+	}
+	results := runner.run(ips, func(idx int, d device) error {
+		if err := checkProtected(cfg, ips[idx], d); err != nil {
+			return err
+		}
+		if err := checkMaintenance(cfg, ips[idx], d); err != nil {
+			return err
+		}
+		info, err := d.GetDeviceInfo()
+		if err != nil {
+			failed++
+			return fmt.Errorf("failed to get device state: %w", err)
+		}
+		if info.DeviceON == deviceOn {
+			return nil
+		}
+		if err := setDeviceState(cfg, ips[idx], d, deviceOn); err != nil {
+			failed++
+			return err
+		}
+		changed = append(changed, undoState{IP: ips[idx], On: info.DeviceON})
+		return nil
+	})
+	printErr := printFleetResults(results)
+	if rollbackAfter > 0 && failed > rollbackAfter {
+		fmt.Printf("%d devices failed, rolling back %d changed devices\n", failed, len(changed))
+		left, err := restoreStates(cfg, changed, stagger)
+		if err != nil {
+			log.Printf("Warning: rollback incomplete: %v", err)
+		}
+		changed = left
+		printErr = fmt.Errorf("rolled back after %d failures", failed)
+	}
+	rec := undoRecord{Time: time.Now(), Command: fmt.Sprintf("%s --group %s", onOff(deviceOn), group), Devices: changed}
+	if err := recordUndo(undoFile, &rec); err != nil {
+		log.Printf("Warning: failed to save undo file: %v", err)
+	}
+	if printErr != nil {
+		return printErr
+	}
+	if len(results) < len(ips) {
+		return fmt.Errorf("%d of %d devices not done: %w", len(ips)-len(results), len(ips), interrupted(cfg))
+	}
+	return nil
+}
+
+// runParallel executes fn on every device, running up to workers operations at
+// the same time, and returns the results in the order of ips. fn receives the
+// index of the device in ips. Devices not started before the command is
+// interrupted are not included.
+func (f *fleetRunner) runParallel(ips []net.IP, workers int, fn func(int, device) error) []fleetResult {
+	results := make([]fleetResult, len(ips))
+	started := make([]bool, len(ips))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for idx, ip := range ips {
+		select {
+		case <-f.cfg.ctx.Done():
+		case sem <- struct{}{}:
+		}
+		if f.cfg.ctx.Err() != nil {
+			break
+		}
+		started[idx] = true
+		wg.Add(1)
+		go func(idx int, ip net.IP) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res := fleetResult{ip: ip}
+			dev, err := getDevice(f.cfg, ip.String())
+			if err == nil {
+				err = fn(idx, dev)
+			}
+			res.err = err
+			results[idx] = res
+		}(idx, ip)
+	}
+	wg.Wait()
+	// devices are started in order, so the started ones are a prefix
+	n := 0
+	for n < len(started) && started[n] {
+		n++
+	}
+	return results[:n]
+}
+
+// groupInfoWorkers is the number of devices queried at the same time by
+// `info --group`.
+const groupInfoWorkers = 8
+
+// deviceSummary is a row of the `info --group --summary` table.
+type deviceSummary struct {
+	name     string
+	model    string
+	fw       string
+	rssi     int
+	on       bool
+	hasToday bool
+	// today is the energy consumed today, in Wh.
+	today int
+}
+
+// cmdGroupInfo prints the information of all the devices of a group. With
+// summary, the devices are queried concurrently and printed as a single
+// comparison table, otherwise the full information of each device is printed
+// in turn.
+func cmdGroupInfo(cfg *cmdCfg, group string, summary bool) error {
+	ips, err := resolveGroup(cfg, group)
+	if err != nil {
+		return err
+	}
+	if !summary {
+		for idx, ip := range ips {
+			if cfg.ctx.Err() != nil {
+				return interrupted(cfg)
+			}
+			if idx > 0 {
+				fmt.Printf("\n")
+			}
+			fmt.Printf("=== %s ===\n", ip)
+			if err := cmdInfo(cfg, ip); err != nil {
+				log.Printf("Warning: %s: %v", ip, err)
+			}
+		}
+		return nil
+	}
+	summaries := make([]deviceSummary, len(ips))
+	runner := fleetRunner{cfg: cfg}
+	results := runner.runParallel(ips, groupInfoWorkers, func(idx int, d device) error {
+		info, err := d.GetDeviceInfo()
+		if err != nil {
+			return fmt.Errorf("failed to get device info: %w", err)
+		}
+		s := deviceSummary{
+			name:  info.DecodedNickname,
+			model: info.Model,
+			fw:    info.FWVersion,
+			rssi:  info.RSSI,
+			on:    info.DeviceON,
+		}
+		// TODO what other plugs support GetEnergyUsage ?
+		if info.Model == "P110" {
+			eUsage, err := d.GetEnergyUsage()
+			if err != nil {
+				return fmt.Errorf("failed to get energy usage: %w", err)
+			}
+			s.hasToday = true
+			s.today = eUsage.TodayEnergy
+		}
+		summaries[idx] = s
+		return nil
+	})
+	printGroupSummary(cfg, results, summaries)
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d devices failed", failed, len(ips))
+	}
+	if len(results) < len(ips) {
+		return fmt.Errorf("%d of %d devices not queried: %w", len(ips)-len(results), len(ips), interrupted(cfg))
+	}
+	return nil
+}
+
+// printGroupSummary prints one row per device with its name, firmware
+// version, signal strength, state and today's energy. summaries is indexed
+// like results.
+func printGroupSummary(cfg *cmdCfg, results []fleetResult, summaries []deviceSummary) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "IP\tNAME\tMODEL\tFW VERSION\tRSSI\tON\tTODAY\n")
+	for idx, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(w, "%s\tFAILED: %v\t\t\t\t\t\n", r.ip, r.err)
+			continue
+		}
+		s := summaries[idx]
+		today := "-"
+		if s.hasToday {
+			today = cfg.units.energy(s.today)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d dBm\t%v\t%s\n", r.ip, s.name, s.model, s.fw, s.rssi, s.on, today)
+	}
+	w.Flush()
+}
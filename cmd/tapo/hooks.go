@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Hook events.
+const (
+	// hookBeforeChange runs before a device is switched. A hook exiting with
+	// a non-zero status cancels the change.
+	hookBeforeChange = "before_change"
+	// hookAfterChange runs after a device is switched, or failed to.
+	hookAfterChange = "after_change"
+	// hookAlert runs on the notifications of telegrambot.
+	hookAlert = "alert"
+)
+
+// hookTimeout is how long a hook can run before it is killed.
+const hookTimeout = 30 * time.Second
+
+// hookCfg is an entry of the hooks section of the configuration file.
+type hookCfg struct {
+	Event string `json:"event"`
+	// Command is the program to run and its arguments. It is not run
+	// through a shell.
+	Command []string `json:"command"`
+}
+
+// hookEvent is the JSON document written to the standard input of the hooks.
+type hookEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// Command is the tapo command that triggered the event.
+	Command string `json:"command"`
+	IP      string `json:"ip,omitempty"`
+	// On is the requested state, for before_change and after_change.
+	On *bool `json:"on,omitempty"`
+	// Error is the error of a failed change, for after_change.
+	Error string `json:"error,omitempty"`
+	// Message is the text of an alert.
+	Message string `json:"message,omitempty"`
+}
+
+// runHooks runs the hooks of an event in order, and stops at the first
+// failing one.
+func runHooks(cfg *cmdCfg, ev hookEvent) error {
+	ev.Time = time.Now()
+	ev.Command = cfg.cmd
+	var input []byte
+	for _, h := range cfg.Hooks {
+		if h.Event != ev.Event || len(h.Command) == 0 {
+			continue
+		}
+		if input == nil {
+			var err error
+			if input, err = json.Marshal(ev); err != nil {
+				return fmt.Errorf("JSON marshal failed: %w", err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(cfg.ctx, hookTimeout)
+		cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(input)
+		// keep the standard output for the results of the command
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s hook '%s' failed: %w", ev.Event, h.Command[0], err)
+		}
+	}
+	return nil
+}
+
+// setDeviceState switches a device, running the before_change and
+// after_change hooks around it.
+func setDeviceState(cfg *cmdCfg, ip net.IP, d device, on bool) error {
+	ev := hookEvent{Event: hookBeforeChange, IP: ip.String(), On: &on}
+	if err := runHooks(cfg, ev); err != nil {
+		return fmt.Errorf("change cancelled: %w", err)
+	}
+	err := d.SetDeviceInfo(on)
+	ev.Event = hookAfterChange
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	if herr := runHooks(cfg, ev); herr != nil {
+		log.Printf("Warning: %v", herr)
+	}
+	return err
+}
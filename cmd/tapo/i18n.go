@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// messages maps the English labels printed by info to their translations,
+// by language. Missing labels, like acronyms, are printed in English.
+var messages = map[string]map[string]string{
+	"de": {
+		"Info":                    "Info",
+		"Device ID":               "Geräte-ID",
+		"FW version":              "Firmware-Version",
+		"HW version":              "Hardware-Version",
+		"Type":                    "Typ",
+		"Model":                   "Modell",
+		"Time Diff":               "Zeitdifferenz",
+		"SignalLevel":             "Signalstärke",
+		"Latitude":                "Breitengrad",
+		"Longitude":               "Längengrad",
+		"Lang":                    "Sprache",
+		"Avatar":                  "Symbol",
+		"Region":                  "Region",
+		"Specs":                   "Spezifikation",
+		"Nickname":                "Name",
+		"Has Set Location Info":   "Standort gesetzt",
+		"Device ON":               "Eingeschaltet",
+		"ON time":                 "Einschaltdauer",
+		"Default states":          "Standardzustand",
+		"State":                   "Zustand",
+		"Overheated":              "Überhitzt",
+		"Power Protection Status": "Überlastschutz",
+		"Location":                "Standort",
+		"Warning":                 "Warnung",
+		"Time usage":              "Nutzungsdauer",
+		"Today":                   "Heute",
+		"Past 7 days":             "Letzte 7 Tage",
+		"Past 30 days":            "Letzte 30 Tage",
+		"Power usage":             "Energieverbrauch",
+		"Saved power":             "Eingesparte Energie",
+		"Device time":             "Gerätezeit",
+		"Time":                    "Zeit",
+		"UTC offset":              "UTC-Abweichung",
+		"Energy usage":            "Energienutzung",
+		"Today runtime":           "Laufzeit heute",
+		"Month runtime":           "Laufzeit Monat",
+		"Today energy":            "Energie heute",
+		"Month energy":            "Energie Monat",
+		"Local time":              "Ortszeit",
+		"Electricity charge":      "Stromkosten",
+		"Current power":           "Aktuelle Leistung",
+		"decoded":                 "dekodiert",
+		"minutes":                 "Minuten",
+		"hours":                   "Stunden",
+	},
+	"fr": {
+		"Info":                    "Informations",
+		"Device ID":               "ID de l'appareil",
+		"FW version":              "Version du firmware",
+		"HW version":              "Version matérielle",
+		"Model":                   "Modèle",
+		"Time Diff":               "Décalage horaire",
+		"SignalLevel":             "Niveau du signal",
+		"Lang":                    "Langue",
+		"Avatar":                  "Icône",
+		"Region":                  "Région",
+		"Specs":                   "Spécifications",
+		"Nickname":                "Nom",
+		"Has Set Location Info":   "Emplacement défini",
+		"Device ON":               "Allumé",
+		"ON time":                 "Durée d'allumage",
+		"Default states":          "État par défaut",
+		"State":                   "État",
+		"Overheated":              "Surchauffe",
+		"Power Protection Status": "Protection surcharge",
+		"Location":                "Emplacement",
+		"Warning":                 "Avertissement",
+		"Time usage":              "Durée d'utilisation",
+		"Today":                   "Aujourd'hui",
+		"Past 7 days":             "7 derniers jours",
+		"Past 30 days":            "30 derniers jours",
+		"Power usage":             "Consommation",
+		"Saved power":             "Énergie économisée",
+		"Device time":             "Heure de l'appareil",
+		"Time":                    "Heure",
+		"UTC offset":              "Décalage UTC",
+		"Energy usage":            "Consommation d'énergie",
+		"Today runtime":           "Durée aujourd'hui",
+		"Month runtime":           "Durée ce mois",
+		"Today energy":            "Énergie aujourd'hui",
+		"Month energy":            "Énergie ce mois",
+		"Local time":              "Heure locale",
+		"Electricity charge":      "Coût de l'électricité",
+		"Current power":           "Puissance actuelle",
+		"decoded":                 "décodé",
+		"hours":                   "heures",
+	},
+	"it": {
+		"Info":                    "Informazioni",
+		"Device ID":               "ID dispositivo",
+		"FW version":              "Versione firmware",
+		"HW version":              "Versione hardware",
+		"Type":                    "Tipo",
+		"Model":                   "Modello",
+		"Time Diff":               "Differenza oraria",
+		"SignalLevel":             "Livello segnale",
+		"Latitude":                "Latitudine",
+		"Longitude":               "Longitudine",
+		"Lang":                    "Lingua",
+		"Avatar":                  "Icona",
+		"Region":                  "Regione",
+		"Specs":                   "Specifiche",
+		"Nickname":                "Nome",
+		"Has Set Location Info":   "Posizione impostata",
+		"Device ON":               "Acceso",
+		"ON time":                 "Tempo di accensione",
+		"Default states":          "Stato predefinito",
+		"State":                   "Stato",
+		"Overheated":              "Surriscaldato",
+		"Power Protection Status": "Protezione sovraccarico",
+		"Location":                "Posizione",
+		"Warning":                 "Avviso",
+		"Time usage":              "Tempo di utilizzo",
+		"Today":                   "Oggi",
+		"Past 7 days":             "Ultimi 7 giorni",
+		"Past 30 days":            "Ultimi 30 giorni",
+		"Power usage":             "Consumo",
+		"Saved power":             "Energia risparmiata",
+		"Device time":             "Ora del dispositivo",
+		"Time":                    "Ora",
+		"UTC offset":              "Scostamento UTC",
+		"Energy usage":            "Consumo di energia",
+		"Today runtime":           "Accensione oggi",
+		"Month runtime":           "Accensione mese",
+		"Today energy":            "Energia oggi",
+		"Month energy":            "Energia mese",
+		"Local time":              "Ora locale",
+		"Electricity charge":      "Costo elettricità",
+		"Current power":           "Potenza attuale",
+		"decoded":                 "decodificato",
+		"minutes":                 "minuti",
+		"hours":                   "ore",
+	},
+}
+
+// translator translates the labels of the info output. The zero value prints
+// them in English.
+type translator map[string]string
+
+// newTranslator returns the translator for a language, given as a code like
+// de or as a locale like de_DE. Unknown languages use English.
+func newTranslator(lang string) translator {
+	lang = strings.ToLower(lang)
+	if i := strings.IndexAny(lang, "_-."); i >= 0 {
+		lang = lang[:i]
+	}
+	return messages[lang]
+}
+
+// validLang returns an error if lang is not a language of --lang.
+func validLang(lang string) error {
+	if lang == "" || lang == "en" || newTranslator(lang) != nil {
+		return nil
+	}
+	return fmt.Errorf("unsupported language '%s', want one of en, de, fr, it", lang)
+}
+
+// T returns the translation of an English label.
+func (t translator) T(s string) string {
+	if v, ok := t[s]; ok {
+		return v
+	}
+	return s
+}
+
+// field prints a label and its value, aligned with the other fields. The
+// leading spaces of the label, which indent it, are kept.
+func (t translator) field(label, format string, args ...interface{}) {
+	key := strings.TrimLeft(label, " ")
+	indent := label[:len(label)-len(key)]
+	fmt.Printf("%-24s: %s\n", indent+t.T(key), fmt.Sprintf(format, args...))
+}
+
+// heading prints the title of a group of fields.
+func (t translator) heading(title string) {
+	fmt.Printf("%s:\n", t.T(title))
+}
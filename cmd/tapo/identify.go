@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// identifyInterval is how long the relay stays in each state while
+// identifying a device: long enough to notice the LED and the click.
+const identifyInterval = time.Second
+
+// cmdIdentify toggles the relay of a device blinks times, so that it can be
+// physically located, then restores its original state. Protected devices are
+// only toggled with --force.
+func cmdIdentify(cfg *cmdCfg, ip net.IP, blinks int) error {
+	if blinks <= 0 {
+		return fmt.Errorf("the number of blinks must be positive")
+	}
+	d, err := getDevice(cfg, ip.String())
+	if err != nil {
+		return err
+	}
+	info, err := d.GetDeviceInfo()
+	if err != nil {
+		return fmt.Errorf("failed to get device info: %w", err)
+	}
+	if isProtected(cfg, ip, info.DecodedNickname) && !cfg.force {
+		return fmt.Errorf("device %s (%s): %w, use --force to toggle it anyway", ip, info.DecodedNickname, errProtected)
+	}
+	log.Printf("Identifying %s (%s), toggling it %d times", ip, info.DecodedNickname, blinks)
+	state := info.DeviceON
+	defer func() {
+		if state == info.DeviceON {
+			return
+		}
+		// restore the original state even if interrupted
+		if err := d.SetDeviceInfo(info.DeviceON); err != nil {
+			log.Printf("Warning: failed to restore the state of %s, it is now %s: %v", ip, onOff(state), err)
+		}
+	}()
+	for i := 0; i < 2*blinks; i++ {
+		if err := d.SetDeviceInfo(!state); err != nil {
+			return fmt.Errorf("failed to toggle device: %w", err)
+		}
+		state = !state
+		select {
+		case <-cfg.ctx.Done():
+			return interrupted(cfg)
+		case <-time.After(identifyInterval):
+		}
+	}
+	return nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
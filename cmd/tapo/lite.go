@@ -0,0 +1,48 @@
+// SPDX-License-Identifier: MIT
+
+//go:build lite
+
+package main
+
+// The lite build, `go build -tags lite`, leaves out the commands that are not
+// needed to control devices from small boards: the agent server and its
+// tokens, bench, wifi survey and the Telegram bot. --agent, --via and agent-discover are still
+// available.
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+func errLite(cmd string) error {
+	return fmt.Errorf("%s is not available in the lite build", cmd)
+}
+
+func cmdAgent(cfg *cmdCfg, listen, token, tokensFile string) error {
+	return errLite("agent")
+}
+
+func cmdTokenCreate(tokensFile string, args []string) error {
+	return errLite("token-create")
+}
+
+func cmdTokenList(tokensFile string) error {
+	return errLite("token-list")
+}
+
+func cmdTokenRevoke(tokensFile string, args []string) error {
+	return errLite("token-revoke")
+}
+
+func cmdBench(cfg *cmdCfg, ip net.IP, count int) error {
+	return errLite("bench")
+}
+
+func cmdWifi(cfg *cmdCfg, args []string, group string, duration, interval time.Duration) error {
+	return errLite("wifi")
+}
+
+func cmdTelegramBot(cfg *cmdCfg, interval time.Duration) error {
+	return errLite("telegrambot")
+}
@@ -3,34 +3,99 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/insomniacslk/tapo"
+	"github.com/insomniacslk/tapo/internal/logout"
 	"github.com/kirsle/configdir"
 	"github.com/spf13/pflag"
 )
 
 const progname = "tapo"
 
-var defaultConfigFile = path.Join(configdir.LocalConfig(progname), "config.json")
+var (
+	defaultConfigFile = path.Join(configdir.LocalConfig(progname), "config.json")
+	defaultTokensFile = path.Join(configdir.LocalConfig(progname), "tokens.json")
+	defaultProtoCache = path.Join(configdir.LocalCache(progname), "protocols.json")
+	defaultKeyFile    = path.Join(configdir.LocalConfig(progname), "key")
+	defaultUndoFile   = path.Join(configdir.LocalCache(progname), "undo.json")
+	defaultMaintFile  = path.Join(configdir.LocalConfig(progname), "maintenance.json")
+	defaultSnapFile   = path.Join(configdir.LocalConfig(progname), "snapshots.json")
+)
 
 var (
-	flagConfigFile = pflag.StringP("config", "c", defaultConfigFile, "Configuration file")
-	flagAddr       = pflag.IPP("addr", "a", nil, "IP address of the Tapo device")
-	flagName       = pflag.StringP("name", "n", "", "Name of the Tapo device. This is slow, it will perform a local discovery first. Ignored if --addr is specified")
-	flagEmail      = pflag.StringP("email", "e", "", "E-mail for login")
-	flagPassword   = pflag.StringP("password", "p", "", "Password for login")
-	flagDebug      = pflag.BoolP("debug", "d", false, "Enable debug logs")
-	flagFormat     = pflag.StringP("format", "f", "{{.Idx}}) name={{.Name}} ip={{.IP}} mac={{.MAC}} type={{.Type}} model={{.Model}} deviceid={{.ID}}\n", "Template for printing each line of a discovered device, works with `list`, `discover` and `cloud-list`, fields may differ across commands. It uses Go's text/template syntax")
+	flagConfigFile  = pflag.StringP("config", "c", defaultConfigFile, "Configuration file")
+	flagAddr        = pflag.IPP("addr", "a", nil, "IP address of the Tapo device")
+	flagName        = pflag.StringP("name", "n", "", "Name of the Tapo device. This is slow, it will perform a local discovery first. Ignored if --addr is specified")
+	flagKeyFile     = pflag.String("key-file", defaultKeyFile, "Key file decrypting the password in the configuration file, when it is encrypted with the config encrypt command")
+	flagEmail       = pflag.StringP("email", "e", "", "E-mail for login")
+	flagPassword    = pflag.StringP("password", "p", "", "Password for login")
+	flagDebug       = pflag.BoolP("debug", "d", false, "Enable debug logs")
+	flagCloudURL    = pflag.String("cloud-url", "", "Override the base URL of the tp-link cloud service. Can also be set via the TAPO_CLOUD_URL environment variable")
+	flagCloudProxy  = pflag.String("cloud-proxy", "", "HTTP, HTTPS or SOCKS5 proxy URL for cloud requests. Can also be set via the TAPO_CLOUD_PROXY environment variable. Defaults to HTTPS_PROXY or ALL_PROXY")
+	flagProxy       = pflag.String("proxy", "", "HTTP, HTTPS or SOCKS5 proxy URL for local device traffic, e.g. socks5://localhost:1080 for an `ssh -D 1080` tunnel. Defaults to HTTP_PROXY or ALL_PROXY, except for the hosts in NO_PROXY. Discovery is not proxied")
+	flagProtocol    = pflag.String("protocol", "auto", "Session protocol of the devices: auto tries klap first and falls back to passthrough, klap or passthrough pin it and skip the protocol cache")
+	flagRace        = pflag.Bool("concurrent-handshakes", false, "With --protocol auto, try the klap and passthrough handshakes at once and use the first that succeeds, instead of passthrough only after klap failed")
+	flagRetries     = pflag.Int("retries", 0, "Send requests again, up to this many times with an exponential backoff, when they fail with a transient device or network error")
+	flagHTTPS       = pflag.Bool("https", false, "Talk to the devices over HTTPS, for firmwares that require it. The self-signed certificates of the devices are not verified")
+	flagRSAKeyFile  = pflag.String("rsa-key-file", "", "PEM file with the RSA key of the passthrough handshakes, generated if missing, to skip generating a key for every handshake. Anybody reading it can decrypt captured handshakes. Defaults to a new key for every handshake")
+	flagRSAKeyBits  = pflag.Int("rsa-key-bits", tapo.DefaultRSAKeyBits, "Size of the key generated for --rsa-key-file. Some firmwares accept 2048")
+	flagIfaces      = pflag.StringSlice("discovery-interface", nil, "Network interfaces to run discovery on, e.g. to skip container bridges. Defaults to all the interfaces that support broadcast")
+	flagVia         = pflag.String("via", "", "Reach the devices through an SSH tunnel to user@host on their network. Discovery runs on the remote host and requires the tapo CLI to be installed there")
+	flagViaCommand  = pflag.String("via-command", "tapo", "Path of the tapo CLI on the --via remote host")
+	flagSite        = pflag.String("site", "", "Name of a site of the configuration file, whose agent, via, proxy, discovery interfaces and groups are used. Flags given on the command line take precedence")
+	flagAgent       = pflag.String("agent", "", "host:port of a tapo agent to proxy all the operations through, including discovery")
+	flagAgentToken  = pflag.String("agent-token", "", "Shared secret to authenticate to the agent API. Used by both the `agent` command and --agent")
+	flagTokensFile  = pflag.String("tokens-file", defaultTokensFile, "File storing the API tokens accepted by the `agent` command, managed with the token-* commands. tapoweb can use the same file")
+	flagProtoCache  = pflag.String("protocol-cache", defaultProtoCache, "File remembering the protocol spoken by each device, to skip the failed KLAP attempt on older firmwares. Set to an empty string to always try both protocols")
+	flagUnits       = pflag.StringSlice("units", nil, "Units for energy and time values in info, energy and energy-data: Wh or kWh, minutes or hours, e.g. --units kWh,hours. Defaults to the device units, Wh and minutes")
+	flagLocale      = pflag.String("locale", "", "Locale for number formatting, e.g. de_DE. Defaults to LC_ALL, LC_NUMERIC or LANG")
+	flagLang        = pflag.String("lang", "", "Language of the labels printed by info: en, de, fr or it. Defaults to the language set on the device")
+	flagLogOutput   = pflag.String("log-output", "stderr", "Where to write the logs of long-running commands like `agent`: stderr, stdout, syslog (also reaches journald), or a file path")
+	flagLogMaxSize  = pflag.Int64("log-max-size", 0, "Rotate the --log-output file when it exceeds this size in MiB, 0 to disable")
+	flagLogMaxAge   = pflag.Duration("log-max-age", 0, "Rotate the --log-output file when it is older than this, e.g. 24h, 0 to disable")
+	flagLogBackups  = pflag.Int("log-max-backups", 5, "Number of rotated --log-output files to keep, 0 to keep all")
+	flagListen      = pflag.StringP("listen", "l", ":7491", "Listen address for the `agent` command")
+	flagCapture     = pflag.String("capture-schemas", "", "Debug option: write every decrypted device response to <dir>/<model>/<method>.json")
+	flagTrace       = pflag.Bool("trace", false, "Debug option: log every request to the devices and its response in plaintext, with the time taken and the status")
+	flagGroup       = pflag.StringP("group", "g", "", "Run `on`, `off`, `info`, `timecheck`, `capabilities`, `snapshot`, `wifi survey` and `firmware` on a group of devices defined in the configuration file, or on all the discovered devices with `all`")
+	flagSummary     = pflag.Bool("summary", false, "With info and --group, query the devices concurrently and print a single table with firmware version, RSSI, state and today's energy of each device")
+	flagStagger     = pflag.Duration("stagger", 0, "Delay between consecutive devices in group operations, to avoid inrush current tripping breakers when turning on many devices")
+	flagSurveyTime  = pflag.Duration("survey-duration", 3*time.Minute, "How long wifi survey samples the RSSI of the devices")
+	flagSurveyEvery = pflag.Duration("survey-interval", 10*time.Second, "Interval between RSSI samples in wifi survey")
+	flagMaxDrift    = pflag.Duration("max-drift", time.Minute, "Clock drift above which timecheck reports a device, and --fix syncs it")
+	flagFix         = pflag.Bool("fix", false, "With timecheck, set the clock of the devices that drifted or have a wrong UTC offset to the host time")
+	flagUndoFile    = pflag.String("undo-file", defaultUndoFile, "File recording the state of the devices before the last group on or off, restored by undo")
+	flagMaintFile   = pflag.String("maintenance-file", defaultMaintFile, "File listing the devices in maintenance, managed with `maintenance set` and `maintenance clear`. telegrambot does not notify when they go offline, and group operations skip them")
+	flagSnapFile    = pflag.String("snapshot-file", defaultSnapFile, "File storing the device settings saved by `snapshot`, applied to a replacement device by `replace`")
+	flagOld         = pflag.String("old", "", "MAC address of the device being replaced, for `replace`")
+	flagNew         = pflag.IP("new", nil, "IP address of the replacement device, for `replace`")
+	flagRepoint     = pflag.StringSlice("repoint-file", nil, "JSON files whose references to the replaced device are updated by `replace`, besides the configuration, maintenance, undo and tokens files, e.g. the tapoweb devices file")
+	flagRollback    = pflag.Int("rollback-after", 0, "Stop a group on or off and restore the devices changed so far when more than this many devices fail, 0 to disable")
+	flagForce       = pflag.Bool("force", false, "Allow on, off, identify and raw set_ methods on protected devices, and do not skip them and the devices in maintenance in group operations")
+	flagScanEvery   = pflag.Duration("scan-interval", time.Minute, "Discovery interval of telegrambot, which bounds how late it notifies devices going offline")
+	flagBatch       = pflag.Int("batch", 1, "Number of devices updated at the same time by `firmware rollout`")
+	flagWait        = pflag.Duration("wait", 10*time.Minute, "How long `firmware rollout` waits for each device to come back online with the new firmware before stopping the rollout")
+	flagBlinks      = pflag.Int("blinks", 3, "Number of times identify toggles the device")
+	flagCount       = pflag.IntP("count", "N", 50, "Number of requests per protocol, used by `bench`")
+	flagResolve     = pflag.Bool("resolve-local", false, "With cloud-list, run a local discovery too and print the local IP of each cloud device, and whether it is reachable")
+	flagFormat      = pflag.StringP("format", "f", "{{.Idx}}) name={{.Name}} ip={{.IP}} mac={{.MAC}} type={{.Type}} model={{.Model}} deviceid={{.ID}}\n", "Template for printing each line of a discovered device, works with `list`, `discover` and `cloud-list`, fields may differ across commands. It uses Go's text/template syntax")
 )
 
 func loadConfig(configFile string) (*cmdCfg, error) {
@@ -69,16 +134,25 @@ func loadConfig(configFile string) (*cmdCfg, error) {
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config file: %w", err)
 	}
+	if isEncrypted(cfg.Password) && !pflag.CommandLine.Changed("password") {
+		key, err := loadKey(*flagKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("config file has an encrypted password: %w", err)
+		}
+		if cfg.Password, err = decryptValue(key, cfg.Password); err != nil {
+			return nil, fmt.Errorf("failed to decrypt password: %w", err)
+		}
+	}
 	return &cfg, nil
 }
 
 func ipByName(cfg *cmdCfg, name string) (net.IP, error) {
-	devices, err := discoverDevices(cfg.logger)
+	devices, _, err := discoverDevices(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("discovery failed: %w", err)
 	}
 	for _, dev := range devices {
-		plug, err := getPlug(cfg, dev.Result.IP.String())
+		plug, err := getDevice(cfg, dev.Result.IP.String())
 		if err != nil {
 			log.Printf("Warning: skipping plug '%s': %v\n", dev.Result.IP.String(), err)
 			continue
@@ -104,52 +178,260 @@ func getPlug(cfg *cmdCfg, addr string) (*tapo.Plug, error) {
 		return nil, fmt.Errorf("Failed to parse IP address: %w", err)
 	}
 
-	plug := tapo.NewPlug(ip, cfg.logger)
-	if err := plug.Handshake(cfg.Email, cfg.Password); err != nil {
+	var opts []tapo.PlugOption
+	if resp, ok := lookupDiscovered(cfg, ip); ok {
+		opts = append(opts, tapo.OptionDiscovered(resp))
+	}
+	plug, err := cfg.sessions.Get(ip, opts...)
+	if err != nil {
 		return nil, fmt.Errorf("login failed: %w", err)
 	}
 	return plug, nil
 }
 
+// device is the set of operations used by the commands. It is implemented by
+// local plugs and by devices reached through an agent.
+type device interface {
+	GetDeviceInfo() (*tapo.DeviceInfo, error)
+	GetDeviceUsage() (*tapo.DeviceUsage, error)
+	GetEnergyUsage() (*tapo.EnergyUsage, error)
+	GetDeviceTime() (*tapo.DeviceTime, error)
+	SetDeviceInfo(deviceOn bool) error
+}
+
+// getDevice returns a logged-in local plug, or a device proxied through the
+// agent if --agent is set.
+func getDevice(cfg *cmdCfg, addr string) (device, error) {
+	if cfg.agent == nil {
+		plug, err := getPlug(cfg, addr)
+		if err != nil {
+			return nil, err
+		}
+		return plug, nil
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse IP address: %w", err)
+	}
+	return cfg.agent.Device(ip), nil
+}
+
+// newClient returns a cloud client configured according to the command line
+// flags.
+func newClient(cfg *cmdCfg) (*tapo.Client, error) {
+	var opts []tapo.ClientOption
+	if *flagCloudURL != "" {
+		opts = append(opts, tapo.OptionCloudURL(*flagCloudURL))
+	}
+	if *flagCloudProxy != "" {
+		proxy, err := url.Parse(*flagCloudProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cloud proxy URL: %w", err)
+		}
+		opts = append(opts, tapo.OptionCloudProxy(proxy))
+	}
+	if len(*flagIfaces) > 0 {
+		opts = append(opts, tapo.OptionDiscoveryInterfaces(*flagIfaces...))
+	}
+	return tapo.NewClient(cfg.logger, opts...), nil
+}
+
+// plugOptions returns the options for local devices according to the command
+// line flags.
+func plugOptions(cfg *cmdCfg) ([]tapo.PlugOption, error) {
+	var opts []tapo.PlugOption
+	if cfg.proxy != "" {
+		proxy, err := url.Parse(cfg.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		opts = append(opts, tapo.OptionProxy(proxy))
+	}
+	proto, err := tapo.ParseProtocol(*flagProtocol)
+	if err != nil {
+		return nil, err
+	}
+	if proto != tapo.ProtocolAuto {
+		opts = append(opts, tapo.OptionProtocol(proto))
+	}
+	if *flagRetries > 0 {
+		opts = append(opts, tapo.OptionRetryOnCommunicationError(*flagRetries))
+	}
+	if *flagRace {
+		opts = append(opts, tapo.OptionConcurrentHandshakes())
+	}
+	if *flagHTTPS {
+		opts = append(opts, tapo.OptionHTTPS(nil))
+	}
+	if *flagRSAKeyFile != "" {
+		key, err := loadRSAKey(*flagRSAKeyFile, *flagRSAKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, tapo.OptionRSAKey(key))
+	}
+	if *flagCapture != "" {
+		opts = append(opts, tapo.OptionMiddleware(captureSchemas(*flagCapture)))
+	}
+	if *flagTrace {
+		opts = append(opts, tapo.OptionTrace(logTrace))
+	}
+	if *flagProtoCache != "" {
+		opts = append(opts, tapo.OptionProtocolCache(loadProtocolCache(*flagProtoCache)))
+	}
+	opts = append(opts, tapo.OptionWarnings(func(w tapo.Warning) {
+		// info prints the undecodable fields itself
+		if w.Kind != tapo.WarningUndecodableField {
+			log.Printf("Warning: %s", w)
+		}
+	}))
+	return opts, nil
+}
+
+// logTrace logs a request and its response for --trace.
+func logTrace(t tapo.Trace) {
+	status := fmt.Sprintf("HTTP %d, error_code %d", t.HTTPStatus, t.ErrorCode)
+	if t.Err != nil {
+		status += ", " + t.Err.Error()
+	}
+	log.Printf("trace: %s %s in %s (%s)\n> %s\n< %s", t.Addr, t.Method, t.Duration.Round(time.Millisecond), status, t.Request, t.Response)
+}
+
 type cmdCfg struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// ctx is cancelled on SIGINT or SIGTERM. Long-running commands check
+	// it between steps, so that they stop after printing what they have.
+	ctx      context.Context
 	logger   *log.Logger
+	sessions *tapo.SessionManager
+	proxy    string
+	agent    *agentClient
+	units    units
 	Debug    bool `json:"debug"`
+	// Groups maps a group name to its members, as IP addresses or device
+	// nicknames.
+	Groups map[string][]string `json:"groups"`
+	// Protected lists the devices that must not be switched by accident,
+	// like a freezer or a server rack, as IP addresses or nicknames.
+	Protected []string `json:"protected"`
+	// force allows mutating commands on protected devices.
+	force bool
+	// maintenanceFile lists the devices in maintenance.
+	maintenanceFile string
+	// discovered holds the discovery responses of the devices, to connect
+	// to them as they advertise, e.g. on their HTTP port. It is filled by
+	// discoverDevices before the devices are used. The agent serves
+	// discoveries and device requests concurrently, so it is guarded by
+	// discoveredMu.
+	discoveredMu sync.Mutex
+	discovered   map[netip.Addr]tapo.DiscoverResponse
+	// Hooks are the commands run on state changes and alerts.
+	Hooks []hookCfg `json:"hooks"`
+	// cmd is the command being run, passed to the hooks.
+	cmd string
+	// Telegram configures the telegrambot command.
+	Telegram *telegramCfg `json:"telegram,omitempty"`
+	// Budgets are the monthly energy budgets checked by budget and
+	// telegrambot.
+	Budgets []budgetCfg `json:"budgets"`
+	// FirmwarePinned lists the devices whose firmware is not updated by
+	// firmware rollout, as IP addresses or nicknames.
+	FirmwarePinned []string `json:"firmware_pinned"`
+	// Sites maps a site name to how to reach its devices, see --site.
+	Sites map[string]siteCfg `json:"sites"`
+}
+
+// telegramCfg is the telegram section of the configuration file.
+type telegramCfg struct {
+	// Token is the bot token given by @BotFather, or its encrypted form.
+	Token string `json:"token"`
+	// Chats are the IDs of the chats allowed to use the bot. They also
+	// receive the notifications.
+	Chats []int64 `json:"chats"`
 }
 
 func cmdOn(cfg *cmdCfg, ip net.IP) error {
-	plug, err := getPlug(cfg, ip.String())
+	plug, err := getDevice(cfg, ip.String())
 	if err != nil {
 		return err
 	}
-	return plug.SetDeviceInfo(true)
+	if err := checkProtected(cfg, ip, plug); err != nil {
+		return err
+	}
+	return setDeviceState(cfg, ip, plug, true)
 }
 
 func cmdOff(cfg *cmdCfg, ip net.IP) error {
-	plug, err := getPlug(cfg, ip.String())
+	plug, err := getDevice(cfg, ip.String())
 	if err != nil {
 		return err
 	}
-	return plug.SetDeviceInfo(false)
+	if err := checkProtected(cfg, ip, plug); err != nil {
+		return err
+	}
+	return setDeviceState(cfg, ip, plug, false)
+}
+
+// statusGetter is implemented by the devices that can return their info and
+// usage in a single round trip. Devices reached through an agent cannot.
+type statusGetter interface {
+	GetStatus() (*tapo.DeviceStatus, error)
+}
+
+// infoUnits returns the units of the info output of a device, in the language
+// of --lang or else in the language of the device.
+func infoUnits(cfg *cmdCfg, info *tapo.DeviceInfo) units {
+	u := cfg.units
+	lang := *flagLang
+	if lang == "" {
+		lang = info.Lang
+	}
+	u.tr = newTranslator(lang)
+	return u
 }
 
 func cmdInfo(cfg *cmdCfg, ip net.IP) error {
-	plug, err := getPlug(cfg, ip.String())
+	plug, err := getDevice(cfg, ip.String())
 	if err != nil {
 		return err
 	}
+	if sg, ok := plug.(statusGetter); ok {
+		st, err := sg.GetStatus()
+		if err != nil {
+			return fmt.Errorf("failed to get device status: %w", err)
+		}
+		u := infoUnits(cfg, st.Info)
+		printDeviceInfo(st.Info, u.tr)
+		dTime, err := plug.GetDeviceTime()
+		if err != nil {
+			return fmt.Errorf("failed to get device time: %w", err)
+		}
+		printDeviceTime(dTime, u.tr)
+		printDeviceUsage(st.Usage, u)
+		if st.Energy != nil {
+			printEnergyUsage(st.Energy, u)
+		}
+		return nil
+	}
 	info, err := plug.GetDeviceInfo()
 	if err != nil {
 		return fmt.Errorf("failed to get device info: %w", err)
 	}
-	printDeviceInfo(info)
+	u := infoUnits(cfg, info)
+	printDeviceInfo(info, u.tr)
+
+	dTime, err := plug.GetDeviceTime()
+	if err != nil {
+		return fmt.Errorf("failed to get device time: %w", err)
+	}
+	printDeviceTime(dTime, u.tr)
 
 	dUsage, err := plug.GetDeviceUsage()
 	if err != nil {
 		return fmt.Errorf("failed to get device usage: %w", err)
 	}
-	printDeviceUsage(dUsage)
+	printDeviceUsage(dUsage, u)
 
 	if info.Model != "P110" {
 		return nil
@@ -159,7 +441,7 @@ func cmdInfo(cfg *cmdCfg, ip net.IP) error {
 	if err != nil {
 		return fmt.Errorf("failed to get energy usage: %w", err)
 	}
-	printEnergyUsage(eUsage)
+	printEnergyUsage(eUsage, u)
 	return nil
 }
 
@@ -173,21 +455,43 @@ type formatObj struct {
 	Name      string
 	FwVersion string
 	HwVersion string
+	// Reachable is yes or no with cloud-list --resolve-local
+	Reachable string
 }
 
 func cmdCloudList(cfg *cmdCfg) error {
-	tmpl, err := template.New("cloud-list").Parse(strings.Replace(*flagFormat, "\\n", "\n", -1))
+	format := *flagFormat
+	if *flagResolve && !pflag.CommandLine.Changed("format") {
+		format = strings.TrimSuffix(format, "\n") + " reachable={{.Reachable}}\n"
+	}
+	tmpl, err := template.New("cloud-list").Parse(strings.Replace(format, "\\n", "\n", -1))
 	if err != nil {
 		return fmt.Errorf("invalid template string: %w", err)
 	}
-	client := tapo.NewClient(cfg.logger)
-	if err := client.CloudLogin(cfg.Email, cfg.Password); err != nil {
+	client, err := newClient(cfg)
+	if err != nil {
+		return err
+	}
+	if err := client.CloudLoginContext(cfg.ctx, cfg.Email, cfg.Password); err != nil {
 		return err
 	}
-	devices, err := client.CloudList()
+	devices, err := client.CloudListContext(cfg.ctx)
 	if err != nil {
 		return err
 	}
+	// local maps the MAC addresses of the locally discovered devices to their
+	// IP, since the device IDs differ between the cloud and the discovery.
+	var local map[string]string
+	if *flagResolve {
+		discovered, _, err := discoverDevices(cfg)
+		if err != nil {
+			return fmt.Errorf("discovery failed: %w", err)
+		}
+		local = make(map[string]string, len(discovered))
+		for _, d := range discovered {
+			local[strings.ToLower(d.Result.MAC.String())] = d.Result.IP.String()
+		}
+	}
 	for idx, dev := range devices {
 		o := formatObj{
 			Idx:       idx,
@@ -200,6 +504,13 @@ func cmdCloudList(cfg *cmdCfg) error {
 			FwVersion: dev.FwVer,
 			HwVersion: dev.DeviceHwVer,
 		}
+		if local != nil {
+			o.Reachable = "no"
+			if ip, ok := local[strings.ToLower(o.MAC)]; ok {
+				o.IP, o.Reachable = ip, "yes"
+				delete(local, strings.ToLower(o.MAC))
+			}
+		}
 		if err := tmpl.Execute(os.Stdout, o); err != nil {
 			return fmt.Errorf("template execution failed: %w", err)
 		}
@@ -207,19 +518,79 @@ func cmdCloudList(cfg *cmdCfg) error {
 			fmt.Printf("    %+v\n", dev)
 		}
 	}
+	if len(local) > 0 {
+		log.Printf("%d locally discovered devices are not in the cloud account", len(local))
+	}
 	return nil
 }
 
-func discoverDevices(logger *log.Logger) (map[string]tapo.DiscoverResponse, error) {
-	client := tapo.NewClient(logger)
-	devices, _, err := client.Discover()
-	return devices, err
+// interrupted returns the error of a command stopped by a signal.
+func interrupted(cfg *cmdCfg) error {
+	return fmt.Errorf("interrupted: %w", context.Cause(cfg.ctx))
+}
+
+// discoverDevices runs a local discovery, or a remote one if --agent or --via
+// are set.
+func discoverDevices(cfg *cmdCfg) (map[string]tapo.DiscoverResponse, []tapo.DiscoverResponse, error) {
+	if cfg.agent != nil {
+		return cfg.agent.Discover()
+	}
+	var (
+		devices map[string]tapo.DiscoverResponse
+		failed  []tapo.DiscoverResponse
+		err     error
+	)
+	if *flagVia != "" {
+		devices, failed, err = remoteDiscover(*flagVia, *flagViaCommand)
+	} else {
+		devices, failed, err = localDiscover(cfg)
+		if err != nil && (len(devices) > 0 || len(failed) > 0) {
+			// use the partial results
+			log.Printf("Warning: %v", err)
+			err = nil
+		}
+	}
+	addDiscovered(cfg, devices)
+	return devices, failed, err
+}
+
+// localDiscover runs a broadcast discovery on the local network. Tests replace
+// it with fake devices.
+var localDiscover = func(cfg *cmdCfg) (map[string]tapo.DiscoverResponse, []tapo.DiscoverResponse, error) {
+	client, err := newClient(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client.DiscoverContext(cfg.ctx)
+}
+
+// addDiscovered records the discovery responses of devices.
+func addDiscovered(cfg *cmdCfg, devices map[string]tapo.DiscoverResponse) {
+	cfg.discoveredMu.Lock()
+	defer cfg.discoveredMu.Unlock()
+	if cfg.discovered == nil {
+		cfg.discovered = make(map[netip.Addr]tapo.DiscoverResponse, len(devices))
+	}
+	for _, dev := range devices {
+		if addr, ok := netip.AddrFromSlice(dev.Result.IP); ok {
+			cfg.discovered[addr.Unmap()] = dev
+		}
+	}
+}
+
+// lookupDiscovered returns the discovery response of the device at ip, if it
+// was discovered.
+func lookupDiscovered(cfg *cmdCfg, ip netip.Addr) (tapo.DiscoverResponse, bool) {
+	cfg.discoveredMu.Lock()
+	defer cfg.discoveredMu.Unlock()
+	resp, ok := cfg.discovered[ip.Unmap()]
+	return resp, ok
 }
 
 // cmdList prints a list of all the locally-reachable devices. It runs a
 // discovery first, then it calls the info API on each device.
 func cmdList(cfg *cmdCfg) error {
-	devices, err := discoverDevices(cfg.logger)
+	devices, _, err := discoverDevices(cfg)
 	if err != nil {
 		return fmt.Errorf("discovery failed: %w", err)
 	}
@@ -229,9 +600,12 @@ func cmdList(cfg *cmdCfg) error {
 	}
 	idx := 0
 	for _, dev := range devices {
+		if cfg.ctx.Err() != nil {
+			return interrupted(cfg)
+		}
 		idx++
 		// TODO specify plug parameters from device.Result.MgtEncryptSchm
-		plug, err := getPlug(cfg, dev.Result.IP.String())
+		plug, err := getDevice(cfg, dev.Result.IP.String())
 		if err != nil {
 			log.Printf("Warning: skipping plug '%s': %v\n", dev.Result.IP.String(), err)
 			continue
@@ -263,8 +637,7 @@ func cmdList(cfg *cmdCfg) error {
 }
 
 func cmdDiscover(cfg *cmdCfg) error {
-	client := tapo.NewClient(cfg.logger)
-	devices, failed, err := client.Discover()
+	devices, failed, err := discoverDevices(cfg)
 	if err != nil {
 		return err
 	}
@@ -315,124 +688,312 @@ func main() {
 	pflag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s <flags> [command]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "command is one of on, off, info, energy, cloud-list, list, discover (local broadcast)\n")
+		fmt.Fprintf(os.Stderr, "command is one of on, off, undo, info, energy, energy-data, budget, raw, identify, timecheck, capabilities, wifi survey, firmware status, firmware rollout, snapshot, replace, maintenance set, maintenance clear, maintenance list, config validate, config init, config encrypt, cloud-list, list, discover (local broadcast), bench, telegrambot, agent, token-create, token-list, token-revoke\n")
 		fmt.Fprintf(os.Stderr, "\n")
 		pflag.PrintDefaults()
 	}
 	pflag.Parse()
-	cmd := pflag.Arg(0)
 
+	logOutput, err := logout.Open(*flagLogOutput, progname, logout.Rotation{
+		MaxSize:    *flagLogMaxSize << 20,
+		MaxAge:     *flagLogMaxAge,
+		MaxBackups: *flagLogBackups,
+	})
+	if err != nil {
+		log.Fatalf("Failed to open log output: %v", err)
+	}
+	log.SetOutput(logOutput)
+	debugFlags := log.Ltime | log.Lshortfile
+	if *flagLogOutput == logout.Syslog {
+		// syslog adds its own timestamps
+		log.SetFlags(0)
+		debugFlags = log.Lshortfile
+	}
+
+	// log.Fatalf would skip the cleanups deferred by run, so failures are
+	// logged here, before closing the log output they go to.
+	err = run(pflag.Arg(0), logOutput, debugFlags)
+	if err != nil {
+		if hint := tapo.ErrorHint(err); hint != tapo.HintNone {
+			log.Printf("%v (hint: %s)", err, hint)
+		} else {
+			log.Printf("%v", err)
+		}
+	}
+	logOutput.Close()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// run executes cmd, logging the debug messages to logOutput.
+func run(cmd string, logOutput io.Writer, debugFlags int) error {
 	cfg, err := loadConfig(*flagConfigFile)
 	if err != nil {
-		log.Fatalf("Failed to load config file: %v", err)
+		if cmd != "config" {
+			return fmt.Errorf("failed to load config file: %w", err)
+		}
+		// config validate reports the errors itself
+		cfg = &cmdCfg{}
+	} else if *flagSite != "" {
+		if err := applySite(cfg, *flagSite); err != nil {
+			return err
+		}
 	}
 
-	var logger *log.Logger
+	logger := log.New(io.Discard, "", 0)
 	if cfg.Debug {
-		logger = log.New(os.Stderr, "[tapo] ", log.Ltime|log.Lshortfile)
+		logger = log.New(logOutput, "[tapo] ", debugFlags)
 	}
 
 	cfg.logger = logger
+	cfg.proxy = *flagProxy
+	cfg.force = *flagForce
+	cfg.maintenanceFile = *flagMaintFile
+	cfg.cmd = strings.ToLower(cmd)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// a second signal kills the process
+		stop()
+	}()
+	cfg.ctx = ctx
+	locale := *flagLocale
+	if locale == "" {
+		locale = envLocale()
+	}
+	cfg.units, err = parseUnits(*flagUnits, locale)
+	if err != nil {
+		return err
+	}
+	if err := validLang(*flagLang); err != nil {
+		return err
+	}
+	switch strings.ToLower(cmd) {
+	case "", "discover", "agent", "agent-discover", "cloud-list", "config", "maintenance", "token-create", "token-list", "token-revoke":
+		// these commands do not talk to devices over HTTP
+	default:
+		if *flagVia != "" {
+			tunnel, err := startSSHTunnel(*flagVia)
+			if err != nil {
+				return fmt.Errorf("failed to set up SSH tunnel: %w", err)
+			}
+			defer tunnel.Close()
+			cfg.proxy = tunnel.ProxyURL()
+		}
+	}
+	plugOpts, err := plugOptions(cfg)
+	if err != nil {
+		return err
+	}
+	cfg.sessions = tapo.NewSessionManager(cfg.Email, cfg.Password, 0, logger, plugOpts...)
+	if *flagAgent != "" && cmd != "agent" {
+		cfg.agent = newAgentClient(*flagAgent, *flagAgentToken)
+	}
 	var ip net.IP
 	switch strings.ToLower(cmd) {
 	case "on":
+		if *flagGroup != "" {
+			err = cmdGroupSet(cfg, *flagGroup, true, *flagStagger, *flagUndoFile, *flagRollback)
+			break
+		}
 		ip, err = getIPFromIPOrName(cfg, *flagAddr, *flagName)
 		if err != nil {
 			break
 		}
 		err = cmdOn(cfg, ip)
 	case "off":
+		if *flagGroup != "" {
+			err = cmdGroupSet(cfg, *flagGroup, false, *flagStagger, *flagUndoFile, *flagRollback)
+			break
+		}
 		ip, err = getIPFromIPOrName(cfg, *flagAddr, *flagName)
 		if err != nil {
 			break
 		}
 		err = cmdOff(cfg, ip)
 	case "info", "energy":
+		if *flagGroup != "" {
+			err = cmdGroupInfo(cfg, *flagGroup, *flagSummary)
+			break
+		}
 		ip, err = getIPFromIPOrName(cfg, *flagAddr, *flagName)
 		if err != nil {
 			break
 		}
 		err = cmdInfo(cfg, ip)
+	case "energy-data":
+		ip, err = getIPFromIPOrName(cfg, *flagAddr, *flagName)
+		if err != nil {
+			break
+		}
+		err = cmdEnergyData(cfg, ip, pflag.Args()[1:])
+	case "budget":
+		err = cmdBudget(cfg)
+	case "raw":
+		args := pflag.Args()[1:]
+		if len(args) > 0 && args[0] != "help" {
+			ip, err = getIPFromIPOrName(cfg, *flagAddr, *flagName)
+			if err != nil {
+				break
+			}
+		}
+		err = cmdRaw(cfg, ip, args)
+	case "undo":
+		err = cmdUndo(cfg, *flagUndoFile, *flagStagger)
+	case "identify":
+		ip, err = getIPFromIPOrName(cfg, *flagAddr, *flagName)
+		if err != nil {
+			break
+		}
+		err = cmdIdentify(cfg, ip, *flagBlinks)
+	case "timecheck":
+		if *flagGroup == "" {
+			ip, err = getIPFromIPOrName(cfg, *flagAddr, *flagName)
+			if err != nil {
+				break
+			}
+		}
+		err = cmdTimecheck(cfg, ip, *flagGroup, *flagMaxDrift, *flagFix)
+	case "capabilities":
+		if *flagGroup == "" {
+			ip, err = getIPFromIPOrName(cfg, *flagAddr, *flagName)
+			if err != nil {
+				break
+			}
+		}
+		err = cmdCapabilities(cfg, ip, *flagGroup)
+	case "wifi":
+		err = cmdWifi(cfg, pflag.Args()[1:], *flagGroup, *flagSurveyTime, *flagSurveyEvery)
+	case "maintenance":
+		err = cmdMaintenance(cfg, pflag.Args()[1:], *flagAddr, *flagName)
+	case "snapshot":
+		if *flagGroup == "" {
+			ip, err = getIPFromIPOrName(cfg, *flagAddr, *flagName)
+			if err != nil {
+				break
+			}
+		}
+		err = cmdSnapshot(cfg, ip, *flagGroup, *flagSnapFile)
+	case "replace":
+		files := append([]string{*flagConfigFile, *flagMaintFile, *flagUndoFile, *flagTokensFile}, *flagRepoint...)
+		err = cmdReplace(cfg, *flagOld, *flagNew, *flagSnapFile, files)
+	case "firmware":
+		err = cmdFirmware(cfg, pflag.Args()[1:], *flagGroup, *flagBatch, *flagWait)
+	case "bench":
+		ip, err = getIPFromIPOrName(cfg, *flagAddr, *flagName)
+		if err != nil {
+			break
+		}
+		err = cmdBench(cfg, ip, *flagCount)
+	case "config":
+		err = cmdConfig(cfg, *flagConfigFile, pflag.Args()[1:])
 	case "cloud-list":
 		err = cmdCloudList(cfg)
 	case "list":
 		err = cmdList(cfg)
 	case "discover":
 		err = cmdDiscover(cfg)
+	case "telegrambot":
+		err = cmdTelegramBot(cfg, *flagScanEvery)
+	case "agent":
+		err = cmdAgent(cfg, *flagListen, *flagAgentToken, *flagTokensFile)
+	case "agent-discover":
+		err = cmdAgentDiscover(cfg)
+	case "token-create":
+		err = cmdTokenCreate(*flagTokensFile, pflag.Args()[1:])
+	case "token-list":
+		err = cmdTokenList(*flagTokensFile)
+	case "token-revoke":
+		err = cmdTokenRevoke(*flagTokensFile, pflag.Args()[1:])
 	case "":
-		log.Fatalf("No command specified")
+		return fmt.Errorf("no command specified")
 	default:
-		log.Fatalf("Unknown command '%s'", cmd)
+		return fmt.Errorf("unknown command '%s'", cmd)
 	}
 	if err != nil {
-		log.Fatalf("Failed to execute command '%s': %v", cmd, err)
+		return fmt.Errorf("failed to execute command '%s': %w", cmd, err)
 	}
-
+	return nil
 }
 
-func printDeviceInfo(i *tapo.DeviceInfo) {
-	fmt.Printf("Info:\n")
-	fmt.Printf("Device ID               : %s\n", i.DeviceID)
-	fmt.Printf("FW version              : %s\n", i.FWVersion)
-	fmt.Printf("HW version              : %s\n", i.HWVersion)
-	fmt.Printf("Type                    : %s\n", i.Type)
-	fmt.Printf("Model                   : %s\n", i.Model)
-	fmt.Printf("MAC                     : %s\n", i.MAC)
-	fmt.Printf("HW ID                   : %s\n", i.HWID)
-	fmt.Printf("FW ID                   : %s\n", i.FWID)
-	fmt.Printf("OEM ID                  : %s\n", i.OEMID)
-	fmt.Printf("IP                      : %s\n", i.IP)
-	fmt.Printf("Time Diff               : %d\n", i.TimeDiff)
+func printDeviceInfo(i *tapo.DeviceInfo, tr translator) {
+	tr.heading("Info")
+	tr.field("Device ID", "%s", i.DeviceID)
+	tr.field("FW version", "%s", i.FWVersion)
+	tr.field("HW version", "%s", i.HWVersion)
+	tr.field("Type", "%s", i.Type)
+	tr.field("Model", "%s", i.Model)
+	tr.field("MAC", "%s", i.MAC)
+	tr.field("HW ID", "%s", i.HWID)
+	tr.field("FW ID", "%s", i.FWID)
+	tr.field("OEM ID", "%s", i.OEMID)
+	tr.field("IP", "%s", i.IP)
+	tr.field("Time Diff", "%d", i.TimeDiff)
 	// TODO check if DecodedSSID is printable
-	fmt.Printf("SSID                    : %s (decoded: %s)\n", i.SSID, i.DecodedSSID)
-	fmt.Printf("RSSI                    : %d\n", i.RSSI)
-	fmt.Printf("SignalLevel             : %d\n", i.SignalLevel)
-	fmt.Printf("Latitude                : %d\n", i.Latitude)
-	fmt.Printf("Longitude               : %d\n", i.Longitude)
-	fmt.Printf("Lang                    : %s\n", i.Lang)
-	fmt.Printf("Avatar                  : %s\n", i.Avatar)
-	fmt.Printf("Region                  : %s\n", i.Region)
-	fmt.Printf("Specs                   : %s\n", i.Specs)
+	tr.field("SSID", "%s (%s: %s)", i.SSID, tr.T("decoded"), i.DecodedSSID)
+	tr.field("RSSI", "%d", i.RSSI)
+	tr.field("SignalLevel", "%d", i.SignalLevel)
+	tr.field("Latitude", "%d", i.Latitude)
+	tr.field("Longitude", "%d", i.Longitude)
+	tr.field("Lang", "%s", i.Lang)
+	tr.field("Avatar", "%s", i.Avatar)
+	tr.field("Region", "%s", i.Region)
+	tr.field("Specs", "%s", i.Specs)
 	// TODO check if DecodedNickname is printable
-	fmt.Printf("Nickname                : %s (decoded: %s)\n", i.Nickname, i.DecodedNickname)
-	fmt.Printf("Has Set Location Info   : %v\n", i.HasSetLocationInfo)
-	fmt.Printf("Device ON               : %v\n", i.DeviceON)
-	fmt.Printf("ON time                 : %d\n", i.OnTime)
-	fmt.Printf("Default states\n")
-	fmt.Printf("  Type                  : %s\n", i.DefaultStates.Type)
-	fmt.Printf("  State                 : %s\n", string(*i.DefaultStates.State))
-	fmt.Printf("Overheated              : %v\n", i.OverHeated)
-	fmt.Printf("Power Protection Status : %s\n", i.PowerProtectionStatus)
-	fmt.Printf("Location                : %s\n", i.Location)
+	tr.field("Nickname", "%s (%s: %s)", i.Nickname, tr.T("decoded"), i.DecodedNickname)
+	tr.field("Has Set Location Info", "%v", i.HasSetLocationInfo)
+	tr.field("Device ON", "%v", i.DeviceON)
+	tr.field("ON time", "%d", i.OnTime)
+	fmt.Printf("%s\n", tr.T("Default states"))
+	tr.field("  Type", "%s", i.DefaultStates.Type)
+	tr.field("  State", "%s", string(*i.DefaultStates.State))
+	tr.field("Overheated", "%v", i.OverHeated)
+	tr.field("Power Protection Status", "%s", i.PowerProtectionStatus)
+	tr.field("Location", "%s", i.Location)
+	for _, w := range i.Warnings {
+		tr.field("Warning", "%s", w)
+	}
 	fmt.Printf("\n")
 }
 
-func printDeviceUsage(u *tapo.DeviceUsage) {
-	fmt.Printf("Time usage:\n")
-	fmt.Printf("  Today                 : %d minutes\n", u.TimeUsage.Today)
-	fmt.Printf("  Past 7 days           : %d minutes\n", u.TimeUsage.Past7)
-	fmt.Printf("  Past 30 days          : %d minutes\n", u.TimeUsage.Past30)
+func printDeviceUsage(d *tapo.DeviceUsage, u units) {
+	tr := u.tr
+	tr.heading("Time usage")
+	tr.field("  Today", "%s", u.duration(d.TimeUsage.Today))
+	tr.field("  Past 7 days", "%s", u.duration(d.TimeUsage.Past7))
+	tr.field("  Past 30 days", "%s", u.duration(d.TimeUsage.Past30))
+	fmt.Printf("\n")
+	tr.heading("Power usage")
+	tr.field("  Today", "%s", u.energy(d.PowerUsage.Today))
+	tr.field("  Past 7 days", "%s", u.energy(d.PowerUsage.Past7))
+	tr.field("  Past 30 days", "%s", u.energy(d.PowerUsage.Past30))
 	fmt.Printf("\n")
-	fmt.Printf("Power usage:\n")
-	fmt.Printf("  Today                 : %d kWh\n", u.PowerUsage.Today)
-	fmt.Printf("  Past 7 days           : %d kWh\n", u.PowerUsage.Past7)
-	fmt.Printf("  Past 30 days          : %d kWh\n", u.PowerUsage.Past30)
+	tr.heading("Saved power")
+	tr.field("  Today", "%s", u.energy(d.SavedPower.Today))
+	tr.field("  Past 7 days", "%s", u.energy(d.SavedPower.Past7))
+	tr.field("  Past 30 days", "%s", u.energy(d.SavedPower.Past30))
 	fmt.Printf("\n")
-	fmt.Printf("Saved power:\n")
-	fmt.Printf("  Today                 : %d kWh\n", u.SavedPower.Today)
-	fmt.Printf("  Past 7 days           : %d kWh\n", u.SavedPower.Past7)
-	fmt.Printf("  Past 30 days          : %d kWh\n", u.SavedPower.Past30)
+}
+
+func printDeviceTime(t *tapo.DeviceTime, tr translator) {
+	tr.heading("Device time")
+	tr.field("  Time", "%s", t.Time().Format(time.RFC3339))
+	tr.field("  Region", "%s", t.Region)
+	tr.field("  UTC offset", "%+d %s", t.TimeDiff, tr.T("minutes"))
 	fmt.Printf("\n")
 }
 
-func printEnergyUsage(u *tapo.EnergyUsage) {
-	fmt.Printf("Energy usage:\n")
-	fmt.Printf("  Today runtime         : %d\n", u.TodayRuntime)
-	fmt.Printf("  Month runtime         : %d\n", u.MonthRuntime)
-	fmt.Printf("  Today energy          : %d\n", u.TodayEnergy)
-	fmt.Printf("  Month energy          : %d\n", u.MonthEnergy)
-	fmt.Printf("  Local time            : %s\n", u.LocalTime)
-	fmt.Printf("  Electricity charge    : %v\n", u.ElectricityCharge)
-	fmt.Printf("  Current power         : %d\n", u.CurrentPower)
+func printEnergyUsage(e *tapo.EnergyUsage, u units) {
+	tr := u.tr
+	tr.heading("Energy usage")
+	tr.field("  Today runtime", "%s", u.duration(e.TodayRuntime))
+	tr.field("  Month runtime", "%s", u.duration(e.MonthRuntime))
+	tr.field("  Today energy", "%s", u.energy(e.TodayEnergy))
+	tr.field("  Month energy", "%s", u.energy(e.MonthEnergy))
+	tr.field("  Local time", "%s", e.LocalTime)
+	tr.field("  Electricity charge", "%v", e.ElectricityCharge)
+	tr.field("  Current power", "%s", u.power(e.CurrentPower))
 	fmt.Printf("\n")
 }
@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+// Devices in maintenance, e.g. while they are rewired, are listed in the
+// maintenance file by `tapo maintenance set`. telegrambot does not notify
+// when they go offline or come back, and group operations and firmware
+// rollouts skip them unless --force is set, until `tapo maintenance clear`.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// errMaintenance is returned when a group operation targets a device in
+// maintenance without --force.
+var errMaintenance = errors.New("device is in maintenance")
+
+// maintenanceEntry is a device in maintenance.
+type maintenanceEntry struct {
+	// Device is the IP address or nickname of the device.
+	Device string    `json:"device"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// loadMaintenance reads the devices in maintenance from path. A missing file
+// means no devices.
+func loadMaintenance(path string) ([]maintenanceEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read maintenance file: %w", err)
+	}
+	var entries []maintenanceEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid maintenance file '%s': %w", path, err)
+	}
+	return entries, nil
+}
+
+// saveMaintenance writes the devices in maintenance atomically, or removes
+// the file if there are none.
+func saveMaintenance(path string, entries []maintenanceEntry) error {
+	if len(entries) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("JSON marshal failed: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// maintenanceList returns the devices in maintenance, as IP addresses or
+// nicknames. The file is read at every call, so that a running telegrambot
+// sees the changes.
+func maintenanceList(cfg *cmdCfg) []string {
+	if cfg.maintenanceFile == "" {
+		return nil
+	}
+	entries, err := loadMaintenance(cfg.maintenanceFile)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+	list := make([]string, len(entries))
+	for idx, e := range entries {
+		list[idx] = e.Device
+	}
+	return list
+}
+
+// inMaintenance returns whether the device with the given address or nickname
+// is in maintenance.
+func inMaintenance(cfg *cmdCfg, ip net.IP, name string) bool {
+	return isListed(maintenanceList(cfg), ip, name)
+}
+
+// checkMaintenance returns an error wrapping errMaintenance if the device at
+// ip is in maintenance and --force is not set.
+func checkMaintenance(cfg *cmdCfg, ip net.IP, d device) error {
+	if cfg.force {
+		return nil
+	}
+	return checkListed(maintenanceList(cfg), ip, d, errMaintenance)
+}
+
+// cmdMaintenance runs the maintenance subcommands. set and clear take the
+// device from --addr or --name, set takes an optional reason after it.
+func cmdMaintenance(cfg *cmdCfg, args []string, ip net.IP, name string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: maintenance set|clear|list")
+	}
+	if cfg.maintenanceFile == "" {
+		return fmt.Errorf("no maintenance file, see --maintenance-file")
+	}
+	entries, err := loadMaintenance(cfg.maintenanceFile)
+	if err != nil {
+		return err
+	}
+	if args[0] == "list" {
+		if len(entries) == 0 {
+			fmt.Printf("No devices in maintenance\n")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "DEVICE\tSINCE\tREASON\n")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", e.Device, e.Since.Local().Format(time.DateTime), e.Reason)
+		}
+		return w.Flush()
+	}
+	// the device is stored as given, nicknames are not resolved
+	ref := name
+	if ip != nil {
+		ref = ip.String()
+	}
+	if ref == "" {
+		return fmt.Errorf("no device name nor IP address specified")
+	}
+	idx := -1
+	for i, e := range entries {
+		if e.Device == ref {
+			idx = i
+			break
+		}
+	}
+	switch args[0] {
+	case "set":
+		e := maintenanceEntry{Device: ref, Since: time.Now(), Reason: strings.Join(args[1:], " ")}
+		if idx >= 0 {
+			entries[idx] = e
+		} else {
+			entries = append(entries, e)
+		}
+		fmt.Printf("%s is in maintenance\n", ref)
+	case "clear":
+		if idx < 0 {
+			return fmt.Errorf("%s is not in maintenance", ref)
+		}
+		entries = append(entries[:idx], entries[idx+1:]...)
+		fmt.Printf("%s is no longer in maintenance\n", ref)
+	default:
+		return fmt.Errorf("unknown maintenance command '%s', want set, clear or list", args[0])
+	}
+	if err := saveMaintenance(cfg.maintenanceFile, entries); err != nil {
+		return fmt.Errorf("failed to update maintenance file: %w", err)
+	}
+	return nil
+}
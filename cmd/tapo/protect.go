@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// errProtected is returned when a mutating command targets a protected device
+// without --force.
+var errProtected = errors.New("device is protected")
+
+// isProtected returns whether the device with the given address or nickname
+// is listed as protected in the configuration.
+func isProtected(cfg *cmdCfg, ip net.IP, name string) bool {
+	return isListed(cfg.Protected, ip, name)
+}
+
+// isListed returns whether the device with the given address or nickname is
+// in a list of IP addresses and nicknames from the configuration.
+func isListed(list []string, ip net.IP, name string) bool {
+	for _, p := range list {
+		if pip := net.ParseIP(p); pip != nil {
+			if pip.Equal(ip) {
+				return true
+			}
+		} else if name != "" && p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProtected returns an error wrapping errProtected if the device at ip is
+// protected and --force is not set.
+func checkProtected(cfg *cmdCfg, ip net.IP, d device) error {
+	if cfg.force {
+		return nil
+	}
+	return checkListed(cfg.Protected, ip, d, errProtected)
+}
+
+// checkListed returns an error wrapping sentinel if the device at ip is in
+// list. The device nickname is only queried if the list contains nicknames.
+func checkListed(list []string, ip net.IP, d device, sentinel error) error {
+	if len(list) == 0 {
+		return nil
+	}
+	if isListed(list, ip, "") {
+		return fmt.Errorf("%s: %w, use --force to override", ip, sentinel)
+	}
+	hasNames := false
+	for _, p := range list {
+		if net.ParseIP(p) == nil {
+			hasNames = true
+			break
+		}
+	}
+	if !hasNames {
+		return nil
+	}
+	info, err := d.GetDeviceInfo()
+	if err != nil {
+		// do not risk switching a listed device
+		return fmt.Errorf("cannot check whether the device is listed: %w", err)
+	}
+	if isListed(list, ip, info.DecodedNickname) {
+		return fmt.Errorf("%s (%s): %w, use --force to override", ip, info.DecodedNickname, sentinel)
+	}
+	return nil
+}
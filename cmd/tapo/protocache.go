@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// protocolCache is a tapo.ProtocolCache stored in a JSON file, mapping the IP
+// address of each device to its protocol. It lets every CLI run skip the
+// failed KLAP attempt against devices with older firmwares.
+type protocolCache struct {
+	path      string
+	mu        sync.Mutex
+	protocols map[netip.Addr]tapo.Protocol
+}
+
+// loadProtocolCache reads the cache from path. A missing or corrupted file
+// results in an empty cache, since it only affects speed.
+func loadProtocolCache(path string) *protocolCache {
+	c := protocolCache{
+		path:      path,
+		protocols: make(map[netip.Addr]tapo.Protocol),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read protocol cache: %v", err)
+		}
+		return &c
+	}
+	if err := json.Unmarshal(data, &c.protocols); err != nil {
+		log.Printf("Warning: ignoring invalid protocol cache '%s': %v", path, err)
+		c.protocols = make(map[netip.Addr]tapo.Protocol)
+	}
+	return &c
+}
+
+func (c *protocolCache) Protocol(addr netip.Addr) tapo.Protocol {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.protocols[addr]
+}
+
+func (c *protocolCache) SetProtocol(addr netip.Addr, p tapo.Protocol) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.protocols[addr] == p {
+		return
+	}
+	c.protocols[addr] = p
+	if err := c.save(); err != nil {
+		log.Printf("Warning: failed to save protocol cache: %v", err)
+	}
+}
+
+// save writes the cache atomically. Must be called with the lock held.
+func (c *protocolCache) save() error {
+	data, err := json.MarshalIndent(c.protocols, "", "  ")
+	if err != nil {
+		return fmt.Errorf("JSON marshal failed: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
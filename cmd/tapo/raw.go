@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// printMethods prints the method catalog, used as the help of `raw`.
+func printMethods() {
+	fmt.Println("usage: raw <method> [JSON params]")
+	fmt.Println()
+	fmt.Println("Known methods:")
+	for _, m := range tapo.Methods() {
+		fmt.Printf("  %s\n      %s\n", m.Name, m.Doc)
+		if m.Component != "" {
+			fmt.Printf("      Requires the %s component.\n", m.Component)
+		}
+		for _, p := range m.Params {
+			fmt.Printf("      %s (%s): %s\n", p.Name, p.Type, p.Doc)
+		}
+	}
+}
+
+// cmdRaw sends a request for an arbitrary method and prints the JSON
+// response. args are the method name and its optional JSON params. Known
+// methods have their params validated against the catalog, unknown ones are
+// sent as they are, to explore what a device supports.
+func cmdRaw(cfg *cmdCfg, ip net.IP, args []string) error {
+	if len(args) == 0 || args[0] == "help" {
+		printMethods()
+		return nil
+	}
+	if len(args) > 2 {
+		return fmt.Errorf("usage: raw <method> [JSON params]")
+	}
+	if cfg.agent != nil {
+		return fmt.Errorf("raw is not supported through --agent")
+	}
+	method := args[0]
+	var params json.RawMessage
+	if len(args) == 2 {
+		params = json.RawMessage(args[1])
+		if !json.Valid(params) {
+			return fmt.Errorf("params are not valid JSON")
+		}
+	}
+	spec, known := tapo.LookupMethod(method)
+	if known {
+		if err := spec.ValidateParams(params); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Warning: '%s' is not in the method catalog, sending it unchecked", method)
+	}
+	plug, err := getPlug(cfg, ip.String())
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(method, "set_") {
+		if err := checkProtected(cfg, ip, plug); err != nil {
+			return err
+		}
+	}
+	resp, callErr := plug.Call(method, params)
+	if resp == nil {
+		return callErr
+	}
+	if known && callErr == nil {
+		if err := spec.CheckResponse(resp); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, resp, "", "  "); err != nil {
+		return fmt.Errorf("failed to format response: %w", err)
+	}
+	out.WriteByte('\n')
+	if _, err := out.WriteTo(os.Stdout); err != nil {
+		return err
+	}
+	return callErr
+}
@@ -0,0 +1,340 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+// A snapshot records the settings of a device that are lost when it is
+// replaced, e.g. after a hardware failure: its nickname, avatar and time zone.
+// `tapo snapshot` stores them in the snapshot file, keyed by MAC address, and
+// `tapo replace --old <mac> --new <ip>` applies the snapshot of the old device
+// to the new one. The configuration, maintenance, undo and API token files
+// refer to devices by IP address, nickname, MAC address or device ID: the
+// nickname carries over, and the other identifiers of the old device are
+// replaced with those of the new one. The snapshot of the old device is kept
+// in the history of the new one.
+//
+// The energy history stays on the old device, since devices do not accept
+// imported data.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// snapshot is the state of a device kept by `tapo snapshot`.
+type snapshot struct {
+	MAC      string `json:"mac"`
+	DeviceID string `json:"device_id"`
+	IP       string `json:"ip"`
+	Model    string `json:"model"`
+	// Nickname is the decoded nickname of the device.
+	Nickname string `json:"nickname"`
+	Avatar   string `json:"avatar,omitempty"`
+	// Region is the IANA time zone of the device.
+	Region string    `json:"region,omitempty"`
+	Taken  time.Time `json:"taken"`
+	// Replaced are the snapshots of the devices this one replaced, the most
+	// recent first.
+	Replaced []snapshot `json:"replaced,omitempty"`
+}
+
+// newSnapshot returns the snapshot of a device from its info.
+func newSnapshot(info *tapo.DeviceInfo) snapshot {
+	return snapshot{
+		MAC:      info.MAC,
+		DeviceID: info.DeviceID,
+		IP:       info.IP,
+		Model:    info.Model,
+		Nickname: info.DecodedNickname,
+		Avatar:   info.Avatar,
+		Region:   info.Region,
+		Taken:    time.Now(),
+	}
+}
+
+// snapshotKey returns the key of a device in the snapshot file, its MAC
+// address in canonical form, since devices and users write them with dashes
+// or colons, in either case.
+func snapshotKey(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", fmt.Errorf("invalid MAC address '%s': %w", mac, err)
+	}
+	return hw.String(), nil
+}
+
+// loadSnapshots reads the snapshots from path, indexed by snapshotKey. A
+// missing file means no snapshots.
+func loadSnapshots(path string) (map[string]snapshot, error) {
+	snaps := make(map[string]snapshot)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return snaps, nil
+		}
+		return nil, fmt.Errorf("failed to read snapshot file: %w", err)
+	}
+	if err := json.Unmarshal(data, &snaps); err != nil {
+		return nil, fmt.Errorf("invalid snapshot file '%s': %w", path, err)
+	}
+	return snaps, nil
+}
+
+// saveSnapshots writes the snapshots atomically.
+func saveSnapshots(path string, snaps map[string]snapshot) error {
+	data, err := json.MarshalIndent(snaps, "", "  ")
+	if err != nil {
+		return fmt.Errorf("JSON marshal failed: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// cmdSnapshot stores the snapshot of a device, or of the devices of a group.
+func cmdSnapshot(cfg *cmdCfg, ip net.IP, group, snapFile string) error {
+	ips := []net.IP{ip}
+	if group != "" {
+		var err error
+		if ips, err = resolveGroup(cfg, group); err != nil {
+			return err
+		}
+	}
+	snaps, err := loadSnapshots(snapFile)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, ip := range ips {
+		if cfg.ctx.Err() != nil {
+			errs = append(errs, interrupted(cfg))
+			break
+		}
+		d, err := getDevice(cfg, ip.String())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ip, err))
+			continue
+		}
+		info, err := d.GetDeviceInfo()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: failed to get device info: %w", ip, err))
+			continue
+		}
+		key, err := snapshotKey(info.MAC)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ip, err))
+			continue
+		}
+		snap := newSnapshot(info)
+		// keep the history of the device across snapshots
+		snap.Replaced = snaps[key].Replaced
+		snaps[key] = snap
+		fmt.Printf("Saved snapshot of '%s' (%s, %s)\n", snap.Nickname, snap.IP, snap.MAC)
+	}
+	if err := saveSnapshots(snapFile, snaps); err != nil {
+		return fmt.Errorf("failed to save snapshots: %w", err)
+	}
+	return errors.Join(errs...)
+}
+
+// cmdReplace applies the snapshot of the device with MAC address oldMAC to the
+// device at newIP, and points the references to the old device in files to
+// the new one.
+func cmdReplace(cfg *cmdCfg, oldMAC string, newIP net.IP, snapFile string, files []string) error {
+	if oldMAC == "" || newIP == nil {
+		return fmt.Errorf("usage: replace --old <mac> --new <ip>")
+	}
+	if cfg.agent != nil {
+		return fmt.Errorf("replace is not supported through --agent")
+	}
+	key, err := snapshotKey(oldMAC)
+	if err != nil {
+		return err
+	}
+	snaps, err := loadSnapshots(snapFile)
+	if err != nil {
+		return err
+	}
+	old, ok := snaps[key]
+	if !ok {
+		return fmt.Errorf("no snapshot of %s in '%s', they are taken by `tapo snapshot`", oldMAC, snapFile)
+	}
+	plug, err := getPlug(cfg, newIP.String())
+	if err != nil {
+		return err
+	}
+	info, err := plug.GetDeviceInfo()
+	if err != nil {
+		return fmt.Errorf("failed to get device info: %w", err)
+	}
+	newKey, err := snapshotKey(info.MAC)
+	if err != nil {
+		return err
+	}
+	if newKey == key {
+		return fmt.Errorf("the device at %s is %s itself", newIP, oldMAC)
+	}
+
+	params := map[string]string{"nickname": base64.StdEncoding.EncodeToString([]byte(old.Nickname))}
+	if old.Avatar != "" {
+		params["avatar"] = old.Avatar
+	}
+	p, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("JSON marshal failed: %w", err)
+	}
+	if _, err := plug.Call("set_device_info", p); err != nil {
+		return fmt.Errorf("failed to set nickname: %w", err)
+	}
+	fmt.Printf("Set nickname '%s' on %s\n", old.Nickname, newIP)
+	if old.Region != "" {
+		loc, err := time.LoadLocation(old.Region)
+		if err != nil {
+			log.Printf("Warning: not setting time zone '%s': %v", old.Region, err)
+		} else if err := plug.SetDeviceTime(tapo.NewDeviceTime(time.Now(), loc)); err != nil {
+			return fmt.Errorf("failed to set time zone: %w", err)
+		}
+	}
+
+	from := deviceIDs{IP: old.IP, MAC: old.MAC, DeviceID: old.DeviceID}
+	to := deviceIDs{IP: info.IP, MAC: info.MAC, DeviceID: info.DeviceID}
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		n, err := repointFile(f, from, to)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			fmt.Printf("Updated %d references in %s\n", n, f)
+		}
+	}
+
+	snap := newSnapshot(info)
+	snap.Nickname, snap.Avatar = old.Nickname, old.Avatar
+	archived := old
+	archived.Replaced = nil
+	snap.Replaced = append([]snapshot{archived}, old.Replaced...)
+	delete(snaps, key)
+	snaps[newKey] = snap
+	if err := saveSnapshots(snapFile, snaps); err != nil {
+		return fmt.Errorf("failed to save snapshots: %w", err)
+	}
+	fmt.Printf("Replaced %s with %s (%s)\n", old.MAC, info.MAC, info.IP)
+	return nil
+}
+
+// deviceIDs are the identifiers of a device that files refer to it by,
+// besides the nickname.
+type deviceIDs struct {
+	IP       string
+	MAC      string
+	DeviceID string
+}
+
+// replacement returns the identifier of to that replaces s, if s is an
+// identifier of ids.
+func (ids deviceIDs) replacement(s string, to deviceIDs) (string, bool) {
+	switch {
+	case ids.IP != "" && s == ids.IP:
+		return to.IP, true
+	case ids.DeviceID != "" && strings.EqualFold(s, ids.DeviceID):
+		return to.DeviceID, true
+	case ids.MAC != "":
+		a, err1 := net.ParseMAC(s)
+		b, err2 := net.ParseMAC(ids.MAC)
+		if err1 == nil && err2 == nil && bytes.Equal(a, b) {
+			return to.MAC, true
+		}
+	}
+	return "", false
+}
+
+// repointJSON replaces the strings of a JSON document, keys included, that are
+// identifiers of from with the identifiers of to. The rest of the document is
+// kept as it is. It returns the new document and the number of replacements.
+func repointJSON(data []byte, from, to deviceIDs) ([]byte, int, error) {
+	// the decoder stops at the end of the input without an error when the
+	// document is truncated.
+	if !json.Valid(data) {
+		return nil, 0, errors.New("not a valid JSON document")
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var out bytes.Buffer
+	last, n := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		s, ok := tok.(string)
+		if !ok {
+			continue
+		}
+		repl, ok := from.replacement(s, to)
+		if !ok || repl == s || repl == "" {
+			continue
+		}
+		// identifiers have no characters to escape, so the literal is
+		// the quoted string, which ends at the offset of the decoder.
+		end := int(dec.InputOffset())
+		start := end - len(s) - 2
+		if start < last || string(data[start:end]) != `"`+s+`"` {
+			continue
+		}
+		out.Write(data[last:start])
+		out.WriteString(`"` + repl + `"`)
+		last = end
+		n++
+	}
+	out.Write(data[last:])
+	return out.Bytes(), n, nil
+}
+
+// repointFile applies repointJSON to a file, keeping its permissions. A
+// missing file is skipped.
+func repointFile(path string, from, to deviceIDs) (int, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	data, n, err := repointJSON(data, from, to)
+	if err != nil {
+		return 0, fmt.Errorf("invalid JSON in '%s': %w", path, err)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, fi.Mode().Perm()); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp, path)
+}
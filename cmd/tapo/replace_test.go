@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	oldDevice = deviceIDs{IP: "192.168.1.20", MAC: "AA-BB-CC-DD-EE-01", DeviceID: "8022AAAA"}
+	newDevice = deviceIDs{IP: "192.168.1.21", MAC: "AA-BB-CC-DD-EE-02", DeviceID: "8022BBBB"}
+)
+
+func TestRepointJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		in    string
+		want  string
+		wantN int
+	}{
+		{
+			name:  "config",
+			in:    "{\n  \"groups\": {\"porch\": [\"192.168.1.20\", \"Lamp\"]},\n  \"protected\": [\"192.168.1.200\"]\n}\n",
+			want:  "{\n  \"groups\": {\"porch\": [\"192.168.1.21\", \"Lamp\"]},\n  \"protected\": [\"192.168.1.200\"]\n}\n",
+			wantN: 1,
+		},
+		{
+			name:  "MAC in another format",
+			in:    `[{"name":"ha","devices":["aa:bb:cc:dd:ee:01","192.168.1.20"]}]`,
+			want:  `[{"name":"ha","devices":["AA-BB-CC-DD-EE-02","192.168.1.21"]}]`,
+			wantN: 2,
+		},
+		{
+			name:  "device ID as a key",
+			in:    `{"8022aaaa":{"label":"Porch"},"8022CCCC":{"label":"Hall"}}`,
+			want:  `{"8022BBBB":{"label":"Porch"},"8022CCCC":{"label":"Hall"}}`,
+			wantN: 1,
+		},
+		{
+			name: "no references",
+			in:   `{"password":"enc:v1:MTkyLjE2OC4xLjIw","debug":true,"count":20}`,
+			want: `{"password":"enc:v1:MTkyLjE2OC4xLjIw","debug":true,"count":20}`,
+		},
+		{
+			// only literals without escapes are replaced
+			name: "escaped string",
+			in:   `["192.168.1.\u0032\u0030"]`,
+			want: `["192.168.1.\u0032\u0030"]`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, n, err := repointJSON([]byte(tc.in), oldDevice, newDevice)
+			if err != nil {
+				t.Fatalf("repointJSON failed: %v", err)
+			}
+			if string(got) != tc.want || n != tc.wantN {
+				t.Errorf("repointJSON() = %s, %d, want %s, %d", got, n, tc.want, tc.wantN)
+			}
+		})
+	}
+	if _, _, err := repointJSON([]byte(`{"groups":`), oldDevice, newDevice); err == nil {
+		t.Errorf("repointJSON of invalid JSON succeeded")
+	}
+}
+
+func TestRepointFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "maintenance.json")
+	if err := os.WriteFile(path, []byte(`[{"device":"192.168.1.20"}]`), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	n, err := repointFile(path, oldDevice, newDevice)
+	if err != nil || n != 1 {
+		t.Fatalf("repointFile() = %d, %v, want 1", n, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"device":"192.168.1.21"}]`; string(data) != want {
+		t.Errorf("file = %s, want %s", data, want)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o640 {
+		t.Errorf("mode = %o, want 640", fi.Mode().Perm())
+	}
+	if n, err := repointFile(filepath.Join(dir, "missing.json"), oldDevice, newDevice); n != 0 || err != nil {
+		t.Errorf("repointFile of a missing file = %d, %v", n, err)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	for mac, want := range map[string]string{
+		"AA-BB-CC-DD-EE-01": "aa:bb:cc:dd:ee:01",
+		"aa:bb:cc:dd:ee:01": "aa:bb:cc:dd:ee:01",
+	} {
+		if got, err := snapshotKey(mac); err != nil || got != want {
+			t.Errorf("snapshotKey(%s) = %s, %v, want %s", mac, got, err, want)
+		}
+	}
+	if _, err := snapshotKey("192.168.1.20"); err == nil {
+		t.Errorf("snapshotKey of an IP address succeeded")
+	}
+
+	path := filepath.Join(t.TempDir(), "tapo", "snapshots.json")
+	snaps, err := loadSnapshots(path)
+	if err != nil || len(snaps) != 0 {
+		t.Fatalf("loadSnapshots of a missing file = %v, %v", snaps, err)
+	}
+	snaps["aa:bb:cc:dd:ee:02"] = snapshot{
+		MAC:      "AA-BB-CC-DD-EE-02",
+		Nickname: "Porch",
+		Taken:    time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC),
+		Replaced: []snapshot{{MAC: "AA-BB-CC-DD-EE-01", Nickname: "Porch"}},
+	}
+	if err := saveSnapshots(path, snaps); err != nil {
+		t.Fatalf("saveSnapshots failed: %v", err)
+	}
+	loaded, err := loadSnapshots(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := loaded["aa:bb:cc:dd:ee:02"]
+	if got.Nickname != "Porch" || len(got.Replaced) != 1 || got.Replaced[0].MAC != "AA-BB-CC-DD-EE-01" {
+		t.Errorf("loaded snapshot = %+v", got)
+	}
+}
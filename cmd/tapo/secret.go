@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// encryptedPrefix marks configuration values encrypted with the key file. The
+// rest of the value is the base64 encoding of the AES-GCM nonce followed by
+// the ciphertext.
+const encryptedPrefix = "enc:v1:"
+
+// isEncrypted reports whether a configuration value is encrypted.
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// loadKey reads a 256-bit key, hex-encoded, from keyFile.
+func loadKey(keyFile string) ([]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file '%s': %w", keyFile, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key file '%s': want 32 bytes, got %d", keyFile, len(key))
+	}
+	return key, nil
+}
+
+// createKey generates a new key and writes it to keyFile, readable only by
+// the user. It does not overwrite an existing key, which would make the
+// values encrypted with it unreadable.
+func createKey(keyFile string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
+	}
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key file: %w", err)
+	}
+	if _, err := fmt.Fprintf(f, "%x\n", key); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptValue encrypts a configuration value with key.
+func encryptValue(key []byte, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptValue decrypts a value returned by encryptValue.
+func decryptValue(key []byte, value string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("malformed encrypted value: too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt value, wrong key file?")
+	}
+	return string(plaintext), nil
+}
+
+// cmdConfigEncrypt reads a password from stdin and prints it encrypted, to be
+// used as the password in the configuration file. The key file is created if
+// it does not exist.
+func cmdConfigEncrypt(keyFile string) error {
+	key, err := loadKey(keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err = createKey(keyFile)
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "Created key file %s, keep it out of version control\n", keyFile)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return fmt.Errorf("failed to read password: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	value, err := encryptValue(key, password)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt password: %w", err)
+	}
+	fmt.Println(value)
+	return nil
+}
@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestEncryptValue(t *testing.T) {
+	for _, plaintext := range []string{"secret", "", "pässwörd with spaces"} {
+		value, err := encryptValue(testKey(1), plaintext)
+		if err != nil {
+			t.Fatalf("encryptValue failed: %v", err)
+		}
+		if !isEncrypted(value) {
+			t.Errorf("encryptValue(%q) = %q", plaintext, value)
+		}
+		got, err := decryptValue(testKey(1), value)
+		if err != nil || got != plaintext {
+			t.Errorf("decryptValue() = %q, %v, want %q", got, err, plaintext)
+		}
+	}
+	// the nonce is random, so the same value never encrypts the same way
+	a, _ := encryptValue(testKey(1), "secret")
+	b, _ := encryptValue(testKey(1), "secret")
+	if a == b {
+		t.Errorf("two encryptions of the same value are equal")
+	}
+}
+
+func TestDecryptValueErrors(t *testing.T) {
+	value, err := encryptValue(testKey(1), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tamper flips a bit of the sealed value at offset off
+	tamper := func(off int) string {
+		data := append([]byte(nil), sealed...)
+		data[off] ^= 1
+		return encryptedPrefix + base64.StdEncoding.EncodeToString(data)
+	}
+	for _, tc := range []struct {
+		name  string
+		key   []byte
+		value string
+	}{
+		{"wrong key", testKey(2), value},
+		{"tampered nonce", testKey(1), tamper(0)},
+		{"tampered ciphertext", testKey(1), tamper(len(sealed) - 17)},
+		{"tampered tag", testKey(1), tamper(len(sealed) - 1)},
+		{"truncated", testKey(1), encryptedPrefix + base64.StdEncoding.EncodeToString(sealed[:8])},
+		{"not base64", testKey(1), encryptedPrefix + "!!!"},
+		{"invalid key size", testKey(1)[:7], value},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, err := decryptValue(tc.key, tc.value); err == nil {
+				t.Errorf("decryptValue() = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "tapo", "key")
+	if _, err := loadKey(keyFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("loadKey of a missing file: err = %v", err)
+	}
+	key, err := createKey(keyFile)
+	if err != nil {
+		t.Fatalf("createKey failed: %v", err)
+	}
+	fi, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("key file mode = %o, want 600", perm)
+	}
+	loaded, err := loadKey(keyFile)
+	if err != nil || !bytes.Equal(loaded, key) {
+		t.Errorf("loadKey() = %x, %v, want %x", loaded, err, key)
+	}
+	if _, err := createKey(keyFile); err == nil {
+		t.Errorf("createKey overwrote an existing key")
+	}
+
+	if err := os.WriteFile(keyFile, []byte("0011\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKey(keyFile); err == nil {
+		t.Errorf("loadKey of a short key succeeded")
+	}
+}
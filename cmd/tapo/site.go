@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+// Sites are the places with devices managed from the same configuration, like
+// home, office and parents. Each site in the sites section of the
+// configuration says how to reach its devices, and --site NAME applies it:
+//
+//	"sites": {
+//	  "office": {"agent": "office.example.org:7491", "agent_token": "..."},
+//	  "parents": {"via": "me@parents.example.org"}
+//	}
+//
+// The settings of the site are defaults, the command line flags take
+// precedence. The groups of the site are added to the global ones, and the
+// files keyed by IP address, like the protocol cache and the undo file, are
+// kept per site, since the same address can be a different device on another
+// site.
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// siteCfg is an entry of the sites section of the configuration file.
+type siteCfg struct {
+	// Agent and AgentToken are the defaults of --agent and --agent-token.
+	// AgentToken can be encrypted with config encrypt.
+	Agent      string `json:"agent,omitempty"`
+	AgentToken string `json:"agent_token,omitempty"`
+	// Via is the default of --via.
+	Via string `json:"via,omitempty"`
+	// Proxy is the default of --proxy.
+	Proxy string `json:"proxy,omitempty"`
+	// DiscoveryInterfaces is the default of --discovery-interface, for a
+	// site on a local subnet.
+	DiscoveryInterfaces []string `json:"discovery_interfaces,omitempty"`
+	// Groups are added to the global groups, and replace the global groups
+	// with the same name.
+	Groups map[string][]string `json:"groups,omitempty"`
+}
+
+// validate checks that the site reaches the devices in a single way.
+func (s siteCfg) validate() error {
+	n := 0
+	for _, v := range []string{s.Agent, s.Via, s.Proxy} {
+		if v != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("set at most one of agent, via and proxy")
+	}
+	if s.AgentToken != "" && s.Agent == "" {
+		return fmt.Errorf("agent_token is set without agent")
+	}
+	return nil
+}
+
+// siteFiles are the flags of the files that are kept per site.
+var siteFiles = []string{"protocol-cache", "undo-file", "maintenance-file", "snapshot-file"}
+
+// siteFile returns path with the site name added before the extension, e.g.
+// undo-office.json.
+func siteFile(path, site string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + site + ext
+}
+
+// applySite sets the flags that are not set on the command line to the
+// settings of the named site, and adds its groups to the configuration.
+func applySite(cfg *cmdCfg, name string) error {
+	site, ok := cfg.Sites[name]
+	if !ok {
+		return fmt.Errorf("unknown site '%s'", name)
+	}
+	if err := site.validate(); err != nil {
+		return fmt.Errorf("site '%s': %w", name, err)
+	}
+	token := site.AgentToken
+	if isEncrypted(token) {
+		key, err := loadKey(*flagKeyFile)
+		if err != nil {
+			return fmt.Errorf("site '%s' has an encrypted agent token: %w", name, err)
+		}
+		if token, err = decryptValue(key, token); err != nil {
+			return fmt.Errorf("failed to decrypt agent token of site '%s': %w", name, err)
+		}
+	}
+	defaults := map[string]string{
+		"agent":               site.Agent,
+		"agent-token":         token,
+		"via":                 site.Via,
+		"proxy":               site.Proxy,
+		"discovery-interface": strings.Join(site.DiscoveryInterfaces, ","),
+	}
+	for _, f := range siteFiles {
+		if v := pflag.Lookup(f).Value.String(); v != "" {
+			defaults[f] = siteFile(v, name)
+		}
+	}
+	for flag, value := range defaults {
+		if value == "" || pflag.CommandLine.Changed(flag) {
+			continue
+		}
+		if err := pflag.Set(flag, value); err != nil {
+			return fmt.Errorf("site '%s': invalid %s: %w", name, flag, err)
+		}
+	}
+	if len(site.Groups) > 0 && cfg.Groups == nil {
+		cfg.Groups = make(map[string][]string, len(site.Groups))
+	}
+	for group, members := range site.Groups {
+		cfg.Groups[group] = members
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !lite
+
+package main
+
+// telegrambot runs a Telegram bot that lists and switches the devices, and
+// notifies when they go offline or come back, unless they are in maintenance,
+// and when the energy budgets reach a threshold. Only the chats listed in the
+// telegram section of the configuration are answered, other chats get their
+// chat ID back so that it can be added.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// telegramAPI is the base URL of the Telegram Bot API.
+const telegramAPI = "https://api.telegram.org"
+
+// telegramPollTimeout is how long a getUpdates long poll waits for messages.
+const telegramPollTimeout = 50 * time.Second
+
+const telegramHelp = `/list - list the devices and their state
+/on NAME - turn a device on
+/off NAME - turn a device off
+/toggle NAME - toggle a device
+NAME is a device nickname or IP address.`
+
+// telegramBot talks to the Bot API.
+type telegramBot struct {
+	token  string
+	client http.Client
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// call invokes a Bot API method with JSON parameters, and decodes its result.
+func (b *telegramBot) call(ctx context.Context, method string, params, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("JSON marshal failed: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telegramAPI+"/bot"+b.token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		// the URL contains the token, do not log it
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("%s failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+	var r struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("%s: invalid response: %w", method, err)
+	}
+	if !r.OK {
+		return fmt.Errorf("%s failed: %s", method, r.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(r.Result, result)
+}
+
+func (b *telegramBot) send(ctx context.Context, chat int64, text string) {
+	params := map[string]interface{}{"chat_id": chat, "text": text}
+	if err := b.call(ctx, "sendMessage", params, nil); err != nil {
+		log.Printf("Warning: failed to send Telegram message to chat %d: %v", chat, err)
+	}
+}
+
+// botDevice is a device as seen by the bot.
+type botDevice struct {
+	dev  device
+	ip   net.IP
+	name string
+	on   bool
+	err  error
+}
+
+// botState tracks the devices found by the scanner and their nicknames.
+type botState struct {
+	cfg     *cmdCfg
+	scanner *tapo.Scanner
+
+	mu sync.Mutex
+	// names maps device IDs to nicknames, to name devices that went offline.
+	names map[string]string
+}
+
+func (s *botState) name(dev tapo.DiscoverResponse) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := s.names[dev.Result.DeviceID]; n != "" {
+		return n
+	}
+	return dev.Result.IP.String()
+}
+
+// devices returns the online devices, sorted by name.
+func (s *botState) devices() []botDevice {
+	var ret []botDevice
+	for _, k := range s.scanner.Known() {
+		if k.Offline {
+			continue
+		}
+		bd := botDevice{ip: net.IP(k.Response.Result.IP), name: k.Response.Result.IP.String()}
+		addr, ok := netip.AddrFromSlice(bd.ip)
+		if !ok {
+			continue
+		}
+		plug, err := s.cfg.sessions.Get(addr.Unmap(), tapo.OptionDiscovered(k.Response))
+		if err == nil {
+			bd.dev = plug
+			var info *tapo.DeviceInfo
+			if info, err = plug.GetDeviceInfo(); err == nil {
+				bd.name, bd.on = info.DecodedNickname, info.DeviceON
+				s.mu.Lock()
+				s.names[k.Response.Result.DeviceID] = info.DecodedNickname
+				s.mu.Unlock()
+			}
+		}
+		bd.err = err
+		ret = append(ret, bd)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+// list formats the devices for /list.
+func (s *botState) list() string {
+	devices := s.devices()
+	if len(devices) == 0 {
+		return "No devices found yet"
+	}
+	var b strings.Builder
+	for _, d := range devices {
+		switch {
+		case d.err != nil:
+			fmt.Fprintf(&b, "%s (%s): error: %v\n", d.name, d.ip, d.err)
+		default:
+			fmt.Fprintf(&b, "%s (%s): %s\n", d.name, d.ip, onOff(d.on))
+		}
+	}
+	return b.String()
+}
+
+// set switches the device named ref, an IP address or nickname. toggle
+// inverts its current state, otherwise on is the new state.
+func (s *botState) set(ref string, on, toggle bool) string {
+	if ref == "" {
+		return "Which device? See /help"
+	}
+	for _, bd := range s.devices() {
+		if bd.ip.String() != ref && !strings.EqualFold(bd.name, ref) {
+			continue
+		}
+		if bd.err != nil {
+			return fmt.Sprintf("%s: %v", bd.name, bd.err)
+		}
+		if isProtected(s.cfg, bd.ip, bd.name) {
+			return fmt.Sprintf("%s is protected, switch it with the tapo CLI and --force", bd.name)
+		}
+		if toggle {
+			on = !bd.on
+		}
+		if err := setDeviceState(s.cfg, bd.ip, bd.dev, on); err != nil {
+			return fmt.Sprintf("Failed to turn %s %s: %v", bd.name, onOff(on), err)
+		}
+		return fmt.Sprintf("%s is %s", bd.name, onOff(on))
+	}
+	return fmt.Sprintf("No online device named '%s'", ref)
+}
+
+// handle returns the reply to a command.
+func (s *botState) handle(text string) string {
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(text), " ")
+	// in groups commands can be addressed as /cmd@botname
+	cmd, _, _ = strings.Cut(cmd, "@")
+	arg = strings.TrimSpace(arg)
+	switch cmd {
+	case "/list":
+		return s.list()
+	case "/on":
+		return s.set(arg, true, false)
+	case "/off":
+		return s.set(arg, false, false)
+	case "/toggle":
+		return s.set(arg, false, true)
+	}
+	return telegramHelp
+}
+
+// cmdTelegramBot runs the bot until interrupted. interval is the discovery
+// interval, which bounds how late the offline notifications are.
+func cmdTelegramBot(cfg *cmdCfg, interval time.Duration) error {
+	if cfg.Telegram == nil || cfg.Telegram.Token == "" {
+		return fmt.Errorf("no telegram token in the configuration file")
+	}
+	if len(cfg.Telegram.Chats) == 0 {
+		return fmt.Errorf("no telegram chats in the configuration file")
+	}
+	if cfg.agent != nil || *flagVia != "" {
+		return fmt.Errorf("telegrambot needs local discovery, it does not work with --agent or --via")
+	}
+	token := cfg.Telegram.Token
+	if isEncrypted(token) {
+		key, err := loadKey(*flagKeyFile)
+		if err != nil {
+			return fmt.Errorf("config file has an encrypted telegram token: %w", err)
+		}
+		if token, err = decryptValue(key, token); err != nil {
+			return fmt.Errorf("failed to decrypt telegram token: %w", err)
+		}
+	}
+	bot := telegramBot{token: token, client: http.Client{Timeout: telegramPollTimeout + 10*time.Second}}
+	allowed := make(map[int64]bool, len(cfg.Telegram.Chats))
+	for _, c := range cfg.Telegram.Chats {
+		allowed[c] = true
+	}
+
+	client, err := newClient(cfg)
+	if err != nil {
+		return err
+	}
+	state := botState{
+		cfg:     cfg,
+		scanner: tapo.NewScanner(client, interval),
+		names:   make(map[string]string),
+	}
+	events, unsubscribe := state.scanner.Subscribe()
+	defer unsubscribe()
+	if err := state.scanner.Start(); err != nil {
+		return err
+	}
+	defer state.scanner.Stop()
+	notify := func(ip, msg string) {
+		log.Print(msg)
+		alert := hookEvent{Event: hookAlert, IP: ip, Message: msg}
+		if err := runHooks(cfg, alert); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		for _, c := range cfg.Telegram.Chats {
+			bot.send(cfg.ctx, c, msg)
+		}
+	}
+	go func() {
+		// devices found by the first scan are not news
+		scanned := false
+		for ev := range events {
+			var msg string
+			switch ev.Type {
+			case tapo.ScanCompleted:
+				if !scanned {
+					scanned = true
+					// learn the nicknames, for the offline notifications
+					state.devices()
+				}
+			case tapo.DeviceLost:
+				msg = fmt.Sprintf("%s (%s) is offline", state.name(ev.Device), ev.Device.Result.IP)
+			case tapo.DeviceFound:
+				if scanned {
+					msg = fmt.Sprintf("%s (%s) is back online", state.name(ev.Device), ev.Device.Result.IP)
+				}
+			}
+			if msg == "" {
+				continue
+			}
+			if inMaintenance(cfg, net.IP(ev.Device.Result.IP), state.name(ev.Device)) {
+				log.Printf("Not notifying, the device is in maintenance: %s", msg)
+				continue
+			}
+			notify(ev.Device.Result.IP.String(), msg)
+		}
+	}()
+	if len(cfg.Budgets) > 0 {
+		go func() {
+			var tracker budgetTracker
+			for {
+				for _, msg := range tracker.check(cfg) {
+					notify("", msg)
+				}
+				select {
+				case <-cfg.ctx.Done():
+					return
+				case <-time.After(budgetCheckInterval):
+				}
+			}
+		}()
+	}
+
+	log.Printf("Telegram bot running for %d chats", len(cfg.Telegram.Chats))
+	var offset int64
+	for cfg.ctx.Err() == nil {
+		var updates []telegramUpdate
+		params := map[string]interface{}{"offset": offset, "timeout": int(telegramPollTimeout / time.Second)}
+		if err := bot.call(cfg.ctx, "getUpdates", params, &updates); err != nil {
+			if cfg.ctx.Err() != nil {
+				break
+			}
+			log.Printf("Warning: %v", err)
+			select {
+			case <-cfg.ctx.Done():
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message == nil || u.Message.Text == "" {
+				continue
+			}
+			chat := u.Message.Chat.ID
+			if !allowed[chat] {
+				log.Printf("Ignoring message from unauthorized Telegram chat %d", chat)
+				bot.send(cfg.ctx, chat, fmt.Sprintf("This chat is not authorized. Add %d to the telegram chats of the configuration file to use it.", chat))
+				continue
+			}
+			bot.send(cfg.ctx, chat, state.handle(u.Message.Text))
+		}
+	}
+	return nil
+}
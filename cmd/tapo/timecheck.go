@@ -0,0 +1,146 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// clockCheck is a row of the timecheck report.
+type clockCheck struct {
+	ip     net.IP
+	region string
+	// drift is the device clock minus the host clock.
+	drift time.Duration
+	// timeDiff is the UTC offset reported by the device, wantDiff the
+	// current offset of its region, both in minutes.
+	timeDiff, wantDiff int
+	fixed              bool
+	err                error
+}
+
+func (c *clockCheck) needsFix(maxDrift time.Duration) bool {
+	return c.drift > maxDrift || c.drift < -maxDrift || c.timeDiff != c.wantDiff
+}
+
+// timeSetter is implemented by the devices whose clock can be set. Devices
+// reached through an agent cannot.
+type timeSetter interface {
+	SetDeviceTime(*tapo.DeviceTime) error
+}
+
+// cmdTimecheck compares the clock of the devices of a group, or of a single
+// device if group is empty, against the host clock, and reports the drift and
+// wrong UTC offsets, which break the firmware schedules. With fix, the devices
+// drifting by more than maxDrift or with a wrong offset are set to the host
+// time, in the time zone they already have.
+func cmdTimecheck(cfg *cmdCfg, ip net.IP, group string, maxDrift time.Duration, fix bool) error {
+	if fix && cfg.agent != nil {
+		return fmt.Errorf("--fix is not supported with --agent")
+	}
+	ips := []net.IP{ip}
+	if group != "" {
+		var err error
+		ips, err = resolveGroup(cfg, group)
+		if err != nil {
+			return err
+		}
+		if len(ips) == 0 {
+			return fmt.Errorf("no devices in group '%s'", group)
+		}
+	}
+	checks := make([]clockCheck, len(ips))
+	runner := fleetRunner{cfg: cfg}
+	results := runner.runParallel(ips, groupInfoWorkers, func(idx int, d device) error {
+		c := &checks[idx]
+		before := time.Now()
+		dt, err := d.GetDeviceTime()
+		if err != nil {
+			return fmt.Errorf("failed to get device time: %w", err)
+		}
+		// assume the device read its clock halfway through the request
+		host := before.Add(time.Since(before) / 2)
+		c.region = dt.Region
+		c.drift = time.Unix(dt.Timestamp, 0).Sub(host.Truncate(time.Second))
+		c.timeDiff = dt.TimeDiff
+		loc := dt.Location()
+		_, offset := host.In(loc).Zone()
+		c.wantDiff = offset / 60
+		if !fix || !c.needsFix(maxDrift) {
+			return nil
+		}
+		setter, ok := d.(timeSetter)
+		if !ok {
+			return fmt.Errorf("device does not support setting the time")
+		}
+		if err := setter.SetDeviceTime(tapo.NewDeviceTime(time.Now(), loc)); err != nil {
+			return fmt.Errorf("failed to set device time: %w", err)
+		}
+		c.fixed = true
+		return nil
+	})
+	for idx, r := range results {
+		checks[idx].ip = r.ip
+		checks[idx].err = r.err
+	}
+	bad := printClockChecks(checks[:len(results)], maxDrift)
+	if len(results) < len(ips) {
+		return fmt.Errorf("%d of %d devices not checked: %w", len(ips)-len(results), len(ips), interrupted(cfg))
+	}
+	if bad > 0 {
+		if fix {
+			return fmt.Errorf("%d of %d devices could not be fixed", bad, len(results))
+		}
+		return fmt.Errorf("%d of %d devices have a wrong clock, use --fix to sync them", bad, len(results))
+	}
+	return nil
+}
+
+// printClockChecks prints the clock of each device, largest drift first, and
+// returns the number of devices that failed or still have a wrong clock.
+func printClockChecks(checks []clockCheck, maxDrift time.Duration) int {
+	abs := func(d time.Duration) time.Duration {
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+	sort.SliceStable(checks, func(i, j int) bool {
+		if (checks[i].err != nil) != (checks[j].err != nil) {
+			return checks[i].err != nil
+		}
+		return abs(checks[i].drift) > abs(checks[j].drift)
+	})
+	bad := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "IP\tREGION\tDRIFT\tUTC OFFSET\t\n")
+	for _, c := range checks {
+		if c.err != nil {
+			bad++
+			fmt.Fprintf(w, "%s\t-\t-\t-\tFAILED: %v\n", c.ip, c.err)
+			continue
+		}
+		note := ""
+		switch {
+		case c.fixed:
+			note = "fixed"
+		case c.needsFix(maxDrift):
+			bad++
+			if c.timeDiff != c.wantDiff {
+				note = fmt.Sprintf("wrong offset, want %+d min", c.wantDiff)
+			} else {
+				note = "drifted"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%+ds\t%+d min\t%s\n", c.ip, c.region, int64(c.drift/time.Second), c.timeDiff, note)
+	}
+	w.Flush()
+	return bad
+}
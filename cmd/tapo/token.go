@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !lite
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/insomniacslk/tapo/internal/apitoken"
+)
+
+// cmdTokenCreate creates an API token and prints its secret. args are the
+// token name, its scope, and optionally the devices it is restricted to.
+func cmdTokenCreate(tokensFile string, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: token-create <name> <read|control> [device IP, MAC or ID...]")
+	}
+	scope, err := apitoken.ParseScope(args[1])
+	if err != nil {
+		return err
+	}
+	tokens, err := apitoken.Load(tokensFile)
+	if err != nil {
+		return err
+	}
+	secret, err := tokens.Create(args[0], scope, args[2:])
+	if err != nil {
+		return err
+	}
+	fmt.Println(secret)
+	return nil
+}
+
+// cmdTokenList prints the API tokens. Secrets are not stored, so they cannot
+// be printed.
+func cmdTokenList(tokensFile string) error {
+	tokens, err := apitoken.Load(tokensFile)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens.List() {
+		devices := "all devices"
+		if len(t.Devices) > 0 {
+			devices = strings.Join(t.Devices, ", ")
+		}
+		fmt.Printf("%-20s %-8s %s\n", t.Name, t.Scope, devices)
+	}
+	return nil
+}
+
+// cmdTokenRevoke removes an API token.
+func cmdTokenRevoke(tokensFile string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: token-revoke <name>")
+	}
+	tokens, err := apitoken.Load(tokensFile)
+	if err != nil {
+		return err
+	}
+	if err := tokens.Revoke(args[0]); err != nil {
+		return fmt.Errorf("failed to revoke '%s': %w", args[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// undoRecord is the state of the devices before the last group operation,
+// stored in the undo file so that `tapo undo` can restore it.
+type undoRecord struct {
+	Time    time.Time   `json:"time"`
+	Command string      `json:"command"`
+	Devices []undoState `json:"devices"`
+}
+
+// undoState is the state of a device before it was changed.
+type undoState struct {
+	IP net.IP `json:"ip"`
+	On bool   `json:"on"`
+}
+
+// loadUndo reads the undo record from path. A missing file returns a nil
+// record.
+func loadUndo(path string) (*undoRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read undo file: %w", err)
+	}
+	var rec undoRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("invalid undo file '%s': %w", path, err)
+	}
+	return &rec, nil
+}
+
+// recordUndo saves the state of the devices changed by a group operation. An
+// operation that changed nothing, e.g. because the devices were already in the
+// requested state or were rolled back, keeps the undo file, so that the
+// previous change can still be undone.
+func recordUndo(path string, rec *undoRecord) error {
+	if len(rec.Devices) == 0 {
+		return nil
+	}
+	return saveUndo(path, rec)
+}
+
+// saveUndo writes the undo record atomically, or removes the file if there is
+// nothing left to undo, i.e. once undo restored all the devices.
+func saveUndo(path string, rec *undoRecord) error {
+	if rec == nil || len(rec.Devices) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("JSON marshal failed: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// restoreStates sets the devices back to their recorded state, and returns
+// the states that could not be restored.
+func restoreStates(cfg *cmdCfg, states []undoState, stagger time.Duration) ([]undoState, error) {
+	ips := make([]net.IP, len(states))
+	for idx, s := range states {
+		ips[idx] = s.IP
+	}
+	runner := fleetRunner{cfg: cfg, stagger: stagger}
+	results := runner.run(ips, func(idx int, d device) error {
+		return setDeviceState(cfg, states[idx].IP, d, states[idx].On)
+	})
+	var left []undoState
+	for idx, r := range results {
+		if r.err != nil {
+			left = append(left, states[idx])
+		}
+	}
+	// devices not reached before an interruption are still to be restored
+	left = append(left, states[len(results):]...)
+	err := printFleetResults(results)
+	if err == nil && len(results) < len(states) {
+		err = fmt.Errorf("%d of %d devices not restored: %w", len(states)-len(results), len(states), interrupted(cfg))
+	}
+	return left, err
+}
+
+// cmdUndo restores the state of the devices before the last group operation.
+// Devices that cannot be restored are kept in the undo file, so that undo can
+// be retried.
+func cmdUndo(cfg *cmdCfg, undoFile string, stagger time.Duration) error {
+	rec, err := loadUndo(undoFile)
+	if err != nil {
+		return err
+	}
+	if rec == nil || len(rec.Devices) == 0 {
+		return errors.New("nothing to undo")
+	}
+	fmt.Printf("Undoing '%s' of %s on %d devices\n", rec.Command, rec.Time.Format(time.DateTime), len(rec.Devices))
+	left, err := restoreStates(cfg, rec.Devices, stagger)
+	rec.Devices = left
+	if serr := saveUndo(undoFile, rec); serr != nil {
+		return fmt.Errorf("failed to update undo file: %w", serr)
+	}
+	return err
+}
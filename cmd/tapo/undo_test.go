@@ -0,0 +1,48 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordUndo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tapo", "undo.json")
+	first := undoRecord{
+		Time:    time.Date(2024, 4, 1, 20, 0, 0, 0, time.UTC),
+		Command: "off --group porch",
+		Devices: []undoState{{IP: net.ParseIP("192.0.2.1"), On: true}},
+	}
+	if err := recordUndo(path, &first); err != nil {
+		t.Fatalf("recordUndo failed: %v", err)
+	}
+
+	// a group operation that changed nothing keeps the previous record
+	noop := undoRecord{Time: time.Now(), Command: "off --group porch"}
+	if err := recordUndo(path, &noop); err != nil {
+		t.Fatalf("recordUndo of no changes failed: %v", err)
+	}
+	rec, err := loadUndo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec == nil || rec.Command != first.Command || len(rec.Devices) != 1 || !rec.Devices[0].IP.Equal(first.Devices[0].IP) {
+		t.Fatalf("undo record = %+v, want %+v", rec, first)
+	}
+
+	// the file is removed once undo restored all the devices
+	rec.Devices = nil
+	if err := saveUndo(path, rec); err != nil {
+		t.Fatalf("saveUndo failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("undo file not removed after a complete undo: %v", err)
+	}
+	if rec, err := loadUndo(path); rec != nil || err != nil {
+		t.Errorf("loadUndo of a missing file = %+v, %v", rec, err)
+	}
+}
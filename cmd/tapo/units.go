@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// numberLocale is how numbers are written in a locale.
+type numberLocale struct {
+	decimal string
+	// group separates the thousands, it is empty if digits are not grouped.
+	group string
+}
+
+var (
+	localeDot   = numberLocale{decimal: ".", group: ","}
+	localeComma = numberLocale{decimal: ",", group: "."}
+	// U+00A0 no-break space, so that numbers do not wrap.
+	localeSpace = numberLocale{decimal: ",", group: " "}
+	localeSwiss = numberLocale{decimal: ".", group: "'"}
+	localeC     = numberLocale{decimal: "."}
+)
+
+// numberLocales maps languages to their number format. Languages not listed
+// here use localeDot.
+var numberLocales = map[string]numberLocale{
+	"da": localeComma, "de": localeComma, "el": localeComma, "es": localeComma,
+	"id": localeComma, "it": localeComma, "nl": localeComma, "pt": localeComma,
+	"ro": localeComma, "tr": localeComma,
+	"bg": localeSpace, "cs": localeSpace, "fi": localeSpace, "fr": localeSpace,
+	"hu": localeSpace, "nb": localeSpace, "no": localeSpace, "pl": localeSpace,
+	"ru": localeSpace, "sk": localeSpace, "sv": localeSpace, "uk": localeSpace,
+}
+
+// parseLocale returns the number format of a POSIX locale name, e.g.
+// de_DE.UTF-8.
+func parseLocale(name string) numberLocale {
+	if i := strings.IndexAny(name, ".@"); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" || name == "C" || name == "POSIX" {
+		return localeC
+	}
+	lang, region, _ := strings.Cut(name, "_")
+	lang = strings.ToLower(lang)
+	if region == "CH" || region == "LI" {
+		return localeSwiss
+	}
+	if l, ok := numberLocales[lang]; ok {
+		return l
+	}
+	return localeDot
+}
+
+// envLocale returns the locale that applies to numbers according to the
+// environment, like setlocale(LC_NUMERIC, "").
+func envLocale() string {
+	for _, v := range []string{"LC_ALL", "LC_NUMERIC", "LANG"} {
+		if l := os.Getenv(v); l != "" {
+			return l
+		}
+	}
+	return ""
+}
+
+// format formats v with the given number of decimals.
+func (l numberLocale) format(v float64, decimals int) string {
+	s := strconv.FormatFloat(math.Abs(v), 'f', decimals, 64)
+	intPart, frac, _ := strings.Cut(s, ".")
+	if l.group != "" && len(intPart) > 3 {
+		var b strings.Builder
+		head := len(intPart) % 3
+		if head > 0 {
+			b.WriteString(intPart[:head])
+		}
+		for i := head; i < len(intPart); i += 3 {
+			if b.Len() > 0 {
+				b.WriteString(l.group)
+			}
+			b.WriteString(intPart[i : i+3])
+		}
+		intPart = b.String()
+	}
+	if v < 0 && strings.Trim(s, "0.") != "" {
+		intPart = "-" + intPart
+	}
+	if frac == "" {
+		return intPart
+	}
+	return intPart + l.decimal + frac
+}
+
+// units formats the values reported by the devices in the units chosen with
+// --units.
+type units struct {
+	kWh    bool
+	hours  bool
+	locale numberLocale
+	// tr translates the names of the time units.
+	tr translator
+}
+
+// parseUnits parses the --units flag, a list of energy and time units.
+func parseUnits(list []string, locale string) (units, error) {
+	u := units{locale: parseLocale(locale)}
+	for _, name := range list {
+		switch strings.ToLower(name) {
+		case "wh":
+			u.kWh = false
+		case "kwh":
+			u.kWh = true
+		case "minutes", "min":
+			u.hours = false
+		case "hours", "h":
+			u.hours = true
+		default:
+			return u, fmt.Errorf("unknown unit '%s', want Wh, kWh, minutes or hours", name)
+		}
+	}
+	return u, nil
+}
+
+// energy formats an energy in Wh.
+func (u units) energy(wh int) string {
+	if u.kWh {
+		return u.locale.format(float64(wh)/1000, 3) + " kWh"
+	}
+	return u.locale.format(float64(wh), 0) + " Wh"
+}
+
+// duration formats a duration in minutes.
+func (u units) duration(minutes int) string {
+	if u.hours {
+		return u.locale.format(float64(minutes)/60, 2) + " " + u.tr.T("hours")
+	}
+	return u.locale.format(float64(minutes), 0) + " " + u.tr.T("minutes")
+}
+
+// power formats a power in mW, as reported by energy-monitoring devices.
+func (u units) power(mW int) string {
+	return u.locale.format(float64(mW)/1000, 1) + " W"
+}
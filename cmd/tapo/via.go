@@ -0,0 +1,146 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// sshTunnel is an `ssh -D` dynamic port forward to a jump host, exposed
+// locally as a SOCKS5 proxy.
+type sshTunnel struct {
+	target string
+	port   int
+	cmd    *exec.Cmd
+}
+
+// freePort returns a TCP port on localhost that is currently unused.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// checkSSHTarget rejects the --via targets that ssh would parse as options,
+// e.g. -oProxyCommand=..., which runs arbitrary commands.
+func checkSSHTarget(target string) error {
+	if target == "" || strings.HasPrefix(target, "-") {
+		return fmt.Errorf("invalid SSH target '%s', must be [user@]host", target)
+	}
+	return nil
+}
+
+// startSSHTunnel starts an SSH dynamic port forward to the given user@host,
+// and waits until the local SOCKS5 port accepts connections.
+func startSSHTunnel(target string) (*sshTunnel, error) {
+	if err := checkSSHTarget(target); err != nil {
+		return nil, err
+	}
+	port, err := freePort()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find a free local port: %w", err)
+	}
+	cmd := exec.Command("ssh", "-N",
+		"-o", "ExitOnForwardFailure=yes",
+		"-D", "127.0.0.1:"+strconv.Itoa(port),
+		"--", target,
+	)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ssh: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		select {
+		case err := <-exited:
+			return nil, fmt.Errorf("ssh exited before the tunnel was ready: %v", err)
+		default:
+		}
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			_ = cmd.Process.Kill()
+			return nil, fmt.Errorf("timed out waiting for the ssh tunnel on %s", addr)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return &sshTunnel{target: target, port: port, cmd: cmd}, nil
+}
+
+// ProxyURL returns the SOCKS5 proxy URL of the tunnel.
+func (t *sshTunnel) ProxyURL() string {
+	return fmt.Sprintf("socks5://127.0.0.1:%d", t.port)
+}
+
+// Close terminates the tunnel.
+func (t *sshTunnel) Close() {
+	if t.cmd.Process != nil {
+		_ = t.cmd.Process.Kill()
+	}
+}
+
+// remoteDiscover runs the discovery on the jump host, since broadcast UDP
+// cannot be forwarded through the tunnel. It requires the tapo CLI to be
+// installed on the remote host.
+func remoteDiscover(target, remoteCommand string) (map[string]tapo.DiscoverResponse, []tapo.DiscoverResponse, error) {
+	if err := checkSSHTarget(target); err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.Command("ssh", "--", target, remoteCommand, "agent-discover")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("remote discovery on '%s' failed: %w", target, err)
+	}
+	var result agentDiscoverResult
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode remote discovery result: %w", err)
+	}
+	return result.Devices, result.Failed, nil
+}
+
+// agentDiscoverResult is the output of the agent-discover command.
+type agentDiscoverResult struct {
+	Devices map[string]tapo.DiscoverResponse `json:"devices"`
+	Failed  []tapo.DiscoverResponse          `json:"failed"`
+}
+
+// cmdAgentDiscover runs a local discovery and prints the result as JSON on
+// stdout. It is the remote side of --via.
+func cmdAgentDiscover(cfg *cmdCfg) error {
+	client, err := newClient(cfg)
+	if err != nil {
+		return err
+	}
+	devices, failed, err := client.DiscoverContext(cfg.ctx)
+	if err != nil {
+		if len(devices) == 0 && len(failed) == 0 {
+			return err
+		}
+		// stdout is parsed by the caller, warnings go to stderr.
+		log.Printf("Warning: %v", err)
+	}
+	return json.NewEncoder(os.Stdout).Encode(agentDiscoverResult{Devices: devices, Failed: failed})
+}
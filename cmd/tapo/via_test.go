@@ -0,0 +1,20 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import "testing"
+
+func TestCheckSSHTarget(t *testing.T) {
+	for target, valid := range map[string]bool{
+		"pi@192.168.1.2":              true,
+		"jumphost":                    true,
+		"user@host-name":              true,
+		"":                            false,
+		"-oProxyCommand=touch /tmp/x": false,
+		"-F/tmp/config":               false,
+	} {
+		if err := checkSSHTarget(target); (err == nil) != valid {
+			t.Errorf("checkSSHTarget(%q) = %v, want valid %v", target, err, valid)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !lite
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// rssiPoor is the signal strength below which a device is reported as poorly
+// placed. Below about -70 dBm plugs start dropping requests.
+const rssiPoor = -70
+
+// rssiStats accumulates the RSSI samples of a device.
+type rssiStats struct {
+	ip       net.IP
+	name     string
+	samples  int
+	failures int
+	sum      int
+	min, max int
+}
+
+func (s *rssiStats) add(rssi int) {
+	if s.samples == 0 || rssi < s.min {
+		s.min = rssi
+	}
+	if s.samples == 0 || rssi > s.max {
+		s.max = rssi
+	}
+	s.sum += rssi
+	s.samples++
+}
+
+func (s *rssiStats) avg() float64 {
+	if s.samples == 0 {
+		return 0
+	}
+	return float64(s.sum) / float64(s.samples)
+}
+
+// cmdWifi runs the wifi subcommands.
+func cmdWifi(cfg *cmdCfg, args []string, group string, duration, interval time.Duration) error {
+	if len(args) != 1 || args[0] != "survey" {
+		return fmt.Errorf("usage: wifi survey")
+	}
+	if group == "" {
+		group = groupAll
+	}
+	return cmdWifiSurvey(cfg, group, duration, interval)
+}
+
+// cmdWifiSurvey samples the RSSI of all the devices of a group every interval
+// for the given duration, and prints the average, minimum and maximum of each
+// device, worst first. It helps finding plugs with a poor Wi-Fi placement.
+func cmdWifiSurvey(cfg *cmdCfg, group string, duration, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("survey interval must be positive")
+	}
+	ips, err := resolveGroup(cfg, group)
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no devices in group '%s'", group)
+	}
+	stats := make([]rssiStats, len(ips))
+	for idx, ip := range ips {
+		stats[idx].ip = ip
+	}
+	rounds := int(duration/interval) + 1
+	log.Printf("Sampling RSSI of %d devices every %s for %s", len(ips), interval, duration)
+	runner := fleetRunner{cfg: cfg}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for round := 0; round < rounds; round++ {
+		if round > 0 {
+			select {
+			case <-cfg.ctx.Done():
+			case <-ticker.C:
+			}
+		}
+		if cfg.ctx.Err() != nil {
+			break
+		}
+		results := runner.runParallel(ips, groupInfoWorkers, func(idx int, d device) error {
+			info, err := d.GetDeviceInfo()
+			if err != nil {
+				return err
+			}
+			// each device is only sampled by one goroutine per round
+			stats[idx].name = info.DecodedNickname
+			stats[idx].add(info.RSSI)
+			return nil
+		})
+		for idx, r := range results {
+			if r.err != nil {
+				stats[idx].failures++
+				cfg.logger.Printf("survey: %s: %v", r.ip, r.err)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "\rRound %d/%d", round+1, rounds)
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	printWifiSurvey(stats)
+	if cfg.ctx.Err() != nil {
+		return fmt.Errorf("survey stopped early: %w", interrupted(cfg))
+	}
+	return nil
+}
+
+// printWifiSurvey prints the RSSI statistics of each device, worst average
+// first.
+func printWifiSurvey(stats []rssiStats) {
+	sort.SliceStable(stats, func(i, j int) bool {
+		if (stats[i].samples == 0) != (stats[j].samples == 0) {
+			return stats[i].samples == 0
+		}
+		return stats[i].avg() < stats[j].avg()
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "IP\tNAME\tAVG\tMIN\tMAX\tSAMPLES\tFAILED\t\n")
+	for _, s := range stats {
+		if s.samples == 0 {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t0\t%d\tunreachable\n", s.ip, s.name, s.failures)
+			continue
+		}
+		note := ""
+		if s.avg() < rssiPoor {
+			note = "poor signal"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.1f dBm\t%d dBm\t%d dBm\t%d\t%d\t%s\n", s.ip, s.name, s.avg(), s.min, s.max, s.samples, s.failures, note)
+	}
+	w.Flush()
+}
@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+)
+
+// harFile is the subset of the HAR format used here. HAR files can be
+// produced by mitmproxy (`mitmdump --set hardump=dump.har`) and by browsers.
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			ServerIPAddress string `json:"serverIPAddress"`
+			Request         struct {
+				Method   string `json:"method"`
+				URL      string `json:"url"`
+				PostData struct {
+					Text     string `json:"text"`
+					Encoding string `json:"encoding"`
+				} `json:"postData"`
+			} `json:"request"`
+			Response struct {
+				Status  int `json:"status"`
+				Content struct {
+					Text     string `json:"text"`
+					Encoding string `json:"encoding"`
+				} `json:"content"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+func harBody(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+// readHAR reads the HTTP exchanges from a HAR file.
+func readHAR(path string) ([]exchange, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("failed to decode HAR file: %w", err)
+	}
+	exchanges := make([]exchange, 0, len(har.Log.Entries))
+	for idx, e := range har.Log.Entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: invalid URL: %w", idx, err)
+		}
+		server, err := netip.ParseAddr(u.Hostname())
+		if err != nil {
+			// fall back to the server address recorded by the tool
+			server, _ = netip.ParseAddr(e.ServerIPAddress)
+		}
+		reqBody, err := harBody(e.Request.PostData.Text, e.Request.PostData.Encoding)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: invalid request body: %w", idx, err)
+		}
+		respBody, err := harBody(e.Response.Content.Text, e.Response.Content.Encoding)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: invalid response body: %w", idx, err)
+		}
+		exchanges = append(exchanges, exchange{
+			server:       server,
+			method:       e.Request.Method,
+			url:          u,
+			requestBody:  reqBody,
+			status:       e.Response.Status,
+			responseBody: respBody,
+		})
+	}
+	return exchanges, nil
+}
@@ -0,0 +1,286 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+// tapodecode decrypts and pretty-prints recorded Tapo traffic, for both the
+// KLAP and the passthrough protocols. It reads classic pcap files (e.g. from
+// `tcpdump -w`) or HAR dumps (e.g. from mitmproxy).
+//
+// KLAP traffic can be decoded with the account credentials, since the session
+// keys are derived from the seeds exchanged in the clear during the handshake.
+// Passthrough traffic requires either the RSA private key used by the client
+// for the handshake, or the session key and IV.
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/tapo"
+	"github.com/spf13/pflag"
+)
+
+var (
+	flagUsername       = pflag.StringP("username", "u", "", "TP-Link username (usually an email), to decode KLAP traffic")
+	flagPassword       = pflag.StringP("password", "p", "", "TP-Link password, to decode KLAP traffic")
+	flagAuthHash       = pflag.String("auth-hash", "", "Hex-encoded KLAP auth hash, alternative to --username and --password")
+	flagRSAKey         = pflag.String("rsa-key", "", "PEM file with the client's RSA private key, to decode passthrough traffic")
+	flagPassthroughKey = pflag.String("passthrough-key", "", "Hex-encoded passthrough session key and IV (32 bytes), to decode passthrough traffic")
+	flagRaw            = pflag.Bool("raw", false, "Print decrypted payloads as they are, instead of indenting JSON")
+)
+
+// exchange is an HTTP request and its response.
+type exchange struct {
+	client       netip.Addr
+	server       netip.Addr
+	method       string
+	url          *url.URL
+	requestBody  []byte
+	status       int
+	responseBody []byte
+}
+
+// decoder holds the per-device protocol state reconstructed from the traffic.
+type decoder struct {
+	authHash       []byte
+	rsaKey         *rsa.PrivateKey
+	passthroughKey []byte
+	klap           map[netip.Addr]*tapo.KlapSession
+	passthrough    map[netip.Addr]*tapo.PassthroughSession
+}
+
+func (d *decoder) print(direction string, payload []byte) {
+	if !*flagRaw {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, payload, "    ", "  "); err == nil {
+			payload = buf.Bytes()
+		}
+	}
+	fmt.Printf("  %s %s\n", direction, payload)
+}
+
+func (d *decoder) decodeKlap(ex exchange) error {
+	switch ex.url.Path {
+	case "/app/handshake1":
+		if len(ex.requestBody) != 16 || len(ex.responseBody) < 16 {
+			return fmt.Errorf("unexpected handshake1 payload sizes")
+		}
+		fmt.Printf("  local seed  %x\n  remote seed %x\n", ex.requestBody, ex.responseBody[:16])
+		if d.authHash == nil {
+			return fmt.Errorf("no credentials specified, cannot decode KLAP session")
+		}
+		s := tapo.NewKlapSession(nil)
+		s.LocalSeed = ex.requestBody
+		s.RemoteSeed = ex.responseBody[:16]
+		s.UserHash = d.authHash
+		d.klap[ex.server] = s
+	case "/app/handshake2":
+		fmt.Printf("  HTTP %d\n", ex.status)
+	case "/app/request":
+		s, ok := d.klap[ex.server]
+		if !ok {
+			return fmt.Errorf("no KLAP handshake seen for %s", ex.server)
+		}
+		seq, err := strconv.ParseInt(ex.url.Query().Get("seq"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid seq: %w", err)
+		}
+		fmt.Printf("  seq %d\n", seq)
+		req, err := s.DecryptSeq(int32(seq), ex.requestBody)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt request: %w", err)
+		}
+		d.print(">>>", req)
+		if ex.status != 200 {
+			fmt.Printf("  HTTP %d\n", ex.status)
+			return nil
+		}
+		resp, err := s.DecryptSeq(int32(seq), ex.responseBody)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt response: %w", err)
+		}
+		d.print("<<<", resp)
+	default:
+		return fmt.Errorf("unknown KLAP path %s", ex.url.Path)
+	}
+	return nil
+}
+
+func (d *decoder) decodePassthrough(ex exchange) error {
+	var msg struct {
+		Method string `json:"method"`
+		Params struct {
+			Request string `json:"request"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(ex.requestBody, &msg); err != nil {
+		return fmt.Errorf("failed to decode request: %w", err)
+	}
+	var resp struct {
+		ErrorCode int `json:"error_code"`
+		Result    struct {
+			Key      string `json:"key"`
+			Response string `json:"response"`
+		} `json:"result"`
+	}
+	if len(ex.responseBody) > 0 {
+		if err := json.Unmarshal(ex.responseBody, &resp); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	switch msg.Method {
+	case "handshake":
+		fmt.Printf("  handshake, error_code %d\n", resp.ErrorCode)
+		var sessionKey []byte
+		switch {
+		case d.rsaKey != nil:
+			encrypted, err := base64.StdEncoding.DecodeString(resp.Result.Key)
+			if err != nil {
+				return fmt.Errorf("failed to base64-decode session key: %w", err)
+			}
+			sessionKey, err = rsa.DecryptPKCS1v15(nil, d.rsaKey, encrypted)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt session key: %w", err)
+			}
+		case d.passthroughKey != nil:
+			sessionKey = d.passthroughKey
+		default:
+			return fmt.Errorf("no RSA key nor passthrough key specified, cannot decode passthrough session")
+		}
+		if len(sessionKey) != 32 {
+			return fmt.Errorf("session key length is not 32 bytes, got %d", len(sessionKey))
+		}
+		s := tapo.NewPassthroughSession(nil)
+		s.Key = sessionKey[:16]
+		s.IV = sessionKey[16:]
+		d.passthrough[ex.server] = s
+	case "securePassthrough":
+		s, ok := d.passthrough[ex.server]
+		if !ok {
+			return fmt.Errorf("no passthrough handshake seen for %s", ex.server)
+		}
+		req, err := s.Decrypt(msg.Params.Request)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt request: %w", err)
+		}
+		d.print(">>>", req)
+		if resp.ErrorCode != 0 {
+			fmt.Printf("  error_code %d\n", resp.ErrorCode)
+			return nil
+		}
+		decrypted, err := s.Decrypt(resp.Result.Response)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt response: %w", err)
+		}
+		d.print("<<<", decrypted)
+	default:
+		d.print(">>>", ex.requestBody)
+		d.print("<<<", ex.responseBody)
+	}
+	return nil
+}
+
+func (d *decoder) decode(ex exchange) {
+	fmt.Printf("%s -> %s %s %s\n", ex.client, ex.server, ex.method, ex.url.RequestURI())
+	var err error
+	switch {
+	case strings.HasPrefix(ex.url.Path, "/app/"):
+		err = d.decodeKlap(ex)
+	case ex.url.Path == "/app":
+		err = d.decodePassthrough(ex)
+	default:
+		fmt.Printf("  not Tapo traffic, skipping\n")
+	}
+	if err != nil {
+		fmt.Printf("  error: %v\n", err)
+	}
+	fmt.Println()
+}
+
+func loadRSAKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA private key")
+	}
+	return rsaKey, nil
+}
+
+func main() {
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags> <file.pcap|file.har>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\n")
+		pflag.PrintDefaults()
+	}
+	pflag.Parse()
+	if pflag.NArg() != 1 {
+		pflag.Usage()
+		os.Exit(2)
+	}
+	d := decoder{
+		klap:        make(map[netip.Addr]*tapo.KlapSession),
+		passthrough: make(map[netip.Addr]*tapo.PassthroughSession),
+	}
+	var err error
+	switch {
+	case *flagAuthHash != "":
+		d.authHash, err = hex.DecodeString(*flagAuthHash)
+		if err != nil {
+			log.Fatalf("Invalid auth hash: %v", err)
+		}
+	case *flagUsername != "" || *flagPassword != "":
+		d.authHash = tapo.KlapAuthHash(*flagUsername, *flagPassword)
+	}
+	if *flagRSAKey != "" {
+		d.rsaKey, err = loadRSAKey(*flagRSAKey)
+		if err != nil {
+			log.Fatalf("Failed to load RSA key: %v", err)
+		}
+	}
+	if *flagPassthroughKey != "" {
+		d.passthroughKey, err = hex.DecodeString(*flagPassthroughKey)
+		if err != nil {
+			log.Fatalf("Invalid passthrough key: %v", err)
+		}
+	}
+
+	path := pflag.Arg(0)
+	var exchanges []exchange
+	if strings.EqualFold(filepath.Ext(path), ".har") {
+		exchanges, err = readHAR(path)
+	} else {
+		exchanges, err = readPcap(path)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read '%s': %v", path, err)
+	}
+	for _, ex := range exchanges {
+		d.decode(ex)
+	}
+}
@@ -0,0 +1,234 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+)
+
+// pcap link types, see https://www.tcpdump.org/linktypes.html
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+)
+
+// flowKey identifies one direction of a TCP connection.
+type flowKey struct {
+	src, dst netip.AddrPort
+}
+
+// segment is a TCP segment payload with its sequence number.
+type segment struct {
+	seq     uint32
+	payload []byte
+}
+
+// readPcap reads a classic libpcap file and returns the HTTP exchanges found in
+// the TCP streams it contains. Only IPv4 is supported, which is what Tapo
+// devices use.
+func readPcap(path string) ([]exchange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %w", err)
+	}
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(hdr[0:4]) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a pcap file (pcapng is not supported, convert it with `editcap -F pcap`)")
+	}
+	linkType := order.Uint32(hdr[20:24]) & 0x0fffffff
+
+	flows := make(map[flowKey][]segment)
+	// order in which connections were first seen, to print exchanges
+	// chronologically.
+	var connOrder []flowKey
+	seen := make(map[flowKey]bool)
+	for {
+		var rec [16]byte
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("failed to read pcap record header: %w", err)
+		}
+		inclLen := order.Uint32(rec[8:12])
+		data := make([]byte, inclLen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("failed to read pcap record: %w", err)
+		}
+		key, seg, ok := parsePacket(linkType, data)
+		if !ok || len(seg.payload) == 0 {
+			continue
+		}
+		flows[key] = append(flows[key], seg)
+		// connections are identified by their client->server direction,
+		// i.e. the first direction that carries data.
+		rev := flowKey{src: key.dst, dst: key.src}
+		if !seen[key] && !seen[rev] {
+			seen[key] = true
+			connOrder = append(connOrder, key)
+		}
+	}
+
+	var exchanges []exchange
+	for _, key := range connOrder {
+		rev := flowKey{src: key.dst, dst: key.src}
+		ex, err := parseHTTPConversation(key.src.Addr(), key.dst.Addr(), reassemble(flows[key]), reassemble(flows[rev]))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping connection %s -> %s: %v\n", key.src, key.dst, err)
+		}
+		exchanges = append(exchanges, ex...)
+	}
+	return exchanges, nil
+}
+
+// parsePacket extracts the TCP payload from a captured packet.
+func parsePacket(linkType uint32, data []byte) (flowKey, segment, bool) {
+	switch linkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return flowKey{}, segment{}, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		if etherType == 0x8100 && len(data) >= 4 {
+			// 802.1Q VLAN tag
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		if etherType != 0x0800 {
+			return flowKey{}, segment{}, false
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 || binary.BigEndian.Uint16(data[14:16]) != 0x0800 {
+			return flowKey{}, segment{}, false
+		}
+		data = data[16:]
+	case linkTypeNull:
+		if len(data) < 4 {
+			return flowKey{}, segment{}, false
+		}
+		data = data[4:]
+	case linkTypeRaw:
+	default:
+		return flowKey{}, segment{}, false
+	}
+	// IPv4
+	if len(data) < 20 || data[0]>>4 != 4 || data[9] != 6 {
+		return flowKey{}, segment{}, false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+	if totalLen > len(data) || ihl > totalLen {
+		return flowKey{}, segment{}, false
+	}
+	src, _ := netip.AddrFromSlice(data[12:16])
+	dst, _ := netip.AddrFromSlice(data[16:20])
+	tcp := data[ihl:totalLen]
+	if len(tcp) < 20 {
+		return flowKey{}, segment{}, false
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset > len(tcp) {
+		return flowKey{}, segment{}, false
+	}
+	key := flowKey{
+		src: netip.AddrPortFrom(src, binary.BigEndian.Uint16(tcp[0:2])),
+		dst: netip.AddrPortFrom(dst, binary.BigEndian.Uint16(tcp[2:4])),
+	}
+	seg := segment{
+		seq:     binary.BigEndian.Uint32(tcp[4:8]),
+		payload: append([]byte(nil), tcp[dataOffset:]...),
+	}
+	return key, seg, true
+}
+
+// reassemble orders the segments by sequence number and concatenates them,
+// dropping retransmissions.
+func reassemble(segs []segment) []byte {
+	if len(segs) == 0 {
+		return nil
+	}
+	base := segs[0].seq
+	sort.SliceStable(segs, func(i, j int) bool {
+		// relative to the first segment, to handle wrap-around
+		return segs[i].seq-base < segs[j].seq-base
+	})
+	var buf bytes.Buffer
+	next := segs[0].seq
+	for _, s := range segs {
+		payload := s.payload
+		if diff := int32(s.seq - next); diff < 0 {
+			// overlaps with data we already have
+			overlap := int(-diff)
+			if overlap >= len(payload) {
+				continue
+			}
+			payload = payload[overlap:]
+		} else if diff > 0 {
+			// missing data, nothing we can do
+			fmt.Fprintf(os.Stderr, "Warning: %d bytes missing from TCP stream\n", diff)
+		}
+		buf.Write(payload)
+		next = s.seq + uint32(len(s.payload))
+	}
+	return buf.Bytes()
+}
+
+// parseHTTPConversation pairs the HTTP requests and responses of a TCP
+// connection.
+func parseHTTPConversation(client, server netip.Addr, clientData, serverData []byte) ([]exchange, error) {
+	var exchanges []exchange
+	reqReader := bufio.NewReader(bytes.NewReader(clientData))
+	respReader := bufio.NewReader(bytes.NewReader(serverData))
+	for {
+		req, err := http.ReadRequest(reqReader)
+		if err != nil {
+			if err == io.EOF {
+				return exchanges, nil
+			}
+			return exchanges, fmt.Errorf("failed to parse HTTP request: %w", err)
+		}
+		reqBody, err := io.ReadAll(req.Body)
+		if err != nil {
+			return exchanges, fmt.Errorf("failed to read HTTP request body: %w", err)
+		}
+		ex := exchange{
+			client:      client,
+			server:      server,
+			method:      req.Method,
+			url:         req.URL,
+			requestBody: reqBody,
+		}
+		resp, err := http.ReadResponse(respReader, req)
+		if err == nil {
+			ex.status = resp.StatusCode
+			ex.responseBody, err = io.ReadAll(resp.Body)
+			if err != nil {
+				return exchanges, fmt.Errorf("failed to read HTTP response body: %w", err)
+			}
+		}
+		exchanges = append(exchanges, ex)
+	}
+}
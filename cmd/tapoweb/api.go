@@ -0,0 +1,264 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+// The REST API exposes the device list as JSON, for scripts and dashboards
+// that poll it frequently.
+//
+//   GET /api/devices?offset=N&limit=N&fields=name,state,power
+//   GET /api/devices.csv    the device table, for spreadsheets
+//   GET /api/openapi.json   OpenAPI document of the API
+//
+// The list is served from the result of the latest background discovery, and
+// carries an ETag: clients sending it back in If-None-Match get an empty 304
+// response until something changes.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// apiFields are the fields of a device returned by the API, in the order they
+// are documented.
+var apiFields = []string{"id", "name", "icon", "order", "model", "ip", "mac", "online", "last_seen", "state", "status", "power", "energy_today", "energy_month"}
+
+// apiError is the JSON body returned by the API on failure.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiDeviceList is the response of /api/devices.
+type apiDeviceList struct {
+	Total   int                      `json:"total"`
+	Offset  int                      `json:"offset"`
+	Limit   int                      `json:"limit"`
+	Devices []map[string]interface{} `json:"devices"`
+}
+
+func writeAPIError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(apiError{Error: fmt.Sprintf(format, args...)}); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// apiDevice returns all the API fields of a device. Energy values are in Wh and
+// power in W, and are omitted for devices without energy monitoring. The state
+// and energy of offline devices are the last known ones, status combines the
+// state and whether the device is online.
+func apiDevice(d Device, custom Customization) map[string]interface{} {
+	state := onOff(d.info.DeviceON)
+	status := state
+	if d.offline {
+		status = "offline"
+	}
+	name := d.info.DecodedNickname
+	if custom.Label != "" {
+		name = custom.Label
+	}
+	ret := map[string]interface{}{
+		"id":        d.info.DeviceID,
+		"name":      name,
+		"icon":      custom.Icon,
+		"order":     custom.Order,
+		"model":     d.info.Model,
+		"ip":        d.info.IP,
+		"mac":       d.info.MAC,
+		"state":     state,
+		"status":    status,
+		"online":    !d.offline,
+		"last_seen": d.lastSeen.UTC().Format(time.RFC3339),
+	}
+	if d.energy != nil {
+		ret["power"] = float64(d.energy.CurrentPower) / 1000
+		ret["energy_today"] = d.energy.TodayEnergy
+		ret["energy_month"] = d.energy.MonthEnergy
+	}
+	return ret
+}
+
+// parseFields validates a comma-separated list of field names. An empty list
+// selects all the fields.
+func parseFields(s string) ([]string, error) {
+	if s == "" {
+		return apiFields, nil
+	}
+	var fields []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		found := false
+		for _, known := range apiFields {
+			if f == known {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown field '%s', valid fields are %s", f, strings.Join(apiFields, ","))
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// parseIntParam parses a non-negative integer query parameter, returning def
+// if it is not set.
+func parseIntParam(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid %s '%s'", name, s)
+	}
+	return v, nil
+}
+
+// etagMatches reports whether the If-None-Match header of a request matches
+// the given entity tag.
+func etagMatches(r *http.Request, etag string) bool {
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// apiDevices returns the API fields of the devices the request has access to,
+// in the same order as the web page.
+func apiDevices(r *http.Request, list *deviceList, st *store) []map[string]interface{} {
+	devices, _ := list.get()
+	devices = allowedDevices(requestToken(r), devices)
+	all := make([]map[string]interface{}, 0, len(devices))
+	for _, d := range devices {
+		all = append(all, apiDevice(d, st.Get(d.info.DeviceID)))
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i]["order"] != all[j]["order"] {
+			return all[i]["order"].(int) < all[j]["order"].(int)
+		}
+		return all[i]["name"].(string) < all[j]["name"].(string)
+	})
+	return all
+}
+
+func getAPIDevicesHandler(list *deviceList, st *store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		offset, err := parseIntParam(r, "offset", 0)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		limit, err := parseIntParam(r, "limit", apiDefaultLimit)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if limit == 0 || limit > apiMaxLimit {
+			writeAPIError(w, http.StatusBadRequest, "limit must be between 1 and %d", apiMaxLimit)
+			return
+		}
+		fields, err := parseFields(r.URL.Query().Get("fields"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+
+		all := apiDevices(r, list, st)
+		resp := apiDeviceList{
+			Total:   len(all),
+			Offset:  offset,
+			Limit:   limit,
+			Devices: make([]map[string]interface{}, 0, limit),
+		}
+		for idx := offset; idx < len(all) && idx < offset+limit; idx++ {
+			dev := make(map[string]interface{}, len(fields))
+			for _, f := range fields {
+				if v, ok := all[idx][f]; ok {
+					dev[f] = v
+				}
+			}
+			resp.Devices = append(resp.Devices, dev)
+		}
+
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(resp); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "failed to encode response: %v", err)
+			return
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		w.Header().Set("ETag", etag)
+		// clients may keep the response, but must revalidate it every time.
+		w.Header().Set("Cache-Control", "no-cache")
+		if etagMatches(r, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			log.Printf("Failed to write response: %v", err)
+		}
+	}
+}
+
+// csvFields are the columns of /api/devices.csv. Energy is in Wh, and empty
+// for devices without energy monitoring.
+var csvFields = []string{"name", "ip", "mac", "state", "energy_today", "energy_month"}
+
+func getAPIDevicesCSVHandler(list *deviceList, st *store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var buf bytes.Buffer
+		cw := csv.NewWriter(&buf)
+		_ = cw.Write(csvFields)
+		row := make([]string, len(csvFields))
+		for _, dev := range apiDevices(r, list, st) {
+			for idx, f := range csvFields {
+				row[idx] = ""
+				if v, ok := dev[f]; ok {
+					row[idx] = fmt.Sprint(v)
+				}
+			}
+			_ = cw.Write(row)
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "failed to encode CSV: %v", err)
+			return
+		}
+		filename := "tapo-devices-" + time.Now().Format("2006-01-02") + ".csv"
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			log.Printf("Failed to write response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/insomniacslk/tapo/internal/apitoken"
+)
+
+const (
+	// tokenCookie is the cookie storing the API token of a browser, so that
+	// a wall-mounted tablet only has to open the page with ?token=... once.
+	tokenCookie = "tapoweb_token"
+	// sessionCookie is the cookie storing the session ID of a logged-in
+	// user.
+	sessionCookie = "tapoweb_session"
+)
+
+//go:embed login.html
+var loginHTML string
+
+var loginTemplate = template.Must(template.New("login").Parse(loginHTML))
+
+// fullAccess is the token used when neither API tokens nor users are
+// configured.
+var fullAccess = &apitoken.Token{Name: "anonymous", Scope: apitoken.ScopeControl}
+
+type tokenKey struct{}
+
+type userKey struct{}
+
+// requestToken returns the token that authenticated a request. Logged-in users
+// get a token with the scope of their role.
+func requestToken(r *http.Request) *apitoken.Token {
+	if tok, ok := r.Context().Value(tokenKey{}).(*apitoken.Token); ok {
+		return tok
+	}
+	return fullAccess
+}
+
+// requestUser returns the name of the logged-in user, or an empty string for
+// requests authenticated with a token.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// allowedDevices returns the devices a token has access to.
+func allowedDevices(tok *apitoken.Token, devices []Device) []Device {
+	ret := make([]Device, 0, len(devices))
+	for _, d := range devices {
+		if tok.AllowsDevice(d.info.IP, d.info.MAC, d.info.DeviceID) {
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+// authenticator authenticates requests with API tokens or user sessions.
+type authenticator struct {
+	tokens   *apitoken.Set
+	users    *userStore
+	sessions *sessionStore
+	// path is the URL path of the root of tapoweb, used for cookies and
+	// redirects.
+	path string
+}
+
+// enabled reports whether requests must be authenticated.
+func (a *authenticator) enabled() bool {
+	return !a.tokens.Empty() || !a.users.Empty()
+}
+
+func (a *authenticator) setCookie(w http.ResponseWriter, name, value string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     a.path,
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		// commands are GET requests, Strict prevents other sites from
+		// triggering them.
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// withAuth requires a valid API token or a logged-in user to call h, unless
+// authentication is disabled. The token is read from the Authorization
+// header, from the token cookie, or from the token query parameter, which sets
+// the cookie.
+func (a *authenticator) withAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled() {
+			h(w, r)
+			return
+		}
+		if secret := r.URL.Query().Get("token"); secret != "" {
+			if a.tokens.Lookup(secret) == nil {
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+			a.setCookie(w, tokenCookie, secret, 10*365*24*time.Hour)
+			// drop the token from the URL, so it does not end up in
+			// bookmarks and history.
+			q := r.URL.Query()
+			q.Del("token")
+			http.Redirect(w, r, (&url.URL{Path: r.URL.Path, RawQuery: q.Encode()}).String(), http.StatusSeeOther)
+			return
+		}
+		secret := apitoken.FromRequest(r)
+		if secret == "" {
+			if c, err := r.Cookie(tokenCookie); err == nil {
+				secret = c.Value
+			}
+		}
+		if tok := a.tokens.Lookup(secret); tok != nil {
+			h(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, tok)))
+			return
+		}
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			if sess, ok := a.sessions.Get(c.Value); ok {
+				tok := &apitoken.Token{Name: sess.user, Scope: sess.role.scope()}
+				ctx := context.WithValue(r.Context(), tokenKey{}, tok)
+				ctx = context.WithValue(ctx, userKey{}, sess.user)
+				h(w, r.WithContext(ctx))
+				return
+			}
+		}
+		if !a.users.Empty() && r.Method == http.MethodGet && r.URL.Path == a.path && r.URL.RawQuery == "" {
+			// a browser opening the page
+			http.Redirect(w, r, a.path+"login", http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "missing or invalid token, log in or open this page with ?token=<token>", http.StatusUnauthorized)
+	}
+}
+
+// loginHandler shows the login form and logs users in.
+func (a *authenticator) loginHandler(w http.ResponseWriter, r *http.Request) {
+	var loginError string
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "invalid form", http.StatusBadRequest)
+			return
+		}
+		user := a.users.Authenticate(r.PostForm.Get("username"), r.PostForm.Get("password"))
+		if user == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			loginError = "Invalid username or password"
+			break
+		}
+		id, err := a.sessions.Create(user)
+		if err != nil {
+			log.Printf("Failed to create session: %v", err)
+			http.Error(w, "failed to create session", http.StatusInternalServerError)
+			return
+		}
+		a.setCookie(w, sessionCookie, id, sessionTTL)
+		http.Redirect(w, r, a.path, http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := loginTemplate.Execute(w, struct{ Error string }{Error: loginError}); err != nil {
+		log.Printf("Failed to render login page: %v", err)
+	}
+}
+
+// logoutHandler ends the session of a user.
+func (a *authenticator) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		a.sessions.Delete(c.Value)
+	}
+	a.setCookie(w, sessionCookie, "", -time.Second)
+	http.Redirect(w, r, a.path+"login", http.StatusSeeOther)
+}
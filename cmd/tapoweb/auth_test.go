@@ -0,0 +1,173 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/tapo/internal/apitoken"
+)
+
+// newTestAuthenticator returns an authenticator with an admin and a viewer
+// user, whose password is their name.
+func newTestAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+	dir := t.TempDir()
+	users, err := loadUsers(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, role := range []Role{RoleAdmin, RoleViewer} {
+		if err := users.Set(string(role), string(role), role); err != nil {
+			t.Fatalf("Set(%s) failed: %v", role, err)
+		}
+	}
+	tokens, err := apitoken.Load(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authenticator{tokens: tokens, users: users, sessions: newSessionStore(), path: "/"}
+}
+
+// login logs a user in and returns the session cookie.
+func login(t *testing.T, a *authenticator, name, password string) *http.Cookie {
+	t.Helper()
+	form := url.Values{"username": {name}, "password": {password}}
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	a.loginHandler(w, r)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestUsersSet(t *testing.T) {
+	a := newTestAuthenticator(t)
+	if err := a.users.Set("root", "root", Role("root")); err == nil {
+		t.Errorf("Set with an unknown role succeeded")
+	}
+	// replacing a user changes the password and the role
+	if err := a.users.Set("viewer", "new", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if u := a.users.Authenticate("viewer", "viewer"); u != nil {
+		t.Errorf("the old password still works")
+	}
+	if u := a.users.Authenticate("viewer", "new"); u == nil || u.Role != RoleAdmin {
+		t.Errorf("Authenticate() = %+v, want an admin", u)
+	}
+	loaded, err := loadUsers(a.users.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := loaded.Authenticate("viewer", "new"); u == nil {
+		t.Errorf("the users were not saved")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	a := newTestAuthenticator(t)
+	for _, tc := range []struct {
+		name, user, password string
+		wantSession          bool
+	}{
+		{"admin", "admin", "admin", true},
+		{"viewer", "viewer", "viewer", true},
+		{"wrong password", "admin", "viewer", false},
+		{"unknown user", "nobody", "nobody", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if c := login(t, a, tc.user, tc.password); (c != nil) != tc.wantSession {
+				t.Errorf("session cookie = %v, want a session %v", c, tc.wantSession)
+			}
+		})
+	}
+}
+
+// TestRoles checks which commands of the root handler each role can run. The
+// devices do not exist, so the allowed commands fail with 404.
+func TestRoles(t *testing.T) {
+	a := newTestAuthenticator(t)
+	st, err := newStore(filepath.Join(t.TempDir(), "devices.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.withAuth(getRootHandler(&deviceList{}, st, &countdowns{}))
+	control, err := a.tokens.Create("control", apitoken.ScopeControl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := a.tokens.Create("read", apitoken.ScopeRead, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := login(t, a, "admin", "admin")
+	viewer := login(t, a, "viewer", "viewer")
+	if admin == nil || viewer == nil {
+		t.Fatalf("login failed")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		cookie *http.Cookie
+		token  string
+		want   int
+	}{
+		{"admin list", "", admin, "", http.StatusOK},
+		{"admin status", "?cmd=status&ip=192.0.2.1", admin, "", http.StatusNotFound},
+		{"admin on", "?cmd=on&ip=192.0.2.1", admin, "", http.StatusNotFound},
+		{"admin off", "?cmd=off&ip=192.0.2.1", admin, "", http.StatusNotFound},
+		{"viewer list", "", viewer, "", http.StatusOK},
+		{"viewer status", "?cmd=status&ip=192.0.2.1", viewer, "", http.StatusNotFound},
+		{"viewer on", "?cmd=on&ip=192.0.2.1", viewer, "", http.StatusForbidden},
+		{"viewer off", "?cmd=off&ip=192.0.2.1", viewer, "", http.StatusForbidden},
+		{"viewer countdown", "?cmd=countdown&ip=192.0.2.1", viewer, "", http.StatusForbidden},
+		{"viewer customize", "?cmd=customize&id=8022ABCD", viewer, "", http.StatusForbidden},
+		{"control token on", "?cmd=on&ip=192.0.2.1", nil, control, http.StatusNotFound},
+		{"read token on", "?cmd=on&ip=192.0.2.1", nil, read, http.StatusForbidden},
+		{"read token status", "?cmd=status&ip=192.0.2.1", nil, read, http.StatusNotFound},
+		{"invalid session", "?cmd=status&ip=192.0.2.1", &http.Cookie{Name: sessionCookie, Value: "forged"}, "", http.StatusUnauthorized},
+		{"invalid token", "?cmd=status&ip=192.0.2.1", nil, "forged", http.StatusUnauthorized},
+		{"anonymous", "?cmd=status&ip=192.0.2.1", nil, "", http.StatusUnauthorized},
+		{"anonymous page", "", nil, "", http.StatusSeeOther},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/"+tc.query, nil)
+			if tc.cookie != nil {
+				r.AddCookie(tc.cookie)
+			}
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	a := newTestAuthenticator(t)
+	c := login(t, a, "admin", "admin")
+	if c == nil {
+		t.Fatalf("login failed")
+	}
+	r := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	r.AddCookie(c)
+	a.logoutHandler(httptest.NewRecorder(), r)
+	if _, ok := a.sessions.Get(c.Value); ok {
+		t.Errorf("the session is still valid after logout")
+	}
+}
@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// countdownDelays are the delays offered by the page, in seconds.
+var countdownDelays = map[int]bool{15 * 60: true, 60 * 60: true, 4 * 60 * 60: true}
+
+// countdowns tracks the "off in" countdowns started from the page, to show
+// the remaining time. Devices whose firmware has no countdown rules are turned
+// off by a local timer instead, which does not survive a restart of tapoweb.
+type countdowns struct {
+	mu sync.Mutex
+	// m maps device IDs to their countdown.
+	m map[string]*countdown
+}
+
+type countdown struct {
+	deadline time.Time
+	// timer is the local timer, nil if the firmware runs the countdown.
+	timer *time.Timer
+}
+
+// start turns the device off after delay, or cancels its countdown if delay is
+// zero.
+func (c *countdowns) start(d Device, delay time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := d.info.DeviceID
+	if prev := c.m[id]; prev != nil && prev.timer != nil {
+		prev.timer.Stop()
+	}
+	delete(c.m, id)
+	err := d.plug.SetCountdown(delay, false)
+	local := errors.Is(err, tapo.StatusUnknownMethod) || errors.Is(err, tapo.StatusCountdown)
+	if err != nil && !local {
+		return err
+	}
+	if delay == 0 {
+		return nil
+	}
+	cd := countdown{deadline: time.Now().Add(delay)}
+	if local {
+		log.Printf("Device %s has no firmware countdown, using a local timer", d.info.IP)
+		plug, ip := d.plug, d.info.IP
+		cd.timer = time.AfterFunc(delay, func() {
+			if err := plug.SetDeviceInfo(false); err != nil {
+				log.Printf("Warning: countdown failed to turn %s off: %v", ip, err)
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.m[id] != nil && c.m[id].deadline.Equal(cd.deadline) {
+				delete(c.m, id)
+			}
+		})
+	}
+	if c.m == nil {
+		c.m = make(map[string]*countdown)
+	}
+	c.m[id] = &cd
+	return nil
+}
+
+// deadline returns when the countdown of a device expires, or the zero time if
+// there is none.
+func (c *countdowns) deadline(id string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cd := c.m[id]
+	if cd == nil {
+		return time.Time{}
+	}
+	if time.Now().After(cd.deadline) {
+		delete(c.m, id)
+		return time.Time{}
+	}
+	return cd.deadline
+}
+
+// startCountdown handles the countdown command of the page: delay is in
+// seconds, 0 cancels the countdown.
+func startCountdown(r *http.Request, cds *countdowns, devices []Device) (int, string) {
+	ip := r.URL.Query().Get("ip")
+	delay, err := strconv.Atoi(r.URL.Query().Get("delay"))
+	if err != nil || (delay != 0 && !countdownDelays[delay]) {
+		return http.StatusBadRequest, fmt.Sprintf("invalid delay '%s'", r.URL.Query().Get("delay"))
+	}
+	for _, d := range devices {
+		if d.info.IP != ip {
+			continue
+		}
+		if d.offline {
+			return http.StatusGone, fmt.Sprintf("device with IP %s is offline", ip)
+		}
+		if err := cds.start(d, time.Duration(delay)*time.Second); err != nil {
+			return http.StatusInternalServerError, fmt.Sprintf("failed to set countdown: %v", err)
+		}
+		return http.StatusOK, "ok"
+	}
+	return http.StatusNotFound, "404 Not Found"
+}
@@ -0,0 +1,225 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+// Inbound webhooks let external services, like a doorbell or IFTTT, trigger
+// device actions:
+//
+//   POST /hooks/{name}
+//
+// The hooks are defined in the --hooks-file, a JSON object mapping hook names
+// to a secret and a list of actions:
+//
+//   {
+//     "doorbell": {
+//       "secret": "a long random string",
+//       "actions": [
+//         {"device": "Porch light", "state": "on"},
+//         {"device": "192.168.1.20", "state": "toggle"}
+//       ]
+//     }
+//   }
+//
+// Hooks do not use API tokens nor user sessions. Instead, every request must
+// carry the current Unix time in the X-Tapo-Timestamp header, and the
+// hex-encoded HMAC-SHA256 of "<timestamp>.<body>" keyed with the secret in the
+// X-Tapo-Signature header, as "sha256=<hmac>". The body itself is not used.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// hookMaxSkew is how far the timestamp of a hook request can be from the
+	// local clock, which limits replays of a captured request.
+	hookMaxSkew = 5 * time.Minute
+	// hookMaxBody is the maximum size of the body of a hook request.
+	hookMaxBody = 64 << 10
+
+	hookTimestampHeader = "X-Tapo-Timestamp"
+	hookSignatureHeader = "X-Tapo-Signature"
+)
+
+// Hook is an inbound webhook, as defined in the hooks file.
+type Hook struct {
+	// Secret is the HMAC key of the requests.
+	Secret  string       `json:"secret"`
+	Actions []HookAction `json:"actions"`
+}
+
+// HookAction is an action run by a hook.
+type HookAction struct {
+	// Device is the IP, MAC, device ID, label or nickname of the device.
+	Device string `json:"device"`
+	// State is one of on, off or toggle.
+	State string `json:"state"`
+}
+
+// loadHooks reads the hooks from the given file. An empty path means no hooks.
+func loadHooks(path string) (map[string]Hook, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	var hooks map[string]Hook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal '%s': %w", path, err)
+	}
+	for name, h := range hooks {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid hook name '%s'", name)
+		}
+		if h.Secret == "" {
+			return nil, fmt.Errorf("hook '%s' has no secret", name)
+		}
+		if len(h.Actions) == 0 {
+			return nil, fmt.Errorf("hook '%s' has no actions", name)
+		}
+		for _, a := range h.Actions {
+			if a.Device == "" {
+				return nil, fmt.Errorf("hook '%s' has an action without device", name)
+			}
+			switch a.State {
+			case "on", "off", "toggle":
+			default:
+				return nil, fmt.Errorf("hook '%s': invalid state '%s' for device '%s', must be one of on, off, toggle", name, a.State, a.Device)
+			}
+		}
+	}
+	return hooks, nil
+}
+
+// verifyHook checks the timestamp and the signature of a hook request.
+func verifyHook(h Hook, r *http.Request, body []byte, now time.Time) error {
+	ts := r.Header.Get(hookTimestampHeader)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or invalid %s header", hookTimestampHeader)
+	}
+	if skew := now.Sub(time.Unix(sec, 0)); skew > hookMaxSkew || skew < -hookMaxSkew {
+		return fmt.Errorf("timestamp is %s away from the server time", skew.Round(time.Second))
+	}
+	sig, ok := strings.CutPrefix(r.Header.Get(hookSignatureHeader), "sha256=")
+	if !ok {
+		return fmt.Errorf("missing or invalid %s header", hookSignatureHeader)
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("invalid %s header: %w", hookSignatureHeader, err)
+	}
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// matchesDevice returns true if the device is the one an action refers to.
+// The device must have been seen once, i.e. d.info is not nil.
+func matchesDevice(d Device, custom Customization, ref string) bool {
+	return ref == d.info.IP ||
+		strings.EqualFold(ref, d.info.MAC) ||
+		ref == d.info.DeviceID ||
+		(custom.Label != "" && ref == custom.Label) ||
+		ref == d.info.DecodedNickname
+}
+
+// runHookAction runs an action on all the devices it refers to.
+func runHookAction(a HookAction, devices []Device, st *store) error {
+	found := false
+	for _, d := range devices {
+		// devices never seen online have no identifiers to match.
+		if d.info == nil {
+			continue
+		}
+		if !matchesDevice(d, st.Get(d.info.DeviceID), a.Device) {
+			continue
+		}
+		found = true
+		if d.offline {
+			return fmt.Errorf("device '%s' is offline", a.Device)
+		}
+		on := a.State == "on"
+		if a.State == "toggle" {
+			// the listed state can be a scan interval old.
+			info, err := d.plug.GetDeviceInfo()
+			if err != nil {
+				return fmt.Errorf("failed to get the state of '%s': %w", a.Device, err)
+			}
+			on = !info.DeviceON
+		}
+		if err := d.plug.SetDeviceInfo(on); err != nil {
+			return fmt.Errorf("failed to turn '%s' %s: %w", a.Device, onOff(on), err)
+		}
+	}
+	if !found {
+		return fmt.Errorf("device '%s' not found", a.Device)
+	}
+	return nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// getHooksHandler returns the handler of /hooks/, prefix is the path of the
+// handler, including the --base-path.
+func getHooksHandler(hooks map[string]Hook, list *deviceList, st *store, prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		h, ok := hooks[name]
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "unknown hook '%s'", name)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeAPIError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, hookMaxBody))
+		if err != nil {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "failed to read body: %v", err)
+			return
+		}
+		if err := verifyHook(h, r, body, time.Now()); err != nil {
+			log.Printf("Rejected request for hook '%s': %v", name, err)
+			writeAPIError(w, http.StatusUnauthorized, "%v", err)
+			return
+		}
+		devices, _ := list.get()
+		var errs []string
+		for _, a := range h.Actions {
+			if err := runHookAction(a, devices, st); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if len(errs) > 0 {
+			log.Printf("Hook '%s' failed: %s", name, strings.Join(errs, "; "))
+			writeAPIError(w, http.StatusBadGateway, "%s", strings.Join(errs, "; "))
+			return
+		}
+		log.Printf("Hook '%s' ran %d actions", name, len(h.Actions))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// signHook returns the signature header of a hook request.
+func signHook(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyHook(t *testing.T) {
+	h := Hook{Secret: "secret"}
+	now := time.Unix(1700000000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	body := []byte(`{"event":"ring"}`)
+	valid := signHook(h.Secret, ts, body)
+	for _, tc := range []struct {
+		name      string
+		timestamp string
+		signature string
+		body      []byte
+		wantErr   string
+	}{
+		{"valid", ts, valid, body, ""},
+		{"valid with skew", strconv.FormatInt(now.Unix()-60, 10), signHook(h.Secret, strconv.FormatInt(now.Unix()-60, 10), body), body, ""},
+		{"tampered body", ts, valid, []byte(`{"event":"open"}`), "signature mismatch"},
+		{"tampered signature", ts, valid[:len(valid)-2] + "00", body, "signature mismatch"},
+		{"wrong secret", ts, signHook("other", ts, body), body, "signature mismatch"},
+		{"tampered timestamp", strconv.FormatInt(now.Unix()+1, 10), valid, body, "signature mismatch"},
+		{"stale timestamp", strconv.FormatInt(now.Add(-time.Hour).Unix(), 10), signHook(h.Secret, strconv.FormatInt(now.Add(-time.Hour).Unix(), 10), body), body, "away from the server time"},
+		{"missing signature", ts, "", body, "missing or invalid " + hookSignatureHeader},
+		{"signature without prefix", ts, strings.TrimPrefix(valid, "sha256="), body, "missing or invalid " + hookSignatureHeader},
+		{"signature not hex", ts, "sha256=zz", body, "invalid " + hookSignatureHeader},
+		{"missing timestamp", "", valid, body, "missing or invalid " + hookTimestampHeader},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/hooks/doorbell", nil)
+			if tc.timestamp != "" {
+				r.Header.Set(hookTimestampHeader, tc.timestamp)
+			}
+			if tc.signature != "" {
+				r.Header.Set(hookSignatureHeader, tc.signature)
+			}
+			err := verifyHook(h, r, tc.body, now)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("verifyHook failed: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("err = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestRunHookActionUnseenDevice checks that devices without info, which were
+// never seen online, are skipped.
+func TestRunHookActionUnseenDevice(t *testing.T) {
+	st, err := newStore(filepath.Join(t.TempDir(), "devices.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := []Device{
+		{offline: true},
+		{offline: true, info: &tapo.DeviceInfo{DeviceID: "8022ABCD", IP: "192.0.2.1"}},
+	}
+	err = runHookAction(HookAction{Device: "192.0.2.9", State: "on"}, devices, st)
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("err = %v, want a device not found", err)
+	}
+	err = runHookAction(HookAction{Device: "192.0.2.1", State: "on"}, devices, st)
+	if err == nil || !strings.Contains(err.Error(), "offline") {
+		t.Errorf("err = %v, want a device offline", err)
+	}
+}
@@ -7,18 +7,26 @@ package main
 // done via broadcast UDP.
 
 import (
+	"bufio"
 	_ "embed"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/netip"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/insomniacslk/tapo"
+	"github.com/insomniacslk/tapo/internal/apitoken"
+	"github.com/kirsle/configdir"
 	"github.com/spf13/pflag"
 )
 
@@ -31,157 +39,155 @@ var offIcon []byte
 //go:embed warning.png
 var warningIcon []byte
 
+//go:embed app.png
+var appIcon []byte
+
+//go:embed manifest.webmanifest
+var manifest []byte
+
+//go:embed sw.js
+var serviceWorker []byte
+
 var (
 	flagListen   = pflag.StringP("listen", "l", ":7490", "Listen host:port address")
 	flagUsername = pflag.StringP("username", "u", "", "TP-Link username (usually an email)")
 	flagPassword = pflag.StringP("password", "p", "", "TP-Link password")
 	flagInterval = pflag.DurationP("interval", "i", time.Minute, "Update interval")
+	flagOffline  = pflag.Duration("offline-after", 0, "Grace period after which a device that does not respond to discovery is shown as offline. Defaults to three update intervals")
+	flagIfaces   = pflag.StringSlice("discovery-interface", nil, "Network interfaces to run discovery on. Defaults to all the interfaces that support broadcast")
+	flagDataDir  = pflag.String("data-dir", configdir.LocalConfig("tapoweb"), "Directory where tapoweb stores its data, like device labels")
+	flagBasePath = pflag.String("base-path", "", "Path prefix tapoweb is served at, e.g. /tapo when a reverse proxy forwards https://example.org/tapo/ to it without stripping the prefix")
+	flagCORS     = pflag.StringSlice("cors-origin", nil, "Origins allowed to call the API from a browser, e.g. https://dashboard.example.org. Use * to allow any origin")
+	flagProxies  = pflag.StringSlice("trusted-proxy", nil, "Addresses or CIDR prefixes of reverse proxies whose X-Forwarded-For header is trusted when logging client addresses")
+	flagTokens   = pflag.String("tokens-file", "", "File with the API tokens, as managed by `tapo token-create`")
+	flagUsers    = pflag.String("users-file", "", "File with the users allowed to log in. Without API tokens nor users, tapoweb is not authenticated")
+	flagAddUser  = pflag.String("add-user", "", "Add or update a user in --users-file, reading the password from stdin, and exit")
+	flagHooks    = pflag.String("hooks-file", "", "JSON file with the inbound webhooks served at /hooks/NAME, mapping each name to a secret and the device actions to run")
+	flagRole     = pflag.String("role", string(RoleViewer), "Role of the user added with --add-user: admin can turn devices on and off, viewer can only see state and energy")
 )
 
-func getListHTML(devices []Device) string {
-	allIPs := make([]string, 0, len(devices))
+//go:embed index.html
+var indexHTML string
+
+var indexTemplate = template.Must(template.New("index").Parse(indexHTML))
+
+// deviceView is the representation of a device used by the HTML template.
+// State is on or off, and StateText is shown next to the state icon so that
+// the state does not depend on the icon alone.
+type deviceView struct {
+	Idx         int
+	Name        string
+	Label       string
+	Icon        string
+	Order       int
+	IP          string
+	MAC         string
+	ID          string
+	On          bool
+	State       string
+	StateText   string
+	Offline     bool
+	LastSeen    string
+	EnergyToday string
+	EnergyMonth string
+	// OffAt is the end of the countdown started from the page, in
+	// milliseconds since the epoch, 0 if none.
+	OffAt int64
+}
+
+// householdSummary is the aggregate of all the devices shown at the top of the
+// page. Power is in W and energy in kWh, summed over the devices with energy
+// monitoring.
+type householdSummary struct {
+	Power       string
+	EnergyToday string
+	EnergyMonth string
+	On          int
+	Off         int
+	Offline     int
+}
+
+// summarize aggregates the state and the energy of the devices. The page
+// updates it with the same computation on the /api/devices response.
+func summarize(devices []Device) householdSummary {
+	var (
+		sum                 householdSummary
+		power, today, month int
+	)
 	for _, d := range devices {
-		allIPs = append(allIPs, `"`+d.info.IP+`"`)
-	}
-	ret := fmt.Sprintf(`<!DOCTYPE html>
-<html>
- <head>
-  <title>Tapo plugs</title>
-  <style>
-  body {
-    background-color: #282828;
-    color: #d3d3d3;
-  }
-  color: white;
-  a {
-  color: white
-  }
-  a:link {
-    color: white;
-  }
-  a:visited {
-    color: white;
-  }
-  a:hover {
-    color: yellow;
-  }
-  a:active {
-    color: yellow;
-  }
-  thead {
-   font-weight: bold;
-  }
-  .text-bold {
-   font-weight: bold;
-  }
-  table, tr, td {
-   border: 1px solid black;
-  }
-  </style>
-  <script>
-   var allIPs = [%s];
-   function updateAll() {
-    console.log("Updating status for " + allIPs);
-    for (let i=0; i<allIPs.length; i++) {
-     updateStatus("status_" + allIPs[i].replaceAll(".", "_"), allIPs[i]);
-    }
-   }
-   setInterval(updateAll, 10000);
-
-   function updateStatus(tagID, ip) {
-    var xmlhttp = new XMLHttpRequest();
-
-    xmlhttp.onreadystatechange = function() {
-        if (xmlhttp.readyState == XMLHttpRequest.DONE) { // XMLHttpRequest.DONE == 4
-           img = document.getElementById(tagID);
-           if (xmlhttp.status == 200) {
-               if (xmlhttp.response == "on") {
-                img.src = "/icons/on.png";
-               img.setAttribute("onclick", "turnOff('" + tagID + "', '" + ip + "');");
-               } else if (xmlhttp.response == "off") {
-                img.src = "/icons/off.png";
-                img.setAttribute("onclick", "turnOn('" + tagID + "', '" + ip + "');");
-               } else {
-                console.log("failed to get status for " + ip + ": " + xmlhttp.response);
-               }
-           } else {
-               img.src = "/icons/warning.png";
-               console.log("failed to get status for " + ip + ": " + xmlhttp.status);
-           }
-        }
-    };
-
-    xmlhttp.open("GET", "/?cmd=status&ip=" + ip, true);
-    xmlhttp.send();
-   }
-
-   function turnOn(tagID, ip) {
-    var xmlhttp = new XMLHttpRequest();
-
-    xmlhttp.onreadystatechange = function() {
-        if (xmlhttp.readyState == XMLHttpRequest.DONE) { // XMLHttpRequest.DONE == 4
-           if (xmlhttp.status == 200) {
-               updateStatus(tagID, ip);
-           } else {
-               console.log('failed to turn plug on, got HTTP ' + xmlhttp.status);
-           }
-        }
-    };
-
-    xmlhttp.open("GET", "/?cmd=on&ip=" + ip, true);
-    xmlhttp.send();
-   }
-
-   function turnOff(tagID, ip) {
-    var xmlhttp = new XMLHttpRequest();
-
-    xmlhttp.onreadystatechange = function() {
-        if (xmlhttp.readyState == XMLHttpRequest.DONE) { // XMLHttpRequest.DONE == 4
-           if (xmlhttp.status == 200) {
-               updateStatus(tagID, ip);
-           } else {
-               alert('failed to turn plug off, got HTTP ' + xmlhttp.status);
-           }
-        }
-    };
-
-    xmlhttp.open("GET", "/?cmd=off&ip=" + ip, true);
-    xmlhttp.send();
-   }
-  </script>
- </head>
- <body>
-`, strings.Join(allIPs, ", "))
-	ret += "  <table>\n"
-	ret += "   <thead><tr><td class=\"text.bold\">#</td><td class=\"text.bold\">Name</td><td class=\"text.bold\">IP</td><td class=\"text.bold\">MAC</td><td class=\"text.bold\">State</td><td class=\"\">Energy<br />today (kWh)</td><td>Energy <br />month (kWh)</td><td class=\"text.bold\">ID</td></tr></thead>\n"
-	for idx, d := range devices {
-		ret += "   <tr>\n"
-		ret += fmt.Sprintf("    <td>%d</td>\n", idx+1)
-		ret += "    <td class=\"text-bold\" onclick=\"navigator.clipboard.writeText('" + d.info.DecodedNickname + "')\">" + d.info.DecodedNickname + "</td>\n"
-		ret += "    <td onclick=\"navigator.clipboard.writeText('" + d.info.IP + "')\">" + d.info.IP + "</td>\n"
-		ret += "    <td onclick=\"navigator.clipboard.writeText('" + d.info.MAC + "')\">" + d.info.MAC + "</td>\n"
-		statusTagID := "status_" + strings.Replace(d.info.IP, ".", "_", -1)
-		callback := "turnOn('" + statusTagID + "', '" + d.info.IP + "')"
-		if d.info.DeviceON {
-			callback = "turnOff('" + statusTagID + "', '" + d.info.IP + "')"
+		switch {
+		case d.offline:
+			sum.Offline++
+		case d.info.DeviceON:
+			sum.On++
+		default:
+			sum.Off++
 		}
-		state := "<img id='" + statusTagID + "' src=\"/icons/off.png\" height=\"16px;\" onclick=\"" + callback + "\" />"
-		if d.info.DeviceON {
-			state = "<img id='" + statusTagID + "' src=\"/icons/on.png\" height=\"16px;\" onclick=\"" + callback + "\" />"
+		if d.energy != nil {
+			if !d.offline {
+				power += d.energy.CurrentPower
+			}
+			today += d.energy.TodayEnergy
+			month += d.energy.MonthEnergy
 		}
+	}
+	sum.Power = fmt.Sprintf("%.1f", float64(power)/1000)
+	sum.EnergyToday = fmt.Sprintf("%.1f", float64(today)/1000)
+	sum.EnergyMonth = fmt.Sprintf("%.1f", float64(month)/1000)
+	return sum
+}
 
-		ret += "    <td>" + state + "</td>\n"
-		var energyInfoDay, energyInfoMonth string
+func getListHTML(devices []Device, st *store, cds *countdowns, readOnly bool, user string) (string, error) {
+	views := make([]deviceView, 0, len(devices))
+	for _, d := range devices {
+		custom := st.Get(d.info.DeviceID)
+		v := deviceView{
+			Name:  d.info.DecodedNickname,
+			Icon:  custom.Icon,
+			Order: custom.Order,
+			IP:    d.info.IP,
+			MAC:   d.info.MAC,
+			ID:    d.info.DeviceID,
+			On:    d.info.DeviceON,
+			State: onOff(d.info.DeviceON),
+		}
+		v.StateText = strings.ToUpper(v.State)
+		if t := cds.deadline(d.info.DeviceID); !t.IsZero() {
+			v.OffAt = t.UnixMilli()
+		}
+		if d.offline {
+			v.Offline = true
+			v.LastSeen = d.lastSeen.Format(time.DateTime)
+		}
+		if custom.Label != "" {
+			v.Name = custom.Label
+			v.Label = custom.Label
+		}
 		if d.energy != nil {
-			energyInfoDay = fmt.Sprintf("%.1f", float64(d.energy.TodayEnergy)/1000)
-			energyInfoMonth = fmt.Sprintf("%.1f", float64(d.energy.MonthEnergy)/1000)
+			v.EnergyToday = fmt.Sprintf("%.1f", float64(d.energy.TodayEnergy)/1000)
+			v.EnergyMonth = fmt.Sprintf("%.1f", float64(d.energy.MonthEnergy)/1000)
+		}
+		views = append(views, v)
+	}
+	sort.SliceStable(views, func(i, j int) bool {
+		if views[i].Order != views[j].Order {
+			return views[i].Order < views[j].Order
 		}
-		ret += "    <td>" + energyInfoDay + "</td>\n"
-		ret += "    <td>" + energyInfoMonth + "</td>\n"
-		ret += "    <td onclick=\"navigator.clipboard.writeText('" + d.info.DeviceID + "')\">" + d.info.DeviceID + "</td>\n"
-		ret += "   </tr>\n"
+		return views[i].Name < views[j].Name
+	})
+	for idx := range views {
+		views[idx].Idx = idx + 1
+	}
+	var buf strings.Builder
+	if err := indexTemplate.Execute(&buf, struct {
+		Devices  []deviceView
+		ReadOnly bool
+		User     string
+		Summary  householdSummary
+	}{Devices: views, ReadOnly: readOnly, User: user, Summary: summarize(devices)}); err != nil {
+		return "", fmt.Errorf("failed to render template: %w", err)
 	}
-	return ret + "  </table>\n </body>\n</html>\n"
+	return buf.String(), nil
 }
 
 // TODO consolidate into a single function for /icons/*
@@ -226,50 +232,142 @@ func getIconWarning(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getRootHandler(username, password string, interval time.Duration) func(http.ResponseWriter, *http.Request) {
-	var (
-		devices []Device
-		failed  []netip.Addr
-		err     error
-	)
-	go func() {
-		for {
-			devices, failed, err = getAllDevices(username, password)
+// getStatic returns a handler serving an embedded static file.
+func getStatic(contentType string, data []byte) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", contentType)
+		if _, err := w.Write(data); err != nil {
+			log.Printf("Warning: failed to write %s: %v", r.URL.Path, err)
+		}
+	}
+}
+
+// customize stores the label, icon and sort order of a device, as submitted by
+// the edit form.
+func customize(r *http.Request, st *store, devices []Device) (int, string) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, "customize requires POST"
+	}
+	if err := r.ParseForm(); err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("invalid form: %v", err)
+	}
+	id := r.PostForm.Get("id")
+	if id == "" {
+		return http.StatusBadRequest, "Missing device ID"
+	}
+	found := false
+	for _, d := range devices {
+		if d.info.DeviceID == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return http.StatusNotFound, "404 Not Found"
+	}
+	c := Customization{
+		Label: strings.TrimSpace(r.PostForm.Get("label")),
+		Icon:  strings.TrimSpace(r.PostForm.Get("icon")),
+	}
+	if len(c.Label) > 64 || len(c.Icon) > 16 {
+		return http.StatusBadRequest, "label or icon too long"
+	}
+	if o := r.PostForm.Get("order"); o != "" {
+		order, err := strconv.Atoi(o)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Sprintf("invalid order '%s'", o)
+		}
+		c.Order = order
+	}
+	if err := st.Set(id, c); err != nil {
+		log.Printf("Failed to save customization: %v", err)
+		return http.StatusInternalServerError, "failed to save customization"
+	}
+	return http.StatusOK, "ok"
+}
+
+// deviceList holds the devices found by the latest discovery. It is refreshed
+// in the background and shared by all the handlers.
+type deviceList struct {
+	mu      sync.RWMutex
+	devices []Device
+	failed  []netip.Addr
+}
+
+// get returns the devices and the addresses of the devices that failed to
+// respond. The returned slices must not be modified.
+func (l *deviceList) get() ([]Device, []netip.Addr) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.devices, l.failed
+}
+
+// refresh updates the device list after every scan, until events is closed.
+func (l *deviceList) refresh(events <-chan tapo.ScanEvent, scanner *tapo.Scanner, sessions *tapo.SessionManager) {
+	for ev := range events {
+		switch ev.Type {
+		case tapo.DeviceFound, tapo.DeviceLost:
+			log.Printf("Device %s %s", ev.Device.Result.IP, ev.Type)
+		case tapo.ScanCompleted:
+			if ev.Err != nil {
+				log.Printf("Warning: discovery failed: %v", ev.Err)
+			}
+			previous, _ := l.get()
+			devices, failed, err := getAllDevices(sessions, scanner.Known(), previous)
 			if err != nil {
-				log.Fatalf("Failed to get devices: %v", err)
+				log.Printf("Warning: failed to get devices: %v", err)
+				continue
 			}
 			log.Printf("Got %d devices and %d failed devices", len(devices), len(failed))
-			time.Sleep(interval)
+			l.mu.Lock()
+			l.devices, l.failed = devices, failed
+			l.mu.Unlock()
 		}
-	}()
+	}
+}
+
+func getRootHandler(list *deviceList, st *store, cds *countdowns) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		tok := requestToken(r)
+		devices, allFailed := list.get()
+		devices = allowedDevices(tok, devices)
+		var failed []netip.Addr
+		for _, addr := range allFailed {
+			if tok.AllowsDevice(addr.String()) {
+				failed = append(failed, addr)
+			}
+		}
 		cmd := r.URL.Query().Get("cmd")
 		ip := r.URL.Query().Get("ip")
 		var (
 			status = http.StatusOK
 			msg    string
 		)
-		if ip == "" && (cmd == "status" || cmd == "on" || cmd == "off") {
+		if ip == "" && (cmd == "status" || cmd == "on" || cmd == "off" || cmd == "countdown") {
 			status = http.StatusBadRequest
 			msg = "Missing IP address"
+		} else if (cmd == "on" || cmd == "off" || cmd == "countdown" || cmd == "customize") && !tok.Allows(apitoken.ScopeControl) {
+			status = http.StatusForbidden
+			msg = fmt.Sprintf("token '%s' is read-only", tok.Name)
 		} else {
 			switch cmd {
 			case "status":
-				// RACE CONDITIONS AHEAD!
 				found := false
 				for _, d := range devices {
 					if d.info.IP == ip {
 						found = true
+						if d.offline {
+							status = http.StatusGone
+							msg = fmt.Sprintf("device with IP %s is offline", ip)
+							break
+						}
 						info, err := d.plug.GetDeviceInfo()
 						if err != nil {
 							status = http.StatusInternalServerError
 							msg = fmt.Sprintf("failed to get plug status: %v", err)
 							break
 						}
-						msg = "off"
-						if info.DeviceON {
-							msg = "on"
-						}
+						msg = onOff(info.DeviceON)
 					}
 				}
 				for _, d := range failed {
@@ -283,11 +381,15 @@ func getRootHandler(username, password string, interval time.Duration) func(http
 					msg = "404 Not Found"
 				}
 			case "on":
-				// RACE CONDITIONS AHEAD!
 				found := false
 				for _, d := range devices {
 					if d.info.IP == ip {
 						found = true
+						if d.offline {
+							status = http.StatusGone
+							msg = fmt.Sprintf("device with IP %s is offline", ip)
+							break
+						}
 						if err := d.plug.SetDeviceInfo(true); err != nil {
 							status = http.StatusInternalServerError
 							msg = fmt.Sprintf("failed to turn plug on: %v", err)
@@ -300,11 +402,15 @@ func getRootHandler(username, password string, interval time.Duration) func(http
 					msg = "404 Not Found"
 				}
 			case "off":
-				// RACE CONDITIONS AHEAD!
 				found := false
 				for _, d := range devices {
 					if d.info.IP == ip {
 						found = true
+						if d.offline {
+							status = http.StatusGone
+							msg = fmt.Sprintf("device with IP %s is offline", ip)
+							break
+						}
 						if err := d.plug.SetDeviceInfo(false); err != nil {
 							status = http.StatusInternalServerError
 							msg = fmt.Sprintf("failed to turn plug off: %v", err)
@@ -316,9 +422,19 @@ func getRootHandler(username, password string, interval time.Duration) func(http
 					status = http.StatusNotFound
 					msg = "404 Not Found"
 				}
+			case "countdown":
+				status, msg = startCountdown(r, cds, devices)
+			case "customize":
+				status, msg = customize(r, st, devices)
 			case "", "list":
-				status = http.StatusOK
-				msg = getListHTML(devices)
+				html, err := getListHTML(devices, st, cds, !tok.Allows(apitoken.ScopeControl), requestUser(r))
+				if err != nil {
+					status = http.StatusInternalServerError
+					msg = err.Error()
+					break
+				}
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				msg = html
 			default:
 				status = http.StatusBadRequest
 				msg = fmt.Sprintf("invalid cmd '%s'", cmd)
@@ -335,47 +451,75 @@ type Device struct {
 	plug   *tapo.Plug
 	info   *tapo.DeviceInfo
 	energy *tapo.EnergyUsage
+	// lastSeen is the time of the last discovery response of the device.
+	lastSeen time.Time
+	// offline devices have not responded to discovery for a while. Their
+	// info is the last one known, and plug is nil.
+	offline bool
 }
 
-func getAllDevices(username, password string) ([]Device, []netip.Addr, error) {
-	client := tapo.NewClient(nil)
-	discovered, _, err := client.Discover()
-	if err != nil {
-		return nil, nil, fmt.Errorf("discover failed: %w", err)
+// offlineDevice returns the entry of an offline device, reusing its last known
+// info if any.
+func offlineDevice(k tapo.KnownDevice, previous []Device) Device {
+	for _, p := range previous {
+		if p.info.DeviceID == k.Response.Result.DeviceID {
+			p.plug = nil
+			p.offline = true
+			p.lastSeen = k.LastSeen
+			return p
+		}
 	}
+	r := k.Response.Result
+	return Device{
+		info: &tapo.DeviceInfo{
+			DeviceID:        r.DeviceID,
+			IP:              r.IP.String(),
+			MAC:             r.MAC.String(),
+			Model:           r.DeviceModel,
+			DecodedNickname: r.IP.String(),
+		},
+		lastSeen: k.LastSeen,
+		offline:  true,
+	}
+}
+
+// getAllDevices logs into the online devices and gets their info. Offline
+// devices are kept with their last known info.
+func getAllDevices(sessions *tapo.SessionManager, known map[string]tapo.KnownDevice, previous []Device) ([]Device, []netip.Addr, error) {
 	var (
 		unsorted = make(map[string]Device)
 		failed   = make([]netip.Addr, 0)
 		devices  []Device
 		keys     []string
 	)
-	for _, d := range discovered {
+	for _, k := range known {
+		if k.Offline {
+			dev := offlineDevice(k, previous)
+			unsorted[dev.info.DecodedNickname] = dev
+			keys = append(keys, dev.info.DecodedNickname)
+			continue
+		}
+		d := k.Response
 		addr, ok := netip.AddrFromSlice(net.IP(d.Result.IP).To4())
 		if !ok {
-			return nil, nil, fmt.Errorf("invalid IP '%s': %w", d.Result.IP.String(), err)
+			return nil, nil, fmt.Errorf("invalid IP '%s'", d.Result.IP.String())
 		}
 		log.Printf("Getting info for '%s'", addr)
-		plug := tapo.NewPlug(addr, nil)
-		if err := plug.Handshake(username, password); err != nil {
+		plug, err := sessions.Get(addr, tapo.OptionDiscovered(d))
+		if err != nil {
 			log.Printf("Warning: handshake failed for %s: %v", addr, err)
 			failed = append(failed, addr)
 			continue
 		}
-		info, err := plug.GetDeviceInfo()
+		// info, usage and energy in a single round trip
+		st, err := plug.GetStatus()
 		if err != nil {
-			log.Printf("Warning: GetDeviceInfo failed for %s: %v", addr, err)
+			log.Printf("Warning: GetStatus failed for %s: %v", addr, err)
 			failed = append(failed, addr)
 			continue
 		}
-		// TODO add more devices that support GetEnergyUsage
-		var energy *tapo.EnergyUsage
-		if info.Model == "P110" {
-			energy, err = plug.GetEnergyUsage()
-			if err != nil {
-				log.Printf("Warning: GetEnergyInfo failed for %s: %v", addr, err)
-			}
-		}
-		unsorted[info.DecodedNickname] = Device{plug: plug, info: info, energy: energy}
+		info := st.Info
+		unsorted[info.DecodedNickname] = Device{plug: plug, info: info, energy: st.Energy, lastSeen: k.LastSeen}
 		keys = append(keys, info.DecodedNickname)
 	}
 	sort.Strings(keys)
@@ -388,18 +532,93 @@ func getAllDevices(username, password string) ([]Device, []netip.Addr, error) {
 func main() {
 	pflag.Parse()
 
-	http.HandleFunc("/", getRootHandler(*flagUsername, *flagPassword, *flagInterval))
+	st, err := newStore(filepath.Join(*flagDataDir, "devices.json"))
+	if err != nil {
+		log.Fatalf("Failed to load device customizations: %v", err)
+	}
+	users, err := loadUsers(*flagUsers)
+	if err != nil {
+		log.Fatalf("Failed to load users: %v", err)
+	}
+	if *flagAddUser != "" {
+		if *flagUsers == "" {
+			log.Fatalf("--add-user requires --users-file")
+		}
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			log.Fatalf("Empty password")
+		}
+		if err := users.Set(*flagAddUser, password, Role(*flagRole)); err != nil {
+			log.Fatalf("Failed to add user: %v", err)
+		}
+		return
+	}
+	tokens, err := apitoken.Load(*flagTokens)
+	if err != nil {
+		log.Fatalf("Failed to load API tokens: %v", err)
+	}
+	hooks, err := loadHooks(*flagHooks)
+	if err != nil {
+		log.Fatalf("Failed to load hooks: %v", err)
+	}
+	sessions := tapo.NewSessionManager(*flagUsername, *flagPassword, 0, nil)
+	client := tapo.NewClient(nil, tapo.OptionDiscoveryInterfaces(*flagIfaces...))
+	scanner := tapo.NewScanner(client, *flagInterval, tapo.OptionScanOfflineAfter(*flagOffline))
+	var list deviceList
+	events, _ := scanner.Subscribe()
+	go list.refresh(events, scanner, sessions)
+	if err := scanner.Start(); err != nil {
+		log.Fatalf("Failed to start scanner: %v", err)
+	}
+	trusted, err := parsePrefixes(*flagProxies)
+	if err != nil {
+		log.Fatalf("Invalid --trusted-proxy: %v", err)
+	}
+	base := normalizeBasePath(*flagBasePath)
+	mux := http.NewServeMux()
+	handle := func(path string, h http.HandlerFunc) {
+		mux.HandleFunc(base+path, h)
+	}
+	auth := authenticator{tokens: tokens, users: users, sessions: newSessionStore(), path: base + "/"}
+	if !auth.enabled() {
+		log.Printf("Warning: no API tokens nor users, tapoweb is not authenticated")
+	}
+	if base != "" {
+		// the page uses relative URLs, so it must be served with a
+		// trailing slash.
+		mux.Handle(base, http.RedirectHandler(base+"/", http.StatusMovedPermanently))
+	}
+	handle("/", auth.withAuth(getRootHandler(&list, st, &countdowns{})))
+	handle("/login", auth.loginHandler)
+	handle("/logout", auth.logoutHandler)
+	handle("/api/devices", withCORS(*flagCORS, auth.withAuth(getAPIDevicesHandler(&list, st))))
+	handle("/api/devices.csv", withCORS(*flagCORS, auth.withAuth(getAPIDevicesCSVHandler(&list, st))))
+	// hooks are authenticated with their own HMAC signatures.
+	if len(hooks) > 0 {
+		handle("/hooks/", getHooksHandler(hooks, &list, st, base+"/hooks/"))
+	}
+	handle("/api/openapi.json", apiDocument(auth.enabled(), base).Handler())
 	// waiting for Go 1.22...
 	/*
-		mux := http.NewServeMux()
-		mux.HandleFunc("/", getRootHandler(*flagUsername, *flagPassword, *flagInterval))
-		mux.HandleFunc("/icons/{icon}.png", getIcon)
+		handle("/icons/{icon}.png", getIcon)
 	*/
-	http.HandleFunc("/icons/on.png", getIconOn)
-	http.HandleFunc("/icons/off.png", getIconOff)
-	http.HandleFunc("/icons/warning.png", getIconWarning)
-	log.Printf("Listening on %s", *flagListen)
-	if err := http.ListenAndServe(*flagListen, nil); err != nil {
+	handle("/icons/on.png", getIconOn)
+	handle("/icons/off.png", getIconOff)
+	handle("/icons/warning.png", getIconWarning)
+	handle("/icons/app.png", getStatic("image/png", appIcon))
+	handle("/manifest.webmanifest", getStatic("application/manifest+json", manifest))
+	// the service worker must not be cached by the browser, so that updates
+	// are picked up.
+	handle("/sw.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		getStatic("text/javascript", serviceWorker)(w, r)
+	})
+	log.Printf("Listening on %s%s/", *flagListen, base)
+	if err := http.ListenAndServe(*flagListen, logErrors(trusted, mux)); err != nil {
 		log.Fatalf("HTTP server failed: %v", err)
 	}
 }
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/insomniacslk/tapo/internal/openapi"
+)
+
+// apiDocument returns the OpenAPI document of the REST API, served at
+// /api/openapi.json. auth tells whether API tokens are required, and base is
+// the --base-path.
+func apiDocument(auth bool, base string) *openapi.Document {
+	doc := openapi.New("tapoweb", "REST API of the tapoweb server.", "1")
+	if base != "" {
+		doc.Servers = []openapi.Server{{URL: base}}
+	}
+	if auth {
+		doc.BearerAuth()
+	}
+	device := &openapi.Schema{
+		Type: "object",
+		Properties: map[string]*openapi.Schema{
+			"id":           {Type: "string"},
+			"name":         {Type: "string", Description: "Custom label if set, device nickname otherwise"},
+			"icon":         {Type: "string"},
+			"order":        {Type: "integer", Format: "int32"},
+			"model":        {Type: "string"},
+			"ip":           {Type: "string"},
+			"mac":          {Type: "string"},
+			"online":       {Type: "boolean", Description: "False if the device has not responded to discovery for the offline grace period"},
+			"last_seen":    {Type: "string", Format: "date-time", Description: "Time of the last discovery response of the device"},
+			"state":        {Type: "string", Enum: []string{"on", "off"}, Description: "Last known state for offline devices"},
+			"status":       {Type: "string", Enum: []string{"on", "off", "offline"}, Description: "Current state, or offline if the device is not online"},
+			"power":        {Type: "number", Format: "double", Description: "Current power in W, only for devices with energy monitoring"},
+			"energy_today": {Type: "integer", Format: "int32", Description: "Energy used today in Wh, only for devices with energy monitoring"},
+			"energy_month": {Type: "integer", Format: "int32", Description: "Energy used this month in Wh, only for devices with energy monitoring"},
+		},
+	}
+	doc.Components.Schemas["Device"] = device
+	list := doc.SchemaOf(apiDeviceList{})
+	doc.Components.Schemas["ApiDeviceList"].Properties["devices"] = &openapi.Schema{
+		Type:  "array",
+		Items: &openapi.Schema{Ref: "#/components/schemas/Device"},
+	}
+	apiErr := openapi.Response{Description: "Error", Content: openapi.JSON(doc.SchemaOf(apiError{}))}
+	doc.Add(http.MethodGet, "/api/devices", &openapi.Operation{
+		Summary:     "List the devices found by the latest discovery",
+		OperationID: "listDevices",
+		Parameters: []openapi.Parameter{
+			{Name: "offset", In: "query", Description: "Index of the first device to return", Schema: &openapi.Schema{Type: "integer"}},
+			{Name: "limit", In: "query", Description: "Maximum number of devices to return", Schema: &openapi.Schema{Type: "integer"}},
+			{Name: "fields", In: "query", Description: "Comma-separated list of the device fields to return", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "If-None-Match", In: "header", Description: "ETag of a previous response", Schema: &openapi.Schema{Type: "string"}},
+		},
+		Responses: map[string]openapi.Response{
+			"200": {
+				Description: "Device list",
+				Headers:     map[string]openapi.Header{"ETag": {Schema: &openapi.Schema{Type: "string"}}},
+				Content:     openapi.JSON(list),
+			},
+			"304": {Description: "The device list did not change"},
+			"400": apiErr,
+			"401": {Description: "Missing or invalid token"},
+		},
+	})
+	doc.Add(http.MethodGet, "/api/devices.csv", &openapi.Operation{
+		Summary:     "Download the device table as CSV",
+		OperationID: "downloadDevicesCSV",
+		Responses: map[string]openapi.Response{
+			"200": {
+				Description: "Device table with columns " + strings.Join(csvFields, ", ") + ", energy in Wh",
+				Content:     map[string]openapi.MediaType{"text/csv": {Schema: &openapi.Schema{Type: "string"}}},
+			},
+			"401": {Description: "Missing or invalid token"},
+		},
+	})
+	return doc
+}
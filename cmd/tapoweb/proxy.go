@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+// Helpers to run tapoweb behind a reverse proxy, possibly at a subpath, and to
+// let dashboards on other origins use the API.
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// normalizeBasePath returns the base path with a leading slash and without a
+// trailing one, or an empty string for the root.
+func normalizeBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// parsePrefixes parses a list of IP addresses and CIDR prefixes.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	ret := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address '%s': %w", s, err)
+			}
+			ret = append(ret, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix '%s': %w", s, err)
+		}
+		ret = append(ret, p.Masked())
+	}
+	return ret, nil
+}
+
+func isTrusted(trusted []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range trusted {
+		if p.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client of a request. When the request
+// comes from a trusted proxy, the X-Forwarded-For header is walked from the
+// right, and the first address that is not a trusted proxy is returned.
+func clientAddr(trusted []netip.Prefix, r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !isTrusted(trusted, addr) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		host = hop.String()
+		if !isTrusted(trusted, hop) {
+			break
+		}
+	}
+	return host
+}
+
+// statusRecorder records the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// logErrors logs the requests that fail, with the real client address, so
+// that failed logins can be traced through a reverse proxy.
+func logErrors(trusted []netip.Prefix, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(&rec, r)
+		if rec.status >= 400 {
+			log.Printf("%s %s %s: %d", clientAddr(trusted, r), r.Method, r.URL.Path, rec.status)
+		}
+	})
+}
+
+// withCORS adds CORS headers to the API responses for the allowed origins, and
+// answers the preflight requests. An origin of "*" allows any origin.
+func withCORS(origins []string, h http.HandlerFunc) http.HandlerFunc {
+	if len(origins) == 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		allowed := false
+		for _, o := range origins {
+			if o == "*" || strings.EqualFold(o, origin) {
+				allowed = true
+				break
+			}
+		}
+		if origin != "" && allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", "ETag")
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, If-None-Match")
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeBasePath(t *testing.T) {
+	for in, want := range map[string]string{
+		"":         "",
+		"/":        "",
+		"tapo":     "/tapo",
+		"/tapo/":   "/tapo",
+		"/a/b/":    "/a/b",
+		"//tapo//": "/tapo",
+	} {
+		if got := normalizeBasePath(in); got != want {
+			t.Errorf("normalizeBasePath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	got, err := parsePrefixes([]string{"10.0.0.1", "192.168.1.7/24", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.1/32", "192.168.1.0/24", "::1/128"}
+	for i, p := range got {
+		if p.String() != want[i] {
+			t.Errorf("prefix %d = %s, want %s", i, p, want[i])
+		}
+	}
+	for _, bad := range []string{"proxy", "10.0.0.0/33"} {
+		if _, err := parsePrefixes([]string{bad}); err == nil {
+			t.Errorf("parsePrefixes(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	trusted, err := parsePrefixes([]string{"10.0.0.1", "172.16.0.0/12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"spoofed by an untrusted peer", "192.0.2.1:1234", []string{"203.0.113.9"}, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"192.0.2.1"}, "192.0.2.1"},
+		{"trusted proxy without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"spoofed through a trusted proxy", "10.0.0.1:1234", []string{"203.0.113.9, 192.0.2.1"}, "192.0.2.1"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"192.0.2.1, 172.16.0.5"}, "192.0.2.1"},
+		{"multiple headers", "10.0.0.1:1234", []string{"203.0.113.9", "192.0.2.1"}, "192.0.2.1"},
+		{"garbage hop", "10.0.0.1:1234", []string{"192.0.2.1, garbage"}, "10.0.0.1"},
+		{"IPv4-mapped trusted proxy", "[::ffff:10.0.0.1]:1234", []string{"192.0.2.1"}, "192.0.2.1"},
+		{"no port", "192.0.2.1", nil, "192.0.2.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remote
+			for _, v := range tc.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientAddr(trusted, r); got != tc.want {
+				t.Errorf("clientAddr() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWithCORS(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	for _, tc := range []struct {
+		name       string
+		origins    []string
+		method     string
+		origin     string
+		wantAllow  string
+		wantStatus int
+	}{
+		{"allowed", []string{"https://dash.example"}, http.MethodGet, "https://dash.example", "https://dash.example", http.StatusOK},
+		{"allowed case insensitive", []string{"https://dash.example"}, http.MethodGet, "https://DASH.example", "https://DASH.example", http.StatusOK},
+		{"allowed preflight", []string{"https://dash.example"}, http.MethodOptions, "https://dash.example", "https://dash.example", http.StatusNoContent},
+		{"disallowed", []string{"https://dash.example"}, http.MethodGet, "https://evil.example", "", http.StatusOK},
+		{"disallowed preflight", []string{"https://dash.example"}, http.MethodOptions, "https://evil.example", "", http.StatusOK},
+		{"wildcard", []string{"*"}, http.MethodGet, "https://any.example", "https://any.example", http.StatusOK},
+		{"no origin", []string{"*"}, http.MethodGet, "", "", http.StatusOK},
+		{"CORS disabled", nil, http.MethodGet, "https://dash.example", "", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/api/devices", nil)
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			w := httptest.NewRecorder()
+			withCORS(tc.origins, ok)(w, r)
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.wantAllow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tc.wantAllow)
+			}
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+			if tc.wantAllow == "" && w.Header().Get("Access-Control-Allow-Methods") != "" {
+				t.Errorf("preflight headers sent to a disallowed origin")
+			}
+		})
+	}
+}
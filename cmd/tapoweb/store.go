@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Customization holds the user-defined presentation of a device, overriding
+// what the firmware reports.
+type Customization struct {
+	// Label replaces the device nickname, if not empty.
+	Label string `json:"label,omitempty"`
+	// Icon is a short text, typically an emoji, shown next to the name.
+	Icon string `json:"icon,omitempty"`
+	// Order is the sort key of the device. Devices with the same order are
+	// sorted by name.
+	Order int `json:"order,omitempty"`
+}
+
+// store persists the device customizations as a JSON file, keyed by device
+// ID.
+type store struct {
+	path string
+
+	mu   sync.Mutex
+	data map[string]Customization
+}
+
+// newStore loads the store from the given path. A missing file is treated as
+// an empty store.
+func newStore(path string) (*store, error) {
+	s := store{
+		path: path,
+		data: make(map[string]Customization),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &s, nil
+		}
+		return nil, fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	if err := json.Unmarshal(data, &s.data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal '%s': %w", path, err)
+	}
+	return &s, nil
+}
+
+// Get returns the customization for a device. The zero value is returned for
+// devices without customizations.
+func (s *store) Get(deviceID string) Customization {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[deviceID]
+}
+
+// Set stores the customization of a device and persists the store to disk.
+func (s *store) Set(deviceID string, c Customization) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c == (Customization{}) {
+		delete(s.data, deviceID)
+	} else {
+		s.data[deviceID] = c
+	}
+	return s.save()
+}
+
+// save writes the store to a temporary file and renames it over the old one,
+// so that a crash never leaves a truncated file behind. Must be called with
+// the lock held.
+func (s *store) save() error {
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal store: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create store directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// Service worker for the tapoweb app shell. Static assets are served from the
+// cache, the page itself is fetched from the network and only falls back to
+// the cached copy when offline. Device state and commands are never cached.
+const CACHE = "tapoweb-v1";
+const STATIC_ASSETS = [
+  "icons/on.png",
+  "icons/off.png",
+  "icons/warning.png",
+  "icons/app.png",
+  "manifest.webmanifest",
+];
+
+self.addEventListener("install", function(event) {
+  event.waitUntil(
+    caches.open(CACHE).then(function(cache) {
+      return cache.addAll(STATIC_ASSETS);
+    })
+  );
+  self.skipWaiting();
+});
+
+self.addEventListener("activate", function(event) {
+  event.waitUntil(
+    caches.keys().then(function(keys) {
+      return Promise.all(keys.filter(function(k) { return k != CACHE; }).map(function(k) { return caches.delete(k); }));
+    })
+  );
+  self.clients.claim();
+});
+
+self.addEventListener("fetch", function(event) {
+  const url = new URL(event.request.url);
+  if (event.request.method != "GET" || url.origin != self.location.origin) {
+    return;
+  }
+  if (url.search != "" || url.pathname.includes("/api/")) {
+    // live state, commands and API responses, always go to the network
+    return;
+  }
+  if (url.pathname.endsWith(".png") || url.pathname.endsWith(".webmanifest")) {
+    event.respondWith(
+      caches.match(event.request).then(function(cached) {
+        return cached || fetch(event.request);
+      })
+    );
+    return;
+  }
+  // the page: network first, cached shell when offline
+  event.respondWith(
+    fetch(event.request).then(function(resp) {
+      if (resp.ok) {
+        const copy = resp.clone();
+        caches.open(CACHE).then(function(cache) { cache.put(event.request, copy); });
+      }
+      return resp;
+    }).catch(function() {
+      return caches.match(event.request);
+    })
+  );
+});
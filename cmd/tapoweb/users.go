@@ -0,0 +1,197 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/tapo/internal/apitoken"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role is the role of a tapoweb user.
+type Role string
+
+const (
+	// RoleAdmin can see and control all the devices.
+	RoleAdmin Role = "admin"
+	// RoleViewer can only see the device state and energy.
+	RoleViewer Role = "viewer"
+)
+
+// scope returns the API scope granted to a role.
+func (r Role) scope() apitoken.Scope {
+	if r == RoleAdmin {
+		return apitoken.ScopeControl
+	}
+	return apitoken.ScopeRead
+}
+
+// User is a tapoweb user.
+type User struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"password_hash"`
+	Role         Role   `json:"role"`
+}
+
+// userStore holds the users, stored as a JSON file.
+type userStore struct {
+	path string
+
+	mu    sync.RWMutex
+	users []User
+}
+
+// loadUsers loads the users from the given file. A missing file, or an empty
+// path, is treated as an empty store.
+func loadUsers(path string) (*userStore, error) {
+	s := userStore{path: path}
+	if path == "" {
+		return &s, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &s, nil
+		}
+		return nil, fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	if err := json.Unmarshal(data, &s.users); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal '%s': %w", path, err)
+	}
+	return &s, nil
+}
+
+// Empty reports whether there are no users. Without users there is no login
+// page.
+func (s *userStore) Empty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users) == 0
+}
+
+// Set adds or replaces a user and saves the store.
+func (s *userStore) Set(name, password string, role Role) error {
+	if role != RoleAdmin && role != RoleViewer {
+		return fmt.Errorf("unknown role '%s', must be one of %s, %s", role, RoleAdmin, RoleViewer)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	u := User{Name: name, PasswordHash: string(hash), Role: role}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	replaced := false
+	for idx := range s.users {
+		if s.users[idx].Name == name {
+			s.users[idx] = u
+			replaced = true
+		}
+	}
+	if !replaced {
+		s.users = append(s.users, u)
+	}
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal users: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create users directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write users: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// dummyHash is compared against when the user does not exist, so that the
+// response time does not tell which users exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// Authenticate returns the user with the given credentials, or nil.
+func (s *userStore) Authenticate(name, password string) *User {
+	s.mu.RLock()
+	var found *User
+	for _, u := range s.users {
+		if u.Name == name {
+			u := u
+			found = &u
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if found == nil {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(found.PasswordHash), []byte(password)) != nil {
+		return nil
+	}
+	return found
+}
+
+// sessionTTL is how long a login lasts.
+const sessionTTL = 30 * 24 * time.Hour
+
+type session struct {
+	user    string
+	role    Role
+	expires time.Time
+}
+
+// sessionStore holds the logged-in sessions in memory. Users have to log in
+// again after a restart.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]session)}
+}
+
+// Create starts a session for a user and returns its ID.
+func (s *sessionStore) Create(u *User) (string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	id := hex.EncodeToString(buf[:])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, v := range s.sessions {
+		if now.After(v.expires) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[id] = session{user: u.Name, role: u.Role, expires: now.Add(sessionTTL)}
+	return id, nil
+}
+
+// Get returns a valid session by ID.
+func (s *sessionStore) Get(id string) (session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok || time.Now().After(sess.expires) {
+		return session{}, false
+	}
+	return sess, true
+}
+
+// Delete ends a session.
+func (s *sessionStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
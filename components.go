@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Component is a feature supported by the device, like energy_monitoring or
+// countdown, with the version of its protocol.
+type Component struct {
+	ID      string `json:"id"`
+	VerCode int    `json:"ver_code"`
+}
+
+// ComponentList is the result of component_nego.
+type ComponentList struct {
+	ComponentList []Component `json:"component_list"`
+}
+
+// Has returns true if the device supports the component with the given ID.
+func (c *ComponentList) Has(id string) bool {
+	for _, comp := range c.ComponentList {
+		if comp.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// GetComponents returns the components supported by the device. The methods
+// of the catalog that require a component are listed in MethodSpec.Component.
+func (p *Plug) GetComponents() (*ComponentList, error) {
+	return p.GetComponentsContext(context.Background())
+}
+
+// GetComponentsContext is like GetComponents, but the request is aborted when
+// ctx is done.
+func (p *Plug) GetComponentsContext(ctx context.Context) (*ComponentList, error) {
+	response, err := p.CallContext(ctx, "component_nego", nil)
+	if err != nil {
+		return nil, err
+	}
+	var resp GetComponentsResponse
+	if err := json.Unmarshal(response, &resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JSON response: %w", err)
+	}
+	return &resp.Result, nil
+}
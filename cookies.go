@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Cookie names set by the devices.
+const (
+	cookieSessionID = "TP_SESSIONID"
+	cookieTimeout   = "TIMEOUT"
+)
+
+// cookieAttributes are the standard Set-Cookie attributes, which are not
+// cookies themselves.
+var cookieAttributes = map[string]bool{
+	"path":     true,
+	"domain":   true,
+	"expires":  true,
+	"max-age":  true,
+	"secure":   true,
+	"httponly": true,
+	"samesite": true,
+}
+
+// parseDeviceCookies returns the cookies set by a device response, by name.
+//
+// The Set-Cookie headers of the devices are not standard, and differ across
+// firmwares: several cookies can be packed in the same header, e.g.
+// "TP_SESSIONID=abc;TIMEOUT=86400", with or without spaces after the
+// separators, and net/http drops everything after the first pair. Standard
+// attributes and parts without a name are skipped, values are unquoted, and
+// if a name appears more than once the last value wins, like in browsers.
+func parseDeviceCookies(h http.Header) map[string]string {
+	cookies := make(map[string]string)
+	for _, line := range h.Values("Set-Cookie") {
+		for _, part := range strings.Split(line, ";") {
+			name, value, ok := strings.Cut(part, "=")
+			if !ok {
+				continue
+			}
+			name = strings.TrimSpace(name)
+			if name == "" || cookieAttributes[strings.ToLower(name)] {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+			cookies[name] = value
+		}
+	}
+	return cookies
+}
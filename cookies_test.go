@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseDeviceCookies(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		headers []string
+		want    map[string]string
+	}{
+		{
+			name:    "klap handshake1",
+			headers: []string{"TP_SESSIONID=3B1E5A1FA8C39B4C1C2FE1B7DB2E6C44;TIMEOUT=86400"},
+			want:    map[string]string{"TP_SESSIONID": "3B1E5A1FA8C39B4C1C2FE1B7DB2E6C44", "TIMEOUT": "86400"},
+		},
+		{
+			name:    "passthrough handshake",
+			headers: []string{"TP_SESSIONID=C9DB5C3AE3C4F0D7D6A1C1E0F24E2B13;TIMEOUT=1440"},
+			want:    map[string]string{"TP_SESSIONID": "C9DB5C3AE3C4F0D7D6A1C1E0F24E2B13", "TIMEOUT": "1440"},
+		},
+		{
+			name:    "spaces after separators",
+			headers: []string{"TP_SESSIONID=abc; TIMEOUT=86400"},
+			want:    map[string]string{"TP_SESSIONID": "abc", "TIMEOUT": "86400"},
+		},
+		{
+			name:    "standard attributes",
+			headers: []string{"TP_SESSIONID=abc; Path=/; HttpOnly; Max-Age=86400; SameSite=Lax"},
+			want:    map[string]string{"TP_SESSIONID": "abc"},
+		},
+		{
+			name:    "one header per cookie",
+			headers: []string{"TP_SESSIONID=abc", "TIMEOUT=86400"},
+			want:    map[string]string{"TP_SESSIONID": "abc", "TIMEOUT": "86400"},
+		},
+		{
+			name:    "duplicate names, last wins",
+			headers: []string{"TP_SESSIONID=old;TIMEOUT=1440", "TP_SESSIONID=new"},
+			want:    map[string]string{"TP_SESSIONID": "new", "TIMEOUT": "1440"},
+		},
+		{
+			name:    "quoted value",
+			headers: []string{`TP_SESSIONID="abc";TIMEOUT="86400"`},
+			want:    map[string]string{"TP_SESSIONID": "abc", "TIMEOUT": "86400"},
+		},
+		{
+			name:    "malformed parts",
+			headers: []string{";;TP_SESSIONID=abc;=nameless;garbage;TIMEOUT=86400;"},
+			want:    map[string]string{"TP_SESSIONID": "abc", "TIMEOUT": "86400"},
+		},
+		{
+			name:    "value containing equal signs",
+			headers: []string{"TP_SESSIONID=YWJj=="},
+			want:    map[string]string{"TP_SESSIONID": "YWJj=="},
+		},
+		{
+			name:    "empty value",
+			headers: []string{"TP_SESSIONID=;TIMEOUT=86400"},
+			want:    map[string]string{"TP_SESSIONID": "", "TIMEOUT": "86400"},
+		},
+		{
+			name: "no cookies",
+			want: map[string]string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := make(http.Header)
+			for _, line := range tc.headers {
+				h.Add("Set-Cookie", line)
+			}
+			if got := parseDeviceCookies(h); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseDeviceCookies(%q) = %v, want %v", tc.headers, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// CountdownState is the state a countdown rule switches the device to.
+type CountdownState struct {
+	On bool `json:"on"`
+}
+
+// CountdownRule switches the device after a delay.
+type CountdownRule struct {
+	ID            string         `json:"id"`
+	Enable        bool           `json:"enable"`
+	Delay         int            `json:"delay"`
+	DesiredStates CountdownState `json:"desired_states"`
+	// Remain is the remaining time in seconds.
+	Remain int `json:"remain"`
+}
+
+// CountdownRules is the result of get_countdown_rules. Plugs support a single
+// rule.
+type CountdownRules struct {
+	Enable   bool            `json:"enable"`
+	MaxCount int             `json:"countdown_rule_max_count"`
+	RuleList []CountdownRule `json:"rule_list"`
+}
+
+// callTyped sends a catalog request and decodes the response into resp. A nil
+// params sends no parameters. The request is aborted when ctx is done.
+func (p *Plug) callTyped(ctx context.Context, method string, params interface{}, resp interface{}) error {
+	var paramsBytes json.RawMessage
+	if params != nil {
+		var err error
+		if paramsBytes, err = json.Marshal(params); err != nil {
+			return fmt.Errorf("failed to marshal %s params: %w", method, err)
+		}
+	}
+	response, err := p.CallContext(ctx, method, paramsBytes)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(response, resp); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON response: %w", err)
+	}
+	return nil
+}
+
+// GetCountdownRules returns the countdown rules of the device. Devices without
+// the countdown component fail with StatusUnknownMethod.
+func (p *Plug) GetCountdownRules() (*CountdownRules, error) {
+	return p.GetCountdownRulesContext(context.Background())
+}
+
+// GetCountdownRulesContext is like GetCountdownRules, but the request is
+// aborted when ctx is done.
+func (p *Plug) GetCountdownRulesContext(ctx context.Context) (*CountdownRules, error) {
+	var resp GetCountdownRulesResponse
+	if err := p.callTyped(ctx, "get_countdown_rules", GetCountdownRulesParams{}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Result, nil
+}
+
+// SetCountdown switches the device on or off after delay, using the countdown
+// rule of the firmware, which runs even if the caller goes away. A zero delay
+// disables the countdown. The delay is rounded to seconds.
+func (p *Plug) SetCountdown(delay time.Duration, on bool) error {
+	return p.SetCountdownContext(context.Background(), delay, on)
+}
+
+// SetCountdownContext is like SetCountdown, but the requests are aborted when
+// ctx is done.
+func (p *Plug) SetCountdownContext(ctx context.Context, delay time.Duration, on bool) error {
+	rules, err := p.GetCountdownRulesContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get countdown rules: %w", err)
+	}
+	secs := int(delay.Round(time.Second) / time.Second)
+	state := CountdownState{On: on}
+	if len(rules.RuleList) > 0 {
+		rule := rules.RuleList[0]
+		params := EditCountdownRuleParams{
+			ID:            rule.ID,
+			Delay:         secs,
+			DesiredStates: state,
+			Enable:        secs > 0,
+			Remain:        secs,
+		}
+		if secs == 0 {
+			// keep the previous delay, some firmwares reject 0
+			params.Delay = rule.Delay
+		}
+		var resp EditCountdownRuleResponse
+		return p.callTyped(ctx, "edit_countdown_rule", params, &resp)
+	}
+	if secs == 0 {
+		return nil
+	}
+	params := AddCountdownRuleParams{
+		Delay:         secs,
+		DesiredStates: state,
+		Enable:        true,
+		Remain:        secs,
+	}
+	var resp AddCountdownRuleResponse
+	return p.callTyped(ctx, "add_countdown_rule", params, &resp)
+}
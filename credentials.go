@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// Credentials are the precomputed forms of the username and password sent by
+// the handshakes, so that a long-running process can log in to devices
+// without holding the plaintext password. They can be stored as JSON.
+type Credentials struct {
+	// KLAPHash is KlapAuthHash(username, password), used by KLAP.
+	KLAPHash []byte `json:"klap_hash,omitempty"`
+	// LoginUsername and LoginPassword are the parameters of the
+	// login_device request of the passthrough protocol. The protocol sends
+	// the password base64-encoded, so LoginPassword is as sensitive as the
+	// password itself: leave it empty to only allow KLAP.
+	LoginUsername string `json:"login_username,omitempty"`
+	LoginPassword string `json:"login_password,omitempty"`
+}
+
+// NewCredentials computes the credentials of a TP-Link account. If passthrough
+// is false, only KLAP devices can be logged in to, and the credentials do not
+// contain the password in a reversible form.
+func NewCredentials(username, password string, passthrough bool) Credentials {
+	c := Credentials{KLAPHash: KlapAuthHash(username, password)}
+	if passthrough {
+		c.LoginUsername, c.LoginPassword = loginParams(username, password)
+	}
+	return c
+}
+
+// loginParams returns the username and password parameters of login_device.
+func loginParams(username, password string) (string, string) {
+	return base64SHA1(username), base64.StdEncoding.EncodeToString([]byte(password))
+}
+
+// loginPassword2 returns the password2 parameter of the version 2 of
+// login_device.
+func loginPassword2(password string) string {
+	return base64SHA1(password)
+}
+
+// base64SHA1 returns the base64 of the hex-encoded SHA1 of s.
+func base64SHA1(s string) string {
+	sum := sha1.Sum([]byte(s))
+	hexsha := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(hexsha, sum[:])
+	return base64.StdEncoding.EncodeToString(hexsha)
+}
@@ -0,0 +1,293 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// DeviceTime is the clock and the time zone of a device.
+type DeviceTime struct {
+	// Timestamp is the device clock, as a Unix timestamp.
+	Timestamp int64 `json:"timestamp"`
+	// TimeDiff is the offset of the device time zone from UTC, in minutes,
+	// including DST.
+	TimeDiff int `json:"time_diff"`
+	// Region is the IANA name of the device time zone, e.g. Europe/Rome.
+	Region string `json:"region"`
+}
+
+// Time returns the device clock, in the device time zone.
+func (dt *DeviceTime) Time() time.Time {
+	return time.Unix(dt.Timestamp, 0).In(dt.Location())
+}
+
+// Location returns the time zone of the device. If the region is not known to
+// the local time zone database, a fixed zone with the current offset is
+// returned, which does not account for future DST changes.
+func (dt *DeviceTime) Location() *time.Location {
+	if dt.Region != "" {
+		if loc, err := time.LoadLocation(dt.Region); err == nil {
+			return loc
+		}
+	}
+	return time.FixedZone(dt.Region, dt.TimeDiff*60)
+}
+
+// NewDeviceTime returns the DeviceTime of t in the time zone loc, with the UTC
+// offset that loc has at t.
+func NewDeviceTime(t time.Time, loc *time.Location) *DeviceTime {
+	_, offset := t.In(loc).Zone()
+	return &DeviceTime{
+		Timestamp: t.Unix(),
+		TimeDiff:  offset / 60,
+		Region:    loc.String(),
+	}
+}
+
+// deviceLocal converts a device-local timestamp to a time in loc. Energy data
+// timestamps count the seconds since the epoch of the device wall clock, as if
+// it were UTC.
+func deviceLocal(ts int64, loc *time.Location) time.Time {
+	t := time.Unix(ts, 0).UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+}
+
+// toDeviceLocal is the inverse of deviceLocal.
+func toDeviceLocal(t time.Time, loc *time.Location) int64 {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC).Unix()
+}
+
+// EnergyInterval is the bucket size of energy data.
+type EnergyInterval int
+
+// Energy data intervals, in minutes.
+const (
+	EnergyHourly  EnergyInterval = 60
+	EnergyDaily   EnergyInterval = 1440
+	EnergyMonthly EnergyInterval = 43200
+)
+
+// EnergyData is the result of get_energy_data.
+type EnergyData struct {
+	LocalTime      string `json:"local_time"`
+	StartTimestamp int64  `json:"start_timestamp"`
+	EndTimestamp   int64  `json:"end_timestamp"`
+	Interval       int    `json:"interval"`
+	// Data is the energy of each bucket, in Wh.
+	Data []int `json:"data"`
+}
+
+// EnergyBucket is the energy consumed in a time interval.
+type EnergyBucket struct {
+	// Start is the start of the bucket, in the device time zone.
+	Start time.Time
+	// Energy is in Wh.
+	Energy int
+}
+
+// Buckets returns the energy data with the timestamps converted to loc, the
+// device time zone returned by DeviceTime.Location. Monthly buckets start on
+// the first day of each month.
+func (ed *EnergyData) Buckets(loc *time.Location) []EnergyBucket {
+	start := deviceLocal(ed.StartTimestamp, loc)
+	ret := make([]EnergyBucket, 0, len(ed.Data))
+	for i, wh := range ed.Data {
+		t := bucketStart(start, i, EnergyInterval(ed.Interval))
+		ret = append(ret, EnergyBucket{Start: t, Energy: wh})
+	}
+	return ret
+}
+
+// bucketStart returns the start of the i-th bucket of energy data starting at
+// start.
+func bucketStart(start time.Time, i int, interval EnergyInterval) time.Time {
+	switch interval {
+	case EnergyMonthly:
+		return time.Date(start.Year(), start.Month()+time.Month(i), 1, 0, 0, 0, 0, start.Location())
+	case EnergyDaily:
+		// days are not always 24h long across DST changes
+		return time.Date(start.Year(), start.Month(), start.Day()+i, 0, 0, 0, 0, start.Location())
+	}
+	// count elapsed time, so that DST changes do not produce duplicate or
+	// missing hours.
+	return start.Add(time.Duration(i*int(interval)) * time.Minute)
+}
+
+// energyChunkEnd returns the end of the largest range starting at t that a
+// device returns in a single get_energy_data response: the end of the day for
+// hourly data, of the quarter for daily data and of the year for monthly data.
+func energyChunkEnd(t time.Time, interval EnergyInterval) time.Time {
+	switch interval {
+	case EnergyMonthly:
+		return time.Date(t.Year()+1, 1, 1, 0, 0, 0, 0, t.Location())
+	case EnergyDaily:
+		q := (t.Month() - 1) / 3
+		return time.Date(t.Year(), 3*q+4, 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+}
+
+func (p *Plug) GetDeviceTime() (*DeviceTime, error) {
+	return p.GetDeviceTimeContext(context.Background())
+}
+
+// GetDeviceTimeContext is like GetDeviceTime, but the request is aborted when
+// ctx is done.
+func (p *Plug) GetDeviceTimeContext(ctx context.Context) (*DeviceTime, error) {
+	if p.currentSession() == nil {
+		return nil, fmt.Errorf("not logged in")
+	}
+	request := NewGetDeviceTimeRequest()
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal get_device_time payload: %w", err)
+	}
+	p.log.Printf("GetDeviceTime request: %s", requestBytes)
+
+	response, err := p.requestContext(ctx, requestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	p.log.Printf("GetDeviceTime response: %s", response)
+	var timeResp GetDeviceTimeResponse
+	if err := json.Unmarshal(response, &timeResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JSON response: %w", err)
+	}
+	if timeResp.ErrorCode != 0 {
+		return nil, fmt.Errorf("request failed: %w", timeResp.ErrorCode)
+	}
+	return &timeResp.Result, nil
+}
+
+// SetDeviceTime sets the clock and the time zone of the device. TimeDiff
+// should match the current offset of Region, see NewDeviceTime.
+func (p *Plug) SetDeviceTime(dt *DeviceTime) error {
+	return p.SetDeviceTimeContext(context.Background(), dt)
+}
+
+// SetDeviceTimeContext is like SetDeviceTime, but the request is aborted when
+// ctx is done.
+func (p *Plug) SetDeviceTimeContext(ctx context.Context, dt *DeviceTime) error {
+	if p.currentSession() == nil {
+		return fmt.Errorf("not logged in")
+	}
+	request := NewSetDeviceTimeRequest(dt.Timestamp, dt.TimeDiff, dt.Region)
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal set_device_time payload: %w", err)
+	}
+	p.log.Printf("SetDeviceTime request: %s", requestBytes)
+
+	response, err := p.requestContext(ctx, requestBytes)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	p.log.Printf("SetDeviceTime response: %s", response)
+	var setResp SetDeviceTimeResponse
+	if err := json.Unmarshal(response, &setResp); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON response: %w", err)
+	}
+	if setResp.ErrorCode != 0 {
+		return fmt.Errorf("request failed: %w", setResp.ErrorCode)
+	}
+	return nil
+}
+
+// GetEnergyData returns the energy consumption between start and end, in
+// buckets of the given interval. loc is the device time zone, see
+// DeviceTime.Location, used to convert start and end to device-local
+// timestamps.
+func (p *Plug) GetEnergyData(start, end time.Time, interval EnergyInterval, loc *time.Location) (*EnergyData, error) {
+	return p.GetEnergyDataContext(context.Background(), start, end, interval, loc)
+}
+
+// GetEnergyDataContext is like GetEnergyData, but the request is aborted when
+// ctx is done.
+func (p *Plug) GetEnergyDataContext(ctx context.Context, start, end time.Time, interval EnergyInterval, loc *time.Location) (*EnergyData, error) {
+	if p.currentSession() == nil {
+		return nil, fmt.Errorf("not logged in")
+	}
+	request := NewGetEnergyDataRequest(toDeviceLocal(start, loc), toDeviceLocal(end, loc), int(interval))
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal get_energy_data payload: %w", err)
+	}
+	p.log.Printf("GetEnergyData request: %s", requestBytes)
+
+	response, err := p.requestContext(ctx, requestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	p.log.Printf("GetEnergyData response: %s", response)
+	var dataResp GetEnergyDataResponse
+	if err := json.Unmarshal(response, &dataResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JSON response: %w", err)
+	}
+	if dataResp.ErrorCode != 0 {
+		return nil, fmt.Errorf("request failed: %w", dataResp.ErrorCode)
+	}
+	return &dataResp.Result, nil
+}
+
+// GetEnergyDataRange is like GetEnergyData, but fetches ranges larger than a
+// device returns at once, e.g. a year of daily data, in chunks aligned to
+// days, quarters or years. The chunks are stitched into a single series.
+// progress, if not nil, is called after each chunk with the number of chunks
+// fetched and the total.
+func (p *Plug) GetEnergyDataRange(start, end time.Time, interval EnergyInterval, loc *time.Location, progress func(done, total int)) (*EnergyData, error) {
+	return p.GetEnergyDataRangeContext(context.Background(), start, end, interval, loc, progress)
+}
+
+// GetEnergyDataRangeContext is like GetEnergyDataRange, but the requests are
+// aborted when ctx is done.
+func (p *Plug) GetEnergyDataRangeContext(ctx context.Context, start, end time.Time, interval EnergyInterval, loc *time.Location, progress func(done, total int)) (*EnergyData, error) {
+	if end.Before(start) {
+		return nil, fmt.Errorf("end %s is before start %s", end, start)
+	}
+	start, end = start.In(loc), end.In(loc)
+	var chunks []time.Time
+	for t := start; !t.After(end); t = energyChunkEnd(t, interval) {
+		chunks = append(chunks, t)
+	}
+	ret := EnergyData{Interval: int(interval)}
+	for idx, from := range chunks {
+		to := end
+		last := idx == len(chunks)-1
+		if !last {
+			// the device range is inclusive
+			to = chunks[idx+1].Add(-time.Second)
+		}
+		data, err := p.GetEnergyDataContext(ctx, from, to, interval, loc)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d of %d starting %s: %w", idx+1, len(chunks), from.Format(time.DateOnly), err)
+		}
+		if idx == 0 {
+			ret.StartTimestamp = data.StartTimestamp
+		}
+		ret.EndTimestamp = data.EndTimestamp
+		ret.LocalTime = data.LocalTime
+		chunkStart := deviceLocal(data.StartTimestamp, loc)
+		n := 0
+		for n < len(data.Data) && (last || bucketStart(chunkStart, n, interval).Before(chunks[idx+1])) {
+			n++
+		}
+		ret.Data = append(ret.Data, data.Data[:n]...)
+		if !last {
+			// keep the following chunks aligned if the device returned
+			// fewer buckets than the chunk spans
+			for bucketStart(chunkStart, n, interval).Before(chunks[idx+1]) {
+				ret.Data = append(ret.Data, 0)
+				n++
+			}
+		}
+		if progress != nil {
+			progress(idx+1, len(chunks))
+		}
+	}
+	return &ret, nil
+}
@@ -0,0 +1,286 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	discoverV1Port = 9999
+	discoverV2Port = 20002
+	// defaultDiscoverTimeout is how long discovery waits for responses.
+	defaultDiscoverTimeout = 5 * time.Second
+)
+
+// discoverV2Request is the payload of a v2 discovery probe.
+var discoverV2Request, _ = hex.DecodeString("020000010000000000000000463cb5d3")
+
+// discoveryInterface is a local IPv4 address to send discovery probes from,
+// with the broadcast address of its network.
+type discoveryInterface struct {
+	name      string
+	local     net.IP
+	broadcast net.IP
+}
+
+func (di discoveryInterface) String() string {
+	return fmt.Sprintf("%s (%s)", di.name, di.local)
+}
+
+// discoveryInterfaces returns the IPv4 addresses of the network interfaces
+// that are up and support broadcast. If names is not empty, only the
+// interfaces with these names are returned.
+func discoveryInterfaces(names []string) ([]discoveryInterface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+	var ret []discoveryInterface
+	for _, iface := range ifaces {
+		if len(names) > 0 {
+			found := false
+			for _, n := range names {
+				if n == iface.Name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get addresses of %s: %w", iface.Name, err)
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip4 := ipnet.IP.To4()
+			if ip4 == nil || len(ipnet.Mask) != net.IPv4len {
+				continue
+			}
+			bcast := make(net.IP, net.IPv4len)
+			for i := range ip4 {
+				bcast[i] = ip4[i] | ^ipnet.Mask[i]
+			}
+			ret = append(ret, discoveryInterface{name: iface.Name, local: ip4, broadcast: bcast})
+		}
+	}
+	if len(names) > 0 && len(ret) == 0 {
+		return nil, fmt.Errorf("no usable IPv4 broadcast interface among %v", names)
+	}
+	return ret, nil
+}
+
+// Discover finds the Tapo devices on the local network via UDP broadcast. It
+// returns the responses of the devices, indexed by device ID, and the
+// responses carrying an error code. Discovery does not stop at the first
+// failure: if responses cannot be read or decoded, the devices found so far
+// are returned along with an error joining all the failures.
+//
+// One socket is used per network interface, and probes are sent to the
+// broadcast address of each interface, so that discovery works on hosts where
+// the default route does not point to the network of the devices, e.g. with
+// VPNs or container bridges.
+func (c *Client) Discover() (map[string]DiscoverResponse, []DiscoverResponse, error) {
+	return c.DiscoverContext(context.Background())
+}
+
+// DiscoverContext is like Discover, but stops listening for responses when ctx
+// is done. The devices found until then are returned, along with an error
+// wrapping ctx.Err().
+func (c *Client) DiscoverContext(ctx context.Context) (map[string]DiscoverResponse, []DiscoverResponse, error) {
+	ret := make(map[string]DiscoverResponse, 0)
+	errs := make([]DiscoverResponse, 0)
+	err := c.discover(ctx, func(resp *DiscoverResponse) {
+		// override earlier responses with later responses
+		if resp.Result.ErrorCode != 0 {
+			errs = append(errs, *resp)
+		} else {
+			ret[resp.Result.DeviceID] = *resp
+		}
+	})
+	return ret, errs, err
+}
+
+// discoverV1Probe returns the payload of a v1 discovery probe: a JSON request
+// XOR'ed with an autokey cipher. It is only built once.
+var discoverV1Probe = sync.OnceValues(func() ([]byte, error) {
+	req := NewDiscoverV1Request()
+	reqb, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal discovery request to JSON: %w", err)
+	}
+	encReq := make([]byte, len(reqb))
+	key := byte(DiscoverV1InitializationVector)
+	for idx := range reqb {
+		key ^= reqb[idx]
+		encReq[idx] = key
+	}
+	return encReq, nil
+})
+
+// discover runs a discovery and calls handle for each response, serially. The
+// response is only valid during the call. See DiscoverContext for the errors.
+func (c *Client) discover(ctx context.Context, handle func(*DiscoverResponse)) error {
+	// discovery protocol v1: send a broadcast UDP message to port 9999
+	// containing a XOR'ed JSON request.
+	encReq, err := discoverV1Probe()
+	if err != nil {
+		return err
+	}
+
+	var ifaces []discoveryInterface
+	if c.discoverTarget != nil {
+		ifaces = []discoveryInterface{{name: "target", local: net.IPv4zero, broadcast: c.discoverTarget.IP}}
+	} else if ifaces, err = discoveryInterfaces(c.discoveryInterfaces); err != nil {
+		return err
+	}
+	if len(ifaces) == 0 {
+		// no suitable interface, fall back to the limited broadcast
+		// address and let the routing table choose.
+		ifaces = []discoveryInterface{{name: "default", local: net.IPv4zero, broadcast: net.IPv4bcast}}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		readErrs []error
+	)
+	for _, iface := range ifaces {
+		wg.Add(1)
+		go func(iface discoveryInterface) {
+			defer wg.Done()
+			n := 0
+			errs := c.discoverOn(ctx, iface, encReq, func(resp *DiscoverResponse) {
+				n++
+				mu.Lock()
+				defer mu.Unlock()
+				handle(resp)
+			})
+			c.log.Printf("Discovery on %s: %d responses, %d errors", iface, n, len(errs))
+			mu.Lock()
+			defer mu.Unlock()
+			for _, e := range errs {
+				readErrs = append(readErrs, fmt.Errorf("%s: %w", iface, e))
+			}
+		}(iface)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		readErrs = append(readErrs, err)
+	}
+	if len(readErrs) > 0 {
+		return fmt.Errorf("discovery incomplete: %w", errors.Join(readErrs...))
+	}
+	return nil
+}
+
+// discoverOn sends the discovery probes out of one interface and passes the
+// responses to handle.
+func (c *Client) discoverOn(ctx context.Context, iface discoveryInterface, reqv1 []byte, handle func(*DiscoverResponse)) []error {
+	pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: iface.local})
+	if err != nil {
+		return []error{fmt.Errorf("failed to listen on packet connection: %w", err)}
+	}
+	defer pc.Close()
+	addrv1 := &net.UDPAddr{IP: iface.broadcast, Port: discoverV1Port}
+	addrv2 := &net.UDPAddr{IP: iface.broadcast, Port: discoverV2Port}
+	if c.discoverTarget != nil {
+		addrv1, addrv2 = c.discoverTarget, c.discoverTarget
+	}
+	if err := pc.SetReadDeadline(time.Now().Add(c.discoverTimeout)); err != nil {
+		return []error{fmt.Errorf("failed to set read deadline: %w", err)}
+	}
+	// on cancellation, expire the deadline so that reading stops as if the
+	// discovery timed out.
+	stop := context.AfterFunc(ctx, func() {
+		_ = pc.SetReadDeadline(time.Now())
+	})
+	defer stop()
+	// send the probes in a different goroutine while listening for
+	// responses
+	go func() {
+		for i := 0; i < 6; i++ {
+			// send req v1
+			if _, err := pc.WriteTo(reqv1, addrv1); err != nil {
+				c.log.Printf("Failed to send broadcast discover v1 packet on %s: %v", iface, err)
+				break
+			}
+			// send req v2
+			if _, err := pc.WriteTo(discoverV2Request, addrv2); err != nil {
+				c.log.Printf("Failed to send broadcast discover v2 packet on %s: %v", iface, err)
+				break
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+	}()
+	return readDiscoverResponses(pc, handle)
+}
+
+// discoverBufSize is the size of the buffer for a discovery response, larger
+// than any response seen in practice.
+const discoverBufSize = 2048
+
+// discoverBufs and discoverResps recycle the buffers and the responses across
+// discoveries, so that a Scanner running for days does not allocate them for
+// every packet.
+var (
+	discoverBufs  = sync.Pool{New: func() any { return new([discoverBufSize]byte) }}
+	discoverResps = sync.Pool{New: func() any { return new(DiscoverResponse) }}
+)
+
+// readDiscoverResponses reads discovery responses from pc until its read
+// deadline expires, and passes them to handle. The response is only valid
+// during the call. Malformed responses are skipped, and a read error stops
+// reading from pc. The errors encountered are returned.
+func readDiscoverResponses(pc net.PacketConn, handle func(*DiscoverResponse)) []error {
+	var errs []error
+	buf := discoverBufs.Get().(*[discoverBufSize]byte)
+	defer discoverBufs.Put(buf)
+	resp := discoverResps.Get().(*DiscoverResponse)
+	defer discoverResps.Put(resp)
+	for {
+		msg := buf[:]
+		n, from, err := pc.ReadFrom(msg)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			errs = append(errs, fmt.Errorf("read failed: %w", err))
+			break
+		}
+		if udpAddr, ok := from.(*net.UDPAddr); ok && udpAddr.Port == discoverV1Port {
+			// v1 responses come from older, non-Tapo devices, which
+			// are not supported.
+			continue
+		}
+		// v2 responses have a 16-byte header before the JSON payload
+		if n < 16 {
+			errs = append(errs, fmt.Errorf("short discover response from %s: %d bytes", from, n))
+			continue
+		}
+		// json.Unmarshal merges into existing values
+		*resp = DiscoverResponse{}
+		if err := json.Unmarshal(msg[16:n], resp); err != nil {
+			errs = append(errs, fmt.Errorf("failed to unmarshal discover response from %s to JSON: %w", from, err))
+			continue
+		}
+		handle(resp)
+	}
+	return errs
+}
@@ -0,0 +1,189 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDiscoveryDevice answers the v2 discovery probes sent to a loopback UDP
+// socket, like a network of devices answering the broadcast probes.
+type fakeDiscoveryDevice struct {
+	conn *net.UDPConn
+
+	mu sync.Mutex
+	// packets are the payloads sent in response to each probe.
+	packets [][]byte
+	// probes is the number of v2 probes received.
+	probes int
+}
+
+// newFakeDiscoveryDevice starts a fake device and returns a client sending its
+// discovery probes to it.
+func newFakeDiscoveryDevice(t *testing.T, packets ...[]byte) (*fakeDiscoveryDevice, *Client) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	d := fakeDiscoveryDevice{conn: conn, packets: packets}
+	done := make(chan struct{})
+	go d.serve(done)
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	c := NewClient(nil)
+	c.discoverTarget = conn.LocalAddr().(*net.UDPAddr)
+	c.discoverTimeout = 300 * time.Millisecond
+	return &d, c
+}
+
+func (d *fakeDiscoveryDevice) serve(done chan struct{}) {
+	defer close(done)
+	buf := make([]byte, discoverBufSize)
+	for {
+		n, from, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(buf[:n], discoverV2Request) {
+			// a v1 probe, there are no v1 devices.
+			continue
+		}
+		d.mu.Lock()
+		d.probes++
+		packets := d.packets
+		d.mu.Unlock()
+		for _, p := range packets {
+			_, _ = d.conn.WriteTo(p, from)
+		}
+	}
+}
+
+// setPackets changes the responses to the next probes.
+func (d *fakeDiscoveryDevice) setPackets(packets ...[]byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.packets = packets
+}
+
+// discoverPacket returns a v2 discovery response with the given JSON payload.
+func discoverPacket(payload string) []byte {
+	return append(make([]byte, 16), payload...)
+}
+
+var (
+	discoveredPlug  = discoverPacket(`{"result":{"device_id":"8022A","device_type":"SMART.TAPOPLUG","device_model":"P110(EU)","ip":"192.0.2.1","mac":"00-11-22-33-44-55","mgt_encrypt_schm":{"encrypt_type":"KLAP","http_port":80,"lv":2}},"error_code":0}`)
+	discoveredBulb  = discoverPacket(`{"result":{"device_id":"8022B","device_type":"SMART.TAPOBULB","device_model":"L530(EU)","ip":"192.0.2.2","mac":"00-11-22-33-44-66"},"error_code":0}`)
+	discoveredError = discoverPacket(`{"result":{"device_id":"8022C","ip":"192.0.2.3","error_code":-40401}}`)
+)
+
+func TestDiscover(t *testing.T) {
+	_, c := newFakeDiscoveryDevice(t, discoveredPlug, discoveredBulb, discoveredError)
+	found, errs, err := c.Discover()
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("found %d devices, want 2", len(found))
+	}
+	plug, ok := found["8022A"]
+	if !ok {
+		t.Fatalf("device 8022A not found")
+	}
+	if got := plug.Result.IP.String(); got != "192.0.2.1" {
+		t.Errorf("IP = %s, want 192.0.2.1", got)
+	}
+	if plug.Result.MgtEncryptSchm.EncryptType != "KLAP" || plug.Result.MgtEncryptSchm.Lv != 2 {
+		t.Errorf("mgt_encrypt_schm = %+v", plug.Result.MgtEncryptSchm)
+	}
+	// every probe is answered, but the errors are not deduplicated
+	if len(errs) == 0 || errs[0].Result.DeviceID != "8022C" || errs[0].Result.ErrorCode != -40401 {
+		t.Errorf("error responses = %+v, want the one of 8022C", errs)
+	}
+}
+
+// TestDiscoverPartial checks that the devices found are returned along with
+// the malformed responses.
+func TestDiscoverPartial(t *testing.T) {
+	_, c := newFakeDiscoveryDevice(t, discoverPacket(`{"result":`), discoveredPlug, []byte("short"))
+	found, _, err := c.Discover()
+	if _, ok := found["8022A"]; !ok || len(found) != 1 {
+		t.Errorf("found = %v, want 8022A", found)
+	}
+	if err == nil {
+		t.Fatalf("Discover of malformed responses succeeded")
+	}
+	for _, want := range []string{"discovery incomplete", "failed to unmarshal", "short discover response"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestDiscoverContext(t *testing.T) {
+	_, c := newFakeDiscoveryDevice(t, discoveredPlug)
+	c.discoverTimeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	found, _, err := c.DiscoverContext(ctx)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("DiscoverContext returned after %s", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, ok := found["8022A"]; !ok {
+		t.Errorf("the devices found before the cancellation were not returned")
+	}
+}
+
+// TestDiscoverProbes checks that the probes are sent repeatedly while waiting
+// for responses, since UDP is lossy.
+func TestDiscoverProbes(t *testing.T) {
+	d, c := newFakeDiscoveryDevice(t)
+	c.discoverTimeout = 500 * time.Millisecond
+	if _, _, err := c.Discover(); err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.probes < 2 {
+		t.Errorf("received %d probes, want at least 2", d.probes)
+	}
+}
+
+func TestDiscoveryInterfaces(t *testing.T) {
+	ifaces, err := discoveryInterfaces(nil)
+	if err != nil {
+		t.Fatalf("discoveryInterfaces failed: %v", err)
+	}
+	for _, di := range ifaces {
+		if di.local.IsLoopback() {
+			t.Errorf("loopback interface %s returned", di)
+		}
+		if di.local.To4() == nil || di.broadcast.To4() == nil {
+			t.Errorf("interface %s is not IPv4", di)
+		}
+	}
+	// the loopback interface cannot broadcast
+	lo, err := net.InterfaceByIndex(1)
+	if err != nil || lo.Flags&net.FlagLoopback == 0 {
+		t.Skip("no loopback interface")
+	}
+	if _, err := discoveryInterfaces([]string{lo.Name}); err == nil {
+		t.Errorf("discoveryInterfaces(%s) succeeded", lo.Name)
+	}
+	if _, err := discoveryInterfaces([]string{"no-such-interface"}); err == nil {
+		t.Errorf("discoveryInterfaces of an unknown interface succeeded")
+	}
+}
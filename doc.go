@@ -0,0 +1,15 @@
+// SPDX-License-Identifier: MIT
+
+// Package tapo implements local and cloud control of TP-Link Tapo smart plugs.
+//
+// The entry points of the API are:
+//   - Plug, created with NewPlug, to talk to a single device on the local
+//     network. It negotiates the KLAP or passthrough protocol on Handshake;
+//   - SessionManager, to share logged-in Plugs across many devices;
+//   - Client, created with NewClient, for cloud operations and local discovery.
+//
+// NewPlug and NewClient accept functional options (PlugOption and
+// ClientOption) so that new settings can be added without breaking callers.
+// Wire-level protocol messages live in an internal package; the aliases kept
+// in this package for compatibility are deprecated and will be removed.
+package tapo
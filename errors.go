@@ -0,0 +1,255 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// TapoError is the error_code returned by a device in its responses. The
+// methods of Plug wrap it in the errors they return, so that callers can test
+// for a specific code with errors.Is, e.g.
+//
+//	if errors.Is(err, tapo.StatusInvalidCredentials) { ... }
+//
+// or get the code with errors.As.
+type TapoError int
+
+// Known device error codes.
+const (
+	StatusSuccess                TapoError = 0
+	StatusTransportNotAvailable  TapoError = 1002
+	StatusCommunicationError     TapoError = 1003
+	StatusHandshakeFailed        TapoError = 1100
+	StatusLoginFailed            TapoError = 1111
+	StatusHTTPTransportFailed    TapoError = 1112
+	StatusMultiRequestFailed     TapoError = 1200
+	StatusSessionTimeout         TapoError = 9999
+	StatusUnspecific             TapoError = -1001
+	StatusUnknownMethod          TapoError = -1002
+	StatusJSONDecodeFailed       TapoError = -1003
+	StatusJSONEncodeFailed       TapoError = -1004
+	StatusAESDecodeFailed        TapoError = -1005
+	StatusRequestLength          TapoError = -1006
+	StatusCloudFailed            TapoError = -1007
+	StatusInvalidParams          TapoError = -1008
+	StatusInvalidPublicKeyLength TapoError = -1010
+	StatusInvalidTerminalUUID    TapoError = -1012
+	StatusSessionParam           TapoError = -1101
+	StatusQuickSetup             TapoError = -1201
+	StatusDevice                 TapoError = -1301
+	StatusDeviceNextEvent        TapoError = -1302
+	StatusFirmware               TapoError = -1401
+	StatusFirmwareVersion        TapoError = -1402
+	StatusInvalidCredentials     TapoError = -1501
+	StatusTime                   TapoError = -1601
+	StatusTimeSys                TapoError = -1602
+	StatusTimeSave               TapoError = -1603
+	StatusWireless               TapoError = -1701
+	StatusWirelessUnsupported    TapoError = -1702
+	StatusSchedule               TapoError = -1801
+	StatusScheduleFull           TapoError = -1802
+	StatusScheduleConflict       TapoError = -1803
+	StatusScheduleSave           TapoError = -1804
+	StatusScheduleIndex          TapoError = -1805
+	StatusCountdown              TapoError = -1901
+	StatusCountdownConflict      TapoError = -1902
+	StatusCountdownSave          TapoError = -1903
+	StatusAntitheft              TapoError = -2001
+	StatusAntitheftConflict      TapoError = -2002
+	StatusAntitheftSave          TapoError = -2003
+	StatusAccount                TapoError = -2101
+	StatusStat                   TapoError = -2201
+	StatusStatSave               TapoError = -2202
+	StatusDST                    TapoError = -2301
+	StatusDSTSave                TapoError = -2302
+
+	// StatusInvalidRequestOrCredentials is StatusInvalidCredentials, named
+	// after its message.
+	StatusInvalidRequestOrCredentials = StatusInvalidCredentials
+)
+
+// Hint is the suggested remediation for a TapoError.
+type Hint int
+
+const (
+	// HintNone means that there is no known remediation.
+	HintNone Hint = iota
+	// HintRetry means that the error is transient, and the same request
+	// can be sent again.
+	HintRetry
+	// HintRehandshake means that the session is not valid anymore, and the
+	// request can be sent again after a new handshake.
+	HintRehandshake
+	// HintCredentials means that the credentials are wrong. Retrying does
+	// not help.
+	HintCredentials
+	// HintUnsupported means that the method or one of its parameters is not
+	// supported by this model or firmware.
+	HintUnsupported
+	// HintInvalidRequest means that the request is malformed, e.g. a
+	// parameter has a wrong type or value.
+	HintInvalidRequest
+	// HintDeviceState means that the request conflicts with the state of
+	// the device, e.g. a full schedule list or an overlapping rule.
+	HintDeviceState
+)
+
+func (h Hint) String() string {
+	switch h {
+	case HintRetry:
+		return "transient error, try again"
+	case HintRehandshake:
+		return "session expired or invalid, handshake again"
+	case HintCredentials:
+		return "check the TP-Link account credentials"
+	case HintUnsupported:
+		return "unsupported on this model or firmware"
+	case HintInvalidRequest:
+		return "invalid request or parameters"
+	case HintDeviceState:
+		return "conflicts with the current device configuration"
+	}
+	return "no known remediation"
+}
+
+// Retryable returns true if the request can succeed when sent again, possibly
+// after a new handshake.
+func (h Hint) Retryable() bool {
+	return h == HintRetry || h == HintRehandshake
+}
+
+type statusInfo struct {
+	message string
+	hint    Hint
+}
+
+var statuses = map[TapoError]statusInfo{
+	StatusSuccess:                {"Success", HintNone},
+	StatusTransportNotAvailable:  {"Incorrect Request", HintUnsupported},
+	StatusCommunicationError:     {"Communication error", HintRetry},
+	StatusHandshakeFailed:        {"Handshake failed", HintRehandshake},
+	StatusLoginFailed:            {"Login failed", HintCredentials},
+	StatusHTTPTransportFailed:    {"HTTP transport failed", HintRetry},
+	StatusMultiRequestFailed:     {"Multiple request failed", HintRetry},
+	StatusSessionTimeout:         {"Session timeout", HintRehandshake},
+	StatusUnspecific:             {"Unspecific error", HintNone},
+	StatusUnknownMethod:          {"Unknown method", HintUnsupported},
+	StatusJSONDecodeFailed:       {"JSON formatting error", HintInvalidRequest},
+	StatusJSONEncodeFailed:       {"JSON encoding error", HintRetry},
+	StatusAESDecodeFailed:        {"AES decoding error", HintRehandshake},
+	StatusRequestLength:          {"Invalid request length", HintInvalidRequest},
+	StatusCloudFailed:            {"Cloud error", HintRetry},
+	StatusInvalidParams:          {"Invalid parameters", HintInvalidRequest},
+	StatusInvalidPublicKeyLength: {"Invalid Public Key Length", HintRehandshake},
+	StatusInvalidTerminalUUID:    {"Invalid terminalUUID", HintRehandshake},
+	StatusSessionParam:           {"Invalid session parameters", HintRehandshake},
+	StatusQuickSetup:             {"Quick setup error", HintNone},
+	StatusDevice:                 {"Device error", HintRetry},
+	StatusDeviceNextEvent:        {"Device next event error", HintRetry},
+	StatusFirmware:               {"Firmware error", HintNone},
+	StatusFirmwareVersion:        {"Invalid firmware version", HintUnsupported},
+	StatusInvalidCredentials:     {"Invalid Request or Credentials", HintCredentials},
+	StatusTime:                   {"Time error", HintNone},
+	StatusTimeSys:                {"System time error", HintNone},
+	StatusTimeSave:               {"Failed to save the time", HintRetry},
+	StatusWireless:               {"Wireless error", HintNone},
+	StatusWirelessUnsupported:    {"Wireless operation unsupported", HintUnsupported},
+	StatusSchedule:               {"Schedule error", HintNone},
+	StatusScheduleFull:           {"Schedule list full", HintDeviceState},
+	StatusScheduleConflict:       {"Schedule conflict", HintDeviceState},
+	StatusScheduleSave:           {"Failed to save the schedule", HintRetry},
+	StatusScheduleIndex:          {"Invalid schedule index", HintInvalidRequest},
+	StatusCountdown:              {"Countdown error", HintNone},
+	StatusCountdownConflict:      {"Countdown conflict", HintDeviceState},
+	StatusCountdownSave:          {"Failed to save the countdown", HintRetry},
+	StatusAntitheft:              {"Anti-theft error", HintNone},
+	StatusAntitheftConflict:      {"Anti-theft conflict", HintDeviceState},
+	StatusAntitheftSave:          {"Failed to save the anti-theft rule", HintRetry},
+	StatusAccount:                {"Account error", HintCredentials},
+	StatusStat:                   {"Statistics error", HintNone},
+	StatusStatSave:               {"Failed to save the statistics", HintRetry},
+	StatusDST:                    {"DST error", HintNone},
+	StatusDSTSave:                {"Failed to save the DST settings", HintRetry},
+}
+
+func (te TapoError) Error() string {
+	if s, ok := statuses[te]; ok {
+		return s.message
+	}
+	return fmt.Sprintf("Unknown error: %d", int(te))
+}
+
+// Hint returns the suggested remediation for the error.
+func (te TapoError) Hint() Hint {
+	return statuses[te].hint
+}
+
+// ErrorHint returns the hint of the TapoError wrapped by err, or HintNone if
+// err does not wrap a TapoError.
+func ErrorHint(err error) Hint {
+	var te TapoError
+	if errors.As(err, &te) {
+		return te.Hint()
+	}
+	return HintNone
+}
+
+// CloudInvalidCredentials is the error_code returned by the TP-Link cloud when
+// the account email or password are wrong.
+const CloudInvalidCredentials = -20601
+
+// CloudError is an error_code returned by the TP-Link cloud. Its codes differ
+// from the ones of the devices.
+type CloudError struct {
+	Code    int
+	Message string
+}
+
+func (e *CloudError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("cloud error %d", e.Code)
+	}
+	return fmt.Sprintf("cloud error %d: %s", e.Code, e.Message)
+}
+
+// Is makes errors.Is(err, StatusInvalidCredentials) true for the wrong
+// credentials of both the devices and the cloud.
+func (e *CloudError) Is(target error) bool {
+	return e.Code == CloudInvalidCredentials && target == StatusInvalidCredentials
+}
+
+// HTTPError is returned when a device answers with an HTTP status other than
+// 200 OK and 403 Forbidden, which is ErrForbidden.
+type HTTPError struct {
+	StatusCode int
+	// Status is the status line, e.g. "500 Internal Server Error".
+	Status string
+	Body   []byte
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("expected 200 OK, got %s. Error message: %s", e.Status, e.Body)
+}
+
+// transientError returns true if err is a device error with HintRetry, like
+// StatusCommunicationError, or a network error that may not happen again,
+// like a timeout or a connection refused or reset while the device reboots or
+// roams between access points.
+func transientError(err error) bool {
+	if ErrorHint(err) == HintRetry {
+		return true
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import "context"
+
+// LatestFirmware is the result of get_latest_fw.
+type LatestFirmware struct {
+	// NeedToUpgrade is true if FWVersion is newer than the installed
+	// firmware.
+	NeedToUpgrade bool   `json:"need_to_upgrade"`
+	FWVersion     string `json:"fw_ver"`
+	FWSize        int    `json:"fw_size"`
+	ReleaseDate   string `json:"release_date"`
+	ReleaseNote   string `json:"release_note"`
+	Type          int    `json:"type"`
+}
+
+// FirmwareDownloadState is the result of get_fw_download_state.
+type FirmwareDownloadState struct {
+	Status int `json:"status"`
+	// DownloadProgress is the percentage of the firmware downloaded.
+	DownloadProgress int `json:"download_progress"`
+	// RebootTime and UpgradeTime are the expected durations of the reboot
+	// and of the installation, in seconds.
+	RebootTime  int  `json:"reboot_time"`
+	UpgradeTime int  `json:"upgrade_time"`
+	AutoUpgrade bool `json:"auto_upgrade"`
+}
+
+// GetLatestFirmware asks the device for the latest firmware published for it.
+// The device queries the cloud, so it needs Internet access.
+func (p *Plug) GetLatestFirmware() (*LatestFirmware, error) {
+	return p.GetLatestFirmwareContext(context.Background())
+}
+
+// GetLatestFirmwareContext is like GetLatestFirmware, but the request is
+// aborted when ctx is done.
+func (p *Plug) GetLatestFirmwareContext(ctx context.Context) (*LatestFirmware, error) {
+	var resp GetLatestFirmwareResponse
+	if err := p.callTyped(ctx, "get_latest_fw", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Result, nil
+}
+
+// UpdateFirmware starts the download and installation of the latest firmware.
+// It returns once the device accepted the request; the device then reboots,
+// and is unreachable for a few minutes.
+func (p *Plug) UpdateFirmware() error {
+	return p.UpdateFirmwareContext(context.Background())
+}
+
+// UpdateFirmwareContext is like UpdateFirmware, but the request is aborted
+// when ctx is done.
+func (p *Plug) UpdateFirmwareContext(ctx context.Context) error {
+	var resp UpdateFirmwareResponse
+	return p.callTyped(ctx, "fw_download", nil, &resp)
+}
+
+// GetFirmwareDownloadState returns the progress of a firmware update started
+// with UpdateFirmware.
+func (p *Plug) GetFirmwareDownloadState() (*FirmwareDownloadState, error) {
+	return p.GetFirmwareDownloadStateContext(context.Background())
+}
+
+// GetFirmwareDownloadStateContext is like GetFirmwareDownloadState, but the
+// request is aborted when ctx is done.
+func (p *Plug) GetFirmwareDownloadStateContext(ctx context.Context) (*FirmwareDownloadState, error) {
+	var resp GetFirmwareDownloadStateResponse
+	if err := p.callTyped(ctx, "get_fw_download_state", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Result, nil
+}
@@ -10,8 +10,9 @@ require (
 	github.com/google/uuid v1.3.1
 	github.com/insomniacslk/xjson v0.0.0-20231023101448-2249e546a131
 	github.com/kirsle/configdir v0.0.0-20170128060238-e45d2f54772f
-	github.com/mergermarket/go-pkcs7 v0.0.0-20170926155232-153b18ea13c9
 	github.com/spf13/pflag v1.0.5
+	golang.org/x/crypto v0.22.0
+	golang.org/x/sync v0.7.0
 )
 
 require (
@@ -24,5 +25,5 @@ require (
 	github.com/getlantern/ops v0.0.0-20190325191751-d70cb0d6f85f // indirect
 	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c // indirect
-	golang.org/x/sys v0.1.0 // indirect
+	golang.org/x/sys v0.19.0 // indirect
 )
@@ -0,0 +1,219 @@
+// SPDX-License-Identifier: MIT
+
+// Package apitoken implements the API tokens shared by the tapo agent and by
+// tapoweb. Each token has a set of scopes and can be restricted to some
+// devices. Only a hash of the tokens is stored.
+package apitoken
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Scope is a permission granted to a token.
+type Scope string
+
+const (
+	// ScopeRead allows reading the device list, state and energy.
+	ScopeRead Scope = "read"
+	// ScopeControl allows turning devices on and off. It implies ScopeRead.
+	ScopeControl Scope = "control"
+)
+
+// ParseScope parses a scope name.
+func ParseScope(s string) (Scope, error) {
+	switch Scope(s) {
+	case ScopeRead, ScopeControl:
+		return Scope(s), nil
+	}
+	return "", fmt.Errorf("unknown scope '%s', must be one of %s, %s", s, ScopeRead, ScopeControl)
+}
+
+// Token is a stored API token.
+type Token struct {
+	Name string `json:"name"`
+	// Hash is the hex-encoded SHA-256 of the token.
+	Hash  string `json:"hash"`
+	Scope Scope  `json:"scope"`
+	// Devices restricts the token to the devices with these IP addresses,
+	// MAC addresses or device IDs. An empty list allows all the devices.
+	Devices []string `json:"devices,omitempty"`
+}
+
+// Allows reports whether the token grants the given scope.
+func (t *Token) Allows(scope Scope) bool {
+	return t.Scope == scope || t.Scope == ScopeControl
+}
+
+// AllowsDevice reports whether the token can access a device, given any of its
+// identifiers. MAC addresses match in any format, e.g. with dashes or colons.
+func (t *Token) AllowsDevice(ids ...string) bool {
+	if len(t.Devices) == 0 {
+		return true
+	}
+	for _, d := range t.Devices {
+		for _, id := range ids {
+			if id != "" && (strings.EqualFold(d, id) || sameMAC(d, id)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameMAC reports whether a and b are the same MAC address.
+func sameMAC(a, b string) bool {
+	ha, err := net.ParseMAC(a)
+	if err != nil {
+		return false
+	}
+	hb, err := net.ParseMAC(b)
+	return err == nil && bytes.Equal(ha, hb)
+}
+
+// ErrNotFound is returned when removing a token that does not exist.
+var ErrNotFound = errors.New("token not found")
+
+// Set is a set of tokens stored in a JSON file.
+type Set struct {
+	path string
+
+	mu     sync.RWMutex
+	tokens []Token
+}
+
+// Load loads the tokens from the given file. A missing file is treated as an
+// empty set.
+func Load(path string) (*Set, error) {
+	s := Set{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &s, nil
+		}
+		return nil, fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	if err := json.Unmarshal(data, &s.tokens); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal '%s': %w", path, err)
+	}
+	return &s, nil
+}
+
+// Empty reports whether the set has no tokens. APIs without tokens are not
+// authenticated.
+func (s *Set) Empty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.tokens) == 0
+}
+
+// List returns the stored tokens.
+func (s *Set) List() []Token {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Token(nil), s.tokens...)
+}
+
+// Create generates a new token, stores it and returns its secret value. The
+// secret cannot be recovered later.
+func (s *Set) Create(name string, scope Scope, devices []string) (string, error) {
+	var buf [24]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	secret := hex.EncodeToString(buf[:])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if t.Name == name {
+			return "", fmt.Errorf("token '%s' already exists", name)
+		}
+	}
+	tokens := append(s.tokens[:len(s.tokens):len(s.tokens)], Token{Name: name, Hash: hash(secret), Scope: scope, Devices: devices})
+	if err := s.save(tokens); err != nil {
+		return "", err
+	}
+	s.tokens = tokens
+	return secret, nil
+}
+
+// Revoke removes a token by name. The token stays valid if the file cannot be
+// written.
+func (s *Set) Revoke(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for idx, t := range s.tokens {
+		if t.Name == name {
+			tokens := append(append([]Token(nil), s.tokens[:idx]...), s.tokens[idx+1:]...)
+			if err := s.save(tokens); err != nil {
+				return err
+			}
+			s.tokens = tokens
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Lookup returns the token matching the given secret, or nil.
+func (s *Set) Lookup(secret string) *Token {
+	if secret == "" {
+		return nil
+	}
+	h := []byte(hash(secret))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(h, []byte(t.Hash)) == 1 {
+			t := t
+			return &t
+		}
+	}
+	return nil
+}
+
+// FromRequest returns the bearer token of a request, or an empty string.
+func FromRequest(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return auth[7:]
+	}
+	return ""
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// save writes the given tokens to disk, before they replace those of the set.
+// Must be called with the lock held.
+func (s *Set) save(tokens []Token) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal tokens: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create tokens directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write tokens: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace tokens: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// SPDX-License-Identifier: MIT
+
+package apitoken
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestSet returns an empty set stored in a temporary directory.
+func newTestSet(t *testing.T) *Set {
+	t.Helper()
+	s, err := Load(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	return s
+}
+
+func TestParseScope(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    Scope
+		wantErr bool
+	}{
+		{"read", ScopeRead, false},
+		{"control", ScopeControl, false},
+		{"admin", "", true},
+		{"", "", true},
+	} {
+		got, err := ParseScope(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("ParseScope(%q) = %q, %v, want %q, error %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	s := newTestSet(t)
+	if !s.Empty() {
+		t.Fatalf("a new set is not empty")
+	}
+	secret, err := s.Create("ha", ScopeRead, []string{"192.0.2.1"})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if s.Empty() {
+		t.Errorf("the set is empty after Create")
+	}
+	tok := s.Lookup(secret)
+	if tok == nil {
+		t.Fatalf("Lookup of the new secret failed")
+	}
+	if tok.Name != "ha" || tok.Scope != ScopeRead || tok.Hash == secret {
+		t.Errorf("Lookup() = %+v", tok)
+	}
+	if s.Lookup(secret+"x") != nil || s.Lookup("") != nil {
+		t.Errorf("Lookup of a wrong secret succeeded")
+	}
+	if _, err := s.Create("ha", ScopeControl, nil); err == nil {
+		t.Errorf("Create of a duplicate name succeeded")
+	}
+
+	// the tokens survive a reload, and only their hash is stored
+	loaded, err := Load(s.path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if tok := loaded.Lookup(secret); tok == nil || tok.Name != "ha" {
+		t.Errorf("Lookup after Load = %+v", tok)
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Errorf("the token file contains the secret")
+	}
+}
+
+func TestAllows(t *testing.T) {
+	for _, tc := range []struct {
+		token Scope
+		scope Scope
+		want  bool
+	}{
+		{ScopeRead, ScopeRead, true},
+		{ScopeRead, ScopeControl, false},
+		{ScopeControl, ScopeRead, true},
+		{ScopeControl, ScopeControl, true},
+	} {
+		tok := Token{Scope: tc.token}
+		if got := tok.Allows(tc.scope); got != tc.want {
+			t.Errorf("%s token: Allows(%s) = %v, want %v", tc.token, tc.scope, got, tc.want)
+		}
+	}
+}
+
+func TestAllowsDevice(t *testing.T) {
+	restricted := Token{Devices: []string{"192.0.2.1", "AA:BB:CC:DD:EE:FF", "8022ABCD"}}
+	for _, tc := range []struct {
+		name  string
+		token Token
+		ids   []string
+		want  bool
+	}{
+		{"unrestricted", Token{}, []string{"192.0.2.9"}, true},
+		{"IP", restricted, []string{"192.0.2.1", "", ""}, true},
+		{"MAC in lower case", restricted, []string{"192.0.2.9", "aa:bb:cc:dd:ee:ff"}, true},
+		{"MAC with dashes", restricted, []string{"aa-bb-cc-dd-ee-ff"}, true},
+		{"device ID", restricted, []string{"", "", "8022abcd"}, true},
+		{"other device", restricted, []string{"192.0.2.9", "11:22:33:44:55:66", "8022FFFF"}, false},
+		{"unknown identifiers", restricted, []string{"", ""}, false},
+		{"no identifiers", restricted, nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.token.AllowsDevice(tc.ids...); got != tc.want {
+				t.Errorf("AllowsDevice(%q) = %v, want %v", tc.ids, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	s := newTestSet(t)
+	first, err := s.Create("first", ScopeRead, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Create("second", ScopeControl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Revoke("first"); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if s.Lookup(first) != nil {
+		t.Errorf("a revoked token is still valid")
+	}
+	if s.Lookup(second) == nil {
+		t.Errorf("Revoke removed another token")
+	}
+	if err := s.Revoke("first"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Revoke of a missing token: err = %v, want %v", err, ErrNotFound)
+	}
+	loaded, err := Load(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Lookup(first) != nil || loaded.Lookup(second) == nil {
+		t.Errorf("the revocation was not saved")
+	}
+}
+
+// TestSaveError checks that the set is unchanged when the token file cannot be
+// written.
+func TestSaveError(t *testing.T) {
+	s := newTestSet(t)
+	secret, err := s.Create("ha", ScopeRead, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a directory in place of the file makes the rename fail
+	if err := os.Remove(s.path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(s.path, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Revoke("ha"); err == nil {
+		t.Fatalf("Revoke succeeded without saving")
+	}
+	if s.Lookup(secret) == nil {
+		t.Errorf("the token was revoked in memory only")
+	}
+	if _, err := s.Create("other", ScopeRead, nil); err == nil {
+		t.Fatalf("Create succeeded without saving")
+	}
+	if got := len(s.List()); got != 1 {
+		t.Errorf("%d tokens after a failed Create, want 1", got)
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   string
+	}{
+		{"Bearer secret", "secret"},
+		{"bearer secret", "secret"},
+		{"Basic secret", ""},
+		{"Bearer ", ""},
+		{"", ""},
+	} {
+		r, err := http.NewRequest(http.MethodGet, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		if got := FromRequest(r); got != tc.want {
+			t.Errorf("FromRequest(%q) = %q, want %q", tc.header, got, tc.want)
+		}
+	}
+}
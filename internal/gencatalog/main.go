@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: MIT
+
+// gencatalog generates the typed requests, responses and constructors of the
+// device methods listed in methods.json, along with the method catalog used
+// by LookupMethod. Run it with `go generate` from the root of the module.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+var (
+	flagIn  = flag.String("in", "methods.json", "Method catalog")
+	flagOut = flag.String("out", "methods_gen.go", "Generated Go file")
+)
+
+type param struct {
+	Name  string `json:"name"`
+	Field string `json:"field"`
+	Type  string `json:"type"`
+	Doc   string `json:"doc"`
+}
+
+// Arg returns the name of the constructor argument for the parameter.
+func (p param) Arg() string {
+	r := []rune(p.Field)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
+
+type method struct {
+	Method    string  `json:"method"`
+	Name      string  `json:"name"`
+	Doc       string  `json:"doc"`
+	Component string  `json:"component"`
+	Timestamp bool    `json:"timestamp"`
+	Params    []param `json:"params"`
+	// Result is the Go type of the result, json.RawMessage if empty.
+	Result string `json:"result"`
+}
+
+func load(path string) ([]method, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var methods []method
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&methods); err != nil {
+		return nil, fmt.Errorf("failed to decode '%s': %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for i, m := range methods {
+		if m.Method == "" || m.Name == "" || m.Doc == "" {
+			return nil, fmt.Errorf("entry %d: method, name and doc are required", i)
+		}
+		if seen[m.Method] {
+			return nil, fmt.Errorf("duplicate method '%s'", m.Method)
+		}
+		seen[m.Method] = true
+		for _, p := range m.Params {
+			if p.Name == "" || p.Field == "" || p.Type == "" || p.Doc == "" {
+				return nil, fmt.Errorf("method '%s': name, field, type and doc are required for params", m.Method)
+			}
+		}
+		if m.Result == "" {
+			methods[i].Result = "json.RawMessage"
+		}
+	}
+	return methods, nil
+}
+
+// imports returns the standard library packages used by the generated code.
+func imports(methods []method) []string {
+	var usesJSON bool
+	for _, m := range methods {
+		usesJSON = usesJSON || strings.Contains(m.Result, "json.")
+		for _, p := range m.Params {
+			usesJSON = usesJSON || strings.Contains(p.Type, "json.")
+		}
+	}
+	var ret []string
+	if usesJSON {
+		ret = append(ret, "encoding/json")
+	}
+	return ret
+}
+
+// comment formats text as a Go comment wrapped at 80 columns, with the given
+// indentation.
+func comment(indent, text string) string {
+	var (
+		lines []string
+		line  string
+	)
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(indent)+3+len(line)+1+len(word) > 80 {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	lines = append(lines, line)
+	return indent + "// " + strings.Join(lines, "\n"+indent+"// ")
+}
+
+func capitalize(s string) string {
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+var funcs = template.FuncMap{
+	"capitalize": capitalize,
+	"comment":    comment,
+}
+
+var tmpl = template.Must(template.New("gen").Funcs(funcs).Parse(`// SPDX-License-Identifier: MIT
+
+// Code generated by gencatalog from methods.json. DO NOT EDIT.
+
+package tapo
+
+import (
+{{- range .Imports}}
+	"{{.}}"
+{{- end}}
+{{- if .Imports}}
+{{end}}
+	"github.com/insomniacslk/tapo/internal/protocol"
+)
+{{range .Methods}}
+{{comment "" (printf "%sRequest is the request of the %s method, which %s." .Name .Method .Doc)}}
+type {{.Name}}Request struct {
+	Envelope
+{{- if .Params}}
+	Params {{.Name}}Params ` + "`json:\"params\"`" + `
+{{- end}}
+}
+{{if .Params}}
+// {{.Name}}Params are the parameters of the {{.Method}} method.
+type {{.Name}}Params struct {
+{{- range .Params}}
+{{comment "\t" (printf "%s %s." .Field .Doc)}}
+	{{.Field}} {{.Type}} ` + "`json:\"{{.Name}}\"`" + `
+{{- end}}
+}
+{{end}}
+// New{{.Name}}Request returns a {{.Method}} request.
+func New{{.Name}}Request({{range $i, $p := .Params}}{{if $i}}, {{end}}{{$p.Arg}} {{$p.Type}}{{end}}) *{{.Name}}Request {
+	r := {{.Name}}Request{
+		Envelope: protocol.NewEnvelope("{{.Method}}", {{.Timestamp}}),
+	}
+{{- range .Params}}
+	r.Params.{{.Field}} = {{.Arg}}
+{{- end}}
+	return &r
+}
+
+// {{.Name}}Response is the response of the {{.Method}} method.
+type {{.Name}}Response struct {
+	ErrorCode TapoError ` + "`json:\"error_code\"`" + `
+	Result {{.Result}} ` + "`json:\"result\"`" + `
+}
+{{end}}
+// methodCatalog lists the methods of methods.json.
+var methodCatalog = []MethodSpec{
+{{- range .Methods}}
+	{
+		Name: "{{.Method}}",
+		Doc: {{printf "%q" (printf "%s." (capitalize .Doc))}},
+		Component: "{{.Component}}",
+{{- if .Params}}
+		Params: []ParamSpec{
+{{- range .Params}}
+			{Name: "{{.Name}}", Type: "{{.Type}}", Doc: {{printf "%q" (printf "%s." (capitalize .Doc))}}},
+{{- end}}
+		},
+		newParams: func() interface{} { return new({{.Name}}Params) },
+{{- end}}
+		newResponse: func() interface{} { return new({{.Name}}Response) },
+	},
+{{- end}}
+}
+`))
+
+func main() {
+	flag.Parse()
+	methods, err := load(*flagIn)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	var buf bytes.Buffer
+	data := struct {
+		Imports []string
+		Methods []method
+	}{
+		Imports: imports(methods),
+		Methods: methods,
+	}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Fatalf("Template execution failed: %v", err)
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("Generated code is invalid: %v\n%s", err, buf.Bytes())
+	}
+	if err := os.WriteFile(*flagOut, src, 0o644); err != nil {
+		log.Fatalf("Failed to write '%s': %v", *flagOut, err)
+	}
+}
@@ -0,0 +1,168 @@
+// SPDX-License-Identifier: MIT
+
+// Package logout implements the log outputs of the long-running commands:
+// the standard streams, size- and time-based rotating files, and syslog,
+// which also reaches journald on systemd hosts.
+package logout
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Syslog is the output name that sends logs to the local syslog daemon.
+const Syslog = "syslog"
+
+// Rotation configures the rotation of file outputs. Zero values disable the
+// corresponding limit.
+type Rotation struct {
+	// MaxSize is the size in bytes after which the file is rotated.
+	MaxSize int64
+	// MaxAge is the time after which the file is rotated.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files to keep.
+	MaxBackups int
+}
+
+// Open returns the output named by spec: stdout, stderr, syslog, or the path
+// of a file that is rotated according to rot. The tag identifies the program
+// in syslog.
+func Open(spec, tag string, rot Rotation) (io.WriteCloser, error) {
+	switch spec {
+	case "", "stderr":
+		return nopCloser{os.Stderr}, nil
+	case "stdout":
+		return nopCloser{os.Stdout}, nil
+	case Syslog:
+		return openSyslog(tag)
+	}
+	return OpenFile(spec, rot)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// File is a log file that rotates itself. Rotated files are renamed to
+// <path>.<timestamp>.
+type File struct {
+	path string
+	rot  Rotation
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenFile opens the log file at path for appending, creating it if needed.
+func OpenFile(path string, rot Rotation) (*File, error) {
+	lf := File{path: path, rot: rot}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return &lf, nil
+}
+
+func (lf *File) open() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	lf.f = f
+	lf.size = fi.Size()
+	lf.opened = time.Now()
+	return nil
+}
+
+// Write writes p to the file, rotating it first if p would exceed the
+// maximum size or if the file is older than the maximum age.
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if lf.needsRotation(len(p)) {
+		if err := lf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+func (lf *File) needsRotation(n int) bool {
+	if lf.size == 0 {
+		return false
+	}
+	if lf.rot.MaxSize > 0 && lf.size+int64(n) > lf.rot.MaxSize {
+		return true
+	}
+	return lf.rot.MaxAge > 0 && time.Since(lf.opened) > lf.rot.MaxAge
+}
+
+// rotate renames the current file and opens a new one. Must be called with
+// the lock held.
+func (lf *File) rotate() error {
+	if err := lf.f.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	lf.f = nil
+	backup := lf.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(lf.path, backup); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	if err := lf.open(); err != nil {
+		return err
+	}
+	return lf.prune()
+}
+
+// prune removes the oldest rotated files beyond the maximum number of
+// backups.
+func (lf *File) prune() error {
+	if lf.rot.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(lf.path + ".*")
+	if err != nil {
+		return err
+	}
+	// timestamps sort lexicographically
+	sort.Strings(backups)
+	for len(backups) > lf.rot.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return fmt.Errorf("failed to remove old log file: %w", err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Close closes the file.
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
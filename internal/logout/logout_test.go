@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: MIT
+
+package logout
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// backups returns the rotated files of the log file at path, oldest first.
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+	files, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestOpen(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want *os.File
+	}{
+		{"", os.Stderr},
+		{"stderr", os.Stderr},
+		{"stdout", os.Stdout},
+	} {
+		w, err := Open(tc.spec, "tapo", Rotation{})
+		if err != nil {
+			t.Fatalf("Open(%q) failed: %v", tc.spec, err)
+		}
+		if nc, ok := w.(nopCloser); !ok || nc.Writer != tc.want {
+			t.Errorf("Open(%q) = %#v, want %s", tc.spec, w, tc.want.Name())
+		}
+		// closing does not close the standard streams
+		if err := w.Close(); err != nil {
+			t.Errorf("Close of %q failed: %v", tc.spec, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "tapo.log")
+	w, err := Open(path, "tapo", Rotation{})
+	if err != nil {
+		t.Fatalf("Open(%q) failed: %v", path, err)
+	}
+	if _, ok := w.(*File); !ok {
+		t.Errorf("Open(%q) = %T, want *File", path, w)
+	}
+	w.Close()
+
+	if _, err := Open(filepath.Join(t.TempDir(), "missing", "tapo.log"), "tapo", Rotation{}); err == nil {
+		t.Errorf("Open in a missing directory succeeded")
+	}
+}
+
+func TestFileAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tapo.log")
+	if err := os.WriteFile(path, []byte("before\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lf, err := OpenFile(path, Rotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lf.Write([]byte("after\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := lf.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := lf.Close(); err != nil {
+		t.Errorf("second Close failed: %v", err)
+	}
+	if got := readFile(t, path); got != "before\nafter\n" {
+		t.Errorf("file = %q, want the lines appended", got)
+	}
+	if _, err := lf.Write([]byte("closed\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write after Close: err = %v, want %v", err, os.ErrClosed)
+	}
+}
+
+func TestFileRotateSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tapo.log")
+	lf, err := OpenFile(path, Rotation{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n"} {
+		if _, err := lf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		// backups are named after the time with millisecond precision
+		time.Sleep(2 * time.Millisecond)
+	}
+	// a line larger than the limit goes to an empty file
+	long := "a line longer than the limit\n"
+	if _, err := lf.Write([]byte(long)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := readFile(t, path); got != long {
+		t.Errorf("file = %q, want %q", got, long)
+	}
+	b := backups(t, path)
+	if len(b) != 3 {
+		t.Fatalf("backups = %v, want 3", b)
+	}
+	for i, want := range []string{"line 1\n", "line 2\n", "line 3\n"} {
+		if got := readFile(t, b[i]); got != want {
+			t.Errorf("backup %d = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestFileRotateAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tapo.log")
+	lf, err := OpenFile(path, Rotation{MaxAge: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	if _, err := lf.Write([]byte("old\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lf.Write([]byte("recent\n")); err != nil {
+		t.Fatal(err)
+	}
+	if b := backups(t, path); len(b) != 0 {
+		t.Fatalf("rotated before the maximum age: %v", b)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := lf.Write([]byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	b := backups(t, path)
+	if len(b) != 1 || readFile(t, b[0]) != "old\nrecent\n" {
+		t.Errorf("backups = %v, want the old lines", b)
+	}
+	if got := readFile(t, path); got != "new\n" {
+		t.Errorf("file = %q, want %q", got, "new\n")
+	}
+}
+
+func TestFilePrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tapo.log")
+	lf, err := OpenFile(path, Rotation{MaxSize: 1, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	for _, line := range []string{"1", "2", "3", "4", "5"} {
+		if _, err := lf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	b := backups(t, path)
+	if len(b) != 2 {
+		t.Fatalf("backups = %v, want 2", b)
+	}
+	// the oldest backups are removed
+	if readFile(t, b[0]) != "3" || readFile(t, b[1]) != "4" {
+		t.Errorf("kept backups %q and %q, want 3 and 4", readFile(t, b[0]), readFile(t, b[1]))
+	}
+	if got := readFile(t, path); got != "5" {
+		t.Errorf("file = %q, want 5", got)
+	}
+}
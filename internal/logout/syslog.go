@@ -0,0 +1,19 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !windows && !plan9
+
+package logout
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+)
+
+func openSyslog(tag string) (io.WriteCloser, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	return w, nil
+}
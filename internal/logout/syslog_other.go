@@ -0,0 +1,14 @@
+// SPDX-License-Identifier: MIT
+
+//go:build windows || plan9
+
+package logout
+
+import (
+	"errors"
+	"io"
+)
+
+func openSyslog(tag string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+
+// Package protocol contains the wire-level messages exchanged with Tapo devices
+// during the handshake and the secure passthrough encapsulation. These are
+// implementation details of the tapo package and are not part of its public
+// API.
+package protocol
+
+import "time"
+
+// Envelope holds the fields common to all the requests to a device. Request
+// structs embed it, so that the fields are marshalled at the top level.
+type Envelope struct {
+	Method string `json:"method"`
+	// RequestTimeMils is the time of the request in milliseconds since the
+	// epoch. It is an int64, which does not overflow on 32-bit platforms.
+	// Methods that do not expect it leave it unset.
+	RequestTimeMils int64 `json:"requestTimeMils,omitempty"`
+	// ID is an optional identifier to correlate requests and responses in
+	// logs and captures. It is only sent when set, since not all firmwares
+	// accept unknown fields.
+	ID uint64 `json:"id,omitempty"`
+}
+
+// NewEnvelope returns the envelope of a request for method. If timestamp is
+// true, RequestTimeMils is set to the current time.
+func NewEnvelope(method string, timestamp bool) Envelope {
+	e := Envelope{Method: method}
+	if timestamp {
+		e.RequestTimeMils = time.Now().UnixMilli()
+	}
+	return e
+}
+
+type HandshakeRequest struct {
+	Envelope
+	Params struct {
+		Key string `json:"key"`
+	} `json:"params"`
+}
+
+type HandshakeResponse struct {
+	ErrorCode int `json:"error_code"`
+	Result    struct {
+		Key string `json:"key"`
+	}
+}
+
+func NewHandshakeRequest(key string) *HandshakeRequest {
+	r := HandshakeRequest{
+		Envelope: NewEnvelope("handshake", true),
+	}
+	r.Params.Key = key
+	return &r
+}
+
+type SecurePassthroughRequest struct {
+	Method string `json:"method"`
+	Params struct {
+		Request string `json:"request"`
+	} `json:"params"`
+}
+
+type SecurePassthroughResponse struct {
+	ErrorCode int `json:"error_code"`
+	Result    struct {
+		Response string `json:"response"`
+	}
+}
+
+func NewSecurePassthroughRequest(innerRequest string) *SecurePassthroughRequest {
+	r := SecurePassthroughRequest{
+		Method: "securePassthrough",
+	}
+	r.Params.Request = innerRequest
+	return &r
+}
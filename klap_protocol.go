@@ -7,52 +7,169 @@ package tapo
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
-	"net/http/cookiejar"
 	"net/netip"
-	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	// klapDefaultTimeout is the session lifetime assumed when the device does
+	// not send a valid TIMEOUT cookie.
+	klapDefaultTimeout = 24 * time.Hour
+)
+
+// errKlapSequence is returned when the signature of a response does not match
+// the sequence number of the request, i.e. the device and the session are out
+// of sync. It is only detected with KlapSession.VerifySignature.
+var errKlapSequence = errors.New("KLAP response does not match the request sequence number")
+
 func NewKlapSession(l *log.Logger) *KlapSession {
+	if l == nil {
+		l = log.New(io.Discard, "", 0)
+	}
 	return &KlapSession{
 		log: l,
 	}
 }
 
 type KlapSession struct {
-	log         *log.Logger
-	addr        netip.Addr
-	username    string
-	password    string
-	SessionID   string
+	// Transport is used for all the HTTP requests to the device. If nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+	// HTTPS makes the session talk to the device over HTTPS, for firmwares
+	// that require it. The TLS settings are those of Transport.
+	HTTPS bool
+	// Port is the HTTP port of the device, see the http_port field of the
+	// discovery response. If zero, the default port of the scheme is used.
+	Port uint16
+	// VerifySignature makes the session check the signature of the
+	// responses, and handshake again when it does not match the sequence
+	// number of the request. It is off by default: the signature of the
+	// responses is not verified by the official clients, and not every
+	// firmware is known to sign them.
+	VerifySignature bool
+	// Timeout is the timeout of each HTTP request to the device, including
+	// the handshakes. Zero means no timeout.
+	//
+	// Transport and Timeout must be set before the first handshake: the
+	// session keeps a single HTTP client, so that the handshakes and the
+	// requests reuse the same keep-alive connection.
+	Timeout  time.Duration
+	client   *http.Client
+	log      *log.Logger
+	addr     netip.Addr
+	username string
+	password string
+	// authHash, if set, is used instead of the hash of username and
+	// password, see HandshakeCredentials.
+	authHash  []byte
+	SessionID string
+	// Expiry is the time at which the device expires the session, computed
+	// from the TIMEOUT cookie and the local clock at handshake time, since the
+	// clock of the device is often wrong.
 	Expiry      time.Time
-	LocalSeed   []byte
-	RemoteSeed  []byte
-	UserHash    []byte
-	key         []byte
-	sig         []byte
-	iv          []byte
+	handshakeAt time.Time
+	// now returns the current time, it is overridden by the tests.
+	now        func() time.Time
+	LocalSeed  []byte
+	RemoteSeed []byte
+	UserHash   []byte
+	// v1 is set when the device accepted a KLAP v1 hash, see KlapAuthHashV1.
+	v1    bool
+	key   []byte
+	block cipher.Block
+	sig   []byte
+	iv    []byte
+	// seq is the sequence number of the last request, it starts from the
+	// last 4 bytes of the IV and increments with every request.
 	seq         int32
 	initialized bool
+	// mu serializes the handshakes and the requests, which share the seeds,
+	// the keys and the sequence number.
+	mu sessionLock
+	// state guards the fields read by IsValid and ExpiresAt. They are
+	// written with both mu and state held, so that IsValid does not wait
+	// for the requests in flight.
+	state sync.Mutex
+}
+
+// httpClient returns the HTTP client of the session, creating it on first use.
+// It must be called with mu held.
+func (s *KlapSession) httpClient() *http.Client {
+	if s.client == nil {
+		s.client = &http.Client{Transport: s.Transport, Timeout: s.Timeout}
+	}
+	return s.client
 }
 
 func (s *KlapSession) Addr() netip.Addr {
 	return s.addr
 }
 
+func (s *KlapSession) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// expired returns true if the session is expired or about to expire, and
+// should be refreshed before sending a request, see sessionExpiring.
+func (s *KlapSession) expired() bool {
+	return sessionExpiring(s.handshakeAt, s.Expiry, s.clock())
+}
+
+// IsValid returns true if the session was established and does not need a new
+// handshake before the next request, i.e. it is not about to expire and its
+// sequence numbers are not exhausted.
+func (s *KlapSession) IsValid() bool {
+	s.state.Lock()
+	defer s.state.Unlock()
+	return s.UserHash != nil && !s.expired() && !s.seqExhausted()
+}
+
+// ExpiresAt returns Expiry.
+func (s *KlapSession) ExpiresAt() time.Time {
+	s.state.Lock()
+	defer s.state.Unlock()
+	return s.Expiry
+}
+
+// seqExhausted returns true if the sequence number would overflow with the
+// next request. Devices reject a sequence number that wraps around, so the
+// session has to be renewed to start from a new one.
+func (s *KlapSession) seqExhausted() bool {
+	return s.initialized && s.seq == math.MaxInt32
+}
+
+// parseKlapTimeout parses the value of the TIMEOUT cookie, the session lifetime
+// in seconds. Missing, malformed and non-positive values result in the default
+// lifetime.
+func parseKlapTimeout(v string) time.Duration {
+	timeout, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || timeout <= 0 || timeout > int64(math.MaxInt64/time.Second) {
+		return klapDefaultTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
 func (s *KlapSession) secretBytes() []byte {
 	ret := append(s.LocalSeed, s.RemoteSeed...)
 	return append(ret, s.UserHash...)
@@ -67,6 +184,19 @@ func (s *KlapSession) getKey() []byte {
 	return s.key
 }
 
+// getBlock returns the AES cipher for the session key, created once per
+// session since it is used by every request.
+func (s *KlapSession) getBlock() (cipher.Block, error) {
+	if s.block == nil {
+		block, err := aes.NewCipher(s.getKey())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new AES block cipher: %w", err)
+		}
+		s.block = block
+	}
+	return s.block, nil
+}
+
 func (s *KlapSession) getSignature() []byte {
 	if s.sig == nil {
 		bytesToHash := append([]byte("ldk"), s.secretBytes()...)
@@ -87,144 +217,184 @@ func (s *KlapSession) getIV() []byte {
 
 func (s *KlapSession) encrypt(data []byte) ([]byte, int32, error) {
 	s.log.Printf("Plaintext: %s", data)
-	key := s.getKey()
+	block, err := s.getBlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	s.state.Lock()
 	if !s.initialized {
 		s.iv = s.getIV()
 		s.seq = int32(binary.BigEndian.Uint32(s.iv[len(s.iv)-4 : len(s.iv)]))
 		s.initialized = true
 	}
 	s.seq++
-	s.log.Printf("Seq: %d", s.seq)
-	binary.BigEndian.PutUint32(s.iv[12:16], uint32(s.seq))
-	s.log.Printf("IV: %v", s.iv)
-	// PKCS7 padding to aes block size (16)
-	neededBytes := (aes.BlockSize - (len(data))%aes.BlockSize)
-	plaintext := make([]byte, len(data)+neededBytes)
-	copy(plaintext, data)
-	for idx := len(data); idx < len(plaintext); idx++ {
-		plaintext[idx] = byte(neededBytes)
-	}
-	s.log.Printf("Padded plaintext: %v", plaintext)
-	ciphertext, err := encryptCBC(key, s.iv[:], plaintext)
-	if err != nil {
-		return nil, 0, fmt.Errorf("encryption failed: %w", err)
-	}
-	s.log.Printf("Ciphertext: %v", ciphertext)
+	seq := s.seq
+	s.state.Unlock()
+	s.log.Printf("Seq: %d", seq)
+	binary.BigEndian.PutUint32(s.iv[12:16], uint32(seq))
+	// the payload is the signature followed by the ciphertext, built in a
+	// single buffer. PKCS7 padding to aes block size (16).
+	neededBytes := aes.BlockSize - len(data)%aes.BlockSize
+	ret := make([]byte, sha256.Size+len(data)+neededBytes)
+	ciphertext := ret[sha256.Size:]
+	copy(ciphertext, data)
+	for idx := len(data); idx < len(ciphertext); idx++ {
+		ciphertext[idx] = byte(neededBytes)
+	}
+	cipher.NewCBCEncrypter(block, s.iv).CryptBlocks(ciphertext, ciphertext)
 
 	// signature
-	bytesToHash := append(s.getSignature(), s.iv[12:16]...)
-	bytesToHash = append(bytesToHash, ciphertext...)
-	s.log.Printf("Digest %d %v", len(bytesToHash), bytesToHash)
-	signature := sha256.Sum256(bytesToHash)
-	s.log.Printf("Signature %d %v", len(signature), signature)
-
-	ret := append(signature[:], ciphertext...)
-	s.log.Printf("Final ciphertext: %d %v", len(ret), ret)
-
-	return ret, s.seq, nil
+	h := sha256.New()
+	h.Write(s.getSignature())
+	h.Write(s.iv[12:16])
+	h.Write(ciphertext)
+	h.Sum(ret[:0])
+	return ret, seq, nil
 }
 
 func (s *KlapSession) decrypt(data []byte) ([]byte, error) {
-	plaintext, err := decryptCBC(s.key, s.iv[:], data[32:])
+	if len(data) < 32 {
+		return nil, fmt.Errorf("payload too short, want at least 32 bytes, got %d", len(data))
+	}
+	block, err := s.getBlock()
 	if err != nil {
 		return nil, err
 	}
+	// the signature covers the sequence number of the request, a mismatch
+	// means that the device answered a different request. It is computed
+	// before decrypting in place, but only reported for well-formed payloads.
+	signed := true
+	if s.VerifySignature {
+		h := sha256.New()
+		h.Write(s.getSignature())
+		h.Write(s.iv[12:16])
+		h.Write(data[32:])
+		signed = bytes.Equal(h.Sum(nil), data[:32])
+	}
+	plaintext, err := decryptCBC(block, s.iv[:], data[32:])
+	if err != nil {
+		return nil, err
+	}
+	if !signed {
+		return nil, errKlapSequence
+	}
+	plaintext, err = unpadPKCS7(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.log.Printf("Plaintext: %s", plaintext)
+	return plaintext, nil
+}
+
+// DecryptSeq decrypts a KLAP request or response payload that was sent with the
+// given sequence number, without altering the state of the session. The
+// session must have its seeds and user hash set. This is useful to decode
+// recorded traffic.
+func (s *KlapSession) DecryptSeq(seq int32, data []byte) ([]byte, error) {
+	if len(data) < 32 {
+		return nil, fmt.Errorf("payload too short, want at least 32 bytes, got %d", len(data))
+	}
+	iv := make([]byte, 16)
+	copy(iv, s.getIV()[:12])
+	binary.BigEndian.PutUint32(iv[12:16], uint32(seq))
+	ciphertext := make([]byte, len(data)-32)
+	copy(ciphertext, data[32:])
+	block, err := s.getBlock()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decryptCBC(block, iv, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return unpadPKCS7(plaintext)
+}
+
+// unpadPKCS7 removes the PKCS7 padding to AES block size (16), used by both
+// protocols.
+func unpadPKCS7(plaintext []byte) ([]byte, error) {
 	if len(plaintext) == 0 {
 		return plaintext, nil
 	}
 	if len(plaintext)%aes.BlockSize != 0 {
 		return nil, fmt.Errorf("plaintext is not padded to AES block size")
 	}
-	// PKCS7 unpadding from aes block size (16)
 	numPadBytes := plaintext[len(plaintext)-1]
+	if numPadBytes == 0 || int(numPadBytes) > aes.BlockSize {
+		return nil, fmt.Errorf("malformed padding")
+	}
 	for n := 1; n < int(numPadBytes); n++ {
 		if plaintext[len(plaintext)-n-1] != numPadBytes {
 			return nil, fmt.Errorf("malformed padding")
 		}
 	}
-	plaintext = plaintext[:len(plaintext)-int(numPadBytes)]
-	s.log.Printf("Plaintext: %v", plaintext)
-	return plaintext, nil
+	return plaintext[:len(plaintext)-int(numPadBytes)], nil
 }
 
-// AES CBC encryption, from https://gist.github.com/locked/b066aa1ddeb2b28e855e
-func encryptCBC(key, iv, plaintext []byte) ([]byte, error) {
-	if len(plaintext)%aes.BlockSize != 0 {
-		return nil, fmt.Errorf("plaintext is not a multiple of the block size")
+// decryptCBC decrypts ciphertext in place.
+func decryptCBC(block cipher.Block, iv, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, fmt.Errorf("ciphertext too short")
 	}
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new AES block cipher: %w", err)
+	if len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("ciphertext is not a multiple of the block size")
 	}
-
-	ciphertext := make([]byte, len(plaintext))
-	cbc := cipher.NewCBCEncrypter(block, iv)
-	cbc.CryptBlocks(ciphertext, plaintext)
-
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
 	return ciphertext, nil
 }
 
-// AES CBC decryption, from https://gist.github.com/locked/b066aa1ddeb2b28e855e
-func decryptCBC(key, iv, ciphertext []byte) ([]byte, error) {
-	var block cipher.Block
+func (s *KlapSession) Request(payload []byte) ([]byte, error) {
+	return s.RequestContext(context.Background(), payload)
+}
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new AES block cipher: %w", err)
+// RequestContext is like Request, but the request and the handshakes it may
+// need are aborted when ctx is done. When the device drops the session,
+// ErrForbidden is returned, and Plug handshakes again within the budget of
+// OptionRehandshakeRetries.
+func (s *KlapSession) RequestContext(ctx context.Context, payload []byte) ([]byte, error) {
+	if err := s.mu.lock(ctx); err != nil {
+		return nil, err
 	}
-
-	if len(ciphertext) < aes.BlockSize {
-		return nil, fmt.Errorf("ciphertext too short")
+	defer s.mu.unlock()
+	if s.expired() {
+		s.log.Printf("KLAP session expires at %s, handshaking again", s.Expiry)
+		if err := s.handshake(ctx, s.addr, s.username, s.password); err != nil {
+			return nil, err
+		}
+	} else if s.seqExhausted() {
+		s.log.Printf("KLAP sequence number exhausted, handshaking again")
+		if err := s.handshake(ctx, s.addr, s.username, s.password); err != nil {
+			return nil, err
+		}
 	}
-
-	cbc := cipher.NewCBCDecrypter(block, iv)
-	cbc.CryptBlocks(ciphertext, ciphertext)
-
-	plaintext := ciphertext
-
-	return plaintext, nil
-}
-
-func (s *KlapSession) Request(payload []byte) ([]byte, error) {
-	ret, err := s.request(payload)
-	if err != ErrForbidden {
+	ret, err := s.request(ctx, payload)
+	if !errors.Is(err, errKlapSequence) {
 		return ret, err
 	}
-	// token expiret? Try to reauthenticate
-	if err := s.Handshake(s.addr, s.username, s.password); err != nil {
+	// the device lost track of the sequence, a new handshake restarts it.
+	s.log.Printf("KLAP request failed (%v), handshaking again", err)
+	if err := s.handshake(ctx, s.addr, s.username, s.password); err != nil {
 		return nil, err
 	}
-	return s.request(payload)
+	return s.request(ctx, payload)
 }
 
-func (s *KlapSession) request(payload []byte) ([]byte, error) {
+func (s *KlapSession) request(ctx context.Context, payload []byte) ([]byte, error) {
 	encrypted, seq, err := s.encrypt(payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to encrypt payload: %w", err)
 	}
 	qs := url.Values{}
 	qs.Add("seq", strconv.FormatInt(int64(seq), 10))
-	u := url.URL{
-		Scheme:   "http",
-		Host:     s.addr.String(),
-		Path:     "/app/request",
-		RawQuery: qs.Encode(),
-	}
+	u := deviceURL(s.addr, s.Port, s.HTTPS, "/app/request")
+	u.RawQuery = qs.Encode()
 	s.log.Printf("Request URL: %s", u.String())
-	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(encrypted))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(encrypted))
 	if err != nil {
 		return nil, fmt.Errorf("http request creation failed: %w", err)
 	}
-	jar, err := cookiejar.New(nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cookie jar: %w", err)
-	}
-	c := http.Client{
-		Jar: jar,
-	}
-	c.Jar.SetCookies(req.URL, []*http.Cookie{&http.Cookie{Name: "TP_SESSIONID", Value: s.SessionID}})
-	resp, err := c.Do(req)
+	req.AddCookie(&http.Cookie{Name: cookieSessionID, Value: s.SessionID})
+	resp, err := s.httpClient().Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("http POST failed: %w", err)
 	}
@@ -237,7 +407,7 @@ func (s *KlapSession) request(payload []byte) ([]byte, error) {
 		if resp.StatusCode == 403 {
 			return nil, ErrForbidden
 		}
-		return nil, fmt.Errorf("expected 200 OK, got %s. Error message: %s", resp.Status, body)
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
 	}
 	decrypted, err := s.decrypt(body)
 	if err != nil {
@@ -247,37 +417,58 @@ func (s *KlapSession) request(payload []byte) ([]byte, error) {
 }
 
 func (s *KlapSession) Handshake(addr netip.Addr, username, password string) error {
+	return s.HandshakeContext(context.Background(), addr, username, password)
+}
+
+// HandshakeContext is like Handshake, but the handshake is aborted when ctx is
+// done.
+func (s *KlapSession) HandshakeContext(ctx context.Context, addr netip.Addr, username, password string) error {
+	if err := s.mu.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.unlock()
+	return s.handshake(ctx, addr, username, password)
+}
+
+// handshake runs both handshakes, with s.mu held.
+func (s *KlapSession) handshake(ctx context.Context, addr netip.Addr, username, password string) error {
 	s.addr = addr
 	s.username = username
 	s.password = password
-	if err := s.handshake1(username, password, addr); err != nil {
+	if err := s.handshake1(ctx, username, password, addr); err != nil {
 		return fmt.Errorf("KLAP handshake1 failed: %w", err)
 	}
-	return s.handshake2(addr)
+	return s.handshake2(ctx, addr)
 }
 
-func (s *KlapSession) handshake2(target netip.Addr) error {
-	u := url.URL{
-		Scheme: "http",
-		Host:   target.String(),
-		Path:   "/app/handshake2",
-	}
-	bytesToHash := append(s.RemoteSeed, s.LocalSeed...)
-	bytesToHash = append(bytesToHash, s.UserHash...)
-	payload := sha256.Sum256(bytesToHash)
-	jar, err := cookiejar.New(nil)
-	if err != nil {
-		return fmt.Errorf("failed to create cookie jar: %w", err)
+// HandshakeCredentials handshakes with precomputed credentials instead of the
+// username and password. Later handshakes of the session, e.g. after it
+// expires, use the same credentials.
+func (s *KlapSession) HandshakeCredentials(addr netip.Addr, c Credentials) error {
+	return s.handshakeCredentials(context.Background(), addr, c)
+}
+
+func (s *KlapSession) handshakeCredentials(ctx context.Context, addr netip.Addr, c Credentials) error {
+	if len(c.KLAPHash) == 0 {
+		return fmt.Errorf("credentials have no KLAP hash")
 	}
-	c := http.Client{
-		Jar: jar,
+	if err := s.mu.lock(ctx); err != nil {
+		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(payload[:]))
+	defer s.mu.unlock()
+	s.authHash = c.KLAPHash
+	return s.handshake(ctx, addr, "", "")
+}
+
+func (s *KlapSession) handshake2(ctx context.Context, target netip.Addr) error {
+	u := deviceURL(target, s.Port, s.HTTPS, "/app/handshake2")
+	payload := klapHandshake2Hash(s.LocalSeed, s.RemoteSeed, s.UserHash, s.v1)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(payload[:]))
 	if err != nil {
 		return fmt.Errorf("http new request creation failed: %w", err)
 	}
-	c.Jar.SetCookies(req.URL, []*http.Cookie{&http.Cookie{Name: "TP_SESSIONID", Value: s.SessionID}})
-	resp, err := c.Do(req)
+	req.AddCookie(&http.Cookie{Name: cookieSessionID, Value: s.SessionID})
+	resp, err := s.httpClient().Do(req)
 	if err != nil {
 		return fmt.Errorf("http POST failed: %w", err)
 	}
@@ -290,23 +481,23 @@ func (s *KlapSession) handshake2(target netip.Addr) error {
 		if resp.StatusCode == 403 {
 			return ErrForbidden
 		}
-		return fmt.Errorf("expected 200 OK, got %s. Error message: %s", resp.Status, body)
+		return &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
 	}
 	return nil
 }
 
-func (s *KlapSession) handshake1(username, password string, target netip.Addr) error {
-	u := url.URL{
-		Scheme: "http",
-		Host:   target.String(),
-		Path:   "/app/handshake1",
-	}
+func (s *KlapSession) handshake1(ctx context.Context, username, password string, target netip.Addr) error {
+	u := deviceURL(target, s.Port, s.HTTPS, "/app/handshake1")
 	var localSeed [16]byte
 	if _, err := rand.Read(localSeed[:]); err != nil {
 		return fmt.Errorf("failed to generate local seed: %w", err)
 	}
-	c := http.Client{}
-	resp, err := c.Post(u.String(), "application/octet-stream", bytes.NewReader(localSeed[:]))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(localSeed[:]))
+	if err != nil {
+		return fmt.Errorf("http new request creation failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.httpClient().Do(req)
 	if err != nil {
 		return fmt.Errorf("http post failed: %w", err)
 	}
@@ -316,74 +507,138 @@ func (s *KlapSession) handshake1(username, password string, target netip.Addr) e
 		return fmt.Errorf("failed to read response body: %w", err)
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("expected 200 OK, got %s. Error message: %s", resp.Status, body)
-	}
-	cookies, err := parseBrokenCookies(resp)
-	if err != nil {
-		return fmt.Errorf("failed to parse cookies: %w", err)
-	}
-	var (
-		sessionID string
-		expiry    time.Time
-	)
-	for _, c := range cookies {
-		if c.Name == "TP_SESSIONID" {
-			sessionID = c.Value
-		} else if c.Name == "TIMEOUT" {
-			timeout, err := strconv.ParseInt(c.Value, 10, 64)
-			if err != nil {
-				return fmt.Errorf("invalid timeout string '%s': %w", c.Value, err)
-			}
-			expiry = time.Now().Add(time.Duration(timeout) * time.Second)
+		if resp.StatusCode == 403 {
+			return ErrForbidden
 		}
+		return &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
+	}
+	cookies := parseDeviceCookies(resp.Header)
+	sessionID := cookies[cookieSessionID]
+	timeout := klapDefaultTimeout
+	if v, ok := cookies[cookieTimeout]; ok {
+		timeout = parseKlapTimeout(v)
+	}
+	// the lifetime counts from when the device answered, as seen by the
+	// local clock.
+	handshakeAt := s.clock()
+	if len(body) < 16 {
+		return fmt.Errorf("handshake1 response too short, want at least 16 bytes, got %d", len(body))
 	}
 	remoteSeed := body[:16]
 	serverHash := body[16:]
-	var bytesToHash []byte
-	calcSha1 := func(s string) []byte {
-		h := sha1.Sum([]byte(s))
-		return h[:]
+	var auth *klapAuth
+	for _, a := range s.authCandidates(username, password) {
+		h := klapHandshake1Hash(localSeed[:], remoteSeed, a.hash, a.v1)
+		if bytes.Equal(h[:], serverHash) {
+			auth = &a
+			break
+		}
 	}
-	bytesToHash = append(bytesToHash, calcSha1(username)...)
-	bytesToHash = append(bytesToHash, calcSha1(password)...)
-	userHash := sha256.Sum256(bytesToHash)
-
-	bytesToHash = append(localSeed[:], remoteSeed...)
-	bytesToHash = append(bytesToHash, userHash[:]...)
-	localSeedAuthHash := sha256.Sum256(bytesToHash)
-
-	if !bytes.Equal(localSeedAuthHash[:], serverHash) {
-		return fmt.Errorf("authentication failed")
+	if auth == nil {
+		return fmt.Errorf("authentication failed: %w", StatusInvalidCredentials)
+	}
+	if auth.fallback != "" {
+		s.log.Printf("KLAP handshake with %s succeeded with %s, the configured credentials were rejected", target, auth.fallback)
 	}
+	userHash := auth.hash
+	s.state.Lock()
+	defer s.state.Unlock()
+	s.v1 = auth.v1
 	s.SessionID = sessionID
-	s.Expiry = expiry
+	s.handshakeAt = handshakeAt
+	s.Expiry = handshakeAt.Add(timeout)
 	s.LocalSeed = localSeed[:]
 	s.RemoteSeed = remoteSeed
-	s.UserHash = userHash[:]
+	s.UserHash = userHash
+	// the keys derive from the seeds, drop the ones of a previous session.
+	s.key, s.sig, s.iv, s.block = nil, nil, nil, nil
+	s.initialized = false
 	return nil
 }
 
-func parseBrokenCookies(r *http.Response) ([]*http.Cookie, error) {
-	// Tapo's HTTP cookies are malformed, so here we go with custom parsing...
-	cookieCount := len(r.Header["Set-Cookie"])
-	cookies := make([]*http.Cookie, 0, cookieCount)
-	if cookieCount != 0 {
-		for _, line := range r.Header["Set-Cookie"] {
-			parts := strings.Split(textproto.TrimString(line), ";")
-			for _, part := range parts {
-				name, value, ok := strings.Cut(part, "=")
-				if !ok {
-					continue
-				}
-				name = textproto.TrimString(name)
-				c := &http.Cookie{
-					Name:  name,
-					Value: value,
-					Raw:   line,
-				}
-				cookies = append(cookies, c)
-			}
-		}
+// klapAuth is an auth hash tried by handshake1.
+type klapAuth struct {
+	hash []byte
+	v1   bool
+	// fallback describes the credentials of the hash, if they are not the
+	// configured ones.
+	fallback string
+}
+
+// klapDefaultCredentials are the usernames and passwords accepted by devices
+// that were never bound to a cloud account, or were reset.
+var klapDefaultCredentials = []struct {
+	name, username, password string
+}{
+	{"blank credentials", "", ""},
+	{"the Kasa default credentials", "kasa@tp-link.net", "kasaSetup"},
+	{"the Tapo default credentials", "test@tp-link.net", "test"},
+}
+
+// authCandidates returns the auth hashes to check the handshake1 response
+// against, in order: the configured credentials, then the default ones,
+// each hashed for KLAP v2 and v1. The check is local, trying more hashes
+// does not send more requests. Precomputed credentials only have a v2 hash.
+func (s *KlapSession) authCandidates(username, password string) []klapAuth {
+	var ret []klapAuth
+	if s.authHash != nil {
+		ret = append(ret, klapAuth{hash: s.authHash})
+	} else {
+		ret = append(ret,
+			klapAuth{hash: KlapAuthHash(username, password)},
+			klapAuth{hash: KlapAuthHashV1(username, password), v1: true},
+		)
+	}
+	for _, c := range klapDefaultCredentials {
+		ret = append(ret,
+			klapAuth{hash: KlapAuthHash(c.username, c.password), fallback: c.name},
+			klapAuth{hash: KlapAuthHashV1(c.username, c.password), v1: true, fallback: c.name + " (KLAP v1)"},
+		)
+	}
+	return ret
+}
+
+// klapHandshake1Hash returns the hash that proves the knowledge of authHash in
+// the handshake1 response.
+func klapHandshake1Hash(localSeed, remoteSeed, authHash []byte, v1 bool) [sha256.Size]byte {
+	var b []byte
+	b = append(b, localSeed...)
+	if !v1 {
+		b = append(b, remoteSeed...)
+	}
+	return sha256.Sum256(append(b, authHash...))
+}
+
+// klapHandshake2Hash returns the payload of the handshake2 request.
+func klapHandshake2Hash(localSeed, remoteSeed, authHash []byte, v1 bool) [sha256.Size]byte {
+	var b []byte
+	b = append(b, remoteSeed...)
+	if !v1 {
+		b = append(b, localSeed...)
+	}
+	return sha256.Sum256(append(b, authHash...))
+}
+
+// KlapAuthHashV1 returns the hash of the credentials used by the first
+// version of KLAP, found on Kasa devices, i.e. MD5(MD5(username) +
+// MD5(password)).
+func KlapAuthHashV1(username, password string) []byte {
+	u := md5.Sum([]byte(username))
+	p := md5.Sum([]byte(password))
+	h := md5.Sum(append(u[:], p[:]...))
+	return h[:]
+}
+
+// KlapAuthHash returns the hash of the credentials used by the KLAP
+// handshake, i.e. SHA256(SHA1(username) + SHA1(password)).
+func KlapAuthHash(username, password string) []byte {
+	var bytesToHash []byte
+	calcSha1 := func(s string) []byte {
+		h := sha1.Sum([]byte(s))
+		return h[:]
 	}
-	return cookies, nil
+	bytesToHash = append(bytesToHash, calcSha1(username)...)
+	bytesToHash = append(bytesToHash, calcSha1(password)...)
+	userHash := sha256.Sum256(bytesToHash)
+	return userHash[:]
 }
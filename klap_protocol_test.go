@@ -0,0 +1,433 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+// fakeKlapDevice is an http.RoundTripper that implements the device side of
+// the KLAP protocol.
+type fakeKlapDevice struct {
+	t          *testing.T
+	username   string
+	password   string
+	timeout    string
+	date       string
+	handshakes int
+	requests   int
+	session    *KlapSession
+	// respond, if set, returns the response to a decrypted request,
+	// otherwise the request is echoed back.
+	respond func(req []byte) []byte
+	// scheme and host are those of the URL of the last request.
+	scheme string
+	host   string
+	// desync is the number of responses to send with a wrong sequence
+	// number, as a device that lost track of the session does.
+	desync int
+	// forbid is the number of requests to reject with HTTP 403, as a
+	// device that dropped the session does.
+	forbid int
+	// forbidHandshake is the handshake step, handshake1 or handshake2,
+	// rejected with HTTP 403.
+	forbidHandshake string
+	// hang makes the device never answer, until the request is cancelled.
+	hang bool
+	// v1 makes the device use the KLAP v1 hashes.
+	v1 bool
+	// mu serializes the requests.
+	mu sync.Mutex
+}
+
+func (d *fakeKlapDevice) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if d.hang {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	resp := http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	if d.date != "" {
+		resp.Header.Set("Date", d.date)
+	}
+	d.scheme, d.host = req.URL.Scheme, req.URL.Host
+	var out []byte
+	switch req.URL.Path {
+	case "/app/handshake1":
+		d.handshakes++
+		if d.forbidHandshake == "handshake1" {
+			resp.StatusCode = http.StatusForbidden
+			break
+		}
+		remoteSeed := bytes.Repeat([]byte{byte(d.handshakes)}, 16)
+		userHash := KlapAuthHash(d.username, d.password)
+		if d.v1 {
+			userHash = KlapAuthHashV1(d.username, d.password)
+		}
+		d.session = NewKlapSession(nil)
+		d.session.LocalSeed, d.session.RemoteSeed, d.session.UserHash = body, remoteSeed, userHash
+		hash := klapHandshake1Hash(body, remoteSeed, userHash, d.v1)
+		cookie := "TP_SESSIONID=session" + strconv.Itoa(d.handshakes)
+		if d.timeout != "" {
+			cookie += ";TIMEOUT=" + d.timeout
+		}
+		resp.Header.Add("Set-Cookie", cookie)
+		out = append(remoteSeed, hash[:]...)
+	case "/app/handshake2":
+		want := klapHandshake2Hash(d.session.LocalSeed, d.session.RemoteSeed, d.session.UserHash, d.v1)
+		if !bytes.Equal(body, want[:]) || d.forbidHandshake == "handshake2" {
+			resp.StatusCode = http.StatusForbidden
+		}
+	case "/app/request":
+		d.requests++
+		seq, err := strconv.ParseInt(req.URL.Query().Get("seq"), 10, 32)
+		if err != nil {
+			d.t.Fatalf("invalid seq: %v", err)
+		}
+		plaintext, err := d.session.DecryptSeq(int32(seq), body)
+		if err != nil || d.forbid > 0 {
+			if d.forbid > 0 {
+				d.forbid--
+			}
+			resp.StatusCode = http.StatusForbidden
+			break
+		}
+		if d.respond != nil {
+			plaintext = d.respond(plaintext)
+		}
+		// reply encrypted with the same seq.
+		if d.desync > 0 {
+			d.desync--
+			seq++
+		}
+		srv := NewKlapSession(nil)
+		srv.LocalSeed, srv.RemoteSeed, srv.UserHash = d.session.LocalSeed, d.session.RemoteSeed, d.session.UserHash
+		srv.iv = append([]byte{}, srv.getIV()...)
+		binary.BigEndian.PutUint32(srv.iv[12:], uint32(seq-1))
+		srv.seq = int32(seq - 1)
+		srv.initialized = true
+		out, _, err = srv.encrypt(plaintext)
+		if err != nil {
+			d.t.Fatalf("encryption failed: %v", err)
+		}
+	default:
+		resp.StatusCode = http.StatusNotFound
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	return &resp, nil
+}
+
+func newTestKlapSession(t *testing.T, dev *fakeKlapDevice, clock *fakeClock) *KlapSession {
+	t.Helper()
+	dev.t = t
+	s := NewKlapSession(nil)
+	s.Transport = dev
+	s.now = clock.now
+	if err := s.Handshake(netip.MustParseAddr("192.0.2.1"), dev.username, dev.password); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	return s
+}
+
+func TestParseKlapTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want time.Duration
+	}{
+		{"86400", 24 * time.Hour},
+		{" 3600 ", time.Hour},
+		{"", klapDefaultTimeout},
+		{"abc", klapDefaultTimeout},
+		{"0", klapDefaultTimeout},
+		{"-10", klapDefaultTimeout},
+		{"99999999999999999999", klapDefaultTimeout},
+	} {
+		if got := parseKlapTimeout(tc.in); got != tc.want {
+			t.Errorf("parseKlapTimeout(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestKlapExpiry(t *testing.T) {
+	start := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		timeout string
+		elapsed time.Duration
+		want    bool
+	}{
+		{"fresh", "86400", 0, false},
+		{"before margin", "86400", 24*time.Hour - sessionExpiryMargin - time.Second, false},
+		{"within margin", "86400", 24*time.Hour - sessionExpiryMargin, true},
+		{"past expiry", "86400", 25 * time.Hour, true},
+		{"short lifetime halves margin", "60", 29 * time.Second, false},
+		{"short lifetime expired", "60", 30 * time.Second, true},
+		{"missing timeout uses default", "", 23 * time.Hour, false},
+		{"clock moved back", "86400", -time.Minute, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := fakeClock{t: start}
+			dev := fakeKlapDevice{username: "user", password: "pass", timeout: tc.timeout}
+			s := newTestKlapSession(t, &dev, &clock)
+			clock.t = start.Add(tc.elapsed)
+			if got := s.expired(); got != tc.want {
+				t.Errorf("expired() = %v, want %v (expiry %s, now %s)", got, tc.want, s.Expiry, clock.t)
+			}
+		})
+	}
+}
+
+// The expiry must only depend on the local clock, whatever the clock of the
+// device says.
+func TestKlapExpiryIgnoresDeviceClock(t *testing.T) {
+	start := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	for _, date := range []string{
+		// devices that never synced their clock
+		"Thu, 01 Jan 1970 00:00:00 GMT",
+		start.Add(48 * time.Hour).Format(http.TimeFormat),
+	} {
+		clock := fakeClock{t: start}
+		dev := fakeKlapDevice{username: "user", password: "pass", timeout: "3600", date: date}
+		s := newTestKlapSession(t, &dev, &clock)
+		if want := start.Add(time.Hour); !s.Expiry.Equal(want) {
+			t.Errorf("device date %q: expiry = %s, want %s", date, s.Expiry, want)
+		}
+		if s.expired() {
+			t.Errorf("device date %q: fresh session reported as expired", date)
+		}
+	}
+}
+
+func TestKlapProactiveRefresh(t *testing.T) {
+	start := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	clock := fakeClock{t: start}
+	dev := fakeKlapDevice{username: "user", password: "pass", timeout: "3600"}
+	s := newTestKlapSession(t, &dev, &clock)
+
+	payload := []byte(`{"method":"get_device_info"}`)
+	resp, err := s.Request(payload)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if !bytes.Equal(resp, payload) {
+		t.Fatalf("unexpected response %q", resp)
+	}
+	if dev.handshakes != 1 {
+		t.Fatalf("handshakes = %d, want 1", dev.handshakes)
+	}
+
+	// close to the expiry the session is renewed before the request, with
+	// fresh keys.
+	clock.t = start.Add(time.Hour - time.Minute)
+	resp, err = s.Request(payload)
+	if err != nil {
+		t.Fatalf("request after refresh failed: %v", err)
+	}
+	if !bytes.Equal(resp, payload) {
+		t.Fatalf("unexpected response after refresh %q", resp)
+	}
+	if dev.handshakes != 2 {
+		t.Fatalf("handshakes = %d, want 2", dev.handshakes)
+	}
+	if dev.requests != 2 {
+		t.Fatalf("requests = %d, want 2", dev.requests)
+	}
+	if s.SessionID != "session2" {
+		t.Errorf("session ID = %q, want session2", s.SessionID)
+	}
+	if want := clock.t.Add(time.Hour); !s.Expiry.Equal(want) {
+		t.Errorf("expiry = %s, want %s", s.Expiry, want)
+	}
+}
+
+func TestKlapSequenceResync(t *testing.T) {
+	clock := fakeClock{t: time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)}
+	dev := fakeKlapDevice{username: "user", password: "pass", desync: 1}
+	s := newTestKlapSession(t, &dev, &clock)
+	s.VerifySignature = true
+
+	payload := []byte(`{"method":"get_device_info"}`)
+	resp, err := s.Request(payload)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if !bytes.Equal(resp, payload) {
+		t.Fatalf("unexpected response %q", resp)
+	}
+	if dev.handshakes != 2 {
+		t.Errorf("handshakes = %d, want 2", dev.handshakes)
+	}
+	if dev.requests != 2 {
+		t.Errorf("requests = %d, want 2", dev.requests)
+	}
+
+	// a device that stays out of sync is reported, not retried forever.
+	dev.desync = 2
+	if _, err := s.Request(payload); !errors.Is(err, errKlapSequence) {
+		t.Errorf("err = %v, want %v", err, errKlapSequence)
+	}
+}
+
+// TestKlapSignatureNotVerified checks that the signature of the responses is
+// ignored by default, without handshaking again.
+func TestKlapSignatureNotVerified(t *testing.T) {
+	clock := fakeClock{t: time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)}
+	dev := fakeKlapDevice{username: "user", password: "pass", desync: 1}
+	s := newTestKlapSession(t, &dev, &clock)
+
+	if _, err := s.Request([]byte(`{"method":"get_device_info"}`)); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if dev.handshakes != 1 {
+		t.Errorf("handshakes = %d, want 1", dev.handshakes)
+	}
+}
+
+// TestKlapHandshakeForbidden checks that both handshake steps report HTTP 403
+// as ErrForbidden.
+func TestKlapHandshakeForbidden(t *testing.T) {
+	for _, step := range []string{"handshake1", "handshake2"} {
+		t.Run(step, func(t *testing.T) {
+			dev := fakeKlapDevice{t: t, username: "user", password: "pass", forbidHandshake: step}
+			s := NewKlapSession(nil)
+			s.Transport = &dev
+			err := s.Handshake(netip.MustParseAddr("192.0.2.1"), dev.username, dev.password)
+			if !errors.Is(err, ErrForbidden) {
+				t.Errorf("err = %v, want %v", err, ErrForbidden)
+			}
+			var herr *HTTPError
+			if errors.As(err, &herr) {
+				t.Errorf("err = %v, want no HTTPError", err)
+			}
+		})
+	}
+}
+
+func TestKlapSequenceRollover(t *testing.T) {
+	clock := fakeClock{t: time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)}
+	dev := fakeKlapDevice{username: "user", password: "pass"}
+	s := newTestKlapSession(t, &dev, &clock)
+
+	payload := []byte(`{"method":"get_device_info"}`)
+	if _, err := s.Request(payload); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	s.seq = math.MaxInt32 - 1
+	if _, err := s.Request(payload); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if dev.handshakes != 1 {
+		t.Fatalf("handshakes = %d before rollover, want 1", dev.handshakes)
+	}
+	// the next request would wrap the sequence number around.
+	resp, err := s.Request(payload)
+	if err != nil {
+		t.Fatalf("request after rollover failed: %v", err)
+	}
+	if !bytes.Equal(resp, payload) {
+		t.Fatalf("unexpected response %q", resp)
+	}
+	if dev.handshakes != 2 {
+		t.Errorf("handshakes = %d after rollover, want 2", dev.handshakes)
+	}
+	if s.seq == math.MinInt32 {
+		t.Errorf("sequence number wrapped around")
+	}
+}
+
+func TestKlapKeepAlive(t *testing.T) {
+	dev := fakeKlapDevice{t: t, username: "user", password: "pass"}
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := dev.RoundTrip(r)
+		if err != nil {
+			t.Errorf("fake device failed: %v", err)
+			return
+		}
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	addrPort := netip.MustParseAddrPort(srv.Listener.Addr().String())
+	plug := NewPlug(addrPort.Addr(), nil, OptionProtocolKLAP, OptionPort(addrPort.Port()))
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	plug.transport = tr
+	if err := plug.Handshake(dev.username, dev.password); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := plug.Call("get_device_info", nil); err != nil {
+			t.Fatalf("request %d failed: %v", i, err)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("got %d connections for a handshake and 3 requests, want 1", n)
+	}
+}
+
+func TestKlapDefaultCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		username, password string
+		v1                 bool
+	}{
+		{"account", "user", "pass", false},
+		{"account v1", "user", "pass", true},
+		{"blank", "", "", false},
+		{"blank v1", "", "", true},
+		{"kasa default v1", "kasa@tp-link.net", "kasaSetup", true},
+		{"tapo default", "test@tp-link.net", "test", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dev := fakeKlapDevice{t: t, username: tc.username, password: tc.password, v1: tc.v1}
+			plug := newFakePlug(&dev)
+			if err := plug.Handshake("user", "pass"); err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			if _, err := plug.GetDeviceInfo(); err != nil {
+				t.Errorf("GetDeviceInfo failed: %v", err)
+			}
+		})
+	}
+}
@@ -3,17 +3,16 @@
 package tapo
 
 import (
-	"crypto/sha1"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"os"
-	"time"
 
+	"github.com/insomniacslk/tapo/internal/protocol"
 	"github.com/insomniacslk/xjson"
 )
 
+//go:generate go run ./internal/gencatalog -in methods.json -out methods_gen.go
+
 const DiscoverV1InitializationVector = 0xab
 
 func NewDiscoverV1Request() *DiscoverV1Request {
@@ -61,37 +60,33 @@ type DiscoverV1Request struct {
 	CamIpcameraCloud GetInfo    `json:"smartlife.cam.ipcamera.cloud"`
 }
 
-type HandshakeRequest struct {
-	Method          string `json:"method"`
-	RequestTimeMils int    `json:"requestTimeMils"`
-	Params          struct {
-		Key string `json:"key"`
-	} `json:"params"`
-}
+// Deprecated: HandshakeRequest is an implementation detail of the passthrough
+// protocol and will be removed from the public API.
+type HandshakeRequest = protocol.HandshakeRequest
 
-type HandshakeResponse struct {
-	ErrorCode TapoError `json:"error_code"`
-	Result    struct {
-		Key string `json:"key"`
-	}
-}
+// Deprecated: HandshakeResponse is an implementation detail of the passthrough
+// protocol and will be removed from the public API.
+type HandshakeResponse = protocol.HandshakeResponse
 
+// Deprecated: NewHandshakeRequest is an implementation detail of the
+// passthrough protocol and will be removed from the public API.
 func NewHandshakeRequest(key string) *HandshakeRequest {
-	r := HandshakeRequest{
-		Method: "handshake",
-	}
-	r.Params.Key = key
-	now := time.Now()
-	r.RequestTimeMils = int(now.UnixMilli())
-	return &r
+	return protocol.NewHandshakeRequest(key)
 }
 
+// Envelope holds the fields common to all the requests to a device, embedded
+// in every request struct.
+type Envelope = protocol.Envelope
+
+// LoginDeviceRequest is the login_device request of the passthrough protocol.
+// Version 1 of the login sends the password in Password, version 2 sends a
+// hash of it in Password2.
 type LoginDeviceRequest struct {
-	Method          string `json:"method"`
-	RequestTimeMils int    `json:"requestTimeMils"`
-	Params          struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+	Envelope
+	Params struct {
+		Username  string `json:"username"`
+		Password  string `json:"password,omitempty"`
+		Password2 string `json:"password2,omitempty"`
 	} `json:"params"`
 }
 
@@ -102,25 +97,27 @@ type LoginDeviceResponse struct {
 	} `json:"result"`
 }
 
+// NewLoginDeviceRequest returns a login_device request, version 1. Some
+// firmwares truncate the passwords longer than 8 characters sent with it, see
+// https://github.com/fishbigger/TapoP100/issues/4 and NewLoginDeviceRequestV2.
 func NewLoginDeviceRequest(username, password string) *LoginDeviceRequest {
-	if len(password) > 8 {
-		fmt.Fprintf(os.Stderr, "Warning: passwords longer than 8 characters will not work due to a Tapo firmware bug, see https://github.com/fishbigger/TapoP100/issues/4")
-	}
 	r := LoginDeviceRequest{
-		Method: "login_device",
+		Envelope: protocol.NewEnvelope("login_device", true),
 	}
-	tmp := sha1.Sum([]byte(username))
-	hexsha := make([]byte, hex.EncodedLen(len(tmp)))
-	hex.Encode(hexsha, tmp[:])
-	r.Params.Username = base64.StdEncoding.EncodeToString(hexsha)
-	r.Params.Password = base64.StdEncoding.EncodeToString([]byte(password))
-	r.RequestTimeMils = int(time.Now().UnixMilli())
+	r.Params.Username, r.Params.Password = loginParams(username, password)
 	return &r
 }
 
-type GetDeviceInfoRequest struct {
-	Method          string `json:"method"`
-	RequestTimeMils int    `json:"requestTimeMils"`
+// NewLoginDeviceRequestV2 returns a login_device request, version 2, for the
+// devices whose discovery response has lv set to 2. It accepts passwords
+// longer than 8 characters.
+func NewLoginDeviceRequestV2(username, password string) *LoginDeviceRequest {
+	r := LoginDeviceRequest{
+		Envelope: protocol.NewEnvelope("login_device", true),
+	}
+	r.Params.Username, _ = loginParams(username, password)
+	r.Params.Password2 = loginPassword2(password)
+	return &r
 }
 
 // TODO differentiate fields between P100 and P110
@@ -163,45 +160,36 @@ type DeviceInfo struct {
 	DecodedSSID string
 	// DecodedNickname is the decoded version of the base64-encoded Nickname field.
 	DecodedNickname string
+	// Warnings lists the fields that could not be decoded. Their decoded
+	// version is set to the raw value.
+	Warnings []FieldWarning `json:",omitempty"`
 }
 
-type GetDeviceInfoResponse struct {
-	ErrorCode TapoError  `json:"error_code"`
-	Result    DeviceInfo `json:"result"`
-}
-
-func NewGetDeviceInfoRequest() *GetDeviceInfoRequest {
-	return &GetDeviceInfoRequest{
-		Method:          "get_device_info",
-		RequestTimeMils: int(time.Now().UnixMilli()),
-	}
+// FieldWarning reports a response field that could not be decoded.
+type FieldWarning struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
 
-type SetDeviceInfoRequest struct {
-	Method string `json:"method"`
-	Params struct {
-		DeviceOn bool `json:"device_on"`
-	} `json:"params"`
+func (w FieldWarning) String() string {
+	return fmt.Sprintf("%s: %s", w.Field, w.Message)
 }
 
-type SetDeviceInfoResponse struct {
-	ErrorCode TapoError `json:"error_code"`
-	Result    struct {
-		Response string `json:"response"`
+// decodeBase64Field decodes a base64-encoded field. Some firmwares return
+// plain text instead, so on failure the raw value is returned and a warning is
+// appended to warnings.
+func decodeBase64Field(name, value string, warnings *[]FieldWarning) string {
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		*warnings = append(*warnings, FieldWarning{Field: name, Message: fmt.Sprintf("not valid base64: %v", err)})
+		return value
 	}
+	return string(decoded)
 }
 
-func NewSetDeviceInfoRequest(deviceOn bool) *SetDeviceInfoRequest {
-	r := SetDeviceInfoRequest{
-		Method: "set_device_info",
-	}
-	r.Params.DeviceOn = deviceOn
-	return &r
-}
-
-type GetDeviceUsageRequest struct {
-	Method          string `json:"method"`
-	RequestTimeMils int    `json:"requestTimeMils"`
+// SetDeviceInfoResult is the result of the set_device_info method.
+type SetDeviceInfoResult struct {
+	Response string `json:"response"`
 }
 
 type DeviceUsage struct {
@@ -232,53 +220,16 @@ type EnergyUsage struct {
 	CurrentPower      int    `json:"current_power"`
 }
 
-type GetDeviceUsageResponse struct {
-	ErrorCode TapoError   `json:"error_code"`
-	Result    DeviceUsage `json:"result"`
-}
-
-func NewGetDeviceUsageRequest() *GetDeviceUsageRequest {
-	return &GetDeviceUsageRequest{
-		Method:          "get_device_usage",
-		RequestTimeMils: int(time.Now().UnixMilli()),
-	}
-}
-
-type GetEnergyUsageRequest struct {
-	Method          string `json:"method"`
-	RequestTimeMils int    `json:"requestTimeMils"`
-}
-
-type GetEnergyUsageResponse struct {
-	ErrorCode TapoError   `json:"error_code"`
-	Result    EnergyUsage `json:"result"`
-}
+// Deprecated: SecurePassthroughRequest is an implementation detail of the
+// passthrough protocol and will be removed from the public API.
+type SecurePassthroughRequest = protocol.SecurePassthroughRequest
 
-func NewGetEnergyUsageRequest() *GetEnergyUsageRequest {
-	return &GetEnergyUsageRequest{
-		Method:          "get_energy_usage",
-		RequestTimeMils: int(time.Now().UnixMilli()),
-	}
-}
-
-type SecurePassthroughRequest struct {
-	Method string `json:"method"`
-	Params struct {
-		Request string `json:"request"`
-	} `json:"params"`
-}
-
-type SecurePassthroughResponse struct {
-	ErrorCode TapoError `json:"error_code"`
-	Result    struct {
-		Response string `json:"response"`
-	}
-}
+// Deprecated: SecurePassthroughResponse is an implementation detail of the
+// passthrough protocol and will be removed from the public API.
+type SecurePassthroughResponse = protocol.SecurePassthroughResponse
 
+// Deprecated: NewSecurePassthroughRequest is an implementation detail of the
+// passthrough protocol and will be removed from the public API.
 func NewSecurePassthroughRequest(innerRequest string) *SecurePassthroughRequest {
-	r := SecurePassthroughRequest{
-		Method: "securePassthrough",
-	}
-	r.Params.Request = innerRequest
-	return &r
+	return protocol.NewSecurePassthroughRequest(innerRequest)
 }
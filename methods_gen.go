@@ -0,0 +1,541 @@
+// SPDX-License-Identifier: MIT
+
+// Code generated by gencatalog from methods.json. DO NOT EDIT.
+
+package tapo
+
+import (
+	"encoding/json"
+
+	"github.com/insomniacslk/tapo/internal/protocol"
+)
+
+// GetDeviceInfoRequest is the request of the get_device_info method, which
+// returns the state, the configuration and the identity of the device.
+type GetDeviceInfoRequest struct {
+	Envelope
+}
+
+// NewGetDeviceInfoRequest returns a get_device_info request.
+func NewGetDeviceInfoRequest() *GetDeviceInfoRequest {
+	r := GetDeviceInfoRequest{
+		Envelope: protocol.NewEnvelope("get_device_info", true),
+	}
+	return &r
+}
+
+// GetDeviceInfoResponse is the response of the get_device_info method.
+type GetDeviceInfoResponse struct {
+	ErrorCode TapoError  `json:"error_code"`
+	Result    DeviceInfo `json:"result"`
+}
+
+// SetDeviceInfoRequest is the request of the set_device_info method, which
+// changes the state of the device.
+type SetDeviceInfoRequest struct {
+	Envelope
+	Params SetDeviceInfoParams `json:"params"`
+}
+
+// SetDeviceInfoParams are the parameters of the set_device_info method.
+type SetDeviceInfoParams struct {
+	// DeviceOn turns the device on or off.
+	DeviceOn bool `json:"device_on"`
+}
+
+// NewSetDeviceInfoRequest returns a set_device_info request.
+func NewSetDeviceInfoRequest(deviceOn bool) *SetDeviceInfoRequest {
+	r := SetDeviceInfoRequest{
+		Envelope: protocol.NewEnvelope("set_device_info", false),
+	}
+	r.Params.DeviceOn = deviceOn
+	return &r
+}
+
+// SetDeviceInfoResponse is the response of the set_device_info method.
+type SetDeviceInfoResponse struct {
+	ErrorCode TapoError           `json:"error_code"`
+	Result    SetDeviceInfoResult `json:"result"`
+}
+
+// GetDeviceUsageRequest is the request of the get_device_usage method, which
+// returns the usage statistics of the device for today, the past 7 and the past
+// 30 days.
+type GetDeviceUsageRequest struct {
+	Envelope
+}
+
+// NewGetDeviceUsageRequest returns a get_device_usage request.
+func NewGetDeviceUsageRequest() *GetDeviceUsageRequest {
+	r := GetDeviceUsageRequest{
+		Envelope: protocol.NewEnvelope("get_device_usage", true),
+	}
+	return &r
+}
+
+// GetDeviceUsageResponse is the response of the get_device_usage method.
+type GetDeviceUsageResponse struct {
+	ErrorCode TapoError   `json:"error_code"`
+	Result    DeviceUsage `json:"result"`
+}
+
+// GetEnergyUsageRequest is the request of the get_energy_usage method, which
+// returns the runtime, the energy consumption and the current power of an
+// energy-monitoring device.
+type GetEnergyUsageRequest struct {
+	Envelope
+}
+
+// NewGetEnergyUsageRequest returns a get_energy_usage request.
+func NewGetEnergyUsageRequest() *GetEnergyUsageRequest {
+	r := GetEnergyUsageRequest{
+		Envelope: protocol.NewEnvelope("get_energy_usage", true),
+	}
+	return &r
+}
+
+// GetEnergyUsageResponse is the response of the get_energy_usage method.
+type GetEnergyUsageResponse struct {
+	ErrorCode TapoError   `json:"error_code"`
+	Result    EnergyUsage `json:"result"`
+}
+
+// GetDeviceTimeRequest is the request of the get_device_time method, which
+// returns the clock, the UTC offset and the time zone of the device.
+type GetDeviceTimeRequest struct {
+	Envelope
+}
+
+// NewGetDeviceTimeRequest returns a get_device_time request.
+func NewGetDeviceTimeRequest() *GetDeviceTimeRequest {
+	r := GetDeviceTimeRequest{
+		Envelope: protocol.NewEnvelope("get_device_time", true),
+	}
+	return &r
+}
+
+// GetDeviceTimeResponse is the response of the get_device_time method.
+type GetDeviceTimeResponse struct {
+	ErrorCode TapoError  `json:"error_code"`
+	Result    DeviceTime `json:"result"`
+}
+
+// SetDeviceTimeRequest is the request of the set_device_time method, which sets
+// the clock and the time zone of the device.
+type SetDeviceTimeRequest struct {
+	Envelope
+	Params SetDeviceTimeParams `json:"params"`
+}
+
+// SetDeviceTimeParams are the parameters of the set_device_time method.
+type SetDeviceTimeParams struct {
+	// Timestamp is the new clock, as a Unix timestamp.
+	Timestamp int64 `json:"timestamp"`
+	// TimeDiff is the offset of the time zone from UTC, in minutes.
+	TimeDiff int `json:"time_diff"`
+	// Region is the IANA name of the time zone.
+	Region string `json:"region"`
+}
+
+// NewSetDeviceTimeRequest returns a set_device_time request.
+func NewSetDeviceTimeRequest(timestamp int64, timeDiff int, region string) *SetDeviceTimeRequest {
+	r := SetDeviceTimeRequest{
+		Envelope: protocol.NewEnvelope("set_device_time", false),
+	}
+	r.Params.Timestamp = timestamp
+	r.Params.TimeDiff = timeDiff
+	r.Params.Region = region
+	return &r
+}
+
+// SetDeviceTimeResponse is the response of the set_device_time method.
+type SetDeviceTimeResponse struct {
+	ErrorCode TapoError       `json:"error_code"`
+	Result    json.RawMessage `json:"result"`
+}
+
+// GetEnergyDataRequest is the request of the get_energy_data method, which
+// returns the energy consumption of an energy-monitoring device over a time
+// range, in hourly, daily or monthly buckets.
+type GetEnergyDataRequest struct {
+	Envelope
+	Params GetEnergyDataParams `json:"params"`
+}
+
+// GetEnergyDataParams are the parameters of the get_energy_data method.
+type GetEnergyDataParams struct {
+	// StartTimestamp is the start of the range, as a device-local Unix timestamp.
+	StartTimestamp int64 `json:"start_timestamp"`
+	// EndTimestamp is the end of the range, as a device-local Unix timestamp.
+	EndTimestamp int64 `json:"end_timestamp"`
+	// Interval is the bucket size in minutes: 60, 1440 or 43200.
+	Interval int `json:"interval"`
+}
+
+// NewGetEnergyDataRequest returns a get_energy_data request.
+func NewGetEnergyDataRequest(startTimestamp int64, endTimestamp int64, interval int) *GetEnergyDataRequest {
+	r := GetEnergyDataRequest{
+		Envelope: protocol.NewEnvelope("get_energy_data", true),
+	}
+	r.Params.StartTimestamp = startTimestamp
+	r.Params.EndTimestamp = endTimestamp
+	r.Params.Interval = interval
+	return &r
+}
+
+// GetEnergyDataResponse is the response of the get_energy_data method.
+type GetEnergyDataResponse struct {
+	ErrorCode TapoError  `json:"error_code"`
+	Result    EnergyData `json:"result"`
+}
+
+// GetComponentsRequest is the request of the component_nego method, which
+// returns the components supported by the device, i.e. its features and their
+// versions.
+type GetComponentsRequest struct {
+	Envelope
+}
+
+// NewGetComponentsRequest returns a component_nego request.
+func NewGetComponentsRequest() *GetComponentsRequest {
+	r := GetComponentsRequest{
+		Envelope: protocol.NewEnvelope("component_nego", false),
+	}
+	return &r
+}
+
+// GetComponentsResponse is the response of the component_nego method.
+type GetComponentsResponse struct {
+	ErrorCode TapoError     `json:"error_code"`
+	Result    ComponentList `json:"result"`
+}
+
+// MultipleRequestRequest is the request of the multipleRequest method, which
+// runs several requests in a single round trip, and returns their responses in
+// order.
+type MultipleRequestRequest struct {
+	Envelope
+	Params MultipleRequestParams `json:"params"`
+}
+
+// MultipleRequestParams are the parameters of the multipleRequest method.
+type MultipleRequestParams struct {
+	// Requests are the batched requests.
+	Requests []SubRequest `json:"requests"`
+}
+
+// NewMultipleRequestRequest returns a multipleRequest request.
+func NewMultipleRequestRequest(requests []SubRequest) *MultipleRequestRequest {
+	r := MultipleRequestRequest{
+		Envelope: protocol.NewEnvelope("multipleRequest", false),
+	}
+	r.Params.Requests = requests
+	return &r
+}
+
+// MultipleRequestResponse is the response of the multipleRequest method.
+type MultipleRequestResponse struct {
+	ErrorCode TapoError             `json:"error_code"`
+	Result    MultipleRequestResult `json:"result"`
+}
+
+// GetLatestFirmwareRequest is the request of the get_latest_fw method, which
+// returns the latest firmware available from the cloud for the device, and
+// whether it is newer than the installed one.
+type GetLatestFirmwareRequest struct {
+	Envelope
+}
+
+// NewGetLatestFirmwareRequest returns a get_latest_fw request.
+func NewGetLatestFirmwareRequest() *GetLatestFirmwareRequest {
+	r := GetLatestFirmwareRequest{
+		Envelope: protocol.NewEnvelope("get_latest_fw", false),
+	}
+	return &r
+}
+
+// GetLatestFirmwareResponse is the response of the get_latest_fw method.
+type GetLatestFirmwareResponse struct {
+	ErrorCode TapoError      `json:"error_code"`
+	Result    LatestFirmware `json:"result"`
+}
+
+// UpdateFirmwareRequest is the request of the fw_download method, which
+// downloads and installs the latest firmware, after which the device reboots.
+type UpdateFirmwareRequest struct {
+	Envelope
+}
+
+// NewUpdateFirmwareRequest returns a fw_download request.
+func NewUpdateFirmwareRequest() *UpdateFirmwareRequest {
+	r := UpdateFirmwareRequest{
+		Envelope: protocol.NewEnvelope("fw_download", false),
+	}
+	return &r
+}
+
+// UpdateFirmwareResponse is the response of the fw_download method.
+type UpdateFirmwareResponse struct {
+	ErrorCode TapoError       `json:"error_code"`
+	Result    json.RawMessage `json:"result"`
+}
+
+// GetFirmwareDownloadStateRequest is the request of the get_fw_download_state
+// method, which returns the progress of a firmware update started with
+// fw_download.
+type GetFirmwareDownloadStateRequest struct {
+	Envelope
+}
+
+// NewGetFirmwareDownloadStateRequest returns a get_fw_download_state request.
+func NewGetFirmwareDownloadStateRequest() *GetFirmwareDownloadStateRequest {
+	r := GetFirmwareDownloadStateRequest{
+		Envelope: protocol.NewEnvelope("get_fw_download_state", false),
+	}
+	return &r
+}
+
+// GetFirmwareDownloadStateResponse is the response of the get_fw_download_state method.
+type GetFirmwareDownloadStateResponse struct {
+	ErrorCode TapoError             `json:"error_code"`
+	Result    FirmwareDownloadState `json:"result"`
+}
+
+// GetCountdownRulesRequest is the request of the get_countdown_rules method,
+// which returns the countdown rules of the device, which switch it after a
+// delay.
+type GetCountdownRulesRequest struct {
+	Envelope
+	Params GetCountdownRulesParams `json:"params"`
+}
+
+// GetCountdownRulesParams are the parameters of the get_countdown_rules method.
+type GetCountdownRulesParams struct {
+	// StartIndex is the index of the first rule to return.
+	StartIndex int `json:"start_index"`
+}
+
+// NewGetCountdownRulesRequest returns a get_countdown_rules request.
+func NewGetCountdownRulesRequest(startIndex int) *GetCountdownRulesRequest {
+	r := GetCountdownRulesRequest{
+		Envelope: protocol.NewEnvelope("get_countdown_rules", false),
+	}
+	r.Params.StartIndex = startIndex
+	return &r
+}
+
+// GetCountdownRulesResponse is the response of the get_countdown_rules method.
+type GetCountdownRulesResponse struct {
+	ErrorCode TapoError      `json:"error_code"`
+	Result    CountdownRules `json:"result"`
+}
+
+// AddCountdownRuleRequest is the request of the add_countdown_rule method,
+// which adds a countdown rule, which switches the device after a delay.
+type AddCountdownRuleRequest struct {
+	Envelope
+	Params AddCountdownRuleParams `json:"params"`
+}
+
+// AddCountdownRuleParams are the parameters of the add_countdown_rule method.
+type AddCountdownRuleParams struct {
+	// Delay is the delay in seconds.
+	Delay int `json:"delay"`
+	// DesiredStates is the state of the device when the delay expires.
+	DesiredStates CountdownState `json:"desired_states"`
+	// Enable enables the rule.
+	Enable bool `json:"enable"`
+	// Remain is the remaining time in seconds, equal to delay for a new rule.
+	Remain int `json:"remain"`
+}
+
+// NewAddCountdownRuleRequest returns a add_countdown_rule request.
+func NewAddCountdownRuleRequest(delay int, desiredStates CountdownState, enable bool, remain int) *AddCountdownRuleRequest {
+	r := AddCountdownRuleRequest{
+		Envelope: protocol.NewEnvelope("add_countdown_rule", false),
+	}
+	r.Params.Delay = delay
+	r.Params.DesiredStates = desiredStates
+	r.Params.Enable = enable
+	r.Params.Remain = remain
+	return &r
+}
+
+// AddCountdownRuleResponse is the response of the add_countdown_rule method.
+type AddCountdownRuleResponse struct {
+	ErrorCode TapoError       `json:"error_code"`
+	Result    json.RawMessage `json:"result"`
+}
+
+// EditCountdownRuleRequest is the request of the edit_countdown_rule method,
+// which changes an existing countdown rule.
+type EditCountdownRuleRequest struct {
+	Envelope
+	Params EditCountdownRuleParams `json:"params"`
+}
+
+// EditCountdownRuleParams are the parameters of the edit_countdown_rule method.
+type EditCountdownRuleParams struct {
+	// ID is the ID of the rule, as returned by get_countdown_rules.
+	ID string `json:"id"`
+	// Delay is the delay in seconds.
+	Delay int `json:"delay"`
+	// DesiredStates is the state of the device when the delay expires.
+	DesiredStates CountdownState `json:"desired_states"`
+	// Enable enables or disables the rule.
+	Enable bool `json:"enable"`
+	// Remain is the remaining time in seconds.
+	Remain int `json:"remain"`
+}
+
+// NewEditCountdownRuleRequest returns a edit_countdown_rule request.
+func NewEditCountdownRuleRequest(iD string, delay int, desiredStates CountdownState, enable bool, remain int) *EditCountdownRuleRequest {
+	r := EditCountdownRuleRequest{
+		Envelope: protocol.NewEnvelope("edit_countdown_rule", false),
+	}
+	r.Params.ID = iD
+	r.Params.Delay = delay
+	r.Params.DesiredStates = desiredStates
+	r.Params.Enable = enable
+	r.Params.Remain = remain
+	return &r
+}
+
+// EditCountdownRuleResponse is the response of the edit_countdown_rule method.
+type EditCountdownRuleResponse struct {
+	ErrorCode TapoError       `json:"error_code"`
+	Result    json.RawMessage `json:"result"`
+}
+
+// methodCatalog lists the methods of methods.json.
+var methodCatalog = []MethodSpec{
+	{
+		Name:        "get_device_info",
+		Doc:         "Returns the state, the configuration and the identity of the device.",
+		Component:   "",
+		newResponse: func() interface{} { return new(GetDeviceInfoResponse) },
+	},
+	{
+		Name:      "set_device_info",
+		Doc:       "Changes the state of the device.",
+		Component: "",
+		Params: []ParamSpec{
+			{Name: "device_on", Type: "bool", Doc: "Turns the device on or off."},
+		},
+		newParams:   func() interface{} { return new(SetDeviceInfoParams) },
+		newResponse: func() interface{} { return new(SetDeviceInfoResponse) },
+	},
+	{
+		Name:        "get_device_usage",
+		Doc:         "Returns the usage statistics of the device for today, the past 7 and the past 30 days.",
+		Component:   "",
+		newResponse: func() interface{} { return new(GetDeviceUsageResponse) },
+	},
+	{
+		Name:        "get_energy_usage",
+		Doc:         "Returns the runtime, the energy consumption and the current power of an energy-monitoring device.",
+		Component:   "energy_monitoring",
+		newResponse: func() interface{} { return new(GetEnergyUsageResponse) },
+	},
+	{
+		Name:        "get_device_time",
+		Doc:         "Returns the clock, the UTC offset and the time zone of the device.",
+		Component:   "",
+		newResponse: func() interface{} { return new(GetDeviceTimeResponse) },
+	},
+	{
+		Name:      "set_device_time",
+		Doc:       "Sets the clock and the time zone of the device.",
+		Component: "",
+		Params: []ParamSpec{
+			{Name: "timestamp", Type: "int64", Doc: "Is the new clock, as a Unix timestamp."},
+			{Name: "time_diff", Type: "int", Doc: "Is the offset of the time zone from UTC, in minutes."},
+			{Name: "region", Type: "string", Doc: "Is the IANA name of the time zone."},
+		},
+		newParams:   func() interface{} { return new(SetDeviceTimeParams) },
+		newResponse: func() interface{} { return new(SetDeviceTimeResponse) },
+	},
+	{
+		Name:      "get_energy_data",
+		Doc:       "Returns the energy consumption of an energy-monitoring device over a time range, in hourly, daily or monthly buckets.",
+		Component: "energy_monitoring",
+		Params: []ParamSpec{
+			{Name: "start_timestamp", Type: "int64", Doc: "Is the start of the range, as a device-local Unix timestamp."},
+			{Name: "end_timestamp", Type: "int64", Doc: "Is the end of the range, as a device-local Unix timestamp."},
+			{Name: "interval", Type: "int", Doc: "Is the bucket size in minutes: 60, 1440 or 43200."},
+		},
+		newParams:   func() interface{} { return new(GetEnergyDataParams) },
+		newResponse: func() interface{} { return new(GetEnergyDataResponse) },
+	},
+	{
+		Name:        "component_nego",
+		Doc:         "Returns the components supported by the device, i.e. its features and their versions.",
+		Component:   "",
+		newResponse: func() interface{} { return new(GetComponentsResponse) },
+	},
+	{
+		Name:      "multipleRequest",
+		Doc:       "Runs several requests in a single round trip, and returns their responses in order.",
+		Component: "",
+		Params: []ParamSpec{
+			{Name: "requests", Type: "[]SubRequest", Doc: "Are the batched requests."},
+		},
+		newParams:   func() interface{} { return new(MultipleRequestParams) },
+		newResponse: func() interface{} { return new(MultipleRequestResponse) },
+	},
+	{
+		Name:        "get_latest_fw",
+		Doc:         "Returns the latest firmware available from the cloud for the device, and whether it is newer than the installed one.",
+		Component:   "firmware",
+		newResponse: func() interface{} { return new(GetLatestFirmwareResponse) },
+	},
+	{
+		Name:        "fw_download",
+		Doc:         "Downloads and installs the latest firmware, after which the device reboots.",
+		Component:   "firmware",
+		newResponse: func() interface{} { return new(UpdateFirmwareResponse) },
+	},
+	{
+		Name:        "get_fw_download_state",
+		Doc:         "Returns the progress of a firmware update started with fw_download.",
+		Component:   "firmware",
+		newResponse: func() interface{} { return new(GetFirmwareDownloadStateResponse) },
+	},
+	{
+		Name:      "get_countdown_rules",
+		Doc:       "Returns the countdown rules of the device, which switch it after a delay.",
+		Component: "countdown",
+		Params: []ParamSpec{
+			{Name: "start_index", Type: "int", Doc: "Is the index of the first rule to return."},
+		},
+		newParams:   func() interface{} { return new(GetCountdownRulesParams) },
+		newResponse: func() interface{} { return new(GetCountdownRulesResponse) },
+	},
+	{
+		Name:      "add_countdown_rule",
+		Doc:       "Adds a countdown rule, which switches the device after a delay.",
+		Component: "countdown",
+		Params: []ParamSpec{
+			{Name: "delay", Type: "int", Doc: "Is the delay in seconds."},
+			{Name: "desired_states", Type: "CountdownState", Doc: "Is the state of the device when the delay expires."},
+			{Name: "enable", Type: "bool", Doc: "Enables the rule."},
+			{Name: "remain", Type: "int", Doc: "Is the remaining time in seconds, equal to delay for a new rule."},
+		},
+		newParams:   func() interface{} { return new(AddCountdownRuleParams) },
+		newResponse: func() interface{} { return new(AddCountdownRuleResponse) },
+	},
+	{
+		Name:      "edit_countdown_rule",
+		Doc:       "Changes an existing countdown rule.",
+		Component: "countdown",
+		Params: []ParamSpec{
+			{Name: "id", Type: "string", Doc: "Is the ID of the rule, as returned by get_countdown_rules."},
+			{Name: "delay", Type: "int", Doc: "Is the delay in seconds."},
+			{Name: "desired_states", Type: "CountdownState", Doc: "Is the state of the device when the delay expires."},
+			{Name: "enable", Type: "bool", Doc: "Enables or disables the rule."},
+			{Name: "remain", Type: "int", Doc: "Is the remaining time in seconds."},
+		},
+		newParams:   func() interface{} { return new(EditCountdownRuleParams) },
+		newResponse: func() interface{} { return new(EditCountdownRuleResponse) },
+	},
+}
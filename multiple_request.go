@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SubRequest is a request batched by Plug.MultipleRequest.
+type SubRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// SubResponse is the response to a SubRequest. A failed request does not
+// fail the others, its error is in ErrorCode.
+type SubResponse struct {
+	Method    string          `json:"method"`
+	ErrorCode TapoError       `json:"error_code"`
+	Result    json.RawMessage `json:"result"`
+}
+
+// MultipleRequestResult is the result of multipleRequest.
+type MultipleRequestResult struct {
+	Responses []SubResponse `json:"responses"`
+}
+
+// MultipleRequest sends several requests in a single round trip, and returns
+// their responses in order. Firmwares without multipleRequest fail with an
+// error whose hint is HintUnsupported.
+func (p *Plug) MultipleRequest(reqs ...SubRequest) ([]SubResponse, error) {
+	return p.MultipleRequestContext(context.Background(), reqs...)
+}
+
+// MultipleRequestContext is like MultipleRequest, but the request is aborted
+// when ctx is done.
+func (p *Plug) MultipleRequestContext(ctx context.Context, reqs ...SubRequest) ([]SubResponse, error) {
+	var resp MultipleRequestResponse
+	if err := p.callTyped(ctx, "multipleRequest", MultipleRequestParams{Requests: reqs}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Result.Responses) != len(reqs) {
+		return nil, fmt.Errorf("multipleRequest returned %d responses for %d requests", len(resp.Result.Responses), len(reqs))
+	}
+	return resp.Result.Responses, nil
+}
+
+// DeviceStatus is the state of a device returned by GetStatus.
+type DeviceStatus struct {
+	Info  *DeviceInfo
+	Usage *DeviceUsage
+	// Energy is nil if the device does not monitor energy, or if getting it
+	// failed.
+	Energy *EnergyUsage
+}
+
+// GetStatus returns the device info, usage and energy usage in a single round
+// trip, or with separate requests on firmwares without multipleRequest.
+func (p *Plug) GetStatus() (*DeviceStatus, error) {
+	return p.GetStatusContext(context.Background())
+}
+
+// GetStatusContext is like GetStatus, but the requests are aborted when ctx is
+// done.
+func (p *Plug) GetStatusContext(ctx context.Context) (*DeviceStatus, error) {
+	responses, err := p.MultipleRequestContext(ctx,
+		SubRequest{Method: "get_device_info"},
+		SubRequest{Method: "get_device_usage"},
+		SubRequest{Method: "get_energy_usage"},
+	)
+	if ErrorHint(err) == HintUnsupported {
+		p.log.Printf("multipleRequest not supported, sending separate requests")
+		return p.getStatusSeparately(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st DeviceStatus
+	for _, r := range responses {
+		if r.ErrorCode != 0 {
+			if r.Method == "get_energy_usage" {
+				if r.ErrorCode.Hint() != HintUnsupported {
+					p.log.Printf("get_energy_usage failed: %v", r.ErrorCode)
+				}
+				continue
+			}
+			return nil, fmt.Errorf("%s failed: %w", r.Method, r.ErrorCode)
+		}
+		var v interface{}
+		switch r.Method {
+		case "get_device_info":
+			st.Info = new(DeviceInfo)
+			v = st.Info
+		case "get_device_usage":
+			st.Usage = new(DeviceUsage)
+			v = st.Usage
+		case "get_energy_usage":
+			st.Energy = new(EnergyUsage)
+			v = st.Energy
+		default:
+			return nil, fmt.Errorf("unexpected response for method '%s'", r.Method)
+		}
+		if err := json.Unmarshal(r.Result, v); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %s result: %w", r.Method, err)
+		}
+	}
+	if st.Info == nil || st.Usage == nil {
+		return nil, errors.New("multipleRequest did not return the device info and usage")
+	}
+	p.processDeviceInfo(st.Info)
+	return &st, nil
+}
+
+func (p *Plug) getStatusSeparately(ctx context.Context) (*DeviceStatus, error) {
+	var (
+		st  DeviceStatus
+		err error
+	)
+	if st.Info, err = p.GetDeviceInfoContext(ctx); err != nil {
+		return nil, err
+	}
+	if st.Usage, err = p.GetDeviceUsageContext(ctx); err != nil {
+		return nil, err
+	}
+	if st.Energy, err = p.GetEnergyUsageContext(ctx); err != nil {
+		if ErrorHint(err) != HintUnsupported {
+			p.log.Printf("GetEnergyUsage failed: %v", err)
+		}
+		st.Energy = nil
+	}
+	return &st, nil
+}
@@ -0,0 +1,236 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"math"
+	"net/url"
+	"time"
+)
+
+// PlugOption is a functional option that configures a Plug. Options are passed
+// to NewPlug.
+type PlugOption func(*Plug)
+
+// ClientOption is a functional option that configures a Client. Options are
+// passed to NewClient.
+type ClientOption func(*Client)
+
+// OptionTimeout sets the timeout of each HTTP request sent to the device,
+// including the handshakes, with both protocols. It defaults to 10 seconds,
+// zero means no timeout.
+func OptionTimeout(d time.Duration) PlugOption {
+	return func(p *Plug) {
+		p.timeout = d
+	}
+}
+
+// OptionClientTimeout sets the timeout of each HTTP request sent to the cloud
+// service.
+func OptionClientTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// OptionProxy routes the HTTP traffic to the device through the given HTTP,
+// HTTPS or SOCKS5 proxy, e.g. an `ssh -D` tunnel to a remote network. If not
+// set, the HTTP_PROXY, ALL_PROXY and NO_PROXY environment variables are
+// honored.
+func OptionProxy(proxy *url.URL) PlugOption {
+	return func(p *Plug) {
+		p.transport = newProxyTransport(proxy)
+	}
+}
+
+// OptionMiddleware adds a middleware that wraps the session established by
+// Plug.Handshake. Middlewares are applied in order, so the last one is the
+// outermost.
+func OptionMiddleware(m Middleware) PlugOption {
+	return func(p *Plug) {
+		p.middlewares = append(p.middlewares, m)
+	}
+}
+
+// OptionTrace calls fn with every request sent to the device and its
+// response, in plaintext, with their timing and status. It is a shortcut for
+// OptionMiddleware(TraceMiddleware(fn)).
+func OptionTrace(fn func(Trace)) PlugOption {
+	return OptionMiddleware(TraceMiddleware(fn))
+}
+
+// OptionCloudURL overrides the base URL of the tp-link cloud service, e.g. to
+// use a regional mirror.
+func OptionCloudURL(u string) ClientOption {
+	return func(c *Client) {
+		c.cloudURL = u
+	}
+}
+
+// OptionCloudProxy routes the requests to the cloud service through the given
+// HTTP, HTTPS or SOCKS5 proxy. If not set, the TAPO_CLOUD_PROXY environment
+// variable is used, then the standard HTTPS_PROXY, ALL_PROXY and NO_PROXY.
+func OptionCloudProxy(proxy *url.URL) ClientOption {
+	return func(c *Client) {
+		c.proxy = proxy
+	}
+}
+
+// OptionMinOffTime enforces a minimum interval between turning the plug off and
+// turning it on again, e.g. to protect the compressor of a fridge or an air
+// conditioner. If wait is true, turning the plug on too early blocks until the
+// interval has elapsed or the context of SetDeviceInfoContext is done,
+// otherwise it fails with a *MinOffTimeError.
+//
+// The off time is tracked by the Plug object, from the calls to Off and from
+// the state changes observed by GetDeviceInfo.
+func OptionMinOffTime(d time.Duration, wait bool) PlugOption {
+	return func(p *Plug) {
+		p.minOffTime = d
+		p.minOffTimeWait = wait
+	}
+}
+
+// OptionDiscoveryInterfaces restricts discovery to the given network
+// interfaces, e.g. to skip container bridges or VPN tunnels. By default all
+// the interfaces that are up and support broadcast are used.
+func OptionDiscoveryInterfaces(names ...string) ClientOption {
+	return func(c *Client) {
+		c.discoveryInterfaces = names
+	}
+}
+
+// OptionProtocol makes the handshake use only the given protocol, instead of
+// trying KLAP first and falling back to passthrough.
+func OptionProtocol(proto Protocol) PlugOption {
+	return func(p *Plug) {
+		p.protocol = proto
+	}
+}
+
+var (
+	// OptionProtocolKLAP pins the KLAP protocol, for devices known to run
+	// a newer firmware. It is a shortcut for OptionProtocol(ProtocolKLAP).
+	OptionProtocolKLAP = OptionProtocol(ProtocolKLAP)
+	// OptionProtocolPassthrough pins the passthrough protocol, for devices
+	// known to run an older firmware. It is a shortcut for
+	// OptionProtocol(ProtocolPassthrough).
+	OptionProtocolPassthrough = OptionProtocol(ProtocolPassthrough)
+)
+
+// OptionProtocolCache looks up the protocol of the device in cache before the
+// handshake, and records it after a successful one. If the cached protocol
+// fails, e.g. after a firmware upgrade, both protocols are tried again.
+// OptionProtocol takes precedence over the cache.
+func OptionProtocolCache(cache ProtocolCache) PlugOption {
+	return func(p *Plug) {
+		p.protocolCache = cache
+	}
+}
+
+// OptionWarnings calls h for every non-fatal condition met by the plug, like
+// undecodable fields or protocol fallbacks, so that applications can surface
+// them without parsing the logs. h may be called concurrently by plugs sharing
+// it.
+func OptionWarnings(h func(Warning)) PlugOption {
+	return func(p *Plug) {
+		p.warnings = h
+	}
+}
+
+// OptionRehandshakeRetries sets how many times a request is sent again after a
+// new handshake, when the device drops the session with an HTTP 403 or a
+// session timeout. The default is 1, and 0 returns these errors to the caller.
+func OptionRehandshakeRetries(n int) PlugOption {
+	return func(p *Plug) {
+		if n < 0 {
+			n = 0
+		}
+		p.rehandshakeRetries = n
+	}
+}
+
+// OptionRetryOnCommunicationError sets how many times a request is sent again
+// when it fails with a transient error: a device error code whose hint is
+// HintRetry, a network timeout, or a connection refused or reset. The retries
+// are spaced by an exponential backoff, see OptionRetryBackoff. The default is
+// 0, which returns these errors to the caller.
+func OptionRetryOnCommunicationError(n int) PlugOption {
+	return func(p *Plug) {
+		if n < 0 {
+			n = 0
+		}
+		p.retriesOnCommunicationError = n
+	}
+}
+
+// OptionRetryBackoff sets the delay before the first retry of
+// OptionRetryOnCommunicationError, which doubles at every retry up to 5
+// seconds. The default is 250ms.
+func OptionRetryBackoff(d time.Duration) PlugOption {
+	return func(p *Plug) {
+		p.retryBackoff = d
+	}
+}
+
+// OptionHTTPS makes the plug talk to the device over HTTPS, for firmwares that
+// require it, see DiscoverResponse.Result.MgtEncryptSchm.IsSupportHTTPS. If
+// config is nil the certificate of the device is not verified, since devices
+// use self-signed certificates.
+func OptionHTTPS(config *tls.Config) PlugOption {
+	return func(p *Plug) {
+		p.https = true
+		p.tlsConfig = config
+	}
+}
+
+// OptionPort sets the HTTP port of the device. By default the port of the
+// scheme is used, 80 or 443 with OptionHTTPS.
+func OptionPort(port uint16) PlugOption {
+	return func(p *Plug) {
+		p.port = port
+	}
+}
+
+// OptionVerifyKlapSignature makes the KLAP sessions check the signature of the
+// responses, and handshake again when the device answered with a sequence
+// number other than that of the request. It is off by default, see
+// KlapSession.VerifySignature.
+func OptionVerifyKlapSignature() PlugOption {
+	return func(p *Plug) {
+		p.verifyKlapSignature = true
+	}
+}
+
+// OptionDiscovered configures the plug from the discovery response of the
+// device, i.e. the HTTP port and the login version it advertises.
+func OptionDiscovered(resp DiscoverResponse) PlugOption {
+	return func(p *Plug) {
+		if port := resp.Result.MgtEncryptSchm.HTTPPort; port > 0 && port <= math.MaxUint16 {
+			p.port = uint16(port)
+		}
+		p.loginVersion = resp.Result.MgtEncryptSchm.Lv
+	}
+}
+
+// OptionRSAKey sets the RSA key pair of the passthrough handshakes, instead of
+// generating one for each handshake. See SharedRSAKey to reuse a key across
+// the process, or persist one with x509.MarshalPKCS1PrivateKey. Anybody with
+// the key can decrypt the captured handshakes.
+func OptionRSAKey(key *rsa.PrivateKey) PlugOption {
+	return func(p *Plug) {
+		p.rsaKey = key
+	}
+}
+
+// OptionConcurrentHandshakes makes plugs of unknown protocol try the KLAP and
+// passthrough handshakes at once, and use the first that succeeds, instead of
+// trying passthrough only after KLAP failed. It halves the connection time to
+// the passthrough devices of a mixed fleet, at the cost of an extra handshake.
+func OptionConcurrentHandshakes() PlugOption {
+	return func(p *Plug) {
+		p.concurrentHandshakes = true
+	}
+}
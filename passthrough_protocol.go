@@ -4,6 +4,7 @@ package tapo
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -12,50 +13,144 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/netip"
-	"strings"
+	"sync"
 	"time"
 
-	"github.com/mergermarket/go-pkcs7"
+	"github.com/insomniacslk/tapo/internal/protocol"
 )
 
+// DefaultRSAKeyBits is the size of the RSA keys generated by the passthrough
+// handshakes. Some firmwares also accept 2048-bit keys.
+const DefaultRSAKeyBits = 1024
+
+var sharedRSAKey = sync.OnceValues(func() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, DefaultRSAKeyBits)
+})
+
+// SharedRSAKey returns an RSA key generated on the first call, to reuse across
+// the passthrough handshakes of the process with OptionRSAKey.
+func SharedRSAKey() (*rsa.PrivateKey, error) {
+	return sharedRSAKey()
+}
+
 func NewPassthroughSession(l *log.Logger) *PassthroughSession {
+	if l == nil {
+		l = log.New(io.Discard, "", 0)
+	}
 	return &PassthroughSession{
 		log: l,
 	}
 }
 
 type PassthroughSession struct {
-	log        *log.Logger
-	Key        []byte
-	IV         []byte
-	ID         string
-	addr       netip.Addr
-	username   string
-	password   string
-	token      string
-	privateKey *rsa.PrivateKey
-	publicKey  *rsa.PublicKey
-	timeout    time.Duration
+	// Transport is used for all the HTTP requests to the device. If nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+	// HTTPS makes the session talk to the device over HTTPS, for firmwares
+	// that require it. The TLS settings are those of Transport.
+	HTTPS bool
+	// Port is the HTTP port of the device, see the http_port field of the
+	// discovery response. If zero, the default port of the scheme is used.
+	Port uint16
+	// RSAKey, if set, is the key pair sent to the device by the handshakes
+	// to encrypt the session key. Otherwise each handshake generates a new
+	// DefaultRSAKeyBits key, which is slow on small CPUs.
+	RSAKey *rsa.PrivateKey
+	// Timeout is the timeout of each HTTP request to the device, including
+	// the handshake. Zero means no timeout.
+	Timeout time.Duration
+	// LoginVersion is the version of login_device, see the lv field of the
+	// discovery response. Version 2 accepts passwords longer than 8
+	// characters. If zero, version 1 is used, and version 2 is tried when
+	// the device rejects a long password; the version that worked is kept
+	// for the next handshakes.
+	LoginVersion int
+	// longV1 is set when the last login sent a password longer than 8
+	// characters with version 1, which some firmwares truncate.
+	longV1   bool
+	log      *log.Logger
+	Key      []byte
+	IV       []byte
+	ID       string
+	addr     netip.Addr
+	username string
+	password string
+	// credentials, if set, are used instead of username and password,
+	// see HandshakeCredentials.
+	credentials *Credentials
+	token       string
+	// handshakeAt and expiry are the local times of the handshake and of
+	// the expiry set by the TIMEOUT cookie, zero if the device sent none.
+	handshakeAt time.Time
+	expiry      time.Time
+	privateKey  *rsa.PrivateKey
+	publicKey   *rsa.PublicKey
+	// block is the cipher for blockKey, a copy of Key when block was
+	// created.
+	block    cipher.Block
+	blockKey []byte
+	// mu serializes the handshakes and the requests.
+	mu sessionLock
+	// state guards the fields read by IsValid and ExpiresAt, which are
+	// written with both mu and state held.
+	state sync.Mutex
 }
 
 func (p *PassthroughSession) Addr() netip.Addr {
 	return p.addr
 }
 
+// HandshakeCredentials handshakes with precomputed credentials instead of the
+// username and password. Later handshakes of the session, e.g. after the
+// token expires, use the same credentials.
+func (p *PassthroughSession) HandshakeCredentials(addr netip.Addr, c Credentials) error {
+	return p.handshakeCredentials(context.Background(), addr, c)
+}
+
+func (p *PassthroughSession) handshakeCredentials(ctx context.Context, addr netip.Addr, c Credentials) error {
+	if c.LoginUsername == "" || c.LoginPassword == "" {
+		return fmt.Errorf("credentials have no passthrough login")
+	}
+	if err := p.mu.lock(ctx); err != nil {
+		return err
+	}
+	defer p.mu.unlock()
+	p.credentials = &c
+	return p.handshake(ctx, addr, "", "")
+}
+
 func (p *PassthroughSession) Handshake(addr netip.Addr, username, password string) error {
+	return p.HandshakeContext(context.Background(), addr, username, password)
+}
+
+// HandshakeContext is like Handshake, but the handshake and the login are
+// aborted when ctx is done.
+func (p *PassthroughSession) HandshakeContext(ctx context.Context, addr netip.Addr, username, password string) error {
+	if err := p.mu.lock(ctx); err != nil {
+		return err
+	}
+	defer p.mu.unlock()
+	return p.handshake(ctx, addr, username, password)
+}
+
+// handshake runs the handshake and the login, with p.mu held.
+func (p *PassthroughSession) handshake(ctx context.Context, addr netip.Addr, username, password string) error {
 	p.addr = addr
 	p.username = username
 	p.password = password
-	// generate an RSA key pair
-	bits := 1024
-	key, err := rsa.GenerateKey(rand.Reader, bits)
-	if err != nil {
-		return fmt.Errorf("failed to generate RSA key: %w", err)
+	key := p.RSAKey
+	if key == nil {
+		// generate an RSA key pair
+		var err error
+		if key, err = rsa.GenerateKey(rand.Reader, DefaultRSAKeyBits); err != nil {
+			return fmt.Errorf("failed to generate RSA key: %w", err)
+		}
 	}
 	privkey, pubkey := key, key.Public().(*rsa.PublicKey)
 	p.privateKey = privkey
@@ -70,14 +165,20 @@ func (p *PassthroughSession) Handshake(addr netip.Addr, username, password strin
 	})
 
 	// make a new handshake request
-	request := NewHandshakeRequest(string(pkixBytes))
+	request := protocol.NewHandshakeRequest(string(pkixBytes))
 	requestBytes, err := json.Marshal(request)
 	if err != nil {
 		return fmt.Errorf("failed to marshal handshake payload: %w", err)
 	}
 	p.log.Printf("Handshake request: %s", requestBytes)
-	u := fmt.Sprintf("http://%s/app", p.addr.String())
-	httpresp, err := http.Post(u, "application/json", bytes.NewBuffer(requestBytes))
+	u := deviceURL(p.addr, p.Port, p.HTTPS, "/app").String()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewBuffer(requestBytes))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	hc := http.Client{Timeout: p.Timeout, Transport: p.Transport}
+	httpresp, err := hc.Do(req)
 	if err != nil {
 		return fmt.Errorf("HTTP POST failed: %w", err)
 	}
@@ -90,15 +191,15 @@ func (p *PassthroughSession) Handshake(addr netip.Addr, username, password strin
 		if httpresp.StatusCode == 403 {
 			return ErrForbidden
 		}
-		return fmt.Errorf("expected 200 OK, got %s. Error message: %s", httpresp.Status, body)
+		return &HTTPError{StatusCode: httpresp.StatusCode, Status: httpresp.Status, Body: body}
 	}
 	p.log.Printf("Handshake response: %s", body)
-	var resp HandshakeResponse
+	var resp protocol.HandshakeResponse
 	if err := json.Unmarshal(body, &resp); err != nil {
 		return fmt.Errorf("failed to unmarshal JSON response: %w", err)
 	}
 	if resp.ErrorCode != 0 {
-		return fmt.Errorf("request failed: %w (%d)", resp.ErrorCode, resp.ErrorCode)
+		return fmt.Errorf("request failed: %w (%d)", TapoError(resp.ErrorCode), resp.ErrorCode)
 	}
 
 	// now decrypt the Tapo device encryption key with our public key
@@ -113,34 +214,124 @@ func (p *PassthroughSession) Handshake(addr netip.Addr, username, password strin
 	if len(sessionKey) != 32 {
 		return fmt.Errorf("session key length is not 32 bytes, got %d", len(sessionKey))
 	}
-	var sessionID string
-	for _, cookie := range httpresp.Cookies() {
-		if cookie.Name == "TP_SESSIONID" {
-			sessionID = "TP_SESSIONID=" + cookie.Value
-			break
-		}
-	}
+	cookies := parseDeviceCookies(httpresp.Header)
+	sessionID := cookies[cookieSessionID]
 	if sessionID == "" {
-		return fmt.Errorf("no TP_SESSIONID cookie found in HTTP response")
+		return fmt.Errorf("no %s cookie found in HTTP response", cookieSessionID)
 	}
+	sessionID = cookieSessionID + "=" + sessionID
 	p.Key = sessionKey[:16]
 	p.ID = sessionID
 	p.IV = sessionKey[16:]
+	p.state.Lock()
+	p.token = ""
+	p.handshakeAt, p.expiry = time.Now(), time.Time{}
+	if v, ok := cookies[cookieTimeout]; ok {
+		p.expiry = p.handshakeAt.Add(parseKlapTimeout(v))
+	}
+	p.state.Unlock()
+	return p.login(ctx, username, password)
+}
+
+// login logs in over the freshly established secure channel, with the version
+// of login_device set by LoginVersion.
+func (p *PassthroughSession) login(ctx context.Context, username, password string) error {
+	if p.credentials != nil {
+		// the credentials hold the password in base64
+		b, err := base64.StdEncoding.DecodeString(p.credentials.LoginPassword)
+		if err != nil {
+			return fmt.Errorf("invalid login password in credentials: %w", err)
+		}
+		password = string(b)
+	}
+	long := len(password) > 8
+	version := p.LoginVersion
+	if version == 0 {
+		version = 1
+	}
+	err := p.loginVersion(ctx, version, username, password)
+	var te TapoError
+	if err != nil && p.LoginVersion == 0 && long && errors.As(err, &te) {
+		p.log.Printf("Login version 1 failed (%v), trying version 2 for the long password", err)
+		if err = p.loginVersion(ctx, 2, username, password); err == nil {
+			p.LoginVersion = 2
+			version = 2
+		}
+	}
+	p.longV1 = long && version == 1
+	return err
+}
+
+// loginVersion sends a login_device request with the given version, and
+// stores the returned token for subsequent requests.
+func (p *PassthroughSession) loginVersion(ctx context.Context, version int, username, password string) error {
+	request := NewLoginDeviceRequest(username, password)
+	if version >= 2 {
+		request = NewLoginDeviceRequestV2(username, password)
+	}
+	if p.credentials != nil {
+		request.Params.Username = p.credentials.LoginUsername
+	}
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal login_device payload: %w", err)
+	}
+	response, err := p.request(ctx, requestBytes)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	var loginResp LoginDeviceResponse
+	if err := json.Unmarshal(response, &loginResp); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON response: %w", err)
+	}
+	if loginResp.ErrorCode != 0 {
+		return fmt.Errorf("request failed: %w", loginResp.ErrorCode)
+	}
+	if loginResp.Result.Token == "" {
+		return fmt.Errorf("empty token returned by device")
+	}
+	p.state.Lock()
+	p.token = loginResp.Result.Token
+	p.state.Unlock()
 	return nil
 }
+
+// IsValid returns true if the session is logged in and not about to expire.
+func (p *PassthroughSession) IsValid() bool {
+	p.state.Lock()
+	defer p.state.Unlock()
+	return p.token != "" && !sessionExpiring(p.handshakeAt, p.expiry, time.Now())
+}
+
+// ExpiresAt returns the expiry set by the device with the TIMEOUT cookie of the
+// handshake, or the zero time if it sent none.
+func (p *PassthroughSession) ExpiresAt() time.Time {
+	p.state.Lock()
+	defer p.state.Unlock()
+	return p.expiry
+}
+
 func (s *PassthroughSession) Request(requestBytes []byte) ([]byte, error) {
-	ret, err := s.request(requestBytes)
-	if err != ErrForbidden {
-		return ret, err
-	}
-	// Token expired? Try to reauthenticate
-	if err := s.Handshake(s.addr, s.username, s.password); err != nil {
+	return s.RequestContext(context.Background(), requestBytes)
+}
+
+// RequestContext is like Request, but the request and the handshake it may
+// need are aborted when ctx is done.
+func (s *PassthroughSession) RequestContext(ctx context.Context, requestBytes []byte) ([]byte, error) {
+	if err := s.mu.lock(ctx); err != nil {
 		return nil, err
 	}
-	return s.request(requestBytes)
+	defer s.mu.unlock()
+	if s.token != "" && !s.IsValid() {
+		s.log.Printf("Passthrough session expires at %s, handshaking again", s.expiry)
+		if err := s.handshake(ctx, s.addr, s.username, s.password); err != nil {
+			return nil, err
+		}
+	}
+	return s.request(ctx, requestBytes)
 }
 
-func (s *PassthroughSession) request(requestBytes []byte) ([]byte, error) {
+func (s *PassthroughSession) request(ctx context.Context, requestBytes []byte) ([]byte, error) {
 	// encrypt the request
 	encodedRequest, err := s.encryptRequest(requestBytes)
 	if err != nil {
@@ -148,7 +339,7 @@ func (s *PassthroughSession) request(requestBytes []byte) ([]byte, error) {
 	}
 
 	// wrap it in a secure_passthrough request
-	passthroughRequest := NewSecurePassthroughRequest(encodedRequest)
+	passthroughRequest := protocol.NewSecurePassthroughRequest(encodedRequest)
 	passthroughRequestBytes, err := json.Marshal(&passthroughRequest)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal securePassthrough payload: %w", err)
@@ -156,17 +347,17 @@ func (s *PassthroughSession) request(requestBytes []byte) ([]byte, error) {
 	s.log.Printf("Passthrough request: %s", passthroughRequestBytes)
 
 	// send it via http
-	u := fmt.Sprintf("http://%s/app", s.addr.String())
+	u := deviceURL(s.addr, s.Port, s.HTTPS, "/app").String()
 	if s.token != "" {
 		u += "?token=" + s.token
 	}
-	req, err := http.NewRequest("POST", u, bytes.NewBuffer(passthroughRequestBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewBuffer(passthroughRequestBytes))
 	if err != nil {
 		return nil, fmt.Errorf("http.NewRequest failed: %w", err)
 	}
 	req.Header.Set("Cookie", s.ID)
 	req.Close = true
-	client := http.Client{Timeout: s.timeout}
+	client := http.Client{Timeout: s.Timeout, Transport: s.Transport}
 	httpresp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("HTTP POST failed: %w", err)
@@ -181,15 +372,15 @@ func (s *PassthroughSession) request(requestBytes []byte) ([]byte, error) {
 		if httpresp.StatusCode == 403 {
 			return nil, ErrForbidden
 		}
-		return nil, fmt.Errorf("expected 200 OK, got %s. Error message: %s", httpresp.Status, body)
+		return nil, &HTTPError{StatusCode: httpresp.StatusCode, Status: httpresp.Status, Body: body}
 	}
 	s.log.Printf("Passthrough response: %s", body)
-	var resp SecurePassthroughResponse
+	var resp protocol.SecurePassthroughResponse
 	if err := json.Unmarshal(body, &resp); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal JSON response: %w", err)
 	}
 	if resp.ErrorCode != 0 {
-		return nil, fmt.Errorf("request failed: %s", resp.ErrorCode)
+		return nil, fmt.Errorf("request failed: %w", TapoError(resp.ErrorCode))
 	}
 	// decrypt response
 	response, err := s.decryptResponse(resp.Result.Response)
@@ -200,23 +391,43 @@ func (s *PassthroughSession) request(requestBytes []byte) ([]byte, error) {
 	return response, nil
 }
 
+// getBlock returns the AES cipher for Key, reused across requests while Key
+// does not change.
+func (s *PassthroughSession) getBlock() (cipher.Block, error) {
+	if s.block == nil || !bytes.Equal(s.blockKey, s.Key) {
+		block, err := aes.NewCipher(s.Key)
+		if err != nil {
+			return nil, fmt.Errorf("aes.NewCipher failed: %w", err)
+		}
+		s.block = block
+		s.blockKey = append(s.blockKey[:0], s.Key...)
+	}
+	return s.block, nil
+}
+
 func (s *PassthroughSession) encryptRequest(req []byte) (string, error) {
-	block, err := aes.NewCipher(s.Key)
+	block, err := s.getBlock()
 	if err != nil {
-		return "", fmt.Errorf("aes.NewCipher failed: %w", err)
+		return "", err
 	}
-	encrypter := cipher.NewCBCEncrypter(block, s.IV)
-	paddedRequestBytes, err := pkcs7.Pad(req, aes.BlockSize)
-	if err != nil {
-		return "", fmt.Errorf("pkcs7.Pad failed: %w", err)
+	// PKCS7 padding to aes block size, then encrypt in place
+	neededBytes := aes.BlockSize - len(req)%aes.BlockSize
+	buf := make([]byte, len(req)+neededBytes)
+	copy(buf, req)
+	for idx := len(req); idx < len(buf); idx++ {
+		buf[idx] = byte(neededBytes)
 	}
-	encryptedRequest := make([]byte, len(paddedRequestBytes))
-	encrypter.CryptBlocks(encryptedRequest, paddedRequestBytes)
+	cipher.NewCBCEncrypter(block, s.IV).CryptBlocks(buf, buf)
 
 	// now base64-encode the request
-	encodedRequest := base64.StdEncoding.EncodeToString(encryptedRequest)
-	encodedRequest = strings.Replace(encodedRequest, "\r\n", "", -1)
-	return encodedRequest, nil
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// Decrypt decrypts a base64-encoded request or response carried by a
+// securePassthrough message, using the session's Key and IV. This is useful to
+// decode recorded traffic.
+func (s *PassthroughSession) Decrypt(payload string) ([]byte, error) {
+	return s.decryptResponse(payload)
 }
 
 func (s *PassthroughSession) decryptResponse(resp string) ([]byte, error) {
@@ -224,19 +435,18 @@ func (s *PassthroughSession) decryptResponse(resp string) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to base64-decode response: %w", err)
 	}
-
-	block, err := aes.NewCipher(s.Key)
+	if len(encryptedResponse)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("ciphertext is not a multiple of the block size")
+	}
+	block, err := s.getBlock()
 	if err != nil {
-		return nil, fmt.Errorf("aes.NewCipher failed: %w", err)
+		return nil, err
 	}
-	encrypter := cipher.NewCBCDecrypter(block, s.IV)
+	cipher.NewCBCDecrypter(block, s.IV).CryptBlocks(encryptedResponse, encryptedResponse)
 
-	paddedResponse := make([]byte, len(encryptedResponse))
-	encrypter.CryptBlocks(paddedResponse, encryptedResponse)
-
-	response, err := pkcs7.Unpad(paddedResponse, aes.BlockSize)
+	response, err := unpadPKCS7(encryptedResponse)
 	if err != nil {
-		return nil, fmt.Errorf("pkcs7.Pad failed: %w", err)
+		return nil, fmt.Errorf("failed to unpad response: %w", err)
 	}
-	return response, err
+	return response, nil
 }
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/insomniacslk/tapo/internal/protocol"
+)
+
+// handshakeKeyRecorder is an http.RoundTripper that records the public keys
+// sent by passthrough handshakes, and rejects them.
+type handshakeKeyRecorder struct {
+	keys []*rsa.PublicKey
+}
+
+func (r *handshakeKeyRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var hr protocol.HandshakeRequest
+	if err := json.NewDecoder(req.Body).Decode(&hr); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(hr.Params.Key))
+	if block == nil {
+		return nil, errors.New("no PEM key in handshake")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	r.keys = append(r.keys, pub.(*rsa.PublicKey))
+	return &http.Response{StatusCode: http.StatusForbidden, Body: io.NopCloser(http.NoBody), Request: req}, nil
+}
+
+func TestPassthroughRSAKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec handshakeKeyRecorder
+	for _, k := range []*rsa.PrivateKey{nil, nil, key, key} {
+		s := NewPassthroughSession(nil)
+		s.Transport = &rec
+		s.RSAKey = k
+		if err := s.Handshake(netip.MustParseAddr("192.0.2.1"), "user", "pass"); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("err = %v, want %v", err, ErrForbidden)
+		}
+	}
+	if rec.keys[0].Equal(rec.keys[1]) {
+		t.Errorf("handshakes without RSAKey reused the same key")
+	}
+	if rec.keys[0].N.BitLen() != DefaultRSAKeyBits {
+		t.Errorf("generated key has %d bits, want %d", rec.keys[0].N.BitLen(), DefaultRSAKeyBits)
+	}
+	for _, pub := range rec.keys[2:] {
+		if !pub.Equal(key.Public()) {
+			t.Errorf("handshake did not use RSAKey")
+		}
+	}
+}
+
+func TestNewLoginDeviceRequestV2(t *testing.T) {
+	r := NewLoginDeviceRequestV2("user@example.org", "a long password")
+	data, err := json.Marshal(r.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, _ := loginParams("user@example.org", "")
+	want := `{"username":"` + username + `","password2":"` + base64SHA1("a long password") + `"}`
+	if string(data) != want {
+		t.Errorf("params = %s, want %s", data, want)
+	}
+}
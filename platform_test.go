@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/tapo/internal/protocol"
+)
+
+// crossTargets are 32-bit and big-endian platforms the module must build on,
+// since plugs are often managed from small ARM and MIPS boards.
+var crossTargets = []struct {
+	goos, goarch string
+}{
+	{"linux", "386"},
+	{"linux", "arm"},
+	{"linux", "mips"},
+	{"linux", "mips64"},
+}
+
+// TestCrossBuild builds and vets the whole module, including the lite CLI, for
+// each of crossTargets. It catches constants and conversions that overflow on
+// 32-bit platforms. The binaries are discarded. It is skipped with -short.
+func TestCrossBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("cross-compilation is slow")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	for _, target := range crossTargets {
+		target := target
+		t.Run(target.goos+"/"+target.goarch, func(t *testing.T) {
+			t.Parallel()
+			for _, args := range [][]string{
+				{"build", "./..."},
+				{"build", "-tags", "lite", "-o", os.DevNull, "./cmd/tapo"},
+				{"vet", "./..."},
+			} {
+				cmd := exec.Command(goBin, args...)
+				cmd.Env = append(os.Environ(), "GOOS="+target.goos, "GOARCH="+target.goarch, "CGO_ENABLED=0")
+				if out, err := cmd.CombinedOutput(); err != nil {
+					t.Errorf("go %v failed: %v\n%s", args, err, out)
+				}
+			}
+		})
+	}
+}
+
+func TestEnvelopeTimestamp(t *testing.T) {
+	e := protocol.NewEnvelope("get_device_info", true)
+	// milliseconds since the epoch do not fit in 32 bits
+	if e.RequestTimeMils <= math.MaxInt32 {
+		t.Fatalf("RequestTimeMils = %d, want more than 32 bits", e.RequestTimeMils)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		RequestTimeMils int64 `json:"requestTimeMils"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.RequestTimeMils != e.RequestTimeMils {
+		t.Errorf("requestTimeMils = %d, want %d", got.RequestTimeMils, e.RequestTimeMils)
+	}
+	if e := protocol.NewEnvelope("set_device_info", false); e.RequestTimeMils != 0 {
+		t.Errorf("RequestTimeMils = %d without timestamp, want 0", e.RequestTimeMils)
+	}
+}
+
+func TestDeviceTimeAfter2038(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	want := time.Date(2040, 7, 1, 12, 0, 0, 0, loc)
+	var dt DeviceTime
+	if err := json.Unmarshal([]byte(`{"timestamp":2224749600,"time_diff":120,"region":"Europe/Rome"}`), &dt); err != nil {
+		t.Fatal(err)
+	}
+	if !dt.Time().Equal(want) {
+		t.Errorf("Time() = %s, want %s", dt.Time(), want)
+	}
+	// energy data timestamps are device-local
+	ts := toDeviceLocal(want, loc)
+	if got := deviceLocal(ts, loc); !got.Equal(want) {
+		t.Errorf("deviceLocal(toDeviceLocal(%s)) = %s", want, got)
+	}
+}
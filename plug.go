@@ -7,109 +7,410 @@ package tapo
 // https://github.com/petretiandrea/plugp100/blob/main/plugp100/protocol/klap_protocol.py
 
 import (
-	"encoding/base64"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/insomniacslk/tapo/internal/protocol"
 )
 
 var defaultTimeout = 10 * time.Second
 
+// defaultRehandshakeRetries is how many times a request is sent again after a
+// new handshake, see OptionRehandshakeRetries.
+const defaultRehandshakeRetries = 1
+
+// defaultRetryBackoff is the delay before the first retry of a request that
+// failed with a transient error, see OptionRetryBackoff. It doubles at every
+// retry, up to maxRetryBackoff.
+const (
+	defaultRetryBackoff = 250 * time.Millisecond
+	maxRetryBackoff     = 5 * time.Second
+)
+
 // This is returned when a Tapo device returns an HTTP 403.
 var ErrForbidden = errors.New("Forbidden")
 
-type TapoError int
-
-func (te TapoError) Error() string {
-	switch te {
-	case 0:
-		return "Success"
-	case -1010:
-		return "Invalid Public Key Length"
-	case -1012:
-		return "Invalid terminalUUID"
-	case -1501:
-		return "Invalid Request or Credentials"
-	case 1002:
-		return "Incorrect Request"
-	case -1003:
-		return "JSON formatting error"
-	case 1003:
-		return "Communication error"
-	case 9999:
-		return "Session timeout"
-	default:
-		return fmt.Sprintf("Unknown error: %d", te)
-	}
-}
-
+// Plug is a device reached over the local network. It is safe for concurrent
+// use, the requests to the device are serialized by its session.
 type Plug struct {
 	log          *log.Logger
 	Addr         netip.Addr
 	terminalUUID uuid.UUID
 	session      Session
+	timeout      time.Duration
+	middlewares  []Middleware
+	transport    http.RoundTripper
+	// minimum off time protection, see OptionMinOffTime
+	minOffTime     time.Duration
+	minOffTimeWait bool
+	lastOff        time.Time
+	lastSeenOn     bool
+	// protocol pins the session protocol, see OptionProtocol
+	protocol      Protocol
+	protocolCache ProtocolCache
+	// warnings is the handler set with OptionWarnings
+	warnings func(Warning)
+	// credentials of the last handshake, to handshake again when the device
+	// drops the session, see OptionRehandshakeRetries
+	username           string
+	password           string
+	rehandshakeRetries int
+	// retriesOnCommunicationError and retryBackoff are set by
+	// OptionRetryOnCommunicationError and OptionRetryBackoff
+	retriesOnCommunicationError int
+	retryBackoff                time.Duration
+	// https and tlsConfig are set by OptionHTTPS
+	https     bool
+	tlsConfig *tls.Config
+	// port is set by OptionPort
+	port uint16
+	// verifyKlapSignature is set by OptionVerifyKlapSignature
+	verifyKlapSignature bool
+	// loginVersion is the passthrough login version, set by
+	// OptionDiscovered
+	loginVersion int
+	// credentials are set by HandshakeCredentials
+	credentials *Credentials
+	// rsaKey is set by OptionRSAKey
+	rsaKey *rsa.PrivateKey
+	// concurrentHandshakes is set by OptionConcurrentHandshakes
+	concurrentHandshakes bool
+	// mu guards session, the credentials and the minimum off time state,
+	// so that a Plug can be used from several goroutines. The sessions
+	// serialize their requests themselves.
+	mu sync.Mutex
 }
 
-func NewPlug(addr netip.Addr, logger *log.Logger) *Plug {
+func NewPlug(addr netip.Addr, logger *log.Logger, opts ...PlugOption) *Plug {
 	if logger == nil {
 		logger = log.New(io.Discard, "", 0)
 	}
-	return &Plug{
-		log:          logger,
-		Addr:         addr,
-		terminalUUID: uuid.New(),
+	p := Plug{
+		log:                logger,
+		Addr:               addr,
+		terminalUUID:       uuid.New(),
+		timeout:            defaultTimeout,
+		rehandshakeRetries: defaultRehandshakeRetries,
+		retryBackoff:       defaultRetryBackoff,
 	}
+	for _, opt := range opts {
+		opt(&p)
+	}
+	return &p
 }
 
 func (p *Plug) Handshake(username, password string) error {
+	return p.HandshakeContext(context.Background(), username, password)
+}
+
+// HandshakeContext is like Handshake, but the handshake is aborted when ctx is
+// done. Concurrent handshakes of the plug share the context of the first one.
+func (p *Plug) HandshakeContext(ctx context.Context, username, password string) error {
+	if p.currentSession() != nil {
+		return nil
+	}
+	// concurrent handshakes of the plug are coalesced into a single one,
+	// and its session is shared among the callers. Plugs are not coalesced
+	// with each other, since their credentials and options may differ, see
+	// SessionManager for a plug per device.
+	key := fmt.Sprintf("plug/%p", p)
+	v, err, shared := handshakes.Do(key, func() (interface{}, error) {
+		return p.newSession(ctx, username, password)
+	})
+	if err != nil {
+		return err
+	}
+	if shared {
+		p.log.Printf("Sharing concurrent handshake for %s", p.Addr)
+	}
+	session := v.(Session)
+	for _, m := range p.middlewares {
+		session = m(session)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if p.session == nil {
-		// try the newer KLAP protocol first
+		p.username, p.password = username, password
+		p.session = session
+	}
+	return nil
+}
+
+// currentSession returns the session, nil if the plug is not logged in.
+func (p *Plug) currentSession() Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.session
+}
+
+// getCredentials returns the credentials set by HandshakeCredentials, if any.
+func (p *Plug) getCredentials() *Credentials {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.credentials
+}
+
+// HandshakeCredentials is like Handshake, with precomputed credentials instead
+// of the username and password, see NewCredentials. The plug and its sessions
+// keep the credentials to handshake again when needed.
+func (p *Plug) HandshakeCredentials(c Credentials) error {
+	p.mu.Lock()
+	if p.session != nil {
+		p.mu.Unlock()
+		return nil
+	}
+	p.credentials = &c
+	p.mu.Unlock()
+	return p.Handshake("", "")
+}
+
+func (p *Plug) newSession(ctx context.Context, username, password string) (Session, error) {
+	if p.protocol != ProtocolAuto {
+		return p.newSessionWith(ctx, p.protocol, username, password)
+	}
+	if p.protocolCache != nil {
+		if proto := p.protocolCache.Protocol(p.Addr); proto != ProtocolAuto {
+			s, err := p.newSessionWith(ctx, proto, username, password)
+			if err == nil {
+				return s, nil
+			}
+			// the device may have been upgraded, or the address reassigned.
+			p.log.Printf("Cached %s handshake failed, trying all the protocols: %v", proto, err)
+		}
+	}
+	s, err := p.probeSession(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+	if p.protocolCache != nil {
+		p.protocolCache.SetProtocol(p.Addr, sessionProtocol(s))
+	}
+	return s, nil
+}
+
+// probeSession tries the KLAP protocol first, then the passthrough protocol,
+// or both at once with OptionConcurrentHandshakes.
+func (p *Plug) probeSession(ctx context.Context, username, password string) (Session, error) {
+	if p.concurrentHandshakes {
+		return p.raceSession(ctx, username, password)
+	}
+	start := time.Now()
+	// try the newer KLAP protocol first
+	ks, err := p.newSessionWith(ctx, ProtocolKLAP, username, password)
+	if err != nil {
+		klapTime := time.Since(start)
+		p.log.Printf("KLAP handshake failed after %s, trying passthrough handshake", klapTime)
+		// then try the older passthrough protocol
+		ps, perr := p.newSessionWith(ctx, ProtocolPassthrough, username, password)
+		if perr != nil {
+			return nil, perr
+		}
+		p.log.Printf("Passthrough handshake succeeded after %s, %s including the KLAP attempt", time.Since(start)-klapTime, time.Since(start))
+		p.warn(WarningProtocolFallback, "KLAP handshake failed after %s, using the deprecated passthrough protocol: %v", klapTime.Round(time.Millisecond), err)
+		return ps, nil
+	}
+	p.log.Printf("KLAP handshake succeeded after %s", time.Since(start))
+	return ks, nil
+}
+
+// raceSession handshakes with both protocols concurrently, and returns the
+// first session established. The other handshake is cancelled.
+func (p *Plug) raceSession(ctx context.Context, username, password string) (Session, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		proto Protocol
+		s     Session
+		err   error
+	}
+	protocols := []Protocol{ProtocolKLAP, ProtocolPassthrough}
+	results := make(chan result, len(protocols))
+	start := time.Now()
+	for _, proto := range protocols {
+		go func(proto Protocol) {
+			s, err := p.newSessionWith(ctx, proto, username, password)
+			results <- result{proto: proto, s: s, err: err}
+		}(proto)
+	}
+	var errs []error
+	for range protocols {
+		r := <-results
+		if r.err != nil {
+			p.log.Printf("%s handshake failed after %s: %v", r.proto, time.Since(start), r.err)
+			errs = append(errs, r.err)
+			continue
+		}
+		p.log.Printf("%s handshake succeeded first, after %s", r.proto, time.Since(start))
+		if r.proto == ProtocolPassthrough {
+			p.warn(WarningProtocolFallback, "passthrough handshake succeeded before KLAP, using the deprecated passthrough protocol")
+		}
+		return r.s, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// newSessionWith handshakes with the given protocol.
+func (p *Plug) newSessionWith(ctx context.Context, proto Protocol, username, password string) (Session, error) {
+	switch proto {
+	case ProtocolKLAP:
 		ks := NewKlapSession(p.log)
-		if err := ks.Handshake(p.Addr, username, password); err != nil {
-			p.log.Printf("KLAP handshake failed, trying passthrough handshake")
-			// then try the older passthrough protocol
-			ps := NewPassthroughSession(p.log)
-			if err := ps.Handshake(p.Addr, username, password); err != nil {
-				return fmt.Errorf("passthrough handshake failed: %w", err)
+		ks.Transport = p.deviceTransport()
+		ks.HTTPS = p.https
+		ks.Port = p.port
+		ks.Timeout = p.timeout
+		ks.VerifySignature = p.verifyKlapSignature
+		var err error
+		if c := p.getCredentials(); c != nil {
+			err = ks.handshakeCredentials(ctx, p.Addr, *c)
+		} else {
+			err = ks.HandshakeContext(ctx, p.Addr, username, password)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("KLAP handshake failed: %w", err)
+		}
+		return ks, nil
+	case ProtocolPassthrough:
+		ps := NewPassthroughSession(p.log)
+		ps.Timeout = p.timeout
+		ps.Transport = p.deviceTransport()
+		ps.HTTPS = p.https
+		ps.Port = p.port
+		ps.RSAKey = p.rsaKey
+		ps.LoginVersion = p.loginVersion
+		var err error
+		if c := p.getCredentials(); c != nil {
+			err = ps.handshakeCredentials(ctx, p.Addr, *c)
+		} else {
+			err = ps.HandshakeContext(ctx, p.Addr, username, password)
+		}
+		if ps.longV1 {
+			p.warn(WarningLongPassword, "passwords longer than 8 characters may not work with version 1 of the passthrough login due to a firmware bug")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("passthrough handshake failed: %w", err)
+		}
+		return ps, nil
+	}
+	return nil, fmt.Errorf("unknown protocol '%s'", proto)
+}
+
+// requestContext sends a request through the session. If the device drops the
+// session, by replying with HTTP 403 or with an error code whose hint is
+// HintRehandshake like StatusSessionTimeout, it handshakes again and resends
+// the request, within the budget set with OptionRehandshakeRetries. If the
+// request fails with a transient error, see transientError, it is sent again
+// after an exponential backoff, within the budget set with
+// OptionRetryOnCommunicationError. Once a budget is exhausted, the last
+// response or error is returned as is. A session that is about to expire, see
+// ExpiringSession, is renewed before sending the request. ctx applies to the
+// requests and to the handshakes.
+func (p *Plug) requestContext(ctx context.Context, requestBytes []byte) ([]byte, error) {
+	p.mu.Lock()
+	session, username, password := p.session, p.username, p.password
+	p.mu.Unlock()
+	if p.sessionExpired() {
+		p.log.Printf("Session for %s is about to expire, handshaking again", p.Addr)
+		if err := rehandshake(ctx, unwrapSession(session), username, password); err != nil {
+			return nil, fmt.Errorf("handshake before expiry failed: %w", err)
+		}
+	}
+	rehandshakes, retries := 0, 0
+	for {
+		response, err := sessionRequest(ctx, session, requestBytes)
+		if err == nil {
+			var resp struct {
+				ErrorCode TapoError `json:"error_code"`
 			}
-			request := NewLoginDeviceRequest(username, password)
-			requestBytes, err := json.Marshal(request)
-			if err != nil {
-				return fmt.Errorf("failed to marshal login_device payload: %w", err)
+			if json.Unmarshal(response, &resp) != nil {
+				return response, nil
 			}
-
-			response, err := ps.Request(requestBytes)
-			if err != nil {
-				return fmt.Errorf("request failed: %w", err)
+			if hint := resp.ErrorCode.Hint(); hint != HintRehandshake && hint != HintRetry {
+				return response, nil
 			}
-			var loginResp LoginDeviceResponse
-			if err := json.Unmarshal(response, &loginResp); err != nil {
-				return fmt.Errorf("failed to unmarshal JSON response: %w", err)
+			err = resp.ErrorCode
+		}
+		switch {
+		case errors.Is(err, ErrForbidden) || ErrorHint(err) == HintRehandshake:
+			if rehandshakes >= p.rehandshakeRetries {
+				return response, err
 			}
-			if loginResp.ErrorCode != 0 {
-				return fmt.Errorf("request failed: %s", loginResp.ErrorCode)
+			rehandshakes++
+			p.log.Printf("Request to %s failed (%v), handshaking again", p.Addr, err)
+			if herr := rehandshake(ctx, unwrapSession(session), username, password); herr != nil {
+				return nil, fmt.Errorf("%w, and handshake failed: %w", err, herr)
 			}
-			if loginResp.Result.Token == "" {
-				return fmt.Errorf("empty token returned by device")
+		case transientError(err):
+			if retries >= p.retriesOnCommunicationError {
+				if response != nil {
+					// the caller decodes the error code
+					return response, nil
+				}
+				return nil, err
 			}
-			ps.token = loginResp.Result.Token
-			p.session = ps
-		} else {
-			p.session = ks
+			delay := p.retryBackoff
+			for i := 0; i < retries && delay < maxRetryBackoff; i++ {
+				delay *= 2
+			}
+			if delay > maxRetryBackoff {
+				delay = maxRetryBackoff
+			}
+			retries++
+			p.log.Printf("Request to %s failed (%v), retrying in %s", p.Addr, err, delay)
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%w, retry cancelled: %w", err, ctx.Err())
+			case <-time.After(delay):
+			}
+		default:
+			return response, err
 		}
 	}
+}
 
-	return nil
+// deviceTransport returns the transport of the sessions, with the TLS
+// settings of OptionHTTPS applied. Without OptionProxy, the proxy environment
+// variables are honored, see proxyFromEnvironment. Custom transports that are
+// not an *http.Transport are used as they are.
+func (p *Plug) deviceTransport() http.RoundTripper {
+	transport := p.transport
+	if transport == nil {
+		transport = defaultTransport
+	}
+	if !p.https {
+		return transport
+	}
+	t, ok := transport.(*http.Transport)
+	if !ok {
+		return transport
+	}
+	tr := t.Clone()
+	tr.TLSClientConfig = p.tlsConfig
+	if tr.TLSClientConfig == nil {
+		// devices have self-signed certificates
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return tr
 }
 
 func (p *Plug) GetDeviceInfo() (*DeviceInfo, error) {
-	if p.session == nil {
+	return p.GetDeviceInfoContext(context.Background())
+}
+
+// GetDeviceInfoContext is like GetDeviceInfo, but the request is aborted when
+// ctx is done.
+func (p *Plug) GetDeviceInfoContext(ctx context.Context) (*DeviceInfo, error) {
+	if p.currentSession() == nil {
 		return nil, fmt.Errorf("not logged in")
 	}
 	request := NewGetDeviceInfoRequest()
@@ -119,7 +420,7 @@ func (p *Plug) GetDeviceInfo() (*DeviceInfo, error) {
 	}
 	p.log.Printf("GetDeviceInfo request: %s", requestBytes)
 
-	response, err := p.session.Request(requestBytes)
+	response, err := p.requestContext(ctx, requestBytes)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
@@ -129,28 +430,47 @@ func (p *Plug) GetDeviceInfo() (*DeviceInfo, error) {
 		return nil, fmt.Errorf("failed to unmarshal JSON response: %w", err)
 	}
 	if infoResp.ErrorCode != 0 {
-		return nil, fmt.Errorf("request failed: %s", infoResp.ErrorCode)
+		return nil, fmt.Errorf("request failed: %w", infoResp.ErrorCode)
 	}
-	// decode base64-encoded fields
-	decodedSSID, err := base64.StdEncoding.DecodeString(infoResp.Result.SSID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to base64-decode SSID: %w", err)
-	}
-	infoResp.Result.DecodedSSID = string(decodedSSID)
+	p.processDeviceInfo(&infoResp.Result)
+	return &infoResp.Result, nil
+}
 
-	decodedNickname, err := base64.StdEncoding.DecodeString(infoResp.Result.Nickname)
-	if err != nil {
-		return nil, fmt.Errorf("failed to base64-decode Nickname: %w", err)
+// processDeviceInfo decodes the fields of a get_device_info result, and
+// tracks the state of the device for OptionMinOffTime.
+func (p *Plug) processDeviceInfo(info *DeviceInfo) {
+	// decode base64-encoded fields, without failing the whole call on
+	// firmwares that send them in clear
+	info.DecodedSSID = decodeBase64Field("ssid", info.SSID, &info.Warnings)
+	info.DecodedNickname = decodeBase64Field("nickname", info.Nickname, &info.Warnings)
+	for _, w := range info.Warnings {
+		p.warn(WarningUndecodableField, "get_device_info: %s", w)
 	}
-	infoResp.Result.DecodedNickname = string(decodedNickname)
 
-	return &infoResp.Result, nil
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lastSeenOn && !info.DeviceON && p.lastOff.IsZero() {
+		// turned off by somebody else since we last looked
+		p.lastOff = time.Now()
+	}
+	p.lastSeenOn = info.DeviceON
 }
 
 func (p *Plug) SetDeviceInfo(deviceOn bool) error {
-	if p.session == nil {
+	return p.SetDeviceInfoContext(context.Background(), deviceOn)
+}
+
+// SetDeviceInfoContext is like SetDeviceInfo, but the request is aborted when
+// ctx is done.
+func (p *Plug) SetDeviceInfoContext(ctx context.Context, deviceOn bool) error {
+	if p.currentSession() == nil {
 		return fmt.Errorf("not logged in")
 	}
+	if deviceOn {
+		if err := p.checkMinOffTime(ctx); err != nil {
+			return err
+		}
+	}
 	request := NewSetDeviceInfoRequest(deviceOn)
 	requestBytes, err := json.Marshal(request)
 	if err != nil {
@@ -158,7 +478,7 @@ func (p *Plug) SetDeviceInfo(deviceOn bool) error {
 	}
 	p.log.Printf("SetDeviceInfo request: %s", requestBytes)
 
-	response, err := p.session.Request(requestBytes)
+	response, err := p.requestContext(ctx, requestBytes)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -168,13 +488,65 @@ func (p *Plug) SetDeviceInfo(deviceOn bool) error {
 		return fmt.Errorf("failed to unmarshal JSON response: %w", err)
 	}
 	if infoResp.ErrorCode != 0 {
-		return fmt.Errorf("request failed: %s", infoResp.ErrorCode)
+		return fmt.Errorf("request failed: %w", infoResp.ErrorCode)
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if deviceOn {
+		p.lastOff = time.Time{}
+	} else if p.lastOff.IsZero() {
+		p.lastOff = time.Now()
+	}
+	p.lastSeenOn = deviceOn
 	return nil
 }
 
+// MinOffTimeError is returned when turning a plug on before its minimum off
+// time has elapsed, see OptionMinOffTime.
+type MinOffTimeError struct {
+	// Remaining is how long to wait before the plug can be turned on.
+	Remaining time.Duration
+}
+
+func (e *MinOffTimeError) Error() string {
+	return fmt.Sprintf("minimum off time not elapsed, %s remaining", e.Remaining.Round(time.Second))
+}
+
+// checkMinOffTime enforces the minimum off time, by either waiting for it to
+// elapse, unless ctx is done first, or returning a *MinOffTimeError.
+func (p *Plug) checkMinOffTime(ctx context.Context) error {
+	p.mu.Lock()
+	lastOff := p.lastOff
+	p.mu.Unlock()
+	if p.minOffTime <= 0 || lastOff.IsZero() {
+		return nil
+	}
+	remaining := p.minOffTime - time.Since(lastOff)
+	if remaining <= 0 {
+		return nil
+	}
+	if !p.minOffTimeWait {
+		return &MinOffTimeError{Remaining: remaining}
+	}
+	p.log.Printf("Waiting %s for the minimum off time to elapse", remaining)
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for the minimum off time: %w", ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
 func (p *Plug) GetDeviceUsage() (*DeviceUsage, error) {
-	if p.session == nil {
+	return p.GetDeviceUsageContext(context.Background())
+}
+
+// GetDeviceUsageContext is like GetDeviceUsage, but the request is aborted
+// when ctx is done.
+func (p *Plug) GetDeviceUsageContext(ctx context.Context) (*DeviceUsage, error) {
+	if p.currentSession() == nil {
 		return nil, fmt.Errorf("not logged in")
 	}
 	request := NewGetDeviceUsageRequest()
@@ -184,7 +556,7 @@ func (p *Plug) GetDeviceUsage() (*DeviceUsage, error) {
 	}
 	p.log.Printf("GetDeviceUsage request: %s", requestBytes)
 
-	response, err := p.session.Request(requestBytes)
+	response, err := p.requestContext(ctx, requestBytes)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
@@ -194,13 +566,19 @@ func (p *Plug) GetDeviceUsage() (*DeviceUsage, error) {
 		return nil, fmt.Errorf("failed to unmarshal JSON response: %w", err)
 	}
 	if usageResp.ErrorCode != 0 {
-		return nil, fmt.Errorf("request failed: %s", usageResp.ErrorCode)
+		return nil, fmt.Errorf("request failed: %w", usageResp.ErrorCode)
 	}
 	return &usageResp.Result, nil
 }
 
 func (p *Plug) GetEnergyUsage() (*EnergyUsage, error) {
-	if p.session == nil {
+	return p.GetEnergyUsageContext(context.Background())
+}
+
+// GetEnergyUsageContext is like GetEnergyUsage, but the request is aborted
+// when ctx is done.
+func (p *Plug) GetEnergyUsageContext(ctx context.Context) (*EnergyUsage, error) {
+	if p.currentSession() == nil {
 		return nil, fmt.Errorf("not logged in")
 	}
 	request := NewGetEnergyUsageRequest()
@@ -210,7 +588,7 @@ func (p *Plug) GetEnergyUsage() (*EnergyUsage, error) {
 	}
 	p.log.Printf("GetEnergyUsage request: %s", requestBytes)
 
-	response, err := p.session.Request(requestBytes)
+	response, err := p.requestContext(ctx, requestBytes)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
@@ -220,11 +598,53 @@ func (p *Plug) GetEnergyUsage() (*EnergyUsage, error) {
 		return nil, fmt.Errorf("failed to unmarshal JSON response: %w", err)
 	}
 	if usageResp.ErrorCode != 0 {
-		return nil, fmt.Errorf("request failed: %s", usageResp.ErrorCode)
+		return nil, fmt.Errorf("request failed: %w", usageResp.ErrorCode)
 	}
 	return &usageResp.Result, nil
 }
 
+// Call sends a request for an arbitrary method, with optional JSON-encoded
+// params, and returns the undecoded response. It fails if the device returns
+// a non-zero error code. See LookupMethod for the known methods.
+func (p *Plug) Call(method string, params json.RawMessage) ([]byte, error) {
+	return p.CallContext(context.Background(), method, params)
+}
+
+// CallContext is like Call, but the request is aborted when ctx is done.
+func (p *Plug) CallContext(ctx context.Context, method string, params json.RawMessage) ([]byte, error) {
+	if p.currentSession() == nil {
+		return nil, fmt.Errorf("not logged in")
+	}
+	request := struct {
+		Envelope
+		Params json.RawMessage `json:"params,omitempty"`
+	}{
+		Envelope: protocol.NewEnvelope(method, true),
+		Params:   params,
+	}
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s payload: %w", method, err)
+	}
+	p.log.Printf("Call request: %s", requestBytes)
+
+	response, err := p.requestContext(ctx, requestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	p.log.Printf("Call response: %s", response)
+	var resp struct {
+		ErrorCode TapoError `json:"error_code"`
+	}
+	if err := json.Unmarshal(response, &resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JSON response: %w", err)
+	}
+	if resp.ErrorCode != 0 {
+		return response, fmt.Errorf("request failed: %w", resp.ErrorCode)
+	}
+	return response, nil
+}
+
 func (p *Plug) On() error {
 	return p.SetDeviceInfo(true)
 }
@@ -240,3 +660,13 @@ func (p *Plug) IsOn() (bool, error) {
 	}
 	return info.DeviceON, nil
 }
+
+// sessionExpired returns true if the plug's session needs a new handshake, see
+// ExpiringSession. Sessions that do not implement it never expire.
+func (p *Plug) sessionExpired() bool {
+	es, ok := unwrapSession(p.currentSession()).(ExpiringSession)
+	if !ok {
+		return false
+	}
+	return !es.IsValid()
+}
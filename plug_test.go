@@ -0,0 +1,739 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestPlug returns a KLAP plug logged in to a fake device that accepts the
+// credentials user and pass. The options are applied after
+// OptionProtocolKLAP. Set the fields of the returned device, like respond, to
+// change how it answers the requests.
+func newTestPlug(t *testing.T, opts ...PlugOption) (*Plug, *fakeKlapDevice) {
+	t.Helper()
+	dev := &fakeKlapDevice{t: t, username: "user", password: "pass"}
+	plug := newFakePlug(dev, opts...)
+	if err := plug.Handshake(dev.username, dev.password); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	return plug, dev
+}
+
+// newFakePlug is like newTestPlug, for a given device and without logging in.
+func newFakePlug(dev *fakeKlapDevice, opts ...PlugOption) *Plug {
+	plug := NewPlug(netip.MustParseAddr("192.0.2.1"), nil, append([]PlugOption{OptionProtocolKLAP}, opts...)...)
+	plug.transport = dev
+	return plug
+}
+
+// TestKlapPlug runs GetDeviceInfo and SetDeviceInfo end to end against a
+// KLAP-only device.
+func TestKlapPlug(t *testing.T) {
+	var setOn *bool
+	plug, dev := newTestPlug(t)
+	dev.respond = func(req []byte) []byte {
+		var r struct {
+			Method string `json:"method"`
+			Params struct {
+				DeviceOn *bool `json:"device_on"`
+			} `json:"params"`
+		}
+		if err := json.Unmarshal(req, &r); err != nil {
+			t.Fatalf("invalid request %q: %v", req, err)
+		}
+		switch r.Method {
+		case "get_device_info":
+			return benchDeviceInfo
+		case "set_device_info":
+			setOn = r.Params.DeviceOn
+			return []byte(`{"error_code":0,"result":{}}`)
+		}
+		return []byte(`{"error_code":-1}`)
+	}
+	info, err := plug.GetDeviceInfo()
+	if err != nil {
+		t.Fatalf("GetDeviceInfo failed: %v", err)
+	}
+	if info.Model != "P110" || info.DecodedNickname != "Living room" || !info.DeviceON {
+		t.Errorf("unexpected device info %+v", info)
+	}
+	if err := plug.SetDeviceInfo(false); err != nil {
+		t.Fatalf("SetDeviceInfo failed: %v", err)
+	}
+	if setOn == nil || *setOn {
+		t.Errorf("device_on = %v, want false", setOn)
+	}
+	if dev.handshakes != 1 || dev.requests != 2 {
+		t.Errorf("handshakes, requests = %d, %d, want 1, 2", dev.handshakes, dev.requests)
+	}
+}
+
+// TestPlugRehandshake checks that a session timeout reported by the device is
+// fixed with a new handshake, within the retry budget.
+func TestPlugRehandshake(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		timeouts       int
+		retries        int
+		wantErr        bool
+		wantHandshakes int
+	}{
+		{"no timeout", 0, 1, false, 1},
+		{"one timeout", 1, 1, false, 2},
+		{"budget exhausted", 2, 1, true, 2},
+		{"larger budget", 2, 3, false, 3},
+		{"retries disabled", 1, 0, true, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			timeouts := tc.timeouts
+			plug, dev := newTestPlug(t, OptionRehandshakeRetries(tc.retries))
+			dev.respond = func(req []byte) []byte {
+				if timeouts > 0 {
+					timeouts--
+					return []byte(`{"error_code":9999}`)
+				}
+				return benchDeviceInfo
+			}
+			_, err := plug.GetDeviceInfo()
+			if tc.wantErr {
+				if !errors.Is(err, StatusSessionTimeout) {
+					t.Errorf("err = %v, want %v", err, StatusSessionTimeout)
+				}
+			} else if err != nil {
+				t.Errorf("GetDeviceInfo failed: %v", err)
+			}
+			if dev.handshakes != tc.wantHandshakes {
+				t.Errorf("handshakes = %d, want %d", dev.handshakes, tc.wantHandshakes)
+			}
+		})
+	}
+}
+
+// TestPlugForbidden checks that a session dropped by the device, which answers
+// with HTTP 403, is fixed with a single new handshake, within the retry budget.
+func TestPlugForbidden(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		forbid         int
+		retries        int
+		wantErr        bool
+		wantHandshakes int
+	}{
+		{"one 403", 1, 1, false, 2},
+		{"budget exhausted", 2, 1, true, 2},
+		{"larger budget", 2, 3, false, 3},
+		{"retries disabled", 1, 0, true, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			plug, dev := newTestPlug(t, OptionRehandshakeRetries(tc.retries))
+			dev.respond = func(req []byte) []byte { return benchDeviceInfo }
+			dev.forbid = tc.forbid
+			_, err := plug.GetDeviceInfo()
+			if tc.wantErr {
+				if !errors.Is(err, ErrForbidden) {
+					t.Errorf("err = %v, want %v", err, ErrForbidden)
+				}
+			} else if err != nil {
+				t.Errorf("GetDeviceInfo failed: %v", err)
+			}
+			if dev.handshakes != tc.wantHandshakes {
+				t.Errorf("handshakes = %d, want %d", dev.handshakes, tc.wantHandshakes)
+			}
+		})
+	}
+}
+
+// TestPlugRehandshakeForbidden checks that a device rejecting the new
+// handshake with HTTP 403 is reported the same at both handshake steps.
+func TestPlugRehandshakeForbidden(t *testing.T) {
+	for _, step := range []string{"handshake1", "handshake2"} {
+		t.Run(step, func(t *testing.T) {
+			plug, dev := newTestPlug(t, OptionRehandshakeRetries(1))
+			dev.forbid = 1
+			dev.forbidHandshake = step
+			_, err := plug.GetDeviceInfo()
+			var herr *HTTPError
+			if !errors.Is(err, ErrForbidden) || errors.As(err, &herr) {
+				t.Errorf("err = %v, want the handshake to fail with %v", err, ErrForbidden)
+			}
+			if dev.handshakes != 2 {
+				t.Errorf("handshakes = %d, want 2", dev.handshakes)
+			}
+		})
+	}
+}
+
+func TestPlugHTTPS(t *testing.T) {
+	plug, dev := newTestPlug(t, OptionHTTPS(nil))
+	dev.respond = func(req []byte) []byte { return benchDeviceInfo }
+	if _, err := plug.GetDeviceInfo(); err != nil {
+		t.Fatalf("GetDeviceInfo failed: %v", err)
+	}
+	if dev.scheme != "https" {
+		t.Errorf("scheme = %q, want https", dev.scheme)
+	}
+
+	// the default transport gets TLS settings for self-signed certificates
+	plug = NewPlug(netip.MustParseAddr("192.0.2.1"), nil, OptionHTTPS(nil))
+	tr, ok := plug.deviceTransport().(*http.Transport)
+	if !ok || tr.TLSClientConfig == nil || !tr.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("unexpected transport %#v", plug.deviceTransport())
+	}
+	if tr == http.DefaultTransport {
+		t.Errorf("http.DefaultTransport was modified")
+	}
+}
+
+func TestPlugPort(t *testing.T) {
+	var resp DiscoverResponse
+	resp.Result.MgtEncryptSchm.HTTPPort = 8080
+	_, dev := newTestPlug(t, OptionDiscovered(resp))
+	if dev.host != "192.0.2.1:8080" {
+		t.Errorf("host = %q, want 192.0.2.1:8080", dev.host)
+	}
+
+	for _, tc := range []struct {
+		addr string
+		port uint16
+		want string
+	}{
+		{"192.0.2.1", 0, "http://192.0.2.1/app"},
+		{"192.0.2.1", 80, "http://192.0.2.1/app"},
+		{"2001:db8::1", 8080, "http://[2001:db8::1]:8080/app"},
+	} {
+		if got := deviceURL(netip.MustParseAddr(tc.addr), tc.port, false, "/app").String(); got != tc.want {
+			t.Errorf("deviceURL(%s, %d) = %s, want %s", tc.addr, tc.port, got, tc.want)
+		}
+	}
+}
+
+func TestPlugGetComponents(t *testing.T) {
+	plug, dev := newTestPlug(t)
+	dev.respond = func(req []byte) []byte {
+		if !bytes.Contains(req, []byte(`"method":"component_nego"`)) {
+			t.Errorf("unexpected request %q", req)
+		}
+		return []byte(`{"error_code":0,"result":{"component_list":[{"id":"device","ver_code":2},{"id":"countdown","ver_code":1},{"id":"energy_monitoring","ver_code":2}]}}`)
+	}
+	components, err := plug.GetComponents()
+	if err != nil {
+		t.Fatalf("GetComponents failed: %v", err)
+	}
+	for id, want := range map[string]bool{"countdown": true, "energy_monitoring": true, "led": false} {
+		if got := components.Has(id); got != want {
+			t.Errorf("Has(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestPlugFirmware(t *testing.T) {
+	plug, dev := newTestPlug(t)
+	var methods []string
+	dev.respond = func(req []byte) []byte {
+		var r struct {
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(req, &r); err != nil {
+			t.Fatalf("invalid request %q: %v", req, err)
+		}
+		if r.Params != nil {
+			t.Errorf("%s: unexpected params %s", r.Method, r.Params)
+		}
+		methods = append(methods, r.Method)
+		switch r.Method {
+		case "get_latest_fw":
+			return []byte(`{"error_code":0,"result":{"need_to_upgrade":true,"fw_ver":"1.2.0 Build 240101 Rel.100000","fw_size":0,"type":1}}`)
+		case "fw_download":
+			return []byte(`{"error_code":0}`)
+		}
+		t.Errorf("unexpected request %q", req)
+		return []byte(`{"error_code":-1}`)
+	}
+	latest, err := plug.GetLatestFirmware()
+	if err != nil {
+		t.Fatalf("GetLatestFirmware failed: %v", err)
+	}
+	if !latest.NeedToUpgrade || latest.FWVersion != "1.2.0 Build 240101 Rel.100000" {
+		t.Errorf("GetLatestFirmware = %+v", latest)
+	}
+	if err := plug.UpdateFirmware(); err != nil {
+		t.Fatalf("UpdateFirmware failed: %v", err)
+	}
+	if want := []string{"get_latest_fw", "fw_download"}; strings.Join(methods, ",") != strings.Join(want, ",") {
+		t.Errorf("methods = %v, want %v", methods, want)
+	}
+}
+
+func TestPlugTrace(t *testing.T) {
+	var traces []Trace
+	plug, dev := newTestPlug(t, OptionTrace(func(tr Trace) {
+		traces = append(traces, tr)
+	}))
+	dev.respond = func(req []byte) []byte {
+		if bytes.Contains(req, []byte(`"method":"set_device_info"`)) {
+			return []byte(`{"error_code":-1008}`)
+		}
+		return []byte(`{"error_code":0,"result":{}}`)
+	}
+	if _, err := plug.Call("get_device_info", nil); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+	if _, err := plug.Call("set_device_info", json.RawMessage(`{"device_on":true}`)); !errors.Is(err, StatusInvalidParams) {
+		t.Fatalf("set_device_info: got %v, want %v", err, StatusInvalidParams)
+	}
+	want := []struct {
+		method    string
+		status    int
+		errorCode TapoError
+	}{
+		{"get_device_info", http.StatusOK, StatusSuccess},
+		{"set_device_info", http.StatusOK, StatusInvalidParams},
+	}
+	if len(traces) != len(want) {
+		t.Fatalf("got %d traces, want %d", len(traces), len(want))
+	}
+	for idx, w := range want {
+		tr := traces[idx]
+		if tr.Method != w.method || tr.HTTPStatus != w.status || tr.ErrorCode != w.errorCode {
+			t.Errorf("trace %d: got %s, HTTP %d, error_code %d, want %s, HTTP %d, error_code %d", idx, tr.Method, tr.HTTPStatus, tr.ErrorCode, w.method, w.status, w.errorCode)
+		}
+		if tr.Addr != plug.Addr {
+			t.Errorf("trace %d: got address %s, want %s", idx, tr.Addr, plug.Addr)
+		}
+		if !bytes.Contains(tr.Request, []byte(w.method)) {
+			t.Errorf("trace %d: request %q does not contain the method", idx, tr.Request)
+		}
+		if tr.Err != nil || len(tr.Response) == 0 {
+			t.Errorf("trace %d: got response %q, error %v", idx, tr.Response, tr.Err)
+		}
+	}
+}
+
+func TestPlugHandshakeCredentials(t *testing.T) {
+	timeouts := 1
+	dev := fakeKlapDevice{t: t, username: "user", password: "pass"}
+	dev.respond = func(req []byte) []byte {
+		if timeouts > 0 {
+			timeouts--
+			return []byte(`{"error_code":9999}`)
+		}
+		return benchDeviceInfo
+	}
+	plug := newFakePlug(&dev)
+	if err := plug.HandshakeCredentials(NewCredentials(dev.username, dev.password, false)); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	// the session timeout makes the plug handshake again with the same
+	// credentials.
+	if _, err := plug.GetDeviceInfo(); err != nil {
+		t.Fatalf("GetDeviceInfo failed: %v", err)
+	}
+	if dev.handshakes != 2 {
+		t.Errorf("handshakes = %d, want 2", dev.handshakes)
+	}
+
+	plug = newFakePlug(&dev)
+	if err := plug.HandshakeCredentials(NewCredentials(dev.username, "wrong", false)); err == nil {
+		t.Errorf("handshake with wrong credentials succeeded")
+	}
+}
+
+func TestPlugContext(t *testing.T) {
+	dev := fakeKlapDevice{t: t, username: "user", password: "pass", hang: true}
+	plug := newFakePlug(&dev)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := plug.HandshakeContext(ctx, dev.username, dev.password); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("HandshakeContext err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	dev.hang = false
+	if err := plug.HandshakeContext(context.Background(), dev.username, dev.password); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	dev.hang = true
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := plug.GetDeviceInfoContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetDeviceInfoContext err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	now := time.Now()
+	for name, call := range map[string]func(context.Context) error{
+		"GetDeviceUsageContext": func(ctx context.Context) error {
+			_, err := plug.GetDeviceUsageContext(ctx)
+			return err
+		},
+		"GetEnergyUsageContext": func(ctx context.Context) error {
+			_, err := plug.GetEnergyUsageContext(ctx)
+			return err
+		},
+		"GetDeviceTimeContext": func(ctx context.Context) error {
+			_, err := plug.GetDeviceTimeContext(ctx)
+			return err
+		},
+		"SetDeviceTimeContext": func(ctx context.Context) error {
+			return plug.SetDeviceTimeContext(ctx, NewDeviceTime(now, time.UTC))
+		},
+		"GetEnergyDataRangeContext": func(ctx context.Context) error {
+			_, err := plug.GetEnergyDataRangeContext(ctx, now.Add(-time.Hour), now, EnergyHourly, time.UTC, nil)
+			return err
+		},
+		"SetCountdownContext": func(ctx context.Context) error {
+			return plug.SetCountdownContext(ctx, time.Minute, false)
+		},
+		"GetLatestFirmwareContext": func(ctx context.Context) error {
+			_, err := plug.GetLatestFirmwareContext(ctx)
+			return err
+		},
+		"UpdateFirmwareContext": func(ctx context.Context) error {
+			return plug.UpdateFirmwareContext(ctx)
+		},
+		"GetFirmwareDownloadStateContext": func(ctx context.Context) error {
+			_, err := plug.GetFirmwareDownloadStateContext(ctx)
+			return err
+		},
+		"GetStatusContext": func(ctx context.Context) error {
+			_, err := plug.GetStatusContext(ctx)
+			return err
+		},
+		"GetComponentsContext": func(ctx context.Context) error {
+			_, err := plug.GetComponentsContext(ctx)
+			return err
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if err := call(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s err = %v, want %v", name, err, context.DeadlineExceeded)
+		}
+		cancel()
+	}
+}
+
+func TestPlugMinOffTime(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		wait bool
+	}{
+		{"fail", false},
+		{"wait", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			plug, dev := newTestPlug(t, OptionMinOffTime(time.Hour, tc.wait))
+			dev.respond = func(req []byte) []byte { return []byte(`{"error_code":0}`) }
+			if err := plug.SetDeviceInfo(false); err != nil {
+				t.Fatalf("SetDeviceInfo(false) failed: %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			err := plug.SetDeviceInfoContext(ctx, true)
+			if tc.wait {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+				}
+			} else if _, ok := err.(*MinOffTimeError); !ok {
+				t.Errorf("err = %v, want a *MinOffTimeError", err)
+			}
+			if dev.requests != 1 {
+				t.Errorf("requests = %d, want 1", dev.requests)
+			}
+		})
+	}
+}
+
+func TestPlugTimeout(t *testing.T) {
+	plug, dev := newTestPlug(t, OptionTimeout(10*time.Millisecond))
+	dev.hang = true
+	_, err := plug.GetDeviceInfo()
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+}
+
+func TestPlugConcurrentHandshakes(t *testing.T) {
+	var warnings []Warning
+	plug, dev := newTestPlug(t, OptionProtocol(ProtocolAuto), OptionConcurrentHandshakes(), OptionWarnings(func(w Warning) {
+		warnings = append(warnings, w)
+	}))
+	if got := plug.Protocol(); got != ProtocolKLAP {
+		t.Errorf("protocol = %s, want %s", got, ProtocolKLAP)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+
+	plug = newFakePlug(dev, OptionProtocol(ProtocolAuto), OptionConcurrentHandshakes())
+	if err := plug.Handshake(dev.username, "wrong"); err == nil {
+		t.Errorf("handshake with wrong password succeeded")
+	}
+}
+
+func TestPlugRetryOnCommunicationError(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		failures     int
+		retries      int
+		wantErr      bool
+		wantRequests int
+	}{
+		{"no failure", 0, 0, false, 1},
+		{"retries disabled", 1, 0, true, 1},
+		{"one failure", 1, 1, false, 2},
+		{"budget exhausted", 3, 2, true, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			failures := tc.failures
+			plug, dev := newTestPlug(t, OptionRetryOnCommunicationError(tc.retries), OptionRetryBackoff(time.Millisecond))
+			dev.respond = func(req []byte) []byte {
+				if failures > 0 {
+					failures--
+					return []byte(`{"error_code":1003}`)
+				}
+				return benchDeviceInfo
+			}
+			_, err := plug.GetDeviceInfo()
+			if tc.wantErr {
+				if !errors.Is(err, StatusCommunicationError) {
+					t.Errorf("err = %v, want %v", err, StatusCommunicationError)
+				}
+			} else if err != nil {
+				t.Errorf("GetDeviceInfo failed: %v", err)
+			}
+			if dev.requests != tc.wantRequests || dev.handshakes != 1 {
+				t.Errorf("requests, handshakes = %d, %d, want %d, 1", dev.requests, dev.handshakes, tc.wantRequests)
+			}
+		})
+	}
+}
+
+func TestPlugGetStatus(t *testing.T) {
+	var info struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(benchDeviceInfo, &info); err != nil {
+		t.Fatal(err)
+	}
+	usage := `{"time_usage":{"today":10,"past7":70,"past30":300}}`
+	for _, tc := range []struct {
+		name         string
+		batched      bool
+		wantRequests int
+	}{
+		{"batched", true, 1},
+		{"separate", false, 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			plug, dev := newTestPlug(t)
+			dev.respond = func(req []byte) []byte {
+				var r struct {
+					Method string `json:"method"`
+				}
+				if err := json.Unmarshal(req, &r); err != nil {
+					t.Fatalf("invalid request %q: %v", req, err)
+				}
+				switch r.Method {
+				case "multipleRequest":
+					if !tc.batched {
+						return []byte(`{"error_code":-1002}`)
+					}
+					return []byte(`{"error_code":0,"result":{"responses":[` +
+						`{"method":"get_device_info","error_code":0,"result":` + string(info.Result) + `},` +
+						`{"method":"get_device_usage","error_code":0,"result":` + usage + `},` +
+						`{"method":"get_energy_usage","error_code":-1002}]}}`)
+				case "get_device_info":
+					return benchDeviceInfo
+				case "get_device_usage":
+					return []byte(`{"error_code":0,"result":` + usage + `}`)
+				}
+				return []byte(`{"error_code":-1002}`)
+			}
+			st, err := plug.GetStatus()
+			if err != nil {
+				t.Fatalf("GetStatus failed: %v", err)
+			}
+			if st.Info.DecodedNickname != "Living room" {
+				t.Errorf("nickname = %q, want %q", st.Info.DecodedNickname, "Living room")
+			}
+			if st.Usage.TimeUsage.Past7 != 70 {
+				t.Errorf("past 7 days time usage = %d, want 70", st.Usage.TimeUsage.Past7)
+			}
+			if st.Energy != nil {
+				t.Errorf("energy = %+v, want nil", st.Energy)
+			}
+			if dev.requests != tc.wantRequests {
+				t.Errorf("requests = %d, want %d", dev.requests, tc.wantRequests)
+			}
+		})
+	}
+}
+
+func TestPlugErrorsIs(t *testing.T) {
+	dev := fakeKlapDevice{t: t, username: "user", password: "pass"}
+	plug := newFakePlug(&dev)
+	if err := plug.Handshake(dev.username, "wrong"); !errors.Is(err, StatusInvalidCredentials) {
+		t.Errorf("handshake with wrong password: err = %v, want %v", err, StatusInvalidCredentials)
+	}
+
+	dev.respond = func(req []byte) []byte {
+		return []byte(`{"error_code":-1501}`)
+	}
+	if err := plug.Handshake(dev.username, dev.password); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	err := plug.SetDeviceInfo(true)
+	if !errors.Is(err, StatusInvalidRequestOrCredentials) {
+		t.Errorf("err = %v, want %v", err, StatusInvalidRequestOrCredentials)
+	}
+	var te TapoError
+	if !errors.As(err, &te) || te != StatusInvalidCredentials {
+		t.Errorf("errors.As(%v) = %d, want %d", err, te, StatusInvalidCredentials)
+	}
+	if errors.Is(err, StatusUnknownMethod) {
+		t.Errorf("err = %v matches %v", err, StatusUnknownMethod)
+	}
+	if hint := ErrorHint(err); hint != HintCredentials {
+		t.Errorf("hint = %v, want %v", hint, HintCredentials)
+	}
+}
+
+func TestPlugSessionExpiry(t *testing.T) {
+	start := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	clock := fakeClock{t: start}
+	plug, dev := newTestPlug(t)
+	dev.timeout = "3600"
+	es, ok := plug.session.(ExpiringSession)
+	if !ok {
+		t.Fatalf("%T does not implement ExpiringSession", plug.session)
+	}
+	// the handshake used the real clock, handshake again on the fake one.
+	ks := unwrapSession(plug.session).(*KlapSession)
+	ks.now = clock.now
+	if err := ks.Handshake(plug.Addr, dev.username, dev.password); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if want := start.Add(time.Hour); !es.ExpiresAt().Equal(want) {
+		t.Errorf("ExpiresAt() = %s, want %s", es.ExpiresAt(), want)
+	}
+	if !es.IsValid() {
+		t.Errorf("fresh session is not valid")
+	}
+
+	clock.t = start.Add(time.Hour - time.Minute)
+	if es.IsValid() {
+		t.Errorf("session about to expire is valid")
+	}
+	handshakes := dev.handshakes
+	if _, err := plug.GetDeviceInfo(); err != nil {
+		t.Fatalf("GetDeviceInfo failed: %v", err)
+	}
+	if dev.handshakes != handshakes+1 {
+		t.Errorf("handshakes = %d, want %d", dev.handshakes, handshakes+1)
+	}
+	if !es.IsValid() {
+		t.Errorf("renewed session is not valid")
+	}
+}
+
+func TestPlugConcurrentUse(t *testing.T) {
+	dev := fakeKlapDevice{t: t, username: "user", password: "pass"}
+	dev.respond = func(req []byte) []byte {
+		return benchDeviceInfo
+	}
+	plug := newFakePlug(&dev)
+	const workers, requests = 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*requests)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := plug.Handshake(dev.username, dev.password); err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < requests; j++ {
+				if _, err := plug.GetDeviceInfo(); err != nil {
+					errs <- err
+				}
+				plug.sessionExpired()
+				plug.Protocol()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if dev.requests != workers*requests {
+		t.Errorf("requests = %d, want %d", dev.requests, workers*requests)
+	}
+}
+
+// roundTripperFunc is an http.RoundTripper implemented by a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// TestPlugHandshakeNotShared checks that concurrent handshakes of two plugs
+// towards the same device do not share their result, since the plugs may have
+// different credentials.
+func TestPlugHandshakeNotShared(t *testing.T) {
+	dev := fakeKlapDevice{t: t, username: "user", password: "pass"}
+	// hold the first handshake request until the other plug sends its own
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/app/handshake1" {
+			arrived.Done()
+			done := make(chan struct{})
+			go func() {
+				arrived.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+			}
+		}
+		return dev.RoundTrip(req)
+	})
+	good, bad := newFakePlug(&dev), newFakePlug(&dev)
+	good.transport, bad.transport = transport, transport
+	var goodErr, badErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		goodErr = good.Handshake(dev.username, dev.password)
+	}()
+	go func() {
+		defer wg.Done()
+		badErr = bad.Handshake(dev.username, "wrong")
+	}()
+	wg.Wait()
+	if goodErr != nil {
+		t.Errorf("handshake with the right password failed: %v", goodErr)
+	}
+	if badErr == nil {
+		t.Errorf("handshake with a wrong password succeeded")
+	}
+	if dev.handshakes != 2 {
+		t.Errorf("handshakes = %d, want 2", dev.handshakes)
+	}
+}
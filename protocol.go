@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Protocol is the session protocol spoken by a device.
+type Protocol string
+
+const (
+	// ProtocolAuto tries KLAP first, then falls back to passthrough.
+	ProtocolAuto Protocol = ""
+	// ProtocolKLAP is the protocol of newer firmwares.
+	ProtocolKLAP Protocol = "klap"
+	// ProtocolPassthrough is the securePassthrough protocol of older
+	// firmwares.
+	ProtocolPassthrough Protocol = "passthrough"
+)
+
+// ParseProtocol parses the name of a protocol, as returned by String.
+func ParseProtocol(s string) (Protocol, error) {
+	switch s {
+	case "auto", "":
+		return ProtocolAuto, nil
+	case string(ProtocolKLAP):
+		return ProtocolKLAP, nil
+	case string(ProtocolPassthrough):
+		return ProtocolPassthrough, nil
+	}
+	return ProtocolAuto, fmt.Errorf("unknown protocol '%s', want auto, klap or passthrough", s)
+}
+
+func (p Protocol) String() string {
+	if p == ProtocolAuto {
+		return "auto"
+	}
+	return string(p)
+}
+
+// ProtocolCache remembers the protocol spoken by each device, so that later
+// handshakes skip the wrong-protocol attempt. Implementations must be safe for
+// concurrent use.
+type ProtocolCache interface {
+	// Protocol returns the protocol known for addr, or ProtocolAuto.
+	Protocol(addr netip.Addr) Protocol
+	// SetProtocol records the protocol spoken by addr.
+	SetProtocol(addr netip.Addr, p Protocol)
+}
+
+// sessionProtocol returns the protocol of a session, ignoring middlewares.
+func sessionProtocol(s Session) Protocol {
+	switch unwrapSession(s).(type) {
+	case *KlapSession:
+		return ProtocolKLAP
+	case *PassthroughSession:
+		return ProtocolPassthrough
+	}
+	return ProtocolAuto
+}
+
+// Protocol returns the protocol of the established session, or ProtocolAuto if
+// the plug is not logged in.
+func (p *Plug) Protocol() Protocol {
+	s := p.currentSession()
+	if s == nil {
+		return ProtocolAuto
+	}
+	return sessionProtocol(s)
+}
@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// defaultTransport is the transport of the devices and of the cloud when no
+// proxy is set with an option. It is shared so that the connections are
+// pooled.
+var defaultTransport = func() *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = proxyFromEnvironment
+	return tr
+}()
+
+// newProxyTransport returns an HTTP transport that sends all the requests
+// through the given HTTP, HTTPS or SOCKS5 proxy.
+func newProxyTransport(proxy *url.URL) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyURL(proxy)
+	return tr
+}
+
+// proxyFromEnvironment is like http.ProxyFromEnvironment, but falls back to
+// ALL_PROXY, as curl does, e.g. ALL_PROXY=socks5://localhost:1080 for an
+// `ssh -D 1080` tunnel to a jump host. NO_PROXY applies to ALL_PROXY too.
+func proxyFromEnvironment(req *http.Request) (*url.URL, error) {
+	if proxy, err := http.ProxyFromEnvironment(req); proxy != nil || err != nil {
+		return proxy, err
+	}
+	all := getenvAny("ALL_PROXY", "all_proxy")
+	if all == "" || !useProxy(req.URL.Hostname(), getenvAny("NO_PROXY", "no_proxy")) {
+		return nil, nil
+	}
+	proxy, err := url.Parse(all)
+	if err != nil || proxy.Scheme == "" || proxy.Host == "" {
+		// a bare host:port, like http.ProxyFromEnvironment accepts
+		if proxy, err := url.Parse("http://" + all); err == nil {
+			return proxy, nil
+		}
+		return nil, err
+	}
+	return proxy, nil
+}
+
+func getenvAny(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// useProxy returns false if host is a loopback address or matches noProxy, a
+// comma-separated list of host names, domain suffixes, IP addresses and CIDR
+// ranges, or "*" for all the hosts.
+func useProxy(host, noProxy string) bool {
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return false
+	}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return false
+		}
+		if ip != nil {
+			if _, cidr, err := net.ParseCIDR(entry); err == nil {
+				if cidr.Contains(ip) {
+					return false
+				}
+				continue
+			}
+			if eip := net.ParseIP(entry); eip != nil && eip.Equal(ip) {
+				return false
+			}
+			continue
+		}
+		// a port in the entry is ignored
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		host := strings.ToLower(host)
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return false
+		}
+	}
+	return true
+}
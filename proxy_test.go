@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUseProxy(t *testing.T) {
+	for _, tc := range []struct {
+		host    string
+		noProxy string
+		want    bool
+	}{
+		{"192.168.1.10", "", true},
+		{"127.0.0.1", "", false},
+		{"localhost", "", false},
+		{"192.168.1.10", "*", false},
+		{"192.168.1.10", "192.168.1.10", false},
+		{"192.168.1.10", "192.168.1.11", true},
+		{"192.168.1.10", "10.0.0.0/8, 192.168.0.0/16", false},
+		{"192.168.1.10", "10.0.0.0/8", true},
+		{"wap.tplinkcloud.com", "tplinkcloud.com", false},
+		{"wap.tplinkcloud.com", ".tplinkcloud.com", false},
+		{"wap.tplinkcloud.com", "TPLinkCloud.com:443", false},
+		{"wap.tplinkcloud.com", "cloud.com", true},
+		{"wap.tplinkcloud.com", "192.168.0.0/16", true},
+	} {
+		if got := useProxy(tc.host, tc.noProxy); got != tc.want {
+			t.Errorf("useProxy(%q, %q) = %v, want %v", tc.host, tc.noProxy, got, tc.want)
+		}
+	}
+}
+
+func TestProxyFromEnvironmentAllProxy(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "http://192.168.1.10/app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy, _ := http.ProxyFromEnvironment(req); proxy != nil {
+		t.Skipf("HTTP_PROXY is set to %s", proxy)
+	}
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("no_proxy", "")
+	t.Setenv("all_proxy", "")
+	for _, tc := range []struct {
+		allProxy string
+		noProxy  string
+		want     string
+	}{
+		{"", "", ""},
+		{"socks5://localhost:1080", "", "socks5://localhost:1080"},
+		{"localhost:3128", "", "http://localhost:3128"},
+		{"socks5://localhost:1080", "192.168.0.0/16", ""},
+	} {
+		t.Setenv("ALL_PROXY", tc.allProxy)
+		t.Setenv("NO_PROXY", tc.noProxy)
+		proxy, err := proxyFromEnvironment(req)
+		if err != nil {
+			t.Errorf("ALL_PROXY=%q NO_PROXY=%q: %v", tc.allProxy, tc.noProxy, err)
+			continue
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != tc.want {
+			t.Errorf("ALL_PROXY=%q NO_PROXY=%q: got proxy %q, want %q", tc.allProxy, tc.noProxy, got, tc.want)
+		}
+	}
+}
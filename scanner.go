@@ -0,0 +1,247 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ScanEventType is the type of a ScanEvent.
+type ScanEventType int
+
+const (
+	// DeviceFound is sent when a device responds to discovery for the first
+	// time, or again after being offline.
+	DeviceFound ScanEventType = iota
+	// DeviceLost is sent when a device goes offline, i.e. it has not
+	// responded to discovery for the offline grace period.
+	DeviceLost
+	// ScanCompleted is sent at the end of every scan.
+	ScanCompleted
+)
+
+func (t ScanEventType) String() string {
+	switch t {
+	case DeviceFound:
+		return "found"
+	case DeviceLost:
+		return "lost"
+	case ScanCompleted:
+		return "completed"
+	}
+	return "unknown"
+}
+
+// ScanEvent is a change observed by a Scanner.
+type ScanEvent struct {
+	Type ScanEventType
+	// Device is the discovery response of the device, for DeviceFound and
+	// DeviceLost events.
+	Device DiscoverResponse
+	// Err is the discovery error, for ScanCompleted events. It can be set
+	// along with partial results, see Client.Discover.
+	Err error
+}
+
+// ScannerOption is a functional option that configures a Scanner.
+type ScannerOption func(*Scanner)
+
+// OptionScanOfflineAfter sets the grace period after which a device that does
+// not respond to discovery is considered offline. The default is three scan
+// intervals, since UDP discovery is lossy.
+func OptionScanOfflineAfter(d time.Duration) ScannerOption {
+	return func(s *Scanner) {
+		if d > 0 {
+			s.offlineAfter = d
+		}
+	}
+}
+
+// KnownDevice is a device seen by a Scanner, online or not.
+type KnownDevice struct {
+	Response DiscoverResponse
+	// LastSeen is the time of the last discovery response of the device.
+	LastSeen time.Time
+	// Offline is true if the device has not responded for longer than the
+	// offline grace period.
+	Offline bool
+}
+
+// scanSubscriberBuffer is the number of events buffered for each subscriber.
+const scanSubscriberBuffer = 64
+
+// ErrScannerRunning is returned when starting a Scanner that is already
+// running.
+var ErrScannerRunning = errors.New("scanner already running")
+
+// Scanner runs discovery in the background at regular intervals, keeps track
+// of the devices on the network, and notifies subscribers when devices appear
+// or disappear.
+type Scanner struct {
+	client       *Client
+	interval     time.Duration
+	offlineAfter time.Duration
+
+	// found holds the responses of the current scan. It is only used by
+	// the scanning goroutine, and reused across scans.
+	found map[string]DiscoverResponse
+
+	mu      sync.Mutex
+	devices map[string]*KnownDevice
+	subs    map[chan ScanEvent]struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewScanner returns a scanner that runs a discovery with client every
+// interval. Call Start to start it.
+func NewScanner(client *Client, interval time.Duration, opts ...ScannerOption) *Scanner {
+	s := Scanner{
+		client:       client,
+		interval:     interval,
+		offlineAfter: 3 * interval,
+		found:        make(map[string]DiscoverResponse),
+		devices:      make(map[string]*KnownDevice),
+		subs:         make(map[chan ScanEvent]struct{}),
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return &s
+}
+
+// Subscribe returns a channel receiving the scanner events, and a function to
+// unsubscribe. Events are dropped if the subscriber does not keep up.
+func (s *Scanner) Subscribe() (<-chan ScanEvent, func()) {
+	ch := make(chan ScanEvent, scanSubscriberBuffer)
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.subs, ch)
+			s.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Devices returns the online devices, indexed by device ID.
+func (s *Scanner) Devices() map[string]DiscoverResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make(map[string]DiscoverResponse, len(s.devices))
+	for k, v := range s.devices {
+		if !v.Offline {
+			ret[k] = v.Response
+		}
+	}
+	return ret
+}
+
+// Known returns all the devices seen since the scanner was created, including
+// the offline ones, indexed by device ID.
+func (s *Scanner) Known() map[string]KnownDevice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make(map[string]KnownDevice, len(s.devices))
+	for k, v := range s.devices {
+		ret[k] = *v
+	}
+	return ret
+}
+
+// Start starts scanning in the background. The first scan starts immediately.
+func (s *Scanner) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return ErrScannerRunning
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(s.stop, s.done)
+	return nil
+}
+
+// Stop stops scanning, and waits for a running scan to finish. It does nothing
+// if the scanner is not running. A stopped scanner can be started again.
+func (s *Scanner) Stop() {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (s *Scanner) run(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.scan()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan runs one discovery and updates the known devices.
+func (s *Scanner) scan() {
+	clear(s.found)
+	err := s.client.discover(context.Background(), func(resp *DiscoverResponse) {
+		// later responses override earlier ones
+		if resp.Result.ErrorCode == 0 {
+			s.found[resp.Result.DeviceID] = *resp
+		}
+	})
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, d := range s.found {
+		known, ok := s.devices[id]
+		if !ok {
+			known = &KnownDevice{}
+			s.devices[id] = known
+		}
+		if !ok || known.Offline {
+			s.notify(ScanEvent{Type: DeviceFound, Device: d})
+		}
+		// update in place, Known returns copies
+		*known = KnownDevice{Response: d, LastSeen: now}
+	}
+	// only mark devices offline on complete scans, a failed socket does not
+	// mean that the devices are gone.
+	if err == nil {
+		for _, d := range s.devices {
+			if !d.Offline && now.Sub(d.LastSeen) > s.offlineAfter {
+				d.Offline = true
+				s.notify(ScanEvent{Type: DeviceLost, Device: d.Response})
+			}
+		}
+	}
+	s.notify(ScanEvent{Type: ScanCompleted, Err: err})
+}
+
+// notify sends an event to all the subscribers. Must be called with the lock
+// held.
+func (s *Scanner) notify(ev ScanEvent) {
+	for ch := range s.subs {
+		select {
+		case ch <- ev:
+		default:
+			s.client.log.Printf("Scanner: dropping %s event for a slow subscriber", ev.Type)
+		}
+	}
+}
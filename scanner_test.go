@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"testing"
+	"time"
+)
+
+// nextScanEvent returns the next event of the given type, failing the test if
+// it does not come in time.
+func nextScanEvent(t *testing.T, events <-chan ScanEvent, typ ScanEventType) ScanEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("events closed while waiting for %s", typ)
+			}
+			if ev.Type == typ {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", typ)
+		}
+	}
+}
+
+func TestScanner(t *testing.T) {
+	d, c := newFakeDiscoveryDevice(t, discoveredPlug)
+	c.discoverTimeout = 50 * time.Millisecond
+	s := NewScanner(c, 50*time.Millisecond, OptionScanOfflineAfter(200*time.Millisecond))
+	events, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer s.Stop()
+	if err := s.Start(); err != ErrScannerRunning {
+		t.Errorf("second Start: err = %v, want %v", err, ErrScannerRunning)
+	}
+
+	if ev := nextScanEvent(t, events, DeviceFound); ev.Device.Result.DeviceID != "8022A" {
+		t.Errorf("found %s, want 8022A", ev.Device.Result.DeviceID)
+	}
+	if _, ok := s.Devices()["8022A"]; !ok {
+		t.Errorf("Devices() = %v, want 8022A", s.Devices())
+	}
+
+	// incomplete scans do not make the devices go offline
+	d.setPackets([]byte("short"))
+	// skip the scan that found the device, and the one in progress, which
+	// may have seen it too.
+	nextScanEvent(t, events, ScanCompleted)
+	nextScanEvent(t, events, ScanCompleted)
+	deadline := time.Now().Add(400 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		select {
+		case ev := <-events:
+			if ev.Type == DeviceLost {
+				t.Fatalf("device lost on an incomplete scan")
+			}
+			if ev.Type == ScanCompleted && ev.Err == nil {
+				t.Errorf("scan of a malformed response succeeded")
+			}
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	d.setPackets()
+	if ev := nextScanEvent(t, events, DeviceLost); ev.Device.Result.DeviceID != "8022A" {
+		t.Errorf("lost %s, want 8022A", ev.Device.Result.DeviceID)
+	}
+	if len(s.Devices()) != 0 {
+		t.Errorf("Devices() = %v after the device was lost", s.Devices())
+	}
+	if known, ok := s.Known()["8022A"]; !ok || !known.Offline {
+		t.Errorf("Known() = %+v, want 8022A offline", s.Known())
+	}
+
+	// a device coming back is found again
+	d.setPackets(discoveredPlug)
+	nextScanEvent(t, events, DeviceFound)
+}
+
+func TestScannerStop(t *testing.T) {
+	_, c := newFakeDiscoveryDevice(t)
+	c.discoverTimeout = 50 * time.Millisecond
+	s := NewScanner(c, time.Hour)
+	events, unsubscribe := s.Subscribe()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	// the first scan starts immediately
+	nextScanEvent(t, events, ScanCompleted)
+	s.Stop()
+	s.Stop()
+	if err := s.Start(); err != nil {
+		t.Errorf("Start after Stop failed: %v", err)
+	}
+	s.Stop()
+	unsubscribe()
+	unsubscribe()
+	// the events sent before unsubscribing are drained, then events is
+	// closed.
+	for range events {
+	}
+}
@@ -2,10 +2,150 @@
 
 package tapo
 
-import "net/netip"
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// sessionExpiryMargin is how long before the expiry a session is refreshed, so
+// that a request is never sent with a session that expires in flight. It is
+// capped at half of the session lifetime.
+const sessionExpiryMargin = 20 * time.Minute
 
 type Session interface {
 	Handshake(addr netip.Addr, username, password string) error
 	Request([]byte) ([]byte, error)
 	Addr() netip.Addr
 }
+
+// ContextSession is a Session whose handshakes and requests can be cancelled,
+// or bounded by a deadline, through a context. KlapSession and
+// PassthroughSession implement it. Through a Session that does not, like a
+// Middleware that only implements Session, the context is only checked before
+// each request.
+type ContextSession interface {
+	Session
+	HandshakeContext(ctx context.Context, addr netip.Addr, username, password string) error
+	RequestContext(ctx context.Context, payload []byte) ([]byte, error)
+}
+
+// ExpiringSession is a Session that knows when the device expires it.
+// KlapSession and PassthroughSession implement it, and Plug uses it to
+// handshake again before a request would fail on an expired session.
+type ExpiringSession interface {
+	Session
+	// IsValid returns false if the session was never established, or is
+	// expired or about to expire.
+	IsValid() bool
+	// ExpiresAt returns the time at which the device expires the session,
+	// or the zero time if it is not known.
+	ExpiresAt() time.Time
+}
+
+// sessionLock serializes the handshakes and the requests of a session, so that
+// a session can be shared by several goroutines. Unlike a sync.Mutex, waiting
+// for it is aborted when the context is done. The zero value is unlocked.
+type sessionLock struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func (l *sessionLock) lock(ctx context.Context) error {
+	l.once.Do(func() { l.ch = make(chan struct{}, 1) })
+	select {
+	case l.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *sessionLock) unlock() {
+	<-l.ch
+}
+
+// sessionExpiring returns true if a session established at handshakeAt, and
+// expiring at expiry, is expired or within sessionExpiryMargin of its expiry
+// at now. A local clock that moved back before the handshake also counts as
+// expired, since the remaining lifetime cannot be trusted. A zero expiry never
+// expires.
+func sessionExpiring(handshakeAt, expiry, now time.Time) bool {
+	if expiry.IsZero() {
+		return false
+	}
+	if now.Before(handshakeAt) {
+		return true
+	}
+	margin := sessionExpiryMargin
+	if lifetime := expiry.Sub(handshakeAt); margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	return !now.Before(expiry.Add(-margin))
+}
+
+// sessionRequest sends a request through s, using ctx if s supports it.
+func sessionRequest(ctx context.Context, s Session, payload []byte) ([]byte, error) {
+	if cs, ok := s.(ContextSession); ok {
+		return cs.RequestContext(ctx, payload)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Request(payload)
+}
+
+// Middleware wraps a Session, to observe or alter the requests sent through it
+// and their responses. A Session returned by a Middleware should implement
+// Unwrap() Session, returning the wrapped session.
+type Middleware func(Session) Session
+
+// unwrapSession returns the innermost session, stripping any middleware.
+func unwrapSession(s Session) Session {
+	for {
+		u, ok := s.(interface{ Unwrap() Session })
+		if !ok {
+			return s
+		}
+		s = u.Unwrap()
+	}
+}
+
+// handshakes deduplicates concurrent handshakes of the same plug or session,
+// so that a burst of callers does not trigger several simultaneous handshakes
+// that the device would then reject.
+var handshakes singleflight.Group
+
+// rehandshake re-runs the handshake on an existing session, coalescing
+// concurrent re-handshakes of the same session into a single one. The shared
+// handshake uses the context of the caller that started it.
+func rehandshake(ctx context.Context, s Session, username, password string) error {
+	key := fmt.Sprintf("session/%p", s)
+	_, err, _ := handshakes.Do(key, func() (interface{}, error) {
+		if cs, ok := s.(ContextSession); ok {
+			return nil, cs.HandshakeContext(ctx, s.Addr(), username, password)
+		}
+		return nil, s.Handshake(s.Addr(), username, password)
+	})
+	return err
+}
+
+// deviceURL returns the URL of path on the device at addr. A zero port is the
+// default port of the scheme.
+func deviceURL(addr netip.Addr, port uint16, https bool, path string) *url.URL {
+	u := &url.URL{Scheme: "http", Host: addr.String(), Path: path}
+	defaultPort := uint16(80)
+	if https {
+		u.Scheme = "https"
+		defaultPort = 443
+	}
+	if port != 0 && port != defaultPort {
+		u.Host = netip.AddrPortFrom(addr, port).String()
+	}
+	return u
+}
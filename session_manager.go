@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"container/list"
+	"io"
+	"log"
+	"net/netip"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultSessionManagerSize is the default maximum number of sessions held by
+// a SessionManager.
+const DefaultSessionManagerSize = 64
+
+// SessionManager owns the sessions towards many devices that share the same
+// credentials. Plugs are handshaked lazily on first use, re-handshaked when
+// their session expires, and the least recently used ones are evicted once
+// the manager holds more than its maximum size.
+type SessionManager struct {
+	log      *log.Logger
+	username string
+	password string
+	// credentials, if set, are used instead of username and password.
+	credentials *Credentials
+	maxSize     int
+	opts        []PlugOption
+
+	mu    sync.Mutex
+	lru   *list.List
+	plugs map[netip.Addr]*list.Element
+	// handshakes coalesces the concurrent calls to Get for the same
+	// address, that would otherwise handshake with a new plug each.
+	handshakes singleflight.Group
+}
+
+// NewSessionManager returns a new SessionManager that will log in to devices
+// with the given credentials and hold at most maxSize sessions. If maxSize is
+// not positive, DefaultSessionManagerSize is used. The options are applied to
+// every Plug created by the manager.
+func NewSessionManager(username, password string, maxSize int, logger *log.Logger, opts ...PlugOption) *SessionManager {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultSessionManagerSize
+	}
+	return &SessionManager{
+		log:      logger,
+		username: username,
+		password: password,
+		maxSize:  maxSize,
+		opts:     opts,
+		lru:      list.New(),
+		plugs:    make(map[netip.Addr]*list.Element),
+	}
+}
+
+// NewSessionManagerCredentials is like NewSessionManager, with precomputed
+// credentials instead of the username and password, see NewCredentials.
+func NewSessionManagerCredentials(c Credentials, maxSize int, logger *log.Logger, opts ...PlugOption) *SessionManager {
+	m := NewSessionManager("", "", maxSize, logger, opts...)
+	m.credentials = &c
+	return m
+}
+
+// Get returns a logged-in Plug for the given address, performing the
+// handshake if there is no valid session for it yet. opts are applied after
+// the options of the manager when a new Plug is created, e.g. to pass
+// OptionDiscovered, and ignored otherwise. Concurrent calls for the same
+// address share a single handshake, with the options of the first call.
+func (m *SessionManager) Get(addr netip.Addr, opts ...PlugOption) (*Plug, error) {
+	m.mu.Lock()
+	if elem, ok := m.plugs[addr]; ok {
+		plug := elem.Value.(*Plug)
+		if !plug.sessionExpired() {
+			m.lru.MoveToFront(elem)
+			m.mu.Unlock()
+			return plug, nil
+		}
+		m.log.Printf("Session for %s expired, handshaking again", addr)
+		m.lru.Remove(elem)
+		delete(m.plugs, addr)
+	}
+	m.mu.Unlock()
+
+	// handshake without holding the lock, so that slow devices do not
+	// block the others. Concurrent calls for the same device share the
+	// plug of the first one.
+	v, err, _ := m.handshakes.Do(addr.String(), func() (interface{}, error) {
+		return m.newPlug(addr, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Plug), nil
+}
+
+// newPlug logs in to the device at addr with a new plug, and stores it.
+func (m *SessionManager) newPlug(addr netip.Addr, opts ...PlugOption) (*Plug, error) {
+	plug := NewPlug(addr, m.log, append(m.opts[:len(m.opts):len(m.opts)], opts...)...)
+	var err error
+	if m.credentials != nil {
+		err = plug.HandshakeCredentials(*m.credentials)
+	} else {
+		err = plug.Handshake(m.username, m.password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.plugs[addr]; ok {
+		// somebody else stored a plug in the meantime, prefer that one.
+		m.lru.MoveToFront(elem)
+		return elem.Value.(*Plug), nil
+	}
+	m.plugs[addr] = m.lru.PushFront(plug)
+	for m.lru.Len() > m.maxSize {
+		oldest := m.lru.Back()
+		evicted := m.lru.Remove(oldest).(*Plug)
+		delete(m.plugs, evicted.Addr)
+		m.log.Printf("Evicted session for %s", evicted.Addr)
+	}
+	return plug, nil
+}
+
+// Forget drops the session for the given address, if any. The next call to
+// Get for the same address will perform a new handshake.
+func (m *SessionManager) Forget(addr netip.Addr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.plugs[addr]; ok {
+		m.lru.Remove(elem)
+		delete(m.plugs, addr)
+	}
+}
+
+// Len returns the number of sessions currently held by the manager.
+func (m *SessionManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"net/http"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestSessionManager returns a SessionManager whose plugs log in to a fake
+// KLAP device accepting the credentials user and pass, at any address.
+func newTestSessionManager(t *testing.T, maxSize int) (*SessionManager, *fakeKlapDevice) {
+	dev := &fakeKlapDevice{t: t, username: "user", password: "pass"}
+	m := NewSessionManager(dev.username, dev.password, maxSize, nil, OptionProtocolKLAP, func(p *Plug) {
+		p.transport = dev
+	})
+	return m, dev
+}
+
+// get is m.Get for a literal address, failing the test on errors.
+func get(t *testing.T, m *SessionManager, addr string) *Plug {
+	t.Helper()
+	plug, err := m.Get(netip.MustParseAddr(addr))
+	if err != nil {
+		t.Fatalf("Get(%s) failed: %v", addr, err)
+	}
+	return plug
+}
+
+func TestSessionManagerReuse(t *testing.T) {
+	m, dev := newTestSessionManager(t, 0)
+	a := get(t, m, "192.0.2.1")
+	if again := get(t, m, "192.0.2.1"); again != a {
+		t.Errorf("Get returned a new plug for the same address")
+	}
+	if b := get(t, m, "192.0.2.2"); b == a {
+		t.Errorf("Get returned the same plug for another address")
+	}
+	if dev.handshakes != 2 || m.Len() != 2 {
+		t.Errorf("handshakes, Len() = %d, %d, want 2, 2", dev.handshakes, m.Len())
+	}
+
+	m.Forget(netip.MustParseAddr("192.0.2.1"))
+	if again := get(t, m, "192.0.2.1"); again == a {
+		t.Errorf("Get returned a forgotten plug")
+	}
+	if dev.handshakes != 3 {
+		t.Errorf("handshakes = %d after Forget, want 3", dev.handshakes)
+	}
+}
+
+func TestSessionManagerEviction(t *testing.T) {
+	m, dev := newTestSessionManager(t, 2)
+	a := get(t, m, "192.0.2.1")
+	b := get(t, m, "192.0.2.2")
+	// a is now the most recently used, so c evicts b
+	get(t, m, "192.0.2.1")
+	get(t, m, "192.0.2.3")
+	if m.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", m.Len())
+	}
+	if get(t, m, "192.0.2.1") != a {
+		t.Errorf("the most recently used plug was evicted")
+	}
+	if get(t, m, "192.0.2.2") == b {
+		t.Errorf("the least recently used plug was not evicted")
+	}
+	if dev.handshakes != 4 {
+		t.Errorf("handshakes = %d, want 4", dev.handshakes)
+	}
+}
+
+func TestSessionManagerExpiry(t *testing.T) {
+	m, dev := newTestSessionManager(t, 0)
+	a := get(t, m, "192.0.2.1")
+	ks := unwrapSession(a.currentSession()).(*KlapSession)
+	ks.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	if again := get(t, m, "192.0.2.1"); again == a {
+		t.Errorf("Get returned a plug with an expired session")
+	}
+	if dev.handshakes != 2 || m.Len() != 1 {
+		t.Errorf("handshakes, Len() = %d, %d, want 2, 1", dev.handshakes, m.Len())
+	}
+}
+
+func TestSessionManagerHandshakeError(t *testing.T) {
+	m, _ := newTestSessionManager(t, 0)
+	m.password = "wrong"
+	if _, err := m.Get(netip.MustParseAddr("192.0.2.1")); err == nil {
+		t.Fatalf("Get with a wrong password succeeded")
+	}
+	if m.Len() != 0 {
+		t.Errorf("Len() = %d after a failed handshake, want 0", m.Len())
+	}
+}
+
+func TestSessionManagerConcurrentGet(t *testing.T) {
+	dev := &fakeKlapDevice{t: t, username: "user", password: "pass"}
+	// a slow handshake, so that the calls overlap
+	slow := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/app/handshake1" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return dev.RoundTrip(req)
+	})
+	m := NewSessionManager(dev.username, dev.password, 0, nil, OptionProtocolKLAP, func(p *Plug) {
+		p.transport = slow
+	})
+	const callers = 8
+	plugs := make([]*Plug, callers)
+	var wg sync.WaitGroup
+	for i := range plugs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if plugs[i], err = m.Get(netip.MustParseAddr("192.0.2.1")); err != nil {
+				t.Errorf("Get failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	for _, p := range plugs[1:] {
+		if p != plugs[0] {
+			t.Fatalf("concurrent calls got different plugs")
+		}
+	}
+	if dev.handshakes != 1 {
+		t.Errorf("handshakes = %d, want 1", dev.handshakes)
+	}
+}
@@ -0,0 +1,108 @@
+// SPDX-License-Identifier: MIT
+
+// Package tapotest provides helpers to test programs built on the tapo
+// package.
+package tapotest
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+)
+
+// ChaosConfig configures the faults injected by Chaos. Rates are probabilities
+// between 0 and 1, evaluated independently on every request.
+type ChaosConfig struct {
+	// Latency is the maximum artificial latency added to a request. The
+	// actual latency is chosen uniformly between 0 and Latency.
+	Latency time.Duration
+	// LatencyRate is the probability of adding latency to a request.
+	LatencyRate float64
+	// ForbiddenRate is the probability of failing a request with
+	// tapo.ErrForbidden, like a device returning HTTP 403.
+	ForbiddenRate float64
+	// CommunicationErrorRate is the probability of responding with
+	// tapo.StatusCommunicationError instead of forwarding the request to the
+	// device. Plug retries it with tapo.OptionRetryOnCommunicationError.
+	CommunicationErrorRate float64
+	// MalformedJSONRate is the probability of truncating the device's
+	// response so that it is no longer valid JSON.
+	MalformedJSONRate float64
+	// Seed initializes the random source, for reproducible runs. If zero,
+	// the current time is used.
+	Seed int64
+}
+
+// Chaos returns a tapo.Middleware that injects faults into the requests sent
+// to a device, according to the given configuration. Use it with
+// tapo.OptionMiddleware to verify how a program copes with the failure modes
+// of real Tapo devices.
+func Chaos(cfg ChaosConfig) tapo.Middleware {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	var mu sync.Mutex
+	return func(s tapo.Session) tapo.Session {
+		return &chaosSession{
+			Session: s,
+			cfg:     cfg,
+			rnd:     rnd,
+			mu:      &mu,
+		}
+	}
+}
+
+type chaosSession struct {
+	tapo.Session
+	cfg ChaosConfig
+	// rnd is shared across all the sessions created by the same middleware
+	// and protected by mu.
+	rnd *rand.Rand
+	mu  *sync.Mutex
+}
+
+func (c *chaosSession) Unwrap() tapo.Session {
+	return c.Session
+}
+
+// roll returns true with the given probability.
+func (c *chaosSession) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rnd.Float64() < rate
+}
+
+func (c *chaosSession) latency() time.Duration {
+	if c.cfg.Latency <= 0 || !c.roll(c.cfg.LatencyRate) {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.rnd.Int63n(int64(c.cfg.Latency)))
+}
+
+func (c *chaosSession) Request(payload []byte) ([]byte, error) {
+	time.Sleep(c.latency())
+	if c.roll(c.cfg.ForbiddenRate) {
+		return nil, tapo.ErrForbidden
+	}
+	if c.roll(c.cfg.CommunicationErrorRate) {
+		return []byte(fmt.Sprintf(`{"error_code":%d}`, tapo.StatusCommunicationError)), nil
+	}
+	resp, err := c.Session.Request(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) > 0 && c.roll(c.cfg.MalformedJSONRate) {
+		return resp[:len(resp)/2], nil
+	}
+	return resp, nil
+}
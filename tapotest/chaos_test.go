@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: MIT
+
+package tapotest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/insomniacslk/tapo"
+)
+
+var deviceResponse = []byte(`{"error_code":0,"result":{"device_on":true}}`)
+
+// fakeSession answers every request with deviceResponse.
+type fakeSession struct {
+	requests int
+}
+
+func (s *fakeSession) Handshake(netip.Addr, string, string) error {
+	return nil
+}
+
+func (s *fakeSession) Request([]byte) ([]byte, error) {
+	s.requests++
+	return deviceResponse, nil
+}
+
+func (s *fakeSession) Addr() netip.Addr {
+	return netip.MustParseAddr("192.0.2.1")
+}
+
+func TestChaos(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		cfg          ChaosConfig
+		wantRequests int
+		check        func(t *testing.T, resp []byte, err error)
+	}{
+		{
+			name:         "no faults",
+			wantRequests: 1,
+			check: func(t *testing.T, resp []byte, err error) {
+				if err != nil || string(resp) != string(deviceResponse) {
+					t.Errorf("Request() = %s, %v, want %s", resp, err, deviceResponse)
+				}
+			},
+		},
+		{
+			name: "forbidden",
+			cfg:  ChaosConfig{ForbiddenRate: 1},
+			check: func(t *testing.T, resp []byte, err error) {
+				if !errors.Is(err, tapo.ErrForbidden) {
+					t.Errorf("err = %v, want %v", err, tapo.ErrForbidden)
+				}
+			},
+		},
+		{
+			name: "communication error",
+			cfg:  ChaosConfig{CommunicationErrorRate: 1},
+			check: func(t *testing.T, resp []byte, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				var r struct {
+					ErrorCode tapo.TapoError `json:"error_code"`
+				}
+				if err := json.Unmarshal(resp, &r); err != nil {
+					t.Fatal(err)
+				}
+				if r.ErrorCode != tapo.StatusCommunicationError {
+					t.Errorf("error_code = %d, want %d", r.ErrorCode, tapo.StatusCommunicationError)
+				}
+				// the error exists to exercise the retries of Plug
+				if hint := r.ErrorCode.Hint(); hint != tapo.HintRetry {
+					t.Errorf("hint = %s, want %s", hint, tapo.HintRetry)
+				}
+			},
+		},
+		{
+			name:         "malformed JSON",
+			cfg:          ChaosConfig{MalformedJSONRate: 1},
+			wantRequests: 1,
+			check: func(t *testing.T, resp []byte, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if json.Valid(resp) {
+					t.Errorf("response %s is valid JSON", resp)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var fs fakeSession
+			s := Chaos(tc.cfg)(&fs)
+			resp, err := s.Request([]byte(`{"method":"get_device_info"}`))
+			tc.check(t, resp, err)
+			if fs.requests != tc.wantRequests {
+				t.Errorf("requests to the device = %d, want %d", fs.requests, tc.wantRequests)
+			}
+		})
+	}
+}
+
+func TestChaosSeed(t *testing.T) {
+	cfg := ChaosConfig{ForbiddenRate: 0.5, Seed: 42}
+	run := func() []bool {
+		s := Chaos(cfg)(&fakeSession{})
+		failed := make([]bool, 100)
+		for i := range failed {
+			_, err := s.Request(nil)
+			failed[i] = err != nil
+		}
+		return failed
+	}
+	first, second := run(), run()
+	n := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("request %d: failed = %v, then %v with the same seed", i, first[i], second[i])
+		}
+		if first[i] {
+			n++
+		}
+	}
+	if n == 0 || n == len(first) {
+		t.Errorf("%d of %d requests failed with rate 0.5", n, len(first))
+	}
+}
+
+func TestChaosUnwrap(t *testing.T) {
+	var fs fakeSession
+	s := Chaos(ChaosConfig{})(&fs)
+	u, ok := s.(interface{ Unwrap() tapo.Session })
+	if !ok || u.Unwrap() != &fs {
+		t.Errorf("Unwrap() does not return the wrapped session")
+	}
+}
@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// Trace describes a request sent to a device and its response, in plaintext.
+// Requests and responses can contain sensitive data, like the Wi-Fi settings
+// of the device.
+type Trace struct {
+	Addr netip.Addr
+	// Method is the method of the request, empty if the request is not
+	// valid JSON.
+	Method   string
+	Request  []byte
+	Response []byte
+	Start    time.Time
+	Duration time.Duration
+	// HTTPStatus is the HTTP status code of the response, 0 if the device
+	// did not answer.
+	HTTPStatus int
+	// ErrorCode is the error_code of the response.
+	ErrorCode TapoError
+	// Err is the error returned by the session, if any.
+	Err error
+}
+
+// TraceMiddleware returns a Middleware that calls fn after every request sent
+// through the session, e.g. to debug a new device model. fn is called by the
+// goroutine sending the request, and must not block. Requests retried by Plug
+// are traced once per attempt, the handshakes are not traced.
+func TraceMiddleware(fn func(Trace)) Middleware {
+	return func(s Session) Session {
+		return &traceSession{Session: s, fn: fn}
+	}
+}
+
+type traceSession struct {
+	Session
+	fn func(Trace)
+}
+
+func (t *traceSession) Unwrap() Session {
+	return t.Session
+}
+
+func (t *traceSession) HandshakeContext(ctx context.Context, addr netip.Addr, username, password string) error {
+	if cs, ok := t.Session.(ContextSession); ok {
+		return cs.HandshakeContext(ctx, addr, username, password)
+	}
+	return t.Session.Handshake(addr, username, password)
+}
+
+func (t *traceSession) Request(payload []byte) ([]byte, error) {
+	return t.RequestContext(context.Background(), payload)
+}
+
+func (t *traceSession) RequestContext(ctx context.Context, payload []byte) ([]byte, error) {
+	start := time.Now()
+	resp, err := sessionRequest(ctx, t.Session, payload)
+	tr := Trace{
+		Addr:     t.Session.Addr(),
+		Request:  payload,
+		Response: resp,
+		Start:    start,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	var req struct {
+		Method string `json:"method"`
+	}
+	if json.Unmarshal(payload, &req) == nil {
+		tr.Method = req.Method
+	}
+	var herr *HTTPError
+	switch {
+	case err == nil:
+		tr.HTTPStatus = http.StatusOK
+		var r struct {
+			ErrorCode TapoError `json:"error_code"`
+		}
+		if json.Unmarshal(resp, &r) == nil {
+			tr.ErrorCode = r.ErrorCode
+		}
+	case errors.Is(err, ErrForbidden):
+		tr.HTTPStatus = http.StatusForbidden
+	case errors.As(err, &herr):
+		tr.HTTPStatus = herr.StatusCode
+	case errors.As(err, &tr.ErrorCode):
+		// passthrough returns the error_code of the envelope as an error
+		tr.HTTPStatus = http.StatusOK
+	}
+	t.fn(tr)
+	return resp, err
+}
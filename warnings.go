@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: MIT
+
+package tapo
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// WarningKind identifies the condition reported by a Warning.
+type WarningKind string
+
+const (
+	// WarningUndecodableField is reported when a response field cannot be
+	// decoded, and its raw value is used instead. See
+	// DeviceInfo.Warnings.
+	WarningUndecodableField WarningKind = "undecodable_field"
+	// WarningProtocolFallback is reported when a device does not speak
+	// KLAP, and the deprecated passthrough protocol is used instead.
+	WarningProtocolFallback WarningKind = "protocol_fallback"
+	// WarningLongPassword is reported when a password longer than 8
+	// characters is sent with version 1 of the passthrough login, which
+	// some firmwares truncate.
+	WarningLongPassword WarningKind = "long_password"
+)
+
+// Warning is a non-fatal condition met while talking to a device.
+type Warning struct {
+	Kind    WarningKind
+	Addr    netip.Addr
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Addr, w.Message)
+}
+
+// warn reports a warning to the handler set with OptionWarnings, and logs it.
+func (p *Plug) warn(kind WarningKind, format string, args ...interface{}) {
+	w := Warning{Kind: kind, Addr: p.Addr, Message: fmt.Sprintf(format, args...)}
+	p.log.Printf("Warning: %s", w)
+	if p.warnings != nil {
+		p.warnings(w)
+	}
+}